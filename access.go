@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// httpRequests counts the requests served, by route
+var httpRequests = NewCounterVec(
+	"webhook_http_requests_total",
+	"HTTP requests served, by route, method and status code.",
+	"route", "method", "code",
+)
+
+// httpDuration records the time taken to serve requests, by route
+var httpDuration = NewHistogramVec(
+	"webhook_http_request_duration_seconds",
+	"Time taken to serve HTTP requests, by route.",
+	[]float64{0.005, 0.025, 0.1, 0.5, 1, 5, 30, 120},
+	"route",
+)
+
+// statusRecorder remembers the status and size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.size += n
+	return n, err
+}
+
+// Flush implements http.Flusher, for streamed responses
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the wrapped writer, for http.ResponseController
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// instrument records the requests to the route in the
+// metrics and, if there is one, the access log
+func (rt *Router) instrument(pattern string, h http.Handler) http.Handler {
+	route := pattern
+	if i := strings.Index(route, " "); i >= 0 {
+		route = route[i+1:]
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		httpRequests.Inc(route, r.Method, strconv.Itoa(rec.status))
+		httpDuration.Observe(time.Since(start).Seconds(), route)
+		if rt.AccessLog != nil {
+			writeAccess(rt.AccessLog, r, rec, start)
+		}
+	})
+}
+
+// writeAccess writes the request as a line of the Apache combined
+// log format, with the secrets of webhook URLs redacted
+func writeAccess(w io.Writer, r *http.Request, rec *statusRecorder, start time.Time) {
+	uri := r.URL.Path
+	query := r.URL.Query()
+	if len(query) > 0 {
+		if query.Get("secret") != "" {
+			query.Set("secret", redacted)
+		}
+		uri += "?" + query.Encode()
+	}
+	size := "-"
+	if rec.size > 0 {
+		size = strconv.Itoa(rec.size)
+	}
+	quote := func(s string) string {
+		if s == "" {
+			return `"-"`
+		}
+		return strconv.Quote(s)
+	}
+	_, err := fmt.Fprintf(w, "%s - - [%s] %s %d %s %s %s\n",
+		clientHost(r),
+		start.Format("02/Jan/2006:15:04:05 -0700"),
+		quote(r.Method+" "+uri+" "+r.Proto),
+		rec.status,
+		size,
+		quote(r.Referer()),
+		quote(r.UserAgent()),
+	)
+	if err != nil {
+		log.Printf("Failed to write access log: %v", err)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// ActionAdopt is the action of the deployment recording
+// the adoption of a container created outside the receiver
+const ActionAdopt = "adopt"
+
+// PhaseAdopt takes over the management of a container
+const PhaseAdopt = Phase("adopt")
+
+// CodeAlreadyManaged is used when adopting a container
+// the receiver already manages
+const CodeAlreadyManaged = ErrorCode("already_managed")
+
+// Baseline is the spec of an adopted container. What the configuration
+// of the container leaves unset is taken from it when recreating it.
+type Baseline struct {
+	ContainerID string    `json:"container_id"`
+	Image       string    `json:"image"`
+	Digest      string    `json:"digest,omitempty"`
+	AdoptedAt   time.Time `json:"adopted_at"`
+	// Config and HostConfig are those of the container, without
+	// what its image sets, so it can change with the image
+	Config     *docker.Config     `json:"config"`
+	HostConfig *docker.HostConfig `json:"host_config"`
+	// Aliases are the aliases of the container on its networks
+	Aliases map[string][]string `json:"aliases,omitempty"`
+}
+
+// Baselines stores the baseline of each adopted container in the state store
+type Baselines struct {
+	store StateStore
+}
+
+// NewBaselines stores baselines in the store
+func NewBaselines(store StateStore) *Baselines {
+	return &Baselines{store: store}
+}
+
+func (b *Baselines) key(container string) string {
+	return container + ".baseline.json"
+}
+
+// Save replaces the baseline of the container
+func (b *Baselines) Save(container string, baseline *Baseline) error {
+	content, err := json.Marshal(baseline)
+	if err != nil {
+		return err
+	}
+	return b.store.Put(b.key(container), content)
+}
+
+// Load returns the baseline of the container, nil if it wasn't adopted
+func (b *Baselines) Load(container string) (*Baseline, error) {
+	content, err := b.store.Get(b.key(container))
+	if err != nil || content == nil {
+		return nil, err
+	}
+	baseline := &Baseline{}
+	return baseline, json.Unmarshal(content, baseline)
+}
+
+// loadBaseline restores the baseline of the container, if it was adopted
+func (d *Deployer) loadBaseline() {
+	if d.Baselines == nil {
+		return
+	}
+	baseline, err := d.Baselines.Load(d.container.Name)
+	if err != nil {
+		log.Printf("Failed to load baseline of %q: %v", d.container.Name, err)
+		return
+	}
+	d.mu.Lock()
+	d.baseline = baseline
+	d.mu.Unlock()
+}
+
+// adopted returns the baseline of the container, nil if it wasn't adopted
+func (d *Deployer) adopted() *Baseline {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.baseline
+}
+
+// Adopt takes over the management of the container running under the
+// name of the configured container, created outside the receiver. Its
+// spec and image are recorded as the baseline future deploys recreate
+// it from, and the adoption in the history of the container.
+func (d *Deployer) Adopt() (*Deployment, *HookError) {
+	d.running.Lock()
+	defer d.running.Unlock()
+
+	dep := &Deployment{
+		ID:         newID(),
+		Container:  d.container.Name,
+		Repository: d.container.Repository,
+		Tag:        d.container.Tag,
+		Action:     ActionAdopt,
+		StartedAt:  time.Now(),
+	}
+	c, err := d.client.InspectContainer(d.container.Name)
+	if _, ok := err.(*docker.NoSuchContainer); ok {
+		herr := clientError(CodeDockerError, PhaseAdopt, fmt.Errorf("no container named %q", d.container.Name))
+		herr.Status = http.StatusNotFound
+		return nil, herr
+	}
+	if err != nil {
+		return nil, serverError(CodeDockerError, PhaseAdopt, err)
+	}
+	if c.Config != nil && c.Config.Labels[containerLabel] != "" && d.managed(c) {
+		herr := clientError(CodeAlreadyManaged, PhaseAdopt, fmt.Errorf("container %q was created by the receiver", d.container.Name))
+		herr.Status = http.StatusConflict
+		return nil, herr
+	}
+	img, err := d.client.InspectImage(c.Image)
+	if err != nil {
+		return nil, serverError(CodeDockerError, PhaseAdopt, err)
+	}
+
+	baseline := newBaseline(c, img)
+	baseline.Digest = repoDigest(img, d.repository())
+	if d.Baselines != nil {
+		err = d.Baselines.Save(d.container.Name, baseline)
+		if err != nil {
+			return nil, serverError(CodeInternal, PhaseAdopt, err)
+		}
+	} else {
+		d.logger().Printf("No -state-dir, the baseline of %q is lost when the receiver restarts", d.container.Name)
+	}
+
+	dep.Image = c.Image
+	dep.Digest = baseline.Digest
+	dep.Labels = imageLabels(img)
+	dep.FinishedAt = time.Now()
+	dep.Result = Success
+
+	d.mu.Lock()
+	d.baseline = baseline
+	d.imageID = c.Image
+	d.external = nil
+	d.recordHistory(dep)
+	d.mu.Unlock()
+	d.saveHistory(dep)
+
+	d.logger().Printf("Adopted container %q running %s", d.container.Name, c.Config.Image)
+	d.Events.Publish(StreamEvent{
+		Event:        EventDeployFinished,
+		Tenant:       d.tenant,
+		Container:    d.container.Name,
+		DeploymentID: dep.ID,
+		Deployment:   dep,
+	})
+	return dep, nil
+}
+
+// newBaseline returns the baseline of the container, leaving
+// out what the image sets, as the import command does
+func newBaseline(c *docker.Container, img *docker.Image) *Baseline {
+	config := *c.Config
+	host := *c.HostConfig
+	baseline := &Baseline{
+		ContainerID: c.ID,
+		Image:       c.Image,
+		AdoptedAt:   time.Now(),
+		Config:      &config,
+		HostConfig:  &host,
+	}
+	config.Image = ""
+	if strings.HasPrefix(c.ID, config.Hostname) {
+		// The default hostname, recreated containers get their own
+		config.Hostname = ""
+	}
+	if img.Config != nil {
+		config.Env = nil
+		for _, env := range c.Config.Env {
+			if !contains(img.Config.Env, env) {
+				config.Env = append(config.Env, env)
+			}
+		}
+		if strings.Join(img.Config.Cmd, " ") == strings.Join(config.Cmd, " ") {
+			config.Cmd = nil
+		}
+		if strings.Join(img.Config.Entrypoint, " ") == strings.Join(config.Entrypoint, " ") {
+			config.Entrypoint = nil
+		}
+		if img.Config.WorkingDir == config.WorkingDir {
+			config.WorkingDir = ""
+		}
+		if img.Config.User == config.User {
+			config.User = ""
+		}
+		config.Labels = map[string]string{}
+		for k, v := range c.Config.Labels {
+			if value, ok := img.Config.Labels[k]; !ok || value != v {
+				config.Labels[k] = v
+			}
+		}
+	}
+	if c.NetworkSettings == nil {
+		return baseline
+	}
+	for network, settings := range c.NetworkSettings.Networks {
+		var aliases []string
+		for _, alias := range settings.Aliases {
+			if !strings.HasPrefix(c.ID, alias) {
+				aliases = append(aliases, alias)
+			}
+		}
+		if len(aliases) > 0 {
+			if baseline.Aliases == nil {
+				baseline.Aliases = map[string][]string{}
+			}
+			baseline.Aliases[network] = aliases
+		}
+	}
+	return baseline
+}
+
+// apply takes what the configuration of the container leaves
+// unset in opts from the baseline
+func (b *Baseline) apply(opts *docker.CreateContainerOptions) {
+	config := *b.Config
+	config.Image = opts.Config.Image
+	config.AttachStderr = opts.Config.AttachStderr
+	config.AttachStdout = opts.Config.AttachStdout
+	if len(opts.Config.Cmd) > 0 {
+		config.Cmd = opts.Config.Cmd
+	}
+	config.Env = mergeEnv(b.Config.Env, opts.Config.Env)
+	config.Labels = map[string]string{}
+	for k, v := range b.Config.Labels {
+		config.Labels[k] = v
+	}
+	for k, v := range opts.Config.Labels {
+		config.Labels[k] = v
+	}
+	opts.Config = &config
+
+	host := *b.HostConfig
+	if len(opts.HostConfig.PortBindings) > 0 {
+		host.PortBindings = opts.HostConfig.PortBindings
+	}
+	if len(opts.HostConfig.Binds) > 0 {
+		host.Binds = opts.HostConfig.Binds
+	}
+	if opts.HostConfig.NetworkMode != "" {
+		host.NetworkMode = opts.HostConfig.NetworkMode
+	} else if aliases := b.Aliases[host.NetworkMode]; len(aliases) > 0 {
+		opts.NetworkingConfig = &docker.NetworkingConfig{
+			EndpointsConfig: map[string]*docker.EndpointConfig{
+				host.NetworkMode: {Aliases: aliases},
+			},
+		}
+	}
+	opts.HostConfig = &host
+}
+
+// mergeEnv returns the NAME=value variables of base
+// and override, those of override taking precedence
+func mergeEnv(base, override []string) []string {
+	set := map[string]bool{}
+	for _, env := range override {
+		set[strings.SplitN(env, "=", 2)[0]] = true
+	}
+	var merged []string
+	for _, env := range base {
+		if !set[strings.SplitN(env, "=", 2)[0]] {
+			merged = append(merged, env)
+		}
+	}
+	return append(merged, override...)
+}
+
+// AdoptHandler takes over the management of a container
+// created outside the receiver on POST /api/containers/{name}/adopt
+type AdoptHandler struct {
+	deployers Deployers
+	audit     *AuditLog
+}
+
+func (h *AdoptHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d, ok := h.deployers.ForTenant(requestTenant(r)).Container(r.PathValue("name"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if d.client == nil {
+		writeError(w, clientError(CodeInvalidPayload, PhaseAdopt, fmt.Errorf("container %q isn't run by a Docker API", d.container.Name)))
+		return
+	}
+
+	dep, herr := d.Adopt()
+
+	entry := AuditEntry{
+		Remote:     r.RemoteAddr,
+		Tenant:     d.tenant,
+		Repository: d.container.Repository,
+		Tag:        d.container.Tag,
+		Result:     Success,
+	}
+	if dep != nil {
+		entry.Deployments = []string{dep.ID}
+	}
+	if herr != nil {
+		entry.Result = Error
+		entry.Error = herr
+	}
+	h.audit.Record(entry)
+
+	if herr != nil {
+		log.Print(herr)
+		writeError(w, herr)
+		return
+	}
+	writeJSON(w, http.StatusOK, dep)
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// agentPrefix marks container hosts deployed to by a remote agent
+const agentPrefix = "agent://"
+
+// PhaseDispatch runs the deploy on a remote agent
+const PhaseDispatch = Phase("dispatch")
+
+const (
+	// agentPollTimeout is how long a poll waits for a command,
+	// and so the interval at which agents heartbeat
+	agentPollTimeout = 30 * time.Second
+	// agentTimeout is how long an agent may go without
+	// polling before it is considered disconnected
+	agentTimeout = 3 * agentPollTimeout
+	// agentDeployTimeout bounds waiting for an agent's deploy result
+	agentDeployTimeout = 30 * time.Minute
+)
+
+// AgentCommand is a deploy dispatched to an agent
+type AgentCommand struct {
+	ID        string          `json:"id"`
+	Container ContainerConfig `json:"container"`
+	Tag       string          `json:"tag"`
+	Version   string          `json:"version"`
+}
+
+// AgentStatus is the state of a remote agent
+type AgentStatus struct {
+	Name       string      `json:"name"`
+	Connected  bool        `json:"connected"`
+	LastSeen   time.Time   `json:"last_seen"`
+	LastDeploy *Deployment `json:"last_deploy,omitempty"`
+}
+
+type agent struct {
+	commands   chan AgentCommand
+	lastSeen   time.Time
+	lastDeploy *Deployment
+}
+
+type pendingCommand struct {
+	agent  string
+	result chan *Deployment
+}
+
+// AgentHub dispatches deploys to the agents polling it. Agents are
+// identified by the common name of their client certificate.
+type AgentHub struct {
+	mu      sync.Mutex
+	agents  map[string]*agent
+	pending map[string]*pendingCommand
+}
+
+// NewAgentHub returns a hub without any agents
+func NewAgentHub() *AgentHub {
+	return &AgentHub{
+		agents:  map[string]*agent{},
+		pending: map[string]*pendingCommand{},
+	}
+}
+
+// agent returns the named agent, registering it if
+// it is unknown. The hub must be locked.
+func (h *AgentHub) agent(name string) *agent {
+	a, ok := h.agents[name]
+	if !ok {
+		a = &agent{commands: make(chan AgentCommand, 16)}
+		h.agents[name] = a
+	}
+	return a
+}
+
+// Dispatch sends the command to the named agent and
+// waits for the deployment it reports back
+func (h *AgentHub) Dispatch(name string, cmd AgentCommand) (*Deployment, error) {
+	result := make(chan *Deployment, 1)
+	h.mu.Lock()
+	a := h.agent(name)
+	if time.Since(a.lastSeen) > agentTimeout {
+		h.mu.Unlock()
+		return nil, fmt.Errorf("agent %q is not connected", name)
+	}
+	h.pending[cmd.ID] = &pendingCommand{agent: name, result: result}
+	h.mu.Unlock()
+
+	defer func() {
+		h.mu.Lock()
+		delete(h.pending, cmd.ID)
+		h.mu.Unlock()
+	}()
+
+	select {
+	case a.commands <- cmd:
+	default:
+		return nil, fmt.Errorf("agent %q has too many queued deploys", name)
+	}
+
+	select {
+	case dep := <-result:
+		h.mu.Lock()
+		a.lastDeploy = dep
+		h.mu.Unlock()
+		return dep, nil
+	case <-time.After(agentDeployTimeout):
+		return nil, fmt.Errorf("timed out waiting for agent %q to deploy", name)
+	}
+}
+
+// Status returns the state of every agent that ever polled, by name
+func (h *AgentHub) Status() []AgentStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	res := []AgentStatus{}
+	for name, a := range h.agents {
+		res = append(res, AgentStatus{
+			Name:       name,
+			Connected:  time.Since(a.lastSeen) <= agentTimeout,
+			LastSeen:   a.lastSeen,
+			LastDeploy: a.lastDeploy,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+// Routes returns the handler of the agent API, which must
+// be served with verified client certificates
+func (h *AgentHub) Routes() http.Handler {
+	router := NewRouter()
+	router.Handle("POST /agent/v1/poll", longRunning(http.HandlerFunc(h.poll)))
+	router.Handle("POST /agent/v1/results/{id}", http.HandlerFunc(h.result))
+	return router
+}
+
+// agentName returns the name of the agent from its client certificate
+func agentName(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return r.TLS.PeerCertificates[0].Subject.CommonName
+}
+
+// poll registers a heartbeat of the agent and replies with the next
+// command for it, or no content if there was none within the timeout
+func (h *AgentHub) poll(w http.ResponseWriter, r *http.Request) {
+	name := agentName(r)
+	if name == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	h.mu.Lock()
+	a := h.agent(name)
+	a.lastSeen = time.Now()
+	h.mu.Unlock()
+
+	select {
+	case cmd := <-a.commands:
+		writeJSON(w, http.StatusOK, &cmd)
+	case <-time.After(agentPollTimeout):
+		w.WriteHeader(http.StatusNoContent)
+	case <-r.Context().Done():
+	}
+}
+
+// result receives the deployment of a command from the agent it was sent to
+func (h *AgentHub) result(w http.ResponseWriter, r *http.Request) {
+	var dep Deployment
+	err := json.NewDecoder(r.Body).Decode(&dep)
+	if err != nil {
+		writeError(w, clientError(CodeInvalidPayload, PhaseDecode, err))
+		return
+	}
+
+	h.mu.Lock()
+	p, ok := h.pending[r.PathValue("id")]
+	h.mu.Unlock()
+	if !ok || p.agent != agentName(r) {
+		http.NotFound(w, r)
+		return
+	}
+
+	select {
+	case p.result <- &dep:
+	default:
+		// Already reported
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AgentsHandler serves the state of the agents
+// on the hosts of the requesting tenant
+type AgentsHandler struct {
+	cfg    *Config
+	agents *AgentHub
+}
+
+func (h *AgentsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	statuses := h.agents.Status()
+	if tenant, ok := h.cfg.Tenant(requestTenant(r)); ok {
+		var allowed []AgentStatus
+		for _, s := range statuses {
+			if contains(tenant.Hosts, agentPrefix+s.Name) {
+				allowed = append(allowed, s)
+			}
+		}
+		statuses = allowed
+	}
+
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// AgentStrategy deploys a container on the host of a remote agent,
+// which runs the container's own strategy against its local daemon
+type AgentStrategy struct {
+	hub  *AgentHub
+	name string
+}
+
+// Deploy implements Strategy
+func (s AgentStrategy) Deploy(d *Deployer, dep *Deployment, version string) *HookError {
+	container := d.container
+	container.Host = ""
+
+	var res *Deployment
+	herr := d.phase(PhaseDispatch, func() (err error) {
+		res, err = s.hub.Dispatch(s.name, AgentCommand{
+			ID:        dep.ID,
+			Container: container,
+			Tag:       dep.Tag,
+			Version:   version,
+		})
+		return err
+	})
+	if herr != nil {
+		return herr
+	}
+
+	dep.Digest = res.Digest
+	dep.Image = res.Image
+	dep.ImageSize = res.ImageSize
+	dep.ImageLayers = res.ImageLayers
+	dep.PreviousImage = res.PreviousImage
+	dep.RolledBack = res.RolledBack
+	dep.TestOutput = res.TestOutput
+	dep.Labels = res.Labels
+	dep.Commit = res.Commit
+	if res.Error != nil {
+		// The status isn't sent over the wire
+		res.Error.Status = http.StatusInternalServerError
+		return res.Error
+	}
+
+	return nil
+}
+
+// loadTLS returns a TLS config presenting the certificate and trusting
+// peers signed by the CA, as server and client of the agent API
+func loadTLS(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// Agent runs the deploys dispatched by a central receiver
+// against the Docker daemon of its host
+type Agent struct {
+	// Server is the URL of the receiver's agent listener
+	Server   string
+	Client   *http.Client
+	Notifier Notifier
+	// SlowPhase and HealthTimeout are passed to the deployers
+	SlowPhase     time.Duration
+	HealthTimeout time.Duration
+
+	mu        sync.Mutex
+	deployers map[string]*Deployer
+	clients   map[string]DockerClient
+}
+
+// Run polls the receiver for commands forever
+func (a *Agent) Run() {
+	a.deployers = map[string]*Deployer{}
+	a.clients = map[string]DockerClient{}
+	for {
+		cmd, err := a.poll()
+		if err != nil {
+			log.Print("Failed to poll receiver: ", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		if cmd != nil {
+			go a.handle(cmd)
+		}
+	}
+}
+
+func (a *Agent) poll() (*AgentCommand, error) {
+	resp, err := a.Client.Post(strings.TrimSuffix(a.Server, "/")+"/agent/v1/poll", "application/json", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusOK:
+		cmd := &AgentCommand{}
+		return cmd, json.NewDecoder(resp.Body).Decode(cmd)
+	default:
+		return nil, fmt.Errorf("receiver replied with status %s", resp.Status)
+	}
+}
+
+// handle deploys the command and reports the deployment to the receiver
+func (a *Agent) handle(cmd *AgentCommand) {
+	var dep *Deployment
+	d, err := a.deployer(cmd.Container)
+	if err != nil {
+		log.Printf("Failed to deploy %q: %v", cmd.Container.Name, err)
+		dep = &Deployment{
+			Container: cmd.Container.Name,
+			Result:    Error,
+			Error:     serverError(CodeDockerError, PhaseDispatch, err),
+		}
+	} else {
+		log.Printf("Deploying %q for the receiver", cmd.Container.Name)
+		dep, _ = d.run(cmd.Tag, cmd.Version, nil)
+	}
+
+	content, err := json.Marshal(dep)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	for attempt := 0; attempt < 5; attempt++ {
+		err = a.report(cmd.ID, content)
+		if err == nil {
+			return
+		}
+		time.Sleep(5 * time.Second)
+	}
+	log.Printf("Failed to report deploy of %q: %v", cmd.Container.Name, err)
+}
+
+func (a *Agent) report(id string, content []byte) error {
+	resp, err := a.Client.Post(strings.TrimSuffix(a.Server, "/")+"/agent/v1/results/"+id, "application/json", bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errors.New("receiver stopped waiting for the result")
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("receiver replied with status %s", resp.Status)
+	}
+	return nil
+}
+
+// deployer returns the deployer of the container, replacing
+// it if the receiver sent a changed configuration
+func (a *Agent) deployer(c ContainerConfig) (*Deployer, error) {
+	// What's derived from the configuration isn't sent
+	err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if d, ok := a.deployers[c.Name]; ok && reflect.DeepEqual(d.container, c) {
+		return d, nil
+	}
+
+	key := c.Engine + " " + c.Namespace
+	client, ok := a.clients[key]
+	if !ok {
+		client, err = newDockerClient("", c.Engine, c.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		a.clients[key] = client
+	}
+
+	d := &Deployer{
+		client:        client,
+		notifier:      a.Notifier,
+		container:     c,
+		strategy:      strategies[c.Strategy],
+		SlowPhase:     a.SlowPhase,
+		HealthTimeout: a.HealthTimeout,
+	}
+	a.deployers[c.Name] = d
+	return d, nil
+}
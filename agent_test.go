@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestAgentDeployerLoadsContainer(t *testing.T) {
+	// As sent by the receiver
+	content, err := json.Marshal(AgentCommand{Container: ContainerConfig{
+		Name:       "app",
+		Repository: "example/app",
+		SizeBudget: "500MB",
+		When:       `tag.startsWith("v")`,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := &AgentCommand{}
+	err = json.Unmarshal(content, cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &Agent{deployers: map[string]*Deployer{}, clients: map[string]DockerClient{"": newFakeDocker()}}
+	d, err := a.deployer(cmd.Container)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.container.sizeBudget != 500<<20 {
+		t.Errorf("got size budget %d", d.container.sizeBudget)
+	}
+	if d.container.when == nil || d.container.Tag != "latest" {
+		t.Errorf("got %+v, want the when condition compiled and defaults set", d.container)
+	}
+	again, err := a.deployer(cmd.Container)
+	if err != nil || again != d {
+		t.Errorf("unchanged container got a new deployer")
+	}
+
+	cmd.Container.When = "tag =="
+	_, err = a.deployer(cmd.Container)
+	if err == nil {
+		t.Error("invalid container accepted")
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AlertingConfig pages on-call when deploys fail
+type AlertingConfig struct {
+	// Type is pagerduty or opsgenie
+	Type string `json:"type"`
+	// RoutingKey is the PagerDuty Events API v2 integration
+	// key, PAGERDUTY_ROUTING_KEY if empty
+	RoutingKey string `json:"routing_key"`
+	// APIKey is the Opsgenie API integration key,
+	// OPSGENIE_API_KEY if empty
+	APIKey string `json:"api_key"`
+	// URL is the Opsgenie API, https://api.opsgenie.com
+	// if empty. Use https://api.eu.opsgenie.com for EU accounts.
+	URL string `json:"url"`
+}
+
+func (c *AlertingConfig) validate() error {
+	switch c.Type {
+	case "pagerduty":
+		if c.RoutingKey == "" {
+			c.RoutingKey = os.Getenv("PAGERDUTY_ROUTING_KEY")
+		}
+		if c.RoutingKey == "" {
+			return errors.New("alerting pagerduty needs a routing key")
+		}
+	case "opsgenie":
+		if c.APIKey == "" {
+			c.APIKey = os.Getenv("OPSGENIE_API_KEY")
+		}
+		if c.APIKey == "" {
+			return errors.New("alerting opsgenie needs an api key")
+		}
+		if c.URL == "" {
+			c.URL = "https://api.opsgenie.com"
+		}
+		c.URL = strings.TrimSuffix(c.URL, "/")
+	default:
+		return fmt.Errorf("unknown alerting type %q", c.Type)
+	}
+	return nil
+}
+
+// Alerter triggers an alert, deduplicated by container name, when a
+// deploy of the container fails or is rolled back, and resolves it
+// on the next successful deploy
+type Alerter struct {
+	cfg       *AlertingConfig
+	container string
+
+	mu sync.Mutex
+	// open is whether an alert may be open. It starts out
+	// set, as an alert may have been left open by a
+	// previous run of the receiver.
+	open bool
+}
+
+// NewAlerter returns an alerter for the container
+func NewAlerter(cfg *AlertingConfig, container string) *Alerter {
+	return &Alerter{cfg: cfg, container: container, open: true}
+}
+
+// DeployStarted implements LifecycleHook
+func (a *Alerter) DeployStarted(*Deployment) {}
+
+// DeployFinished implements LifecycleHook
+func (a *Alerter) DeployFinished(dep *Deployment) {
+	failed := dep.Result != Success || dep.RolledBack
+	a.mu.Lock()
+	resolve := !failed && a.open
+	a.open = failed
+	a.mu.Unlock()
+	if !failed && !resolve {
+		return
+	}
+
+	summary := fmt.Sprintf("Deploy of %s:%s to %s failed", dep.Repository, dep.Tag, a.container)
+	if dep.Error != nil {
+		summary += ": " + dep.Error.Message
+	}
+	severity := "error"
+	if dep.RolledBack {
+		severity = "warning"
+		summary += ", rolled back to " + dep.PreviousImage
+	}
+	go func() {
+		var err error
+		if failed {
+			err = a.trigger(dep, summary, severity)
+		} else {
+			err = a.resolve()
+		}
+		if err != nil {
+			log.WithField("deployment", dep.ID).Printf("Failed to send %s alert: %v", a.cfg.Type, err)
+		}
+	}()
+}
+
+var alertClient = &http.Client{Timeout: 30 * time.Second}
+
+func (a *Alerter) trigger(dep *Deployment, summary, severity string) error {
+	details := map[string]string{
+		"deployment_id": dep.ID,
+		"repository":    dep.Repository,
+		"tag":           dep.Tag,
+	}
+	if dep.Error != nil {
+		details["phase"] = string(dep.Error.Phase)
+		details["code"] = string(dep.Error.Code)
+	}
+	if a.cfg.Type == "pagerduty" {
+		return a.pagerduty("trigger", map[string]interface{}{
+			"summary":        summary,
+			"source":         "docker-webhook-receiver",
+			"severity":       severity,
+			"component":      a.container,
+			"custom_details": details,
+		})
+	}
+	priority := "P2"
+	if dep.RolledBack {
+		priority = "P3"
+	}
+	if len(summary) > 130 {
+		// The limit of Opsgenie
+		summary = summary[:127] + "..."
+	}
+	return a.opsgenie("/v2/alerts", map[string]interface{}{
+		"message":  summary,
+		"alias":    a.container,
+		"priority": priority,
+		"source":   "docker-webhook-receiver",
+		"details":  details,
+	})
+}
+
+func (a *Alerter) resolve() error {
+	if a.cfg.Type == "pagerduty" {
+		return a.pagerduty("resolve", nil)
+	}
+	return a.opsgenie("/v2/alerts/"+url.PathEscape(a.container)+"/close?identifierType=alias", map[string]string{
+		"source": "docker-webhook-receiver",
+		"note":   "Deployed successfully",
+	})
+}
+
+func (a *Alerter) pagerduty(action string, payload map[string]interface{}) error {
+	event := map[string]interface{}{
+		"routing_key":  a.cfg.RoutingKey,
+		"event_action": action,
+		"dedup_key":    a.container,
+	}
+	if payload != nil {
+		event["payload"] = payload
+	}
+	return githubRequest(alertClient, "POST", "https://events.pagerduty.com/v2/enqueue", "", event, nil)
+}
+
+func (a *Alerter) opsgenie(path string, in interface{}) error {
+	return githubRequest(alertClient, "POST", a.cfg.URL+path, "GenieKey "+a.cfg.APIKey, in, nil)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// EventPushSpike is sent when the pushes to a repository
+// spike far above its usual cadence
+const EventPushSpike = Event("push_spike")
+
+// CodePushSpike is used when a push is held because of a spike
+const CodePushSpike = ErrorCode("push_spike")
+
+// pushSpike is 1 for repositories pushed to abnormally often
+var pushSpike = NewGaugeVec(
+	"webhook_push_spike",
+	"Whether the repository is pushed to far more often than usual.",
+	"tenant", "repository",
+)
+
+// maxTrackedPushes bounds the pushes remembered per repository
+const maxTrackedPushes = 10000
+
+// AnomalyConfig detects spikes in the pushes to a repository, like
+// 20 pushes in 5 minutes, which usually are a CI loop or a compromise
+type AnomalyConfig struct {
+	// Window is the period pushes are counted in, 5m if empty
+	Window string `json:"window"`
+	// Baseline is the period the usual cadence is learnt from, 7 days
+	// (168h) if empty
+	Baseline string `json:"baseline"`
+	// MinPushes is the number of pushes in a window below which
+	// there is no spike, 10 if zero
+	MinPushes int `json:"min_pushes"`
+	// Factor is how many times the usual number of pushes per window
+	// is a spike, 5 if zero
+	Factor float64 `json:"factor"`
+	// Action is alert (default), only notifying, or hold, rejecting
+	// the pushes during the spike. Held pushes can be deployed with
+	// POST /api/deploy once they were found to be genuine.
+	Action string `json:"action"`
+
+	window, baseline time.Duration
+}
+
+func (c *AnomalyConfig) validate() error {
+	var err error
+	c.window = 5 * time.Minute
+	if c.Window != "" {
+		c.window, err = time.ParseDuration(c.Window)
+		if err != nil || c.window <= 0 {
+			return fmt.Errorf("anomalies: invalid window %q", c.Window)
+		}
+	}
+	c.baseline = 7 * 24 * time.Hour
+	if c.Baseline != "" {
+		c.baseline, err = time.ParseDuration(c.Baseline)
+		if err != nil || c.baseline <= c.window {
+			return fmt.Errorf("anomalies: invalid baseline %q, it must be longer than the window", c.Baseline)
+		}
+	}
+	if c.MinPushes == 0 {
+		c.MinPushes = 10
+	}
+	if c.Factor == 0 {
+		c.Factor = 5
+	}
+	if c.MinPushes < 0 || c.Factor < 0 {
+		return fmt.Errorf("anomalies: min pushes and factor must be positive")
+	}
+	switch c.Action {
+	case "":
+		c.Action = "alert"
+	case "alert", "hold":
+	default:
+		return fmt.Errorf("anomalies: unknown action %q", c.Action)
+	}
+	return nil
+}
+
+// PushRates tracks the pushes to every repository
+type PushRates struct {
+	cfg *AnomalyConfig
+
+	mu sync.Mutex
+	// pushes are the times of the pushes within the baseline, by
+	// tenant and repository
+	pushes map[string][]time.Time
+	// spiking are the repositories currently spiking
+	spiking map[string]bool
+}
+
+// NewPushRates returns a tracker detecting spikes as configured
+func NewPushRates(cfg *AnomalyConfig) *PushRates {
+	return &PushRates{
+		cfg:     cfg,
+		pushes:  map[string][]time.Time{},
+		spiking: map[string]bool{},
+	}
+}
+
+// observe records a push to the repository and reports whether it
+// is part of a spike, and whether the spike just started
+func (r *PushRates) observe(tenant, repo string, now time.Time) (spike, started bool, inWindow int, usual float64) {
+	key := tenant + "/" + repo
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pushes := r.pushes[key]
+	i := 0
+	for i < len(pushes) && now.Sub(pushes[i]) > r.cfg.baseline {
+		i++
+	}
+	pushes = append(pushes[i:], now)
+	if len(pushes) > maxTrackedPushes {
+		pushes = pushes[len(pushes)-maxTrackedPushes:]
+	}
+	r.pushes[key] = pushes
+
+	before := 0
+	for _, t := range pushes {
+		if now.Sub(t) >= r.cfg.window {
+			before++
+		}
+	}
+	inWindow = len(pushes) - before
+	// The usual pushes per window, learnt from the baseline
+	// before the current window
+	usual = float64(before) / float64((r.cfg.baseline-r.cfg.window)/r.cfg.window)
+
+	spike = inWindow >= r.cfg.MinPushes && float64(inWindow) > r.cfg.Factor*usual
+	started = spike && !r.spiking[key]
+	r.spiking[key] = spike
+	if spike {
+		pushSpike.Set(1, tenant, repo)
+	} else {
+		pushSpike.Set(0, tenant, repo)
+	}
+	return spike, started, inWindow, usual
+}
+
+// checkRate records the push, notifying about spikes in the pushes to
+// its repository. Pushes during a spike fail if they are to be held.
+func (r *PushRates) checkRate(tenant string, deployers Deployers, hook *DockerHubWebhook) *HookError {
+	if r == nil {
+		return nil
+	}
+	spike, started, inWindow, usual := r.observe(tenant, hook.Repository.RepoName, time.Now())
+	if !spike {
+		return nil
+	}
+	msg := fmt.Sprintf("%d pushes to %s in the last %s, usually %.1f", inWindow, hook.Repository.RepoName, r.cfg.window, usual)
+	if started {
+		log.Printf("Push spike: %s", msg)
+		for _, d := range deployers {
+			notify(d.notifier, Notification{
+				Event:     EventPushSpike,
+				Container: d.container.Name,
+				Phase:     PhaseVerify,
+				Message:   msg,
+			})
+		}
+	}
+	if r.cfg.Action != "hold" {
+		return nil
+	}
+	herr := clientError(CodePushSpike, PhaseVerify, fmt.Errorf("push of %s:%s held: %s", hook.Repository.RepoName, hook.PushData.Tag, msg))
+	herr.Status = http.StatusTooManyRequests
+	return herr
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Role grants access to parts of the management API
+type Role string
+
+// Allowed values of Role, each granting everything the previous one does
+const (
+	// RoleViewer may read status and deployment history
+	RoleViewer = Role("viewer")
+	// RoleDeployer may additionally trigger deploys and rollbacks
+	RoleDeployer = Role("deployer")
+	// RoleAdmin may additionally approve deployments and change freezes
+	RoleAdmin = Role("admin")
+)
+
+var roleRank = map[Role]int{
+	RoleViewer:   1,
+	RoleDeployer: 2,
+	RoleAdmin:    3,
+}
+
+// Allows reports whether the role grants the required role
+func (r Role) Allows(required Role) bool {
+	return roleRank[r] >= roleRank[required]
+}
+
+type contextKey int
+
+const (
+	tenantKey contextKey = iota
+	// listenerRoleKey is the role granted by the listener
+	listenerRoleKey
+	// clientKey is the address of the client behind trusted proxies
+	clientKey
+)
+
+// requireRole only passes requests authenticated by a bearer token
+// granting role. The tenant of the token is stored in the request context.
+// When no API tokens are configured only the viewer routes are
+// open to everyone.
+// Requests without a token on a listener granting a role, like a Unix
+// socket, get that role for all tenants. Browsers' cross-site requests
+// changing anything are rejected, see crossSite.
+func requireRole(cfg *Config, role Role) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !safeMethod(r.Method) && crossSite(r) {
+				log.Printf("Denied cross-site %s of %s", r.Method, r.URL.Path)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			granted, byListener := r.Context().Value(listenerRoleKey).(Role)
+			if !cfg.HasAPITokens() {
+				if role != RoleViewer && !(byListener && granted.Allows(role)) {
+					log.Printf("Denied access to %s, %s routes need API tokens", r.URL.Path, role)
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				h.ServeHTTP(w, r)
+				return
+			}
+			if byListener && r.Header.Get("Authorization") == "" {
+				if !granted.Allows(role) {
+					log.Printf("Listener role %q denied access to %s", granted, r.URL.Path)
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			t, granted, ok := cfg.TenantForToken(token)
+			if !ok {
+				authFailures.fail(r, "invalid API token")
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if !granted.Allows(role) {
+				log.Printf("Token for tenant %q with role %q denied access to %s", t.Name, granted, r.URL.Path)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), tenantKey, t.Name)
+			h.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// apiServer is what the management API serves
+type apiServer struct {
+	cfg        *Config
+	deployers  Deployers
+	webhooks   *WebhookHandler
+	events     *EventStream
+	slos       *SLOTracker
+	deployLogs *DeployLogs
+	sboms      *SBOMStore
+	audit      *AuditLog
+	cordons    *Cordons
+	scheduler  *Scheduler
+	agents     *AgentHub
+	archiveDir string
+	// archiveURLs are the prefixes archives may be downloaded from
+	archiveURLs []string
+}
+
+// handleAPI serves the management API on /api/, each route
+// requiring the role of the tokens allowed to use it
+func handleAPI(router *Router, s *apiServer) {
+	router.Handle("GET /api/status", &StatusHandler{
+		deployers: s.deployers,
+		slos:      s.slos,
+	}, requireRole(s.cfg, RoleViewer))
+	router.Handle("GET /api/events/stream", s.events, requireRole(s.cfg, RoleViewer), longRunning)
+	router.Handle("GET /api/deployments", &HistoryHandler{
+		deployers: s.deployers,
+	}, requireRole(s.cfg, RoleViewer))
+	router.Handle("GET /api/deployments/{id}", &DeploymentHandler{
+		deployers: s.deployers,
+	}, requireRole(s.cfg, RoleViewer))
+	router.Handle("GET /api/deployments/{id}/wait", &WaitHandler{
+		deployers: s.deployers,
+		events:    s.events,
+	}, requireRole(s.cfg, RoleViewer), longRunning)
+	router.Handle("GET /api/deployments/{id}/diff", &DiffHandler{
+		deployers: s.deployers,
+	}, requireRole(s.cfg, RoleViewer))
+	router.Handle("GET /api/deployments/{id}/sbom", &SBOMHandler{
+		deployers: s.deployers,
+		sboms:     s.sboms,
+	}, requireRole(s.cfg, RoleViewer))
+	router.Handle("GET /api/deployments/{id}/log", &DeployLogHandler{
+		deployers: s.deployers,
+		logs:      s.deployLogs,
+	}, requireRole(s.cfg, RoleViewer))
+	router.Handle("POST /api/deployments/{id}/replay", &ReplayHandler{
+		deployers: s.deployers,
+		webhooks:  s.webhooks,
+	}, requireRole(s.cfg, RoleDeployer), longRunning)
+	deadLetters := &DeadLettersHandler{
+		deadLetters: s.webhooks.deadLetters,
+		webhooks:    s.webhooks,
+	}
+	router.Handle("GET /api/dead-letters", deadLetters, requireRole(s.cfg, RoleViewer))
+	router.Handle("DELETE /api/dead-letters", deadLetters, requireRole(s.cfg, RoleDeployer))
+	router.Handle("GET /api/dead-letters/{id}", deadLetters, requireRole(s.cfg, RoleViewer))
+	router.Handle("DELETE /api/dead-letters/{id}", deadLetters, requireRole(s.cfg, RoleDeployer))
+	router.Handle("POST /api/dead-letters/{id}/retry", deadLetters, requireRole(s.cfg, RoleDeployer), longRunning)
+	router.Handle("POST /api/deploy", &DeployHandler{
+		deployers:   s.deployers,
+		audit:       s.audit,
+		archiveDir:  s.archiveDir,
+		archiveURLs: s.archiveURLs,
+	}, requireSignatureOrRole(s.cfg, RoleDeployer))
+	router.Handle("POST /api/containers/{name}/deploy", &TriggerHandler{
+		deployers: s.deployers,
+		audit:     s.audit,
+	}, requireRole(s.cfg, RoleDeployer), longRunning)
+	pin := &PinHandler{
+		deployers: s.deployers,
+		audit:     s.audit,
+	}
+	router.Handle("POST /api/containers/{name}/pin", pin, requireRole(s.cfg, RoleDeployer))
+	router.Handle("DELETE /api/containers/{name}/pin", pin, requireRole(s.cfg, RoleDeployer))
+	router.Handle("POST /api/containers/{name}/adopt", &AdoptHandler{
+		deployers: s.deployers,
+		audit:     s.audit,
+	}, requireRole(s.cfg, RoleAdmin))
+	hosts := &HostsHandler{
+		deployers: s.deployers,
+		cordons:   s.cordons,
+		audit:     s.audit,
+	}
+	router.Handle("GET /api/hosts", hosts, requireRole(s.cfg, RoleViewer))
+	router.Handle("POST /api/hosts/cordon", hosts, requireRole(s.cfg, RoleAdmin), longRunning)
+	router.Handle("DELETE /api/hosts/cordon", hosts, requireRole(s.cfg, RoleAdmin), longRunning)
+
+	router.Handle("GET /api/schedules", &SchedulesHandler{
+		deployers: s.deployers,
+		scheduler: s.scheduler,
+	}, requireRole(s.cfg, RoleViewer))
+	router.Handle("GET /api/containers/{name}/logs", &LogsHandler{
+		deployers: s.deployers,
+	}, requireRole(s.cfg, RoleViewer), longRunning)
+	router.Handle("GET /api/config", &ConfigHandler{
+		cfg:       s.cfg,
+		deployers: s.deployers,
+	}, requireRole(s.cfg, RoleAdmin))
+
+	if s.agents != nil {
+		router.Handle("GET /api/agents", &AgentsHandler{
+			cfg:    s.cfg,
+			agents: s.agents,
+		}, requireRole(s.cfg, RoleViewer))
+	}
+}
+
+// requestTenant returns the tenant the request was authenticated for.
+// An empty tenant grants access to all tenants.
+func requestTenant(r *http.Request) string {
+	tenant, _ := r.Context().Value(tenantKey).(string)
+	return tenant
+}
+
+// writeJSON replies to the request with the JSON encoded value
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// protectedRoutes are the routes of the management API
+// and the role they require
+var protectedRoutes = []struct {
+	method, path string
+	role         Role
+}{
+	{"GET", "/api/status", RoleViewer},
+	{"GET", "/api/events/stream", RoleViewer},
+	{"GET", "/api/deployments", RoleViewer},
+	{"GET", "/api/deployments/1", RoleViewer},
+	{"GET", "/api/deployments/1/wait", RoleViewer},
+	{"GET", "/api/deployments/1/diff", RoleViewer},
+	{"GET", "/api/deployments/1/sbom", RoleViewer},
+	{"GET", "/api/deployments/1/log", RoleViewer},
+	{"POST", "/api/deployments/1/replay", RoleDeployer},
+	{"GET", "/api/dead-letters", RoleViewer},
+	{"DELETE", "/api/dead-letters", RoleDeployer},
+	{"GET", "/api/dead-letters/1", RoleViewer},
+	{"DELETE", "/api/dead-letters/1", RoleDeployer},
+	{"POST", "/api/dead-letters/1/retry", RoleDeployer},
+	{"POST", "/api/deploy", RoleDeployer},
+	{"POST", "/api/containers/app/deploy", RoleDeployer},
+	{"POST", "/api/containers/app/pin", RoleDeployer},
+	{"DELETE", "/api/containers/app/pin", RoleDeployer},
+	{"POST", "/api/containers/app/adopt", RoleAdmin},
+	{"GET", "/api/hosts", RoleViewer},
+	{"POST", "/api/hosts/cordon", RoleAdmin},
+	{"DELETE", "/api/hosts/cordon", RoleAdmin},
+	{"GET", "/api/schedules", RoleViewer},
+	{"GET", "/api/containers/app/logs", RoleViewer},
+	{"GET", "/api/config", RoleAdmin},
+	{"GET", "/api/agents", RoleViewer},
+	{"GET", "/debug/pprof/cmdline", RoleAdmin},
+}
+
+// newTestAPI returns the router of the management API
+// of a receiver without containers
+func newTestAPI(t *testing.T, cfg *Config) *Router {
+	t.Helper()
+	err := cfg.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadLetters, err := NewDeadLetters(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployLogs, err := NewDeployLogs("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sboms, err := NewSBOMStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit, err := NewAuditLog(AuditConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cordons, err := NewCordons(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter(recoverPanics)
+	handleAPI(router, &apiServer{
+		cfg:        cfg,
+		webhooks:   &WebhookHandler{cfg: cfg, audit: audit, deadLetters: deadLetters},
+		events:     NewEventStream(),
+		deployLogs: deployLogs,
+		sboms:      sboms,
+		audit:      audit,
+		cordons:    cordons,
+		scheduler:  NewScheduler(nil),
+		agents:     NewAgentHub(),
+	})
+	handlePprof(router, cfg)
+	return router
+}
+
+// serveTest serves the request, with its context canceled
+// so streaming handlers return right away
+func serveTest(h http.Handler, method, path, token string, listenerRole Role) int {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if listenerRole != "" {
+		ctx = context.WithValue(ctx, listenerRoleKey, listenerRole)
+	}
+	r := httptest.NewRequest(method, path, nil).WithContext(ctx)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestRequireRoleTokens(t *testing.T) {
+	router := newTestAPI(t, &Config{Tenants: []TenantConfig{{
+		Name: DefaultTenant,
+		APITokens: []APIToken{
+			{Token: "viewer-token", Role: RoleViewer},
+			{Token: "deployer-token", Role: RoleDeployer},
+			{Token: "admin-token", Role: RoleAdmin},
+		},
+	}}})
+	tokens := map[Role]string{
+		RoleViewer:   "viewer-token",
+		RoleDeployer: "deployer-token",
+		RoleAdmin:    "admin-token",
+	}
+
+	for _, route := range protectedRoutes {
+		for _, token := range []string{"", "wrong-token"} {
+			code := serveTest(router, route.method, route.path, token, "")
+			if code != http.StatusUnauthorized {
+				t.Errorf("%s %s with token %q: got %d, want %d", route.method, route.path, token, code, http.StatusUnauthorized)
+			}
+		}
+		for role, token := range tokens {
+			code := serveTest(router, route.method, route.path, token, "")
+			denied := code == http.StatusUnauthorized || code == http.StatusForbidden
+			if allowed := role.Allows(route.role); denied == allowed {
+				t.Errorf("%s %s as %s: got %d, allowed %v", route.method, route.path, role, code, allowed)
+			}
+		}
+	}
+}
+
+func TestRequireRoleListener(t *testing.T) {
+	router := newTestAPI(t, &Config{Tenants: []TenantConfig{{
+		Name:      DefaultTenant,
+		APITokens: []APIToken{{Token: "viewer-token", Role: RoleViewer}},
+	}}})
+
+	for _, route := range protectedRoutes {
+		code := serveTest(router, route.method, route.path, "", RoleDeployer)
+		denied := code == http.StatusUnauthorized || code == http.StatusForbidden
+		if allowed := RoleDeployer.Allows(route.role); denied == allowed {
+			t.Errorf("%s %s on a deployer listener: got %d, allowed %v", route.method, route.path, code, allowed)
+		}
+	}
+}
+
+func TestRequireRoleNoTokens(t *testing.T) {
+	router := newTestAPI(t, &Config{Tenants: []TenantConfig{{Name: DefaultTenant}}})
+
+	for _, route := range protectedRoutes {
+		code := serveTest(router, route.method, route.path, "", "")
+		denied := code == http.StatusUnauthorized || code == http.StatusForbidden
+		if viewer := route.role == RoleViewer; denied == viewer {
+			t.Errorf("%s %s without tokens: got %d, want denied %v", route.method, route.path, code, !viewer)
+		}
+
+		code = serveTest(router, route.method, route.path, "", RoleDeployer)
+		denied = code == http.StatusUnauthorized || code == http.StatusForbidden
+		if admin := route.role == RoleAdmin; denied != admin {
+			t.Errorf("%s %s without tokens on a deployer listener: got %d, want denied %v", route.method, route.path, code, admin)
+		}
+
+		code = serveTest(router, route.method, route.path, "", RoleAdmin)
+		if code == http.StatusUnauthorized || code == http.StatusForbidden {
+			t.Errorf("%s %s without tokens on an admin listener: got %d", route.method, route.path, code)
+		}
+	}
+}
+
+func TestAPITokenPlainString(t *testing.T) {
+	var tenant TenantConfig
+	err := json.Unmarshal([]byte(`{"name": "web", "api_tokens": ["old-token", {"token": "new-token"}]}`), &tenant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{Tenants: []TenantConfig{tenant}}
+	err = cfg.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for token, want := range map[string]Role{"old-token": RoleAdmin, "new-token": RoleViewer} {
+		_, role, ok := cfg.TenantForToken(token)
+		if !ok || role != want {
+			t.Errorf("%s: got role %q, want %q", token, role, want)
+		}
+	}
+}
+
+func TestRequireRoleCrossSite(t *testing.T) {
+	cfg := &Config{Tenants: []TenantConfig{{Name: DefaultTenant}}}
+	h := requireRole(cfg, RoleDeployer)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tt := range []struct {
+		name    string
+		method  string
+		headers map[string]string
+		want    int
+	}{
+		{"no browser", http.MethodPost, nil, http.StatusOK},
+		{"same origin", http.MethodPost, map[string]string{"Sec-Fetch-Site": "same-origin", "Origin": "http://example.com"}, http.StatusOK},
+		{"typed in", http.MethodPost, map[string]string{"Sec-Fetch-Site": "none"}, http.StatusOK},
+		{"cross site", http.MethodPost, map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		{"same site", http.MethodDelete, map[string]string{"Sec-Fetch-Site": "same-site"}, http.StatusForbidden},
+		{"other origin", http.MethodPost, map[string]string{"Origin": "https://evil.example"}, http.StatusForbidden},
+		{"opaque origin", http.MethodPost, map[string]string{"Origin": "null"}, http.StatusForbidden},
+		{"matching origin", http.MethodPost, map[string]string{"Origin": "http://EXAMPLE.com"}, http.StatusOK},
+		{"other referer", http.MethodPut, map[string]string{"Referer": "https://evil.example/page"}, http.StatusForbidden},
+		{"matching referer", http.MethodPost, map[string]string{"Referer": "http://example.com/api/status"}, http.StatusOK},
+		{"cross site read", http.MethodGet, map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusOK},
+	} {
+		ctx := context.WithValue(context.Background(), listenerRoleKey, RoleDeployer)
+		r := httptest.NewRequest(tt.method, "/api/deploy", nil).WithContext(ctx)
+		for name, value := range tt.headers {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
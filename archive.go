@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// PhaseLoad loads the image from an archive instead of pulling it
+const PhaseLoad = Phase("load")
+
+// CodeInvalidArchive is used for archives that can't be deployed
+const CodeInvalidArchive = ErrorCode("invalid_archive")
+
+var archiveClient = &http.Client{Timeout: 30 * time.Minute}
+
+// isURL reports whether the archive is downloaded rather than on disk
+func isURL(archive string) bool {
+	return strings.HasPrefix(archive, "http://") || strings.HasPrefix(archive, "https://")
+}
+
+// resolveArchive returns the archive to deploy, either a URL starting
+// with one of the allowed prefixes or the path of a file in dir, which
+// may be given as a file:// URL. Paths outside dir are rejected, so API
+// tokens can't read arbitrary files, and other URLs too, so they can't
+// run images from anywhere.
+func resolveArchive(archive, dir string, allowed []string) (string, *HookError) {
+	if isURL(archive) {
+		for _, prefix := range allowed {
+			if hasURLPrefix(archive, prefix) {
+				return archive, nil
+			}
+		}
+		herr := clientError(CodeInvalidArchive, PhaseVerify, fmt.Errorf("archive %s isn't under the URLs passed as -archive-urls", archive))
+		herr.Status = http.StatusForbidden
+		return "", herr
+	}
+	if u, err := url.Parse(archive); err == nil && u.Scheme != "" {
+		if u.Scheme != "file" || u.Host != "" {
+			return "", clientError(CodeInvalidArchive, PhaseVerify, fmt.Errorf("archive %s is neither an http(s) URL nor in the archive dir", archive))
+		}
+		archive = u.Path
+	}
+	if dir == "" {
+		return "", clientError(CodeInvalidArchive, PhaseVerify, errors.New("archives on disk are disabled, pass -archive-dir to enable them"))
+	}
+	path := filepath.Join(dir, filepath.Clean("/"+archive))
+	info, err := os.Stat(path)
+	if err != nil {
+		herr := clientError(CodeInvalidArchive, PhaseVerify, fmt.Errorf("archive %s not found in the archive dir", archive))
+		herr.Status = http.StatusNotFound
+		return "", herr
+	}
+	if !info.Mode().IsRegular() {
+		return "", clientError(CodeInvalidArchive, PhaseVerify, fmt.Errorf("archive %s is not a file", archive))
+	}
+	return path, nil
+}
+
+// hasURLPrefix reports whether the URL is on the host of the prefix
+// and its path under the prefix's, compared cleaned so neither dots
+// nor a host like prefix.example.com escape it
+func hasURLPrefix(archive, prefix string) bool {
+	u, err := url.Parse(archive)
+	p, perr := url.Parse(prefix)
+	if err != nil || perr != nil || u.User != nil {
+		return false
+	}
+	if !strings.EqualFold(u.Scheme, p.Scheme) || !strings.EqualFold(u.Host, p.Host) {
+		return false
+	}
+	dir := path.Clean("/" + p.Path)
+	file := path.Clean("/" + u.Path)
+	return dir == "/" || file == dir || strings.HasPrefix(file, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// load loads the images in the archive, a docker save tarball,
+// optionally gzip compressed, into the Docker daemon
+func (d *Deployer) load(archive string) error {
+	var r io.Reader
+	if isURL(archive) {
+		resp, err := archiveClient.Get(archive)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("failed to download %s: %s", archive, resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(archive)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	return d.client.LoadImage(docker.LoadImageOptions{
+		InputStream:  r,
+		OutputStream: io.Discard,
+	})
+}
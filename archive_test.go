@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveArchive(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "app.tar"), nil, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed := []string{"https://artifacts.example.com/images/", "http://10.0.0.5:8080"}
+
+	for archive, want := range map[string]string{
+		"app.tar":         filepath.Join(dir, "app.tar"),
+		"file:///app.tar": filepath.Join(dir, "app.tar"),
+		"../../app.tar":   filepath.Join(dir, "app.tar"),
+		"https://artifacts.example.com/images/app.tar":         "https://artifacts.example.com/images/app.tar",
+		"https://ARTIFACTS.example.com/images/team/app.tar.gz": "https://ARTIFACTS.example.com/images/team/app.tar.gz",
+		"http://10.0.0.5:8080/app.tar":                         "http://10.0.0.5:8080/app.tar",
+	} {
+		got, herr := resolveArchive(archive, dir, allowed)
+		if herr != nil || got != want {
+			t.Errorf("%s: got %s, %v, want %s", archive, got, herr, want)
+		}
+	}
+
+	for _, archive := range []string{
+		"https://evil.example.com/app.tar",
+		"https://artifacts.example.com/app.tar",
+		"https://artifacts.example.com/images/../app.tar",
+		"https://artifacts.example.com/imagesx/app.tar",
+		"https://artifacts.example.com.evil.example.com/images/app.tar",
+		"https://user@artifacts.example.com/images/app.tar",
+		"http://artifacts.example.com/images/app.tar",
+		"http://10.0.0.5:8081/app.tar",
+		"file://host/app.tar",
+		"ftp://artifacts.example.com/images/app.tar",
+		"missing.tar",
+	} {
+		got, herr := resolveArchive(archive, dir, allowed)
+		if herr == nil || herr.Status < 400 || herr.Status >= 500 {
+			t.Errorf("%s: got %s, %v, want it refused", archive, got, herr)
+		}
+	}
+}
+
+func TestDeployArchiveNeedsToken(t *testing.T) {
+	client := newFakeDocker()
+	h := &DeployHandler{
+		deployers:   Deployers{newTestDeployer(client, ContainerConfig{})},
+		archiveDir:  t.TempDir(),
+		archiveURLs: []string{"https://artifacts.example.com/"},
+	}
+	for _, tenant := range []string{"", DefaultTenant} {
+		r := httptest.NewRequest("POST", "/api/deploy", strings.NewReader("repo=example/app&archive=https://evil.example.com/app.tar"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tenant != "" {
+			r = r.WithContext(context.WithValue(r.Context(), tenantKey, tenant))
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("tenant %q: got %d, want %d", tenant, w.Code, http.StatusForbidden)
+		}
+	}
+	if len(client.calls) != 0 {
+		t.Errorf("calls %v made for refused archives", client.calls)
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// EngineArtifact deploys static artifacts, e.g. a website,
+// instead of containers
+const EngineArtifact = "artifact"
+
+// Phases of artifact deploys
+const (
+	PhaseDownload    = Phase("download")
+	PhaseExtract     = Phase("extract")
+	PhasePostExtract = Phase("post_extract")
+)
+
+// Codes of failed artifact deploys
+const (
+	CodeInvalidArtifact  = ErrorCode("invalid_artifact")
+	CodeChecksumMismatch = ErrorCode("checksum_mismatch")
+)
+
+// ArtifactConfig deploys a tarball or zip, downloaded from the URL
+// passed with the push, by extracting it to a directory
+type ArtifactConfig struct {
+	// Dir the artifact is extracted to. It's replaced as a whole,
+	// so its parent must be writable.
+	Dir string `json:"dir"`
+	// URLPrefixes, if set, are the only URLs artifacts may be downloaded
+	// from, e.g. https://ci.example.com/artifacts/
+	URLPrefixes []string `json:"url_prefixes"`
+	// Command is run in Dir after extracting, e.g. to reload a server
+	Command []string `json:"command"`
+	// Timeout of the download and command, 10m if empty
+	Timeout string `json:"timeout"`
+
+	timeout time.Duration
+}
+
+// ArtifactRef is the artifact to deploy
+type ArtifactRef struct {
+	URL string `json:"url"`
+	// Checksum is the hex SHA-256 of the artifact, or
+	// the SHA-256 or SHA-512 prefixed with sha256: or sha512:
+	Checksum string `json:"checksum"`
+}
+
+func (c *ArtifactConfig) validate() error {
+	if !filepath.IsAbs(c.Dir) || filepath.Clean(c.Dir) == "/" {
+		return fmt.Errorf("artifact: dir %q is not an absolute path", c.Dir)
+	}
+	c.Dir = filepath.Clean(c.Dir)
+	for _, prefix := range c.URLPrefixes {
+		if !isURL(prefix) {
+			return fmt.Errorf("artifact: URL prefix %q is not an http(s) URL", prefix)
+		}
+	}
+	c.timeout = 10 * time.Minute
+	if c.Timeout != "" {
+		var err error
+		c.timeout, err = time.ParseDuration(c.Timeout)
+		if err != nil || c.timeout <= 0 {
+			return fmt.Errorf("artifact: invalid timeout %q", c.Timeout)
+		}
+	}
+	return nil
+}
+
+// check verifies the artifact may be deployed
+func (c *ArtifactConfig) check(ref *ArtifactRef) error {
+	if ref == nil || ref.URL == "" {
+		return errors.New("the push names no artifact to deploy")
+	}
+	if !isURL(ref.URL) {
+		return fmt.Errorf("artifact %s is not an http(s) URL", ref.URL)
+	}
+	if ref.Checksum == "" {
+		return fmt.Errorf("artifact %s has no checksum", ref.URL)
+	}
+	if _, _, _, err := parseChecksum(ref.Checksum); err != nil {
+		return err
+	}
+	if len(c.URLPrefixes) == 0 {
+		return nil
+	}
+	for _, prefix := range c.URLPrefixes {
+		if strings.HasPrefix(ref.URL, prefix) {
+			return nil
+		}
+	}
+	return fmt.Errorf("artifact %s is not from an allowed URL", ref.URL)
+}
+
+// parseChecksum returns the algorithm, hash and expected sum of the checksum
+func parseChecksum(checksum string) (alg string, h hash.Hash, sum string, err error) {
+	alg, sum = "sha256", checksum
+	if i := strings.Index(checksum, ":"); i >= 0 {
+		alg, sum = checksum[:i], checksum[i+1:]
+	}
+	sum = strings.ToLower(sum)
+	switch alg {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return "", nil, "", fmt.Errorf("unsupported checksum algorithm %q", alg)
+	}
+	if _, err := hex.DecodeString(sum); err != nil || len(sum) != 2*h.Size() {
+		return "", nil, "", fmt.Errorf("invalid %s checksum %q", alg, sum)
+	}
+	return alg, h, sum, nil
+}
+
+// ArtifactStrategy deploys artifacts: it downloads the artifact of the
+// deployment, verifies its checksum, extracts it next to the directory,
+// swaps it in and runs the command. If the command fails, the
+// previous contents of the directory are restored.
+type ArtifactStrategy struct {
+	cfg *ArtifactConfig
+}
+
+// Deploy implements Strategy
+func (s ArtifactStrategy) Deploy(d *Deployer, dep *Deployment, version string) *HookError {
+	if dep.Artifact == nil {
+		// Redeploys without a push, e.g. scheduled ones,
+		// deploy the last deployed artifact again
+		history := d.History()
+		for i := len(history) - 1; i >= 0; i-- {
+			if history[i].Result == Success && history[i].Artifact != nil {
+				dep.Artifact = history[i].Artifact
+				break
+			}
+		}
+	}
+	if err := s.cfg.check(dep.Artifact); err != nil {
+		return clientError(CodeInvalidArtifact, PhaseVerify, err)
+	}
+
+	var file string
+	herr := d.phase(PhaseDownload, func() error {
+		var err error
+		file, err = s.download(dep)
+		return err
+	})
+	if file != "" {
+		defer os.Remove(file)
+	}
+	if herr != nil {
+		return herr
+	}
+
+	staging := s.cfg.Dir + ".new"
+	herr = d.phase(PhaseExtract, func() error {
+		os.RemoveAll(staging)
+		err := extract(file, staging)
+		if err != nil {
+			os.RemoveAll(staging)
+			return clientError(CodeInvalidArtifact, PhaseExtract, err)
+		}
+		return nil
+	})
+	if herr != nil {
+		return herr
+	}
+
+	previous := s.cfg.Dir + ".previous"
+	herr = d.phase(PhaseSwitch, func() error {
+		os.RemoveAll(previous)
+		err := os.Rename(s.cfg.Dir, previous)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return os.Rename(staging, s.cfg.Dir)
+	})
+	if herr != nil {
+		os.RemoveAll(staging)
+		return herr
+	}
+
+	if len(s.cfg.Command) == 0 {
+		return nil
+	}
+	herr = d.phase(PhasePostExtract, func() error {
+		var err error
+		dep.ExecOutput, err = s.run(dep)
+		if err != nil {
+			return serverError(CodeExecFailed, PhasePostExtract, err)
+		}
+		return nil
+	})
+	if herr == nil {
+		return nil
+	}
+	if _, err := os.Stat(previous); err != nil {
+		// Nothing deployed before
+		return herr
+	}
+	d.logger().Printf("Restoring the previous contents of %s", s.cfg.Dir)
+	rerr := d.phase(PhaseRollback, func() error {
+		os.RemoveAll(s.cfg.Dir)
+		return os.Rename(previous, s.cfg.Dir)
+	})
+	if rerr != nil {
+		d.logger().Printf("Failed to restore the previous contents of %s: %v", s.cfg.Dir, rerr)
+	} else {
+		dep.RolledBack = true
+	}
+	return herr
+}
+
+// download downloads the artifact to a temporary file next to the
+// directory, verifying its checksum
+func (s ArtifactStrategy) download(dep *Deployment) (string, error) {
+	alg, h, want, _ := parseChecksum(dep.Artifact.Checksum)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dep.Artifact.URL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := archiveClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to download %s: %s", dep.Artifact.URL, resp.Status)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(s.cfg.Dir), ".artifact-*")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	_, err = io.Copy(io.MultiWriter(f, h), resp.Body)
+	if err != nil {
+		return f.Name(), err
+	}
+	got := hex.EncodeToString(h.Sum(nil))
+	if got != want {
+		return f.Name(), &HookError{
+			Code:    CodeChecksumMismatch,
+			Message: fmt.Sprintf("artifact %s has checksum %s, want %s", dep.Artifact.URL, got, want),
+			Phase:   PhaseDownload,
+			Status:  http.StatusBadRequest,
+		}
+	}
+	dep.Digest = alg + ":" + got
+	return f.Name(), nil
+}
+
+// run runs the command in the directory
+func (s ArtifactStrategy) run(dep *Deployment) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, s.cfg.Command[0], s.cfg.Command[1:]...)
+	cmd.Dir = s.cfg.Dir
+	cmd.Env = append(os.Environ(),
+		"DEPLOYMENT_ID="+dep.ID,
+		"TAG="+dep.Tag,
+		"ARTIFACT_URL="+dep.Artifact.URL,
+	)
+	var output bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &output, &output
+	err := cmd.Run()
+	out := output.String()
+	if len(out) > maxTestOutput {
+		out = out[len(out)-maxTestOutput:]
+	}
+	if ctx.Err() != nil {
+		return out, fmt.Errorf("%v timed out after %s", s.cfg.Command, s.cfg.timeout)
+	}
+	if err != nil {
+		return out, fmt.Errorf("%v: %v", s.cfg.Command, err)
+	}
+	return out, nil
+}
+
+// extract extracts the zip or, optionally gzip compressed,
+// tarball to dir, which must not exist yet
+func extract(file, dir string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(4)
+	err = os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")):
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		return extractZip(f, info.Size(), dir)
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		return extractTar(gz, dir)
+	default:
+		return extractTar(br, dir)
+	}
+}
+
+// entryPath returns where the archive entry name is extracted to,
+// rejecting names escaping dir
+func entryPath(dir, name string) (string, error) {
+	p := filepath.Join(dir, name)
+	if p != dir && !strings.HasPrefix(p, dir+string(filepath.Separator)) {
+		return "", fmt.Errorf("archive entry %q is outside the archive", name)
+	}
+	return p, nil
+}
+
+func extractTar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		p, err := entryPath(dir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(p, 0o755)
+		case tar.TypeReg:
+			err = writeEntry(p, hdr.FileInfo().Mode().Perm(), tr)
+		case tar.TypeSymlink:
+			// Links may only point within the archive
+			_, err = entryPath(dir, filepath.Join(filepath.Dir(hdr.Name), hdr.Linkname))
+			if err == nil && filepath.IsAbs(hdr.Linkname) {
+				err = fmt.Errorf("archive entry %q links to absolute path %q", hdr.Name, hdr.Linkname)
+			}
+			if err == nil {
+				err = os.MkdirAll(filepath.Dir(p), 0o755)
+			}
+			if err == nil {
+				err = os.Symlink(hdr.Linkname, p)
+			}
+		default:
+			// Hard links, devices and the like aren't deployed
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func extractZip(r io.ReaderAt, size int64, dir string) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	for _, zf := range zr.File {
+		p, err := entryPath(dir, zf.Name)
+		if err != nil {
+			return err
+		}
+		if zf.FileInfo().IsDir() {
+			err = os.MkdirAll(p, 0o755)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if !zf.Mode().IsRegular() {
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		err = writeEntry(p, zf.Mode().Perm(), rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeEntry writes the contents of a file of the archive
+func writeEntry(p string, perm os.FileMode, r io.Reader) error {
+	err := os.MkdirAll(filepath.Dir(p), 0o755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm|0o200)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
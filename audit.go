@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditEntry is a single record in the audit log
+type AuditEntry struct {
+	Time       time.Time  `json:"time"`
+	Remote     string     `json:"remote"`
+	Tenant     string     `json:"tenant,omitempty"`
+	Repository string     `json:"repository,omitempty"`
+	Tag        string     `json:"tag,omitempty"`
+	Pusher     string     `json:"pusher,omitempty"`
+	Result     HookState  `json:"result"`
+	Error      *HookError `json:"error,omitempty"`
+	// Payload is the webhook as received
+	Payload *WebhookPayload `json:"payload,omitempty"`
+	// ReplayOf is the ID of the deployment whose webhook was replayed
+	ReplayOf string `json:"replay_of,omitempty"`
+	// Deployments are the IDs of the deployments that were run
+	Deployments []string `json:"deployments,omitempty"`
+	// Policy is the decision of the policy on the image of the deployment
+	Policy *PolicyDecision `json:"policy,omitempty"`
+}
+
+// AuditConfig configures where audit entries are exported to
+type AuditConfig struct {
+	// File is appended to with one entry per line
+	File string `json:"file"`
+	// Format of the file and syslog messages, json (default) or cef
+	Format string `json:"format"`
+	// Syslog sends RFC5424 messages to a syslog server
+	Syslog *SyslogConfig `json:"syslog"`
+	// WebhookURL is posted every entry as JSON
+	WebhookURL string `json:"webhook_url"`
+}
+
+// SyslogConfig is the address of a syslog server
+type SyslogConfig struct {
+	// Network is udp (default) or tcp
+	Network string `json:"network"`
+	Address string `json:"address"`
+}
+
+// AuditSink receives audit entries
+type AuditSink interface {
+	Write(entry AuditEntry) error
+}
+
+// AuditLog exports every entry to each of its sinks
+type AuditLog struct {
+	sinks []AuditSink
+}
+
+// NewAuditLog creates the sinks described by the config
+func NewAuditLog(cfg AuditConfig) (*AuditLog, error) {
+	format := formatJSON
+	switch cfg.Format {
+	case "", "json":
+	case "cef":
+		format = formatCEF
+	default:
+		return nil, fmt.Errorf("unknown audit format %q", cfg.Format)
+	}
+
+	a := &AuditLog{}
+	if cfg.File != "" {
+		f, err := os.OpenFile(cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		a.sinks = append(a.sinks, &fileSink{w: f, format: format})
+	}
+	if cfg.Syslog != nil {
+		network := cfg.Syslog.Network
+		if network == "" {
+			network = "udp"
+		}
+		conn, err := net.Dial(network, cfg.Syslog.Address)
+		if err != nil {
+			return nil, err
+		}
+		hostname, err := os.Hostname()
+		if err != nil || hostname == "" {
+			hostname = "-"
+		}
+		a.sinks = append(a.sinks, &syslogSink{
+			conn:     conn,
+			framed:   network != "udp",
+			hostname: hostname,
+			format:   format,
+		})
+	}
+	if cfg.WebhookURL != "" {
+		a.sinks = append(a.sinks, &webhookSink{
+			url:    cfg.WebhookURL,
+			client: &http.Client{Timeout: 10 * time.Second},
+		})
+	}
+
+	return a, nil
+}
+
+// AddSink also sends the entries recorded from now on to the sink
+func (a *AuditLog) AddSink(sink AuditSink) {
+	a.sinks = append(a.sinks, sink)
+}
+
+// Record sends the entry to all sinks
+func (a *AuditLog) Record(entry AuditEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	for _, s := range a.sinks {
+		err := s.Write(entry)
+		if err != nil {
+			log.Print("Failed to write audit entry: ", err)
+		}
+	}
+}
+
+func formatJSON(entry AuditEntry) []byte {
+	content, err := json.Marshal(&entry)
+	if err != nil {
+		// AuditEntry only contains types that always marshal
+		panic(err)
+	}
+	return content
+}
+
+// cefEscaper escapes CEF extension values
+var cefEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+
+// formatCEF formats the entry in the ArcSight Common Event Format
+func formatCEF(entry AuditEntry) []byte {
+	signature, name, severity := "deploy", "Deploy succeeded", 3
+	switch {
+	case entry.Error != nil && !entry.Error.Retryable:
+		signature, name, severity = string(entry.Error.Code), "Webhook rejected", 6
+	case entry.Error != nil:
+		signature, name, severity = string(entry.Error.Code), "Deploy failed", 7
+	}
+
+	ext := []string{
+		"rt=" + fmt.Sprint(entry.Time.UnixNano()/int64(time.Millisecond)),
+		"src=" + cefEscaper.Replace(remoteHost(entry.Remote)),
+		"outcome=" + cefEscaper.Replace(string(entry.Result)),
+	}
+	if entry.Pusher != "" {
+		ext = append(ext, "suser="+cefEscaper.Replace(entry.Pusher))
+	}
+	if entry.Tenant != "" {
+		ext = append(ext, "cs1Label=tenant", "cs1="+cefEscaper.Replace(entry.Tenant))
+	}
+	if entry.Repository != "" {
+		ext = append(ext, "cs2Label=repository", "cs2="+cefEscaper.Replace(entry.Repository))
+	}
+	if entry.Tag != "" {
+		ext = append(ext, "cs3Label=tag", "cs3="+cefEscaper.Replace(entry.Tag))
+	}
+	if entry.Error != nil {
+		ext = append(ext, "cs4Label=phase", "cs4="+cefEscaper.Replace(string(entry.Error.Phase)))
+		ext = append(ext, "msg="+cefEscaper.Replace(entry.Error.Message))
+	}
+
+	return []byte(fmt.Sprintf("CEF:0|johanbrandhorst|docker-webhook-receiver|1.0|%s|%s|%d|%s",
+		signature, name, severity, strings.Join(ext, " ")))
+}
+
+// remoteHost strips the port from a remote address
+func remoteHost(remote string) string {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		return remote
+	}
+	return host
+}
+
+type fileSink struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format func(AuditEntry) []byte
+}
+
+func (f *fileSink) Write(entry AuditEntry) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, err := f.w.Write(append(f.format(entry), '\n'))
+	return err
+}
+
+// auditSize is the number of audit entries kept in a state store
+const auditSize = 10000
+
+// stateSink keeps the last entries as JSON in the state store
+type stateSink struct {
+	store StateStore
+}
+
+func (s *stateSink) Write(entry AuditEntry) error {
+	return s.store.Append("audit", formatJSON(entry), auditSize)
+}
+
+// syslogFacility is the "log audit" facility of RFC5424
+const syslogFacility = 13
+
+type syslogSink struct {
+	mu       sync.Mutex
+	conn     net.Conn
+	framed   bool
+	hostname string
+	format   func(AuditEntry) []byte
+}
+
+func (s *syslogSink) Write(entry AuditEntry) error {
+	severity := 6 // informational
+	switch entry.Result {
+	case Failure:
+		severity = 4 // warning
+	case Error:
+		severity = 3 // error
+	}
+
+	msg := fmt.Sprintf("<%d>1 %s %s docker-webhook-receiver %d audit - %s",
+		syslogFacility*8+severity,
+		entry.Time.UTC().Format(time.RFC3339Nano),
+		s.hostname,
+		os.Getpid(),
+		s.format(entry),
+	)
+	if s.framed {
+		// Octet counting framing of RFC6587
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := io.WriteString(s.conn, msg)
+	return err
+}
+
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *webhookSink) Write(entry AuditEntry) error {
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(formatJSON(entry)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("audit webhook rejected entry with status %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AWSCredentials sign requests to AWS APIs
+type AWSCredentials struct {
+	// AccessKeyID and SecretAccessKey default to the
+	// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+	// environment variables
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	// SessionToken is AWS_SESSION_TOKEN if empty
+	SessionToken string `json:"session_token"`
+}
+
+func (c *AWSCredentials) validate() error {
+	if c.AccessKeyID == "" {
+		c.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		c.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		c.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return errors.New("aws needs an access key id and secret access key")
+	}
+	return nil
+}
+
+// sign signs the request to the AWS service in region
+// with Signature Version 4
+func (c *AWSCredentials) sign(r *http.Request, body []byte, service, region string) {
+	now := time.Now().UTC()
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	r.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	r.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.SessionToken != "" {
+		r.Header.Set("X-Amz-Security-Token", c.SessionToken)
+	}
+
+	var names []string
+	headers := map[string]string{"host": r.URL.Host}
+	for name := range r.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(r.Header.Get(name))
+	}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := r.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		path,
+		strings.Replace(r.URL.Query().Encode(), "+", "%20", -1),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+c.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	r.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", c.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// awsRequest sends the signed request, returning the reply body
+func (c *AWSCredentials) awsRequest(client *http.Client, method, url, contentType string, body []byte, service, region string) ([]byte, error) {
+	req, err := http.NewRequest(method, url, strings.NewReader(string(body)))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	c.sign(req, body, service, region)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	reply, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("aws %s: %s: %s", service, resp.Status, strings.TrimSpace(string(reply)))
+	}
+	return reply, nil
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+)
+
+// BadgeHandler serves a shields.io style SVG badge with the
+// result of the last deploy of a repository on /badge/{repo}.svg
+type BadgeHandler struct {
+	deployers Deployers
+}
+
+func (h *BadgeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	repo := r.PathValue("repo")
+	if !strings.HasSuffix(repo, ".svg") {
+		http.NotFound(w, r)
+		return
+	}
+	deployers := h.deployers.ForRepository(strings.TrimSuffix(repo, ".svg"))
+	if len(deployers) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	message, color := "unknown", "#9f9f9f"
+	_, last := deployers[0].Pending()
+	if last != nil {
+		switch last.Result {
+		case Success:
+			message, color = last.Tag+" deployed", "#4c1"
+		default:
+			message, color = last.Tag+" failed", "#e05d44"
+		}
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "no-cache, max-age=0")
+	_, err := fmt.Fprint(w, badge("deploy", message, color))
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// badgeTextWidth approximates the rendered width of s
+// in 11px Verdana, which is what shields.io uses
+func badgeTextWidth(s string) int {
+	return len(s)*7 + 10
+}
+
+// badge renders a flat two-part badge
+func badge(label, message, color string) string {
+	lw, mw := badgeTextWidth(label), badgeTextWidth(message)
+	label, message = html.EscapeString(label), html.EscapeString(message)
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20" role="img" aria-label="%[4]s: %[5]s">
+<title>%[4]s: %[5]s</title>
+<linearGradient id="s" x2="0" y2="100%%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>
+<clipPath id="r"><rect width="%[1]d" height="20" rx="3" fill="#fff"/></clipPath>
+<g clip-path="url(#r)"><rect width="%[2]d" height="20" fill="#555"/><rect x="%[2]d" width="%[3]d" height="20" fill="%[6]s"/><rect width="%[1]d" height="20" fill="url(#s)"/></g>
+<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+<text x="%[7]d" y="14">%[4]s</text>
+<text x="%[8]d" y="14">%[5]s</text>
+</g>
+</svg>
+`, lw+mw, lw, mw, label, message, color, lw/2, lw+mw/2)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// EventStaleBase is sent when the base image of a running
+// image was updated upstream
+const EventStaleBase = Event("stale_base")
+
+// baseImageStale is 1 for containers whose base image was updated upstream
+var baseImageStale = NewGaugeVec(
+	"webhook_base_image_stale",
+	"Whether the base image of the running image was updated upstream.",
+	"container",
+)
+
+// BaseImageConfig periodically checks whether the base image of the
+// running image, named by its org.opencontainers.image.base.name and
+// base.digest labels, was updated upstream
+type BaseImageConfig struct {
+	// Interval between checks, 24h if empty
+	Interval string `json:"interval"`
+	// Username and Password authenticate with the
+	// registry of the base image, if needed
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// RebuildURL is posted a BaseImageUpdate when the base image was
+	// updated, e.g. to trigger a CI build of the image
+	RebuildURL string `json:"rebuild_url"`
+	// RebuildToken is sent to the RebuildURL as a bearer token
+	RebuildToken string `json:"rebuild_token"`
+
+	interval time.Duration
+}
+
+// BaseImageUpdate is posted to the RebuildURL
+type BaseImageUpdate struct {
+	Container  string `json:"container"`
+	Repository string `json:"repository"`
+	// Revision is the source revision of the running image, if labeled
+	Revision   string `json:"revision,omitempty"`
+	BaseName   string `json:"base_name"`
+	BaseDigest string `json:"base_digest"`
+	// LatestDigest is the digest the base image's tag now points at
+	LatestDigest string `json:"latest_digest"`
+}
+
+func (c *BaseImageConfig) validate() error {
+	c.interval = 24 * time.Hour
+	if c.Interval != "" {
+		var err error
+		c.interval, err = time.ParseDuration(c.Interval)
+		if err != nil || c.interval < time.Minute {
+			return fmt.Errorf("base image: invalid interval %q, it must be at least 1m", c.Interval)
+		}
+	}
+	return nil
+}
+
+// WatchBaseImages checks the base images of the containers
+// configured to at their interval
+func WatchBaseImages(deployers Deployers) {
+	for _, d := range deployers {
+		if d.container.BaseImage != nil {
+			go d.watchBaseImage()
+		}
+	}
+}
+
+func (d *Deployer) watchBaseImage() {
+	// notified is the latest digest of the base image notified about
+	notified := ""
+	for {
+		latest, stale, err := d.checkBaseImage()
+		if err != nil {
+			log.Printf("Failed to check the base image of %q: %v", d.container.Name, err)
+		}
+		if stale && latest != notified && d.coordinator.Leader() {
+			notified = latest
+			d.baseImageUpdated(latest)
+		}
+		time.Sleep(d.container.BaseImage.interval)
+	}
+}
+
+// checkBaseImage returns the digest the tag of the base image of the
+// running image points at, and whether it is another than that of
+// the base. Images without base labels are never stale.
+func (d *Deployer) checkBaseImage() (latest string, stale bool, err error) {
+	labels, err := d.runningLabels()
+	if err != nil || labels == nil || labels.BaseName == "" || labels.BaseDigest == "" {
+		baseImageStale.Set(0, d.container.Name)
+		return "", false, err
+	}
+	repo, tag, pinned := splitReference(labels.BaseName)
+	if pinned {
+		baseImageStale.Set(0, d.container.Name)
+		return "", false, nil
+	}
+
+	cfg := d.container.BaseImage
+	latest, err = newRegistry(repo, cfg.Username, cfg.Password).tagDigest(tag)
+	if err != nil {
+		return "", false, err
+	}
+	stale = latest != labels.BaseDigest
+	if stale {
+		baseImageStale.Set(1, d.container.Name)
+	} else {
+		baseImageStale.Set(0, d.container.Name)
+	}
+	return latest, stale, nil
+}
+
+// runningLabels returns the labels of the running image or,
+// without a Docker daemon, of the last successful deploy
+func (d *Deployer) runningLabels() (*ImageLabels, error) {
+	if d.client == nil {
+		history := d.History()
+		for i := len(history) - 1; i >= 0; i-- {
+			if history[i].Result == Success {
+				return history[i].Labels, nil
+			}
+		}
+		return nil, nil
+	}
+	c, err := d.client.InspectContainer(d.container.Name)
+	if err != nil {
+		return nil, err
+	}
+	img, err := d.client.InspectImage(c.Image)
+	if err != nil {
+		return nil, err
+	}
+	return imageLabels(img), nil
+}
+
+// splitReference splits an image reference into its repository and
+// tag, latest if it has none. pinned is set for references by digest.
+func splitReference(ref string) (repo, tag string, pinned bool) {
+	if strings.Contains(ref, "@") {
+		return ref, "", true
+	}
+	repo, tag = ref, "latest"
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		repo, tag = ref[:i], ref[i+1:]
+	}
+	return repo, tag, false
+}
+
+// baseImageUpdated notifies about the base image update and
+// asks for a rebuild, if configured
+func (d *Deployer) baseImageUpdated(latest string) {
+	labels, _ := d.runningLabels()
+	if labels == nil {
+		return
+	}
+	msg := fmt.Sprintf("Base image %s of %q was updated to %s", labels.BaseName, d.container.Name, latest)
+	log.Print(msg)
+	notify(d.notifier, Notification{
+		Event:     EventStaleBase,
+		Container: d.container.Name,
+		Message:   msg,
+		Labels:    labels,
+	})
+
+	cfg := d.container.BaseImage
+	if cfg.RebuildURL == "" {
+		return
+	}
+	err := postRebuild(cfg, &BaseImageUpdate{
+		Container:    d.container.Name,
+		Repository:   d.container.Repository,
+		Revision:     labels.Revision,
+		BaseName:     labels.BaseName,
+		BaseDigest:   labels.BaseDigest,
+		LatestDigest: latest,
+	})
+	if err != nil {
+		log.Printf("Failed to request a rebuild of %q: %v", d.container.Name, err)
+	}
+}
+
+var rebuildClient = &http.Client{Timeout: 30 * time.Second}
+
+func postRebuild(cfg *BaseImageConfig, update *BaseImageUpdate) error {
+	content, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, cfg.RebuildURL, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.RebuildToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.RebuildToken)
+	}
+	resp, err := rebuildClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.New(resp.Status + ": " + strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
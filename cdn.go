@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// CDNPurgeConfig is a CDN cache purged after every successful deploy
+type CDNPurgeConfig struct {
+	// Type is cloudflare or fastly
+	Type string `json:"type"`
+	// ZoneID is the Cloudflare zone
+	ZoneID string `json:"zone_id"`
+	// ServiceID is the Fastly service
+	ServiceID string `json:"service_id"`
+	// Token is the API token, CLOUDFLARE_API_TOKEN or
+	// FASTLY_API_TOKEN if empty
+	Token string `json:"token"`
+	// URLs are purged, everything if neither
+	// URLs nor SurrogateKeys are set
+	URLs []string `json:"urls"`
+	// SurrogateKeys are the Fastly surrogate keys purged
+	SurrogateKeys []string `json:"surrogate_keys"`
+}
+
+func (c *CDNPurgeConfig) validate() error {
+	switch c.Type {
+	case "cloudflare":
+		if c.ZoneID == "" {
+			return errors.New("cdn purge cloudflare needs a zone id")
+		}
+		if len(c.SurrogateKeys) > 0 {
+			return errors.New("cdn purge cloudflare doesn't support surrogate keys")
+		}
+		if c.Token == "" {
+			c.Token = os.Getenv("CLOUDFLARE_API_TOKEN")
+		}
+	case "fastly":
+		if c.ServiceID == "" {
+			return errors.New("cdn purge fastly needs a service id")
+		}
+		if c.Token == "" {
+			c.Token = os.Getenv("FASTLY_API_TOKEN")
+		}
+	default:
+		return fmt.Errorf("unknown cdn purge type %q", c.Type)
+	}
+	if c.Token == "" {
+		return fmt.Errorf("cdn purge %s needs a token", c.Type)
+	}
+	return nil
+}
+
+// CDNPurger purges the caches of a container
+// after every successful deploy
+type CDNPurger struct {
+	cfgs []CDNPurgeConfig
+}
+
+// DeployStarted implements LifecycleHook
+func (p *CDNPurger) DeployStarted(*Deployment) {}
+
+// DeployFinished implements LifecycleHook
+func (p *CDNPurger) DeployFinished(dep *Deployment) {
+	if dep.Result != Success {
+		return
+	}
+	for _, c := range p.cfgs {
+		c := c
+		go func() {
+			err := c.purge()
+			if err != nil {
+				log.WithField("deployment", dep.ID).Printf("Failed to purge %s cache: %v", c.Type, err)
+			}
+		}()
+	}
+}
+
+func (c *CDNPurgeConfig) purge() error {
+	if c.Type == "cloudflare" {
+		body := map[string]interface{}{"purge_everything": true}
+		if len(c.URLs) > 0 {
+			body = map[string]interface{}{"files": c.URLs}
+		}
+		return cloudflareRequest("POST", "https://api.cloudflare.com/client/v4/zones/"+url.PathEscape(c.ZoneID)+"/purge_cache", "Bearer "+c.Token, body, nil)
+	}
+
+	service := "https://api.fastly.com/service/" + url.PathEscape(c.ServiceID)
+	if len(c.URLs) == 0 && len(c.SurrogateKeys) == 0 {
+		return c.fastlyRequest("POST", service+"/purge_all", "")
+	}
+	if len(c.SurrogateKeys) > 0 {
+		err := c.fastlyRequest("POST", service+"/purge", strings.Join(c.SurrogateKeys, " "))
+		if err != nil {
+			return err
+		}
+	}
+	for _, u := range c.URLs {
+		err := c.fastlyRequest("PURGE", u, "")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var cdnClient = &http.Client{Timeout: 30 * time.Second}
+
+// fastlyRequest sends the request, with the surrogate
+// keys to purge if any
+func (c *CDNPurgeConfig) fastlyRequest(method, url, keys string) error {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Fastly-Key", c.Token)
+	req.Header.Set("Accept", "application/json")
+	if keys != "" {
+		req.Header.Set("Surrogate-Key", keys)
+	}
+	resp, err := cdnClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("fastly %s %s: %s: %s", method, req.URL.Path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
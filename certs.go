@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// EventCertRenewed is sent when containers were reloaded
+// or restarted for a renewed certificate
+const EventCertRenewed = Event("cert_renewed")
+
+// Actions on the containers mounting a renewed certificate
+const (
+	CertReload  = "reload"
+	CertRestart = "restart"
+	CertIgnore  = "ignore"
+)
+
+// certSettle is how long to wait for a renewal to finish
+// writing all its files before acting on it
+const certSettle = 10 * time.Second
+
+// CertificatesConfig watches TLS certificates renewed outside the
+// receiver, e.g. by certbot or lego, and reloads or restarts the
+// containers mounting them
+type CertificatesConfig struct {
+	// Paths are the certificate files or directories to watch,
+	// e.g. /etc/letsencrypt/live
+	Paths []string `json:"paths"`
+	// Interval between checks, 1m if empty
+	Interval string `json:"interval"`
+	// Action is reload (default), sending Signal to the containers,
+	// or restart. Containers can override it with on_cert_renewal.
+	Action string `json:"action"`
+	// Signal sent to reload containers, SIGHUP if empty
+	Signal string `json:"signal"`
+
+	interval time.Duration
+	signal   docker.Signal
+}
+
+// signals are the signals containers can be reloaded with
+var signals = map[string]docker.Signal{
+	"HUP":   docker.SIGHUP,
+	"USR1":  docker.SIGUSR1,
+	"USR2":  docker.SIGUSR2,
+	"INT":   docker.SIGINT,
+	"QUIT":  docker.SIGQUIT,
+	"TERM":  docker.SIGTERM,
+	"WINCH": docker.SIGWINCH,
+}
+
+func (c *CertificatesConfig) validate() error {
+	if len(c.Paths) == 0 {
+		return fmt.Errorf("certificates: no paths to watch")
+	}
+	for i, p := range c.Paths {
+		if !filepath.IsAbs(p) {
+			return fmt.Errorf("certificates: path %q is not absolute", p)
+		}
+		c.Paths[i] = filepath.Clean(p)
+	}
+	c.interval = time.Minute
+	if c.Interval != "" {
+		var err error
+		c.interval, err = time.ParseDuration(c.Interval)
+		if err != nil || c.interval < time.Second {
+			return fmt.Errorf("certificates: invalid interval %q", c.Interval)
+		}
+	}
+	switch c.Action {
+	case "":
+		c.Action = CertReload
+	case CertReload, CertRestart:
+	default:
+		return fmt.Errorf("certificates: unknown action %q", c.Action)
+	}
+	name := strings.TrimPrefix(strings.ToUpper(c.Signal), "SIG")
+	if name == "" {
+		name = "HUP"
+	}
+	var ok bool
+	c.signal, ok = signals[name]
+	if !ok {
+		return fmt.Errorf("certificates: unknown signal %q", c.Signal)
+	}
+	return nil
+}
+
+// WatchCertificates checks the certificates every interval and, once a
+// renewal settled, reloads or restarts the containers mounting them.
+// Containers being deployed are handled after their deploy.
+func WatchCertificates(cfg *CertificatesConfig, deployers Deployers) {
+	sums := certSums(cfg.Paths)
+	pending := map[*Deployer][]string{}
+	for range time.Tick(cfg.interval) {
+		changed := changedCerts(sums, certSums(cfg.Paths))
+		if len(changed) > 0 {
+			// Renewals write the certificate, key and chain one by one
+			time.Sleep(certSettle)
+			latest := certSums(cfg.Paths)
+			changed = append(changed, changedCerts(sums, latest)...)
+			sums = latest
+			log.Printf("Certificates changed: %s", strings.Join(dedupe(changed), ", "))
+			for _, d := range deployers {
+				if files := d.mountedFiles(changed); len(files) > 0 {
+					pending[d] = dedupe(append(pending[d], files...))
+				}
+			}
+		}
+
+		for d, files := range pending {
+			if d.busy() {
+				continue
+			}
+			delete(pending, d)
+			d.certRenewed(cfg, files)
+		}
+	}
+}
+
+// certSums returns the SHA-256 of every file under the paths. Symlinks,
+// as in certbot's live directory, are followed.
+func certSums(paths []string) map[string]string {
+	sums := map[string]string{}
+	for _, root := range paths {
+		filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				// Missing files are changes, too
+				return nil
+			}
+			content, err := os.ReadFile(p)
+			if err != nil {
+				return nil
+			}
+			sum := sha256.Sum256(content)
+			sums[p] = hex.EncodeToString(sum[:])
+			return nil
+		})
+	}
+	return sums
+}
+
+// changedCerts returns the files added, changed or removed in b
+func changedCerts(a, b map[string]string) []string {
+	var changed []string
+	for p, sum := range b {
+		if a[p] != sum {
+			changed = append(changed, p)
+		}
+	}
+	for p := range a {
+		if _, ok := b[p]; !ok {
+			changed = append(changed, p)
+		}
+	}
+	return changed
+}
+
+// dedupe sorts the files and removes duplicates
+func dedupe(files []string) []string {
+	sort.Strings(files)
+	var res []string
+	for i, f := range files {
+		if i == 0 || f != files[i-1] {
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+// mountedFiles returns the files bind mounted into the container
+func (d *Deployer) mountedFiles(files []string) []string {
+	if d.client == nil || d.container.OnCertRenewal == CertIgnore {
+		return nil
+	}
+	var mounted []string
+	for _, m := range d.container.Mounts {
+		source := filepath.Clean(strings.SplitN(m, ":", 2)[0])
+		if !filepath.IsAbs(source) {
+			// A named volume
+			continue
+		}
+		for _, f := range files {
+			rel, err := filepath.Rel(source, f)
+			if err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+				mounted = append(mounted, f)
+			}
+		}
+	}
+	return mounted
+}
+
+// certRenewed reloads or restarts the container for the renewed files.
+// Like a deploy, it waits for the deploys of the container and
+// its concurrency group.
+func (d *Deployer) certRenewed(cfg *CertificatesConfig, files []string) {
+	d.running.Lock()
+	defer d.running.Unlock()
+	if d.group != nil {
+		d.group.Lock()
+		defer d.group.Unlock()
+	}
+
+	action := d.container.OnCertRenewal
+	if action == "" {
+		action = cfg.Action
+	}
+	var err error
+	if action == CertRestart {
+		log.Printf("Restarting %q for renewed certificates", d.container.Name)
+		err = d.restartContainer()
+	} else {
+		log.Printf("Reloading %q for renewed certificates", d.container.Name)
+		err = d.client.KillContainer(docker.KillContainerOptions{ID: d.container.Name, Signal: cfg.signal})
+	}
+
+	msg := fmt.Sprintf("Container %s %sed for renewed certificates %s", d.container.Name, action, strings.Join(files, ", "))
+	if err != nil {
+		log.Printf("Failed to %s %q for renewed certificates: %v", action, d.container.Name, err)
+		msg = fmt.Sprintf("Failed to %s container %s for renewed certificates %s: %v", action, d.container.Name, strings.Join(files, ", "), err)
+	}
+	notify(d.notifier, Notification{
+		Event:     EventCertRenewed,
+		Container: d.container.Name,
+		Message:   msg,
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// chaosFaults counts the faults injected into deploys
+var chaosFaults = NewCounterVec(
+	"webhook_chaos_faults_total",
+	"Faults injected into deploys with -chaos, by container, phase and kind: error or delay.",
+	"container", "phase", "kind",
+)
+
+// ChaosConfig injects faults into the deploys of the container, so
+// rollbacks and alerting can be rehearsed without breaking real
+// images. It only takes effect when the receiver is run with -chaos.
+type ChaosConfig struct {
+	Faults []FaultConfig `json:"faults"`
+}
+
+// FaultConfig is a fault injected into a phase of the deploys
+type FaultConfig struct {
+	// Phase the fault is injected into, e.g. pull, start or healthcheck
+	Phase Phase `json:"phase"`
+	// Rate is the probability of failing the phase, from 0 to 1
+	Rate float64 `json:"rate"`
+	// Delay is waited before the phase runs, e.g. 20s for slow starts
+	Delay string `json:"delay"`
+	// Error is the message of the injected failures
+	Error string `json:"error"`
+
+	delay time.Duration
+}
+
+func (c *ChaosConfig) validate() error {
+	if len(c.Faults) == 0 {
+		return errors.New("chaos: no faults")
+	}
+	for i := range c.Faults {
+		f := &c.Faults[i]
+		if f.Phase == "" {
+			return errors.New("chaos: fault without phase")
+		}
+		if f.Rate < 0 || f.Rate > 1 {
+			return fmt.Errorf("chaos: %s: rate %v isn't between 0 and 1", f.Phase, f.Rate)
+		}
+		if f.Delay != "" {
+			var err error
+			f.delay, err = time.ParseDuration(f.Delay)
+			if err != nil || f.delay <= 0 {
+				return fmt.Errorf("chaos: %s: invalid delay %q", f.Phase, f.Delay)
+			}
+		}
+		if f.Rate == 0 && f.delay == 0 {
+			return fmt.Errorf("chaos: %s: needs a rate or delay", f.Phase)
+		}
+		if f.Error == "" {
+			f.Error = "injected " + string(f.Phase) + " failure"
+		}
+	}
+	return nil
+}
+
+// injectFault delays or fails the phase as the chaos
+// configuration of the container asks, if chaos is enabled
+func (d *Deployer) injectFault(p Phase) error {
+	if !d.Chaos || d.container.Chaos == nil {
+		return nil
+	}
+	for _, f := range d.container.Chaos.Faults {
+		if f.Phase != p {
+			continue
+		}
+		if f.delay > 0 {
+			chaosFaults.Inc(d.container.Name, string(p), "delay")
+			d.logger().Printf("Chaos: delaying %s of %q by %s", p, d.container.Name, f.delay)
+			time.Sleep(f.delay)
+		}
+		if f.Rate > 0 && rand.Float64() < f.Rate {
+			chaosFaults.Inc(d.container.Name, string(p), "error")
+			d.logger().Printf("Chaos: failing %s of %q", p, d.container.Name)
+			return errors.New("chaos: " + f.Error)
+		}
+	}
+	return nil
+}
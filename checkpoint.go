@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Step is a step of a deploy recorded in its checkpoint
+type Step string
+
+// Allowed values of Step
+const (
+	StepBegun   = Step("begun")
+	StepStopped = Step("stopped")
+	StepRemoved = Step("removed")
+	StepPulled  = Step("pulled")
+	StepCreated = Step("created")
+	StepStarted = Step("started")
+)
+
+// checkpointSteps are the steps completed by the phases
+var checkpointSteps = map[Phase]Step{
+	PhaseStop:   StepStopped,
+	PhaseRemove: StepRemoved,
+	PhasePull:   StepPulled,
+	PhaseLoad:   StepPulled,
+	PhaseCreate: StepCreated,
+	PhaseStart:  StepStarted,
+}
+
+// Checkpoint is the progress of a deploy, persisted so a deploy
+// interrupted by a crash can be resumed at startup
+type Checkpoint struct {
+	DeploymentID string `json:"deployment_id"`
+	Tag          string `json:"tag"`
+	// Version is the tag or digest being deployed
+	Version string `json:"version"`
+	// PreviousImage is the image of the replaced container, if known
+	PreviousImage string `json:"previous_image,omitempty"`
+	// Archive is the image archive being deployed, if any
+	Archive string    `json:"archive,omitempty"`
+	Step    Step      `json:"step"`
+	Time    time.Time `json:"time"`
+}
+
+// Checkpoints stores the checkpoint of the deploy
+// in progress of each container in a directory
+type Checkpoints struct {
+	dir string
+}
+
+// NewCheckpoints stores checkpoints in dir, creating it if needed
+func NewCheckpoints(dir string) (*Checkpoints, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &Checkpoints{dir: dir}, nil
+}
+
+func (c *Checkpoints) path(container string) string {
+	return filepath.Join(c.dir, container+".checkpoint.json")
+}
+
+// Save replaces the checkpoint of the container
+func (c *Checkpoints) Save(container string, cp *Checkpoint) error {
+	content, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	// Written to a temporary file first, so a crash
+	// never leaves a partial checkpoint behind
+	tmp := c.path(container) + ".tmp"
+	err = os.WriteFile(tmp, content, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path(container))
+}
+
+// Load returns the checkpoint of the container, nil if there is none
+func (c *Checkpoints) Load(container string) (*Checkpoint, error) {
+	content, err := os.ReadFile(c.path(container))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cp := &Checkpoint{}
+	return cp, json.Unmarshal(content, cp)
+}
+
+// Clear removes the checkpoint of the container
+func (c *Checkpoints) Clear(container string) error {
+	err := os.Remove(c.path(container))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// checkpoint records that the deploy in progress completed step.
+// It must only be called by the goroutine running the deploy.
+func (d *Deployer) checkpoint(step Step) {
+	if d.Checkpoints == nil || d.progress == nil {
+		return
+	}
+	d.progress.Step = step
+	d.progress.Time = time.Now()
+	d.mu.Lock()
+	if d.current != nil && d.current.PreviousImage != "" {
+		d.progress.PreviousImage = d.current.PreviousImage
+	}
+	d.mu.Unlock()
+	err := d.Checkpoints.Save(d.container.Name, d.progress)
+	if err != nil {
+		log.Printf("Failed to save checkpoint of %q: %v", d.container.Name, err)
+	}
+}
+
+// ResumeInterrupted finishes the deploys that were interrupted by the
+// receiver stopping, as found in their checkpoints. Deploys that left
+// the container running are abandoned, the others are run again, rolling
+// back to the previous image on failure if the container has rollback
+// enabled.
+func ResumeInterrupted(deployers Deployers) {
+	for _, d := range deployers {
+		if d.Checkpoints == nil {
+			continue
+		}
+		cp, err := d.Checkpoints.Load(d.container.Name)
+		if err != nil {
+			log.Printf("Failed to load checkpoint of %q: %v", d.container.Name, err)
+			continue
+		}
+		if cp == nil {
+			continue
+		}
+
+		// Temporary containers of the other strategies
+		d.discard(d.container.Name + "-next")
+		d.discard(d.container.Name + "-canary")
+
+		c, err := d.client.InspectContainer(d.container.Name)
+		if _, ok := err.(*docker.NoSuchContainer); ok {
+			// Renamed out of the way by a switch that didn't finish
+			if d.client.RenameContainer(docker.RenameContainerOptions{ID: d.container.Name + "-old", Name: d.container.Name}) == nil {
+				c, err = d.client.InspectContainer(d.container.Name)
+			}
+		}
+		if _, ok := err.(*docker.NoSuchContainer); !ok && err != nil {
+			log.Printf("Failed to inspect %q: %v", d.container.Name, err)
+			continue
+		}
+		if err == nil && c.State.Running {
+			log.Printf("Deploy %s of %q was interrupted after step %s, the container is running", cp.DeploymentID, d.container.Name, cp.Step)
+			err = d.Checkpoints.Clear(d.container.Name)
+			if err != nil {
+				log.Printf("Failed to clear checkpoint of %q: %v", d.container.Name, err)
+			}
+			continue
+		}
+
+		log.Printf("Deploy %s of %q was interrupted after step %s, resuming", cp.DeploymentID, d.container.Name, cp.Step)
+		dep := d.enqueue(cp.Tag, nil)
+		// The container is gone, so the strategy can't
+		// record the image it ran for the rollback
+		dep.PreviousImage = cp.PreviousImage
+		dep.Archive = cp.Archive
+		herr := d.execute(dep, cp.Version)
+		if herr != nil {
+			log.Printf("Failed to resume deploy of %q: %v", d.container.Name, herr)
+		}
+	}
+}
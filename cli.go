@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/johanbrandhorst/docker-webhook-receiver/client"
+)
+
+func init() {
+	commands["status"] = statusCommand
+	commands["deploy"] = deployCommand
+	commands["adopt"] = adoptCommand
+	commands["pin"] = pinCommand
+	commands["cordon"] = cordonCommand
+	commands["dead-letters"] = deadLettersCommand
+}
+
+// apiFlags adds the flags locating the API of a receiver
+// to fs, returning a function creating its client
+func apiFlags(fs *flag.FlagSet) func() (*client.Client, error) {
+	server := fs.String("url", os.Getenv("WEBHOOK_URL"), "URL of the receiver, or unix:/path of its socket, WEBHOOK_URL by default")
+	token := fs.String("token", os.Getenv("WEBHOOK_TOKEN"), "API token, WEBHOOK_TOKEN by default")
+	return func() (*client.Client, error) {
+		if *server == "" {
+			return nil, errors.New("need -url or WEBHOOK_URL")
+		}
+		if strings.HasPrefix(*server, unixPrefix) {
+			c := client.Unix(strings.TrimPrefix(*server, unixPrefix))
+			c.Token = *token
+			return c, nil
+		}
+		return &client.Client{URL: *server, Token: *token}, nil
+	}
+}
+
+// statusCommand prints the status of the containers and, with
+// -follow, the events of their deploys as they happen
+func statusCommand(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	newClient := apiFlags(fs)
+	container := fs.String("container", "", "Only show this container, and with -follow stream its output")
+	follow := fs.Bool("follow", false, "Stream deploys as they happen until interrupted")
+	fs.Parse(args)
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	status, err := c.Status()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CONTAINER\tTENANT\tRUNNING\tIMAGE\tLAST DEPLOY")
+	for _, cs := range status.Containers {
+		if *container != "" && cs.Name != *container {
+			continue
+		}
+		last := "-"
+		if cs.LastDeploy != nil {
+			last = fmt.Sprintf("%s %s (%s ago)", cs.LastDeploy.Tag, cs.LastDeploy.Result, time.Since(cs.LastDeploy.FinishedAt).Round(time.Second))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%t\t%s\t%s\n", cs.Name, cs.Tenant, cs.Running, cs.Image, last)
+	}
+	tw.Flush()
+	if !*follow {
+		return nil
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	events, err := c.Events(ctx)
+	if err != nil {
+		return err
+	}
+	if *container != "" {
+		go func() {
+			err := c.Logs(ctx, *container, time.Now(), true, os.Stdout)
+			if err != nil && ctx.Err() == nil {
+				fmt.Fprintf(os.Stderr, "Failed to stream output of %s: %v\n", *container, err)
+			}
+		}()
+	}
+	for ev := range events {
+		if *container == "" || ev.Container == *container {
+			printEvent(ev)
+		}
+	}
+	return nil
+}
+
+// deployCommand deploys a container or the containers of a
+// repository and, with -follow, prints the deploy as it happens
+// and the output of the deployed containers
+func deployCommand(args []string) error {
+	fs := flag.NewFlagSet("deploy", flag.ExitOnError)
+	newClient := apiFlags(fs)
+	container := fs.String("container", "", "Container to redeploy with its configured tag")
+	repo := fs.String("repo", "", "Repository whose containers are deployed like a push would, instead of -container")
+	tag := fs.String("tag", "latest", "Tag of -repo to deploy")
+	follow := fs.Bool("follow", false, "Stream the deploy and the output of the new container until it finished")
+	fs.Parse(args)
+	if (*container == "") == (*repo == "") {
+		return errors.New("need one of -container or -repo")
+	}
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	if !*follow {
+		if *container != "" {
+			dep, err := c.Deploy(*container)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s %s %s\n", dep.ID, dep.Container, dep.Result)
+			return nil
+		}
+		ack, err := c.DeployRepository(*repo, *tag)
+		if err != nil {
+			return err
+		}
+		for _, dep := range ack.Deployments {
+			fmt.Printf("%s %s %s\n", dep.ID, dep.Container, dep.Status)
+		}
+		return nil
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	events, err := c.Events(ctx)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+
+	// The deployments followed, by ID, and whether they finished
+	pending := map[string]bool{}
+	failed := make(chan error, 1)
+	if *container != "" {
+		go func() {
+			_, err := c.Deploy(*container)
+			if _, ok := err.(*client.HookError); !ok && err != nil {
+				failed <- err
+			}
+		}()
+	} else {
+		ack, err := c.DeployRepository(*repo, *tag)
+		if err != nil {
+			return err
+		}
+		for _, dep := range ack.Deployments {
+			pending[dep.ID] = true
+		}
+	}
+
+	var finished []*client.Deployment
+	for len(finished) == 0 || len(pending) > 0 {
+		var ev *client.StreamEvent
+		var ok bool
+		select {
+		case ev, ok = <-events:
+		case err := <-failed:
+			return err
+		}
+		if !ok {
+			return errors.New("event stream closed before the deploy finished")
+		}
+		if ev.Event == "deploy_started" && ev.Container == *container && len(finished) == 0 {
+			pending[ev.DeploymentID] = true
+		}
+		if !pending[ev.DeploymentID] {
+			continue
+		}
+		printEvent(ev)
+		if ev.Event == "deploy_finished" {
+			delete(pending, ev.DeploymentID)
+			finished = append(finished, ev.Deployment)
+		}
+	}
+
+	var herr error
+	for _, dep := range finished {
+		fmt.Printf("--- output of %s\n", dep.Container)
+		err := c.Logs(ctx, dep.Container, start, false, os.Stdout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to get output of %s: %v\n", dep.Container, err)
+		}
+		if dep.Result != "success" {
+			herr = fmt.Errorf("deploy of %s failed", dep.Container)
+		}
+	}
+	return herr
+}
+
+// printEvent prints a lifecycle event as a line
+func printEvent(ev *client.StreamEvent) {
+	prefix := ev.Time.Local().Format("15:04:05") + " " + ev.Container
+	switch ev.Event {
+	case "deploy_started":
+		fmt.Printf("%s: deploy %s started\n", prefix, ev.DeploymentID)
+	case "phase_finished":
+		if ev.Error != "" {
+			fmt.Printf("%s: %s failed: %s\n", prefix, ev.Phase, ev.Error)
+		} else {
+			fmt.Printf("%s: %s done\n", prefix, ev.Phase)
+		}
+	case "deploy_finished":
+		result := "finished"
+		if ev.Deployment != nil {
+			result = ev.Deployment.Result
+			if ev.Deployment.Error != nil {
+				result += ": " + ev.Deployment.Error.Message
+			}
+		}
+		fmt.Printf("%s: deploy %s %s\n", prefix, ev.DeploymentID, result)
+	default:
+		fmt.Printf("%s: %s\n", prefix, ev.Event)
+	}
+}
+
+// adoptCommand has the receiver take over the management of
+// a container created outside it
+func adoptCommand(args []string) error {
+	fs := flag.NewFlagSet("adopt", flag.ExitOnError)
+	newClient := apiFlags(fs)
+	container := fs.String("container", "", "Configured container whose running container is adopted")
+	fs.Parse(args)
+	if *container == "" {
+		return errors.New("need -container")
+	}
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	dep, err := c.Adopt(*container)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s %s adopted, running %s\n", dep.ID, dep.Container, dep.Image)
+	return nil
+}
+
+// pinCommand pins a container to the image it runs or, with
+// -unpin, unpins it
+func pinCommand(args []string) error {
+	fs := flag.NewFlagSet("pin", flag.ExitOnError)
+	newClient := apiFlags(fs)
+	container := fs.String("container", "", "Container to pin")
+	unpin := fs.Bool("unpin", false, "Unpin the container instead, deploying the last version held while pinned")
+	fs.Parse(args)
+	if *container == "" {
+		return errors.New("need -container")
+	}
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	if *unpin {
+		pin, err := c.Unpin(*container)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s unpinned, %d deploys were held\n", *container, len(pin.Held))
+		if pin.Released != "" {
+			fmt.Printf("%s deploying the last held version\n", pin.Released)
+		}
+		return nil
+	}
+	pin, err := c.Pin(*container)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s pinned to %s\n", *container, pin.Image)
+	return nil
+}
+
+// cordonCommand cordons a host, or with -uncordon uncordons it.
+// Without -host it lists the hosts and their cordons.
+func cordonCommand(args []string) error {
+	fs := flag.NewFlagSet("cordon", flag.ExitOnError)
+	newClient := apiFlags(fs)
+	host := fs.String("host", "", "Host to cordon, its endpoint or local for the daemon from the environment")
+	reason := fs.String("reason", "", "Why the host is cordoned")
+	drain := fs.Bool("drain", false, "Also stop the containers on the host")
+	uncordon := fs.Bool("uncordon", false, "Uncordon the host instead, starting the containers stopped by draining it")
+	fs.Parse(args)
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	if *host == "" {
+		hosts, err := c.Hosts()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "HOST\tCONTAINERS\tCORDONED")
+		for _, h := range hosts {
+			cordoned := "-"
+			if h.Cordon != nil {
+				cordoned = h.Cordon.Since.Format(time.RFC3339) + " " + h.Cordon.Reason
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", h.Host, strings.Join(h.Containers, ","), cordoned)
+		}
+		return tw.Flush()
+	}
+	if *uncordon {
+		cordon, err := c.Uncordon(*host)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s uncordoned, started %d drained containers\n", *host, len(cordon.Stopped))
+		return nil
+	}
+	cordon, err := c.Cordon(*host, *reason, *drain)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s cordoned\n", *host)
+	if len(cordon.Stopped) > 0 {
+		fmt.Printf("Stopped %s\n", strings.Join(cordon.Stopped, ", "))
+	}
+	return nil
+}
+
+// deadLettersCommand lists the dead letters or, with
+// -retry or -purge, retries or purges one
+func deadLettersCommand(args []string) error {
+	fs := flag.NewFlagSet("dead-letters", flag.ExitOnError)
+	newClient := apiFlags(fs)
+	retry := fs.String("retry", "", "ID of a dead letter to process again")
+	purge := fs.String("purge", "", "ID of a dead letter to remove, or all")
+	fs.Parse(args)
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *retry != "":
+		ack, err := c.RetryDeadLetter(*retry)
+		if err != nil {
+			return err
+		}
+		for _, dep := range ack.Deployments {
+			fmt.Printf("%s %s %s\n", dep.ID, dep.Container, dep.Status)
+		}
+		return nil
+	case *purge == "all":
+		n, err := c.PurgeDeadLetters()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Purged %d dead letters\n", n)
+		return nil
+	case *purge != "":
+		return c.PurgeDeadLetter(*purge)
+	}
+
+	letters, err := c.DeadLetters()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTENANT\tPUSH\tATTEMPTS\tLAST FAILED\tERROR")
+	for _, l := range letters {
+		msg := ""
+		if l.Error != nil {
+			msg = l.Error.Message
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s:%s\t%d\t%s\t%s\n", l.ID, l.Tenant, l.Repository, l.Tag, l.Attempts, l.LastFailedAt.Format(time.RFC3339), msg)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,627 @@
+// Package client is a client of the docker-webhook-receiver management API,
+// as described by the OpenAPI specification served on /api/openapi.json.
+// It is maintained by hand along with the specification in openapi.json.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// HookError is the error returned by failed requests
+type HookError struct {
+	Code      string   `json:"code"`
+	Message   string   `json:"message"`
+	Phase     string   `json:"phase"`
+	Retryable bool     `json:"retryable"`
+	Details   []string `json:"details,omitempty"`
+	// RetryAfter is the number of seconds to wait before retrying
+	RetryAfter int `json:"retry_after,omitempty"`
+
+	// Status is the HTTP status code of the reply
+	Status int `json:"-"`
+}
+
+func (e *HookError) Error() string {
+	return fmt.Sprintf("%s: %s (%s)", e.Phase, e.Message, e.Code)
+}
+
+// Deployment is the outcome of a single deploy
+type Deployment struct {
+	ID            string       `json:"id"`
+	Container     string       `json:"container"`
+	Repository    string       `json:"repository"`
+	Tag           string       `json:"tag"`
+	Digest        string       `json:"digest,omitempty"`
+	StartedAt     time.Time    `json:"started_at"`
+	FinishedAt    time.Time    `json:"finished_at"`
+	Result        string       `json:"result"`
+	Error         *HookError   `json:"error,omitempty"`
+	Action        string       `json:"action,omitempty"`
+	ExecOutput    string       `json:"exec_output,omitempty"`
+	Artifact      *ArtifactRef `json:"artifact,omitempty"`
+	Image         string       `json:"image,omitempty"`
+	ImageSize     int64        `json:"image_size,omitempty"`
+	ImageLayers   int          `json:"image_layers,omitempty"`
+	SBOM          *SBOMInfo    `json:"sbom,omitempty"`
+	PreviousImage string       `json:"previous_image,omitempty"`
+	RolledBack    bool         `json:"rolled_back,omitempty"`
+	TestOutput    string       `json:"test_output,omitempty"`
+	Labels        *ImageLabels `json:"labels,omitempty"`
+	Commit        *Commit      `json:"commit,omitempty"`
+	Archive       string       `json:"archive,omitempty"`
+	Snapshot      string       `json:"snapshot,omitempty"`
+}
+
+// ImageLabels are the OCI annotations describing an image
+type ImageLabels struct {
+	Version     string `json:"version,omitempty"`
+	Revision    string `json:"revision,omitempty"`
+	Created     string `json:"created,omitempty"`
+	Description string `json:"description,omitempty"`
+	Source      string `json:"source,omitempty"`
+	BaseName    string `json:"base_name,omitempty"`
+	BaseDigest  string `json:"base_digest,omitempty"`
+}
+
+// ArtifactRef is an artifact deployed by the artifact engine
+type ArtifactRef struct {
+	URL      string `json:"url"`
+	Checksum string `json:"checksum"`
+}
+
+// Commit is the source commit a deployed image was built from
+type Commit struct {
+	SHA     string `json:"sha"`
+	Message string `json:"message,omitempty"`
+	Author  string `json:"author,omitempty"`
+	URL     string `json:"url,omitempty"`
+}
+
+// SBOMInfo describes the SBOM stored for a deployment
+type SBOMInfo struct {
+	// Format is spdx or cyclonedx
+	Format string `json:"format"`
+	Digest string `json:"digest"`
+}
+
+// ImageDiff is what changed between the image a deploy replaced
+// and the one it deployed
+type ImageDiff struct {
+	Previous     *ImageInfo    `json:"previous"`
+	Current      *ImageInfo    `json:"current"`
+	SizeChange   int64         `json:"size_change"`
+	Labels       []ValueChange `json:"labels,omitempty"`
+	Env          []ValueChange `json:"env,omitempty"`
+	PortsAdded   []string      `json:"ports_added,omitempty"`
+	PortsRemoved []string      `json:"ports_removed,omitempty"`
+}
+
+// ImageInfo describes one side of an ImageDiff
+type ImageInfo struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	Size    int64     `json:"size"`
+}
+
+// ValueChange is a label or environment variable that was added,
+// removed or changed
+type ValueChange struct {
+	Name string `json:"name"`
+	Old  string `json:"old,omitempty"`
+	New  string `json:"new,omitempty"`
+}
+
+// DeployLogLine is a line logged during a deploy
+type DeployLogLine struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+}
+
+// Ack is the reply to a request starting deployments
+type Ack struct {
+	// Status is the combined status of the deployments
+	Status      string          `json:"status"`
+	Deployments []DeploymentAck `json:"deployments"`
+}
+
+// DeploymentAck identifies a deployment started by a request
+type DeploymentAck struct {
+	ID        string `json:"id"`
+	Container string `json:"container"`
+	Status    string `json:"status"`
+	StatusURL string `json:"status_url"`
+}
+
+// ExternalEvent is a change to a container not made by the receiver
+type ExternalEvent struct {
+	Action   string    `json:"action"`
+	Time     time.Time `json:"time"`
+	ExitCode *int      `json:"exit_code,omitempty"`
+}
+
+// ContainerStatus summarizes the state of a managed container
+type ContainerStatus struct {
+	Name          string         `json:"name"`
+	Tenant        string         `json:"tenant"`
+	Running       bool           `json:"running"`
+	Image         string         `json:"image,omitempty"`
+	ImageID       string         `json:"image_id,omitempty"`
+	Digest        string         `json:"digest,omitempty"`
+	StartedAt     *time.Time     `json:"started_at,omitempty"`
+	UptimeSeconds float64        `json:"uptime_seconds"`
+	QueueLength   int            `json:"queue_length"`
+	LastDeploy    *Deployment    `json:"last_deploy,omitempty"`
+	ExternalEvent *ExternalEvent `json:"external_event,omitempty"`
+	Drift         []string       `json:"drift,omitempty"`
+	Labels        *ImageLabels   `json:"labels,omitempty"`
+	// Prepulled are the images of waiting deploys already pulled
+	Prepulled []PrepulledImage `json:"prepulled,omitempty"`
+	// Pin holds the deploys of the container, if pinned
+	Pin *Pin `json:"pin,omitempty"`
+}
+
+// Pin holds a container at the image it ran when it was pinned
+type Pin struct {
+	Image    string    `json:"image"`
+	Digest   string    `json:"digest,omitempty"`
+	PinnedAt time.Time `json:"pinned_at"`
+	// Held are the IDs of the deploys held since the container was pinned
+	Held []string `json:"held,omitempty"`
+	// Released is the deploy of the last held version
+	// started by unpinning the container, if any
+	Released string `json:"released,omitempty"`
+}
+
+// HostStatus is a host of the containers
+type HostStatus struct {
+	Host       string   `json:"host"`
+	Containers []string `json:"containers"`
+	Cordon     *Cordon  `json:"cordon,omitempty"`
+}
+
+// Cordon excludes a host from deploys during maintenance
+type Cordon struct {
+	// Host is the endpoint of the host, local for the daemon from the environment
+	Host   string    `json:"host"`
+	Since  time.Time `json:"since"`
+	Reason string    `json:"reason,omitempty"`
+	// Stopped are the containers stopped by draining the host
+	Stopped []string `json:"stopped,omitempty"`
+}
+
+// DeadLetter is a webhook whose processing failed, kept
+// so it can be retried once the problem is fixed
+type DeadLetter struct {
+	ID         string `json:"id"`
+	Tenant     string `json:"tenant"`
+	Repository string `json:"repository,omitempty"`
+	Tag        string `json:"tag,omitempty"`
+	// Attempts counts the deliveries and retries that failed
+	Attempts      int       `json:"attempts"`
+	FirstFailedAt time.Time `json:"first_failed_at"`
+	LastFailedAt  time.Time `json:"last_failed_at"`
+	// Error is the last failure
+	Error       *HookError      `json:"error"`
+	Deployments []string        `json:"deployments,omitempty"`
+	Payload     json.RawMessage `json:"payload"`
+}
+
+// PrepulledImage is an image pulled for a deploy that hasn't run yet
+type PrepulledImage struct {
+	Image    string    `json:"image"`
+	PulledAt time.Time `json:"pulled_at"`
+}
+
+// Status is the state of all containers visible to the token
+type Status struct {
+	Time       time.Time         `json:"time"`
+	Containers []ContainerStatus `json:"containers"`
+	// SLOs are the SLOs of the repositories deployed to, if configured
+	SLOs []SLOStatus `json:"slos,omitempty"`
+}
+
+// SLOStatus is how the deploys of a repository do against the SLOs
+type SLOStatus struct {
+	Tenant                string   `json:"tenant"`
+	Repository            string   `json:"repository"`
+	Deploys               int      `json:"deploys"`
+	SuccessRate           float64  `json:"success_rate"`
+	SuccessTarget         float64  `json:"success_target,omitempty"`
+	ErrorBudgetRemaining  *float64 `json:"error_budget_remaining,omitempty"`
+	P95DurationSeconds    float64  `json:"p95_duration_seconds"`
+	DurationTargetSeconds float64  `json:"duration_target_seconds,omitempty"`
+	Met                   bool     `json:"met"`
+}
+
+// ScheduleStatus is the state of a scheduled action of a container
+type ScheduleStatus struct {
+	Container string     `json:"container"`
+	Tenant    string     `json:"tenant"`
+	Cron      string     `json:"cron"`
+	Action    string     `json:"action"`
+	Next      time.Time  `json:"next"`
+	LastRun   *time.Time `json:"last_run,omitempty"`
+	// LastResult is success, error or skipped
+	LastResult  string `json:"last_result,omitempty"`
+	LastMessage string `json:"last_message,omitempty"`
+}
+
+// AgentStatus is the state of a remote agent
+type AgentStatus struct {
+	Name       string      `json:"name"`
+	Connected  bool        `json:"connected"`
+	LastSeen   time.Time   `json:"last_seen"`
+	LastDeploy *Deployment `json:"last_deploy,omitempty"`
+}
+
+// ConfigExport is the effective configuration of the
+// receiver with the deployed state
+type ConfigExport struct {
+	// Config is the configuration with all defaults
+	// applied and secrets redacted
+	Config   json.RawMessage     `json:"config"`
+	Deployed []DeployedContainer `json:"deployed"`
+}
+
+// DeployedContainer is what a container currently runs
+type DeployedContainer struct {
+	Tenant    string `json:"tenant"`
+	Container string `json:"container"`
+	Running   bool   `json:"running"`
+	Image     string `json:"image,omitempty"`
+	ImageID   string `json:"image_id,omitempty"`
+	Digest    string `json:"digest,omitempty"`
+}
+
+// StreamEvent is a deployment lifecycle event
+type StreamEvent struct {
+	// Event is deploy_started, phase_finished or deploy_finished
+	Event        string    `json:"event"`
+	Time         time.Time `json:"time"`
+	Tenant       string    `json:"tenant"`
+	Container    string    `json:"container"`
+	DeploymentID string    `json:"deployment_id,omitempty"`
+	Phase        string    `json:"phase,omitempty"`
+	// Error is the failure of the phase, if any
+	Error string `json:"error,omitempty"`
+	// Deployment is the finished deployment
+	Deployment *Deployment `json:"deployment,omitempty"`
+}
+
+// Client calls the API of the receiver at URL
+type Client struct {
+	// URL is the base URL of the receiver, e.g. https://deploy.example.com.
+	// Use Unix for receivers listening on a Unix socket.
+	URL string
+	// Token is sent as bearer token, if set
+	Token string
+	// HTTPClient is used for requests, http.DefaultClient if nil
+	HTTPClient *http.Client
+}
+
+// Unix returns a client talking to the receiver on the Unix socket
+func Unix(socket string) *Client {
+	var dialer net.Dialer
+	return &Client{
+		URL: "http://unix",
+		HTTPClient: &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		}},
+	}
+}
+
+// Status returns the status of the containers
+func (c *Client) Status() (*Status, error) {
+	status := &Status{}
+	return status, c.do("GET", "/api/status", nil, status)
+}
+
+// Deployments returns the deployments, most recent first
+func (c *Client) Deployments() ([]Deployment, error) {
+	var deployments []Deployment
+	return deployments, c.do("GET", "/api/deployments", nil, &deployments)
+}
+
+// Deployment returns the deployment, which may not have finished yet
+func (c *Client) Deployment(id string) (*Deployment, error) {
+	dep := &Deployment{}
+	return dep, c.do("GET", "/api/deployments/"+url.PathEscape(id), nil, dep)
+}
+
+// Wait waits up to timeout for the deployment to finish and returns it.
+// The result of a deployment that didn't finish in time is queued or running.
+func (c *Client) Wait(id string, timeout time.Duration) (*Deployment, error) {
+	dep := &Deployment{}
+	return dep, c.do("GET", "/api/deployments/"+url.PathEscape(id)+"/wait?timeout="+url.QueryEscape(timeout.String()), nil, dep)
+}
+
+// Diff compares the image the deployment replaced with the one it deployed
+func (c *Client) Diff(id string) (*ImageDiff, error) {
+	diff := &ImageDiff{}
+	return diff, c.do("GET", "/api/deployments/"+url.PathEscape(id)+"/diff", nil, diff)
+}
+
+// SBOM returns the SBOM document of the deployed image
+func (c *Client) SBOM(id string) (json.RawMessage, error) {
+	var doc json.RawMessage
+	return doc, c.do("GET", "/api/deployments/"+url.PathEscape(id)+"/sbom", nil, &doc)
+}
+
+// DeploymentLog returns the lines logged during the deployment
+func (c *Client) DeploymentLog(id string) ([]DeployLogLine, error) {
+	var lines []DeployLogLine
+	return lines, c.do("GET", "/api/deployments/"+url.PathEscape(id)+"/log", nil, &lines)
+}
+
+// Replay re-runs the webhook that triggered the deployment
+func (c *Client) Replay(id string) (*Ack, error) {
+	ack := &Ack{}
+	return ack, c.do("POST", "/api/deployments/"+url.PathEscape(id)+"/replay", nil, ack)
+}
+
+// Deploy redeploys the container with its configured tag
+func (c *Client) Deploy(container string) (*Deployment, error) {
+	dep := &Deployment{}
+	return dep, c.do("POST", "/api/containers/"+url.PathEscape(container)+"/deploy", nil, dep)
+}
+
+// Pin pins the container to the image it runs. Its deploys
+// are held, and not run, until it is unpinned.
+func (c *Client) Pin(container string) (*Pin, error) {
+	pin := &Pin{}
+	return pin, c.do("POST", "/api/containers/"+url.PathEscape(container)+"/pin", nil, pin)
+}
+
+// Unpin unpins the container, deploying the last version held
+// while it was pinned, if any
+func (c *Client) Unpin(container string) (*Pin, error) {
+	pin := &Pin{}
+	return pin, c.do("DELETE", "/api/containers/"+url.PathEscape(container)+"/pin", nil, pin)
+}
+
+// Adopt takes over the management of the running container of the
+// name, created outside the receiver, recording its spec and image as
+// the baseline it is recreated from
+func (c *Client) Adopt(container string) (*Deployment, error) {
+	dep := &Deployment{}
+	return dep, c.do("POST", "/api/containers/"+url.PathEscape(container)+"/adopt", nil, dep)
+}
+
+// Hosts returns the hosts of the containers
+func (c *Client) Hosts() ([]HostStatus, error) {
+	var hosts []HostStatus
+	return hosts, c.do("GET", "/api/hosts", nil, &hosts)
+}
+
+// Cordon excludes the host from deploys. Drain also stops the
+// containers on it, taking them out of their load balancers first.
+func (c *Client) Cordon(host, reason string, drain bool) (*Cordon, error) {
+	cordon := &Cordon{}
+	req := map[string]interface{}{"reason": reason, "drain": drain}
+	return cordon, c.do("POST", "/api/hosts/cordon?"+url.Values{"host": {host}}.Encode(), req, cordon)
+}
+
+// Uncordon includes the host in deploys again, starting
+// the containers stopped by draining it
+func (c *Client) Uncordon(host string) (*Cordon, error) {
+	cordon := &Cordon{}
+	return cordon, c.do("DELETE", "/api/hosts/cordon?"+url.Values{"host": {host}}.Encode(), nil, cordon)
+}
+
+// DeadLetters returns the webhooks whose processing
+// failed, the most recent failure first
+func (c *Client) DeadLetters() ([]DeadLetter, error) {
+	var letters []DeadLetter
+	return letters, c.do("GET", "/api/dead-letters", nil, &letters)
+}
+
+// RetryDeadLetter processes the webhook of the dead letter again,
+// removing it if it succeeds
+func (c *Client) RetryDeadLetter(id string) (*Ack, error) {
+	ack := &Ack{}
+	return ack, c.do("POST", "/api/dead-letters/"+url.PathEscape(id)+"/retry", nil, ack)
+}
+
+// PurgeDeadLetter removes the dead letter without retrying it
+func (c *Client) PurgeDeadLetter(id string) error {
+	return c.do("DELETE", "/api/dead-letters/"+url.PathEscape(id), nil, nil)
+}
+
+// PurgeDeadLetters removes all dead letters, returning their number
+func (c *Client) PurgeDeadLetters() (int, error) {
+	var purged struct {
+		Purged int `json:"purged"`
+	}
+	err := c.do("DELETE", "/api/dead-letters", nil, &purged)
+	return purged.Purged, err
+}
+
+// DeployRepository queues deploys of the containers of the
+// repository, like a push of tag to it would
+func (c *Client) DeployRepository(repo, tag string) (*Ack, error) {
+	ack := &Ack{}
+	return ack, c.do("POST", "/api/deploy", map[string]string{"repo": repo, "tag": tag}, ack)
+}
+
+// DeployArchive is like DeployRepository, but loads the image from the
+// archive, a URL under the -archive-urls or a path in the archive dir of
+// the receiver, instead of pulling it
+func (c *Client) DeployArchive(repo, tag, archive string) (*Ack, error) {
+	ack := &Ack{}
+	return ack, c.do("POST", "/api/deploy", map[string]string{"repo": repo, "tag": tag, "archive": archive}, ack)
+}
+
+// DeployArtifact is like DeployRepository, for containers with the
+// artifact engine. checksum is the SHA-256 of the artifact at url.
+func (c *Client) DeployArtifact(repo, tag, url, checksum string) (*Ack, error) {
+	ack := &Ack{}
+	req := map[string]interface{}{
+		"repo":     repo,
+		"tag":      tag,
+		"artifact": ArtifactRef{URL: url, Checksum: checksum},
+	}
+	return ack, c.do("POST", "/api/deploy", req, ack)
+}
+
+// Agents returns the remote agents on the token's hosts
+func (c *Client) Agents() ([]AgentStatus, error) {
+	var agents []AgentStatus
+	return agents, c.do("GET", "/api/agents", nil, &agents)
+}
+
+// Schedules lists the scheduled actions of the containers
+func (c *Client) Schedules() ([]ScheduleStatus, error) {
+	var schedules []ScheduleStatus
+	return schedules, c.do("GET", "/api/schedules", nil, &schedules)
+}
+
+// Config returns the effective configuration, which needs an admin token
+func (c *Client) Config() (*ConfigExport, error) {
+	export := &ConfigExport{}
+	return export, c.do("GET", "/api/config", nil, export)
+}
+
+// Events subscribes to the lifecycle events of all deploys, returning
+// once subscribed. The events are received on the channel as they
+// happen, which is closed when the context is done or the stream
+// breaks. The HTTPClient must not have a timeout.
+func (c *Client) Events(ctx context.Context) (<-chan *StreamEvent, error) {
+	body, err := c.stream(ctx, "/api/events/stream")
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan *StreamEvent)
+	go func() {
+		defer close(events)
+		defer body.Close()
+		scanner := bufio.NewScanner(body)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			ev := &StreamEvent{}
+			if json.Unmarshal([]byte(data), ev) != nil {
+				continue
+			}
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// Logs copies the output of the container since the time, all of it
+// if zero, to w. With follow, new output is copied until the context
+// is done. The HTTPClient must not have a timeout.
+func (c *Client) Logs(ctx context.Context, container string, since time.Time, follow bool, w io.Writer) error {
+	query := url.Values{"follow": {fmt.Sprint(follow)}}
+	if !since.IsZero() {
+		query.Set("since", since.Format(time.RFC3339))
+	}
+	body, err := c.stream(ctx, "/api/containers/"+url.PathEscape(container)+"/logs?"+query.Encode())
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	_, err = io.Copy(w, body)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// stream sends a GET request, returning the body of a
+// successful reply as it is received
+func (c *Client) stream(ctx context.Context, path string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(c.URL, "/")+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("GET %s: %s: %s", path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp.Body, nil
+}
+
+// do sends the request with in as JSON body and decodes the reply into
+// out, either if not nil. Failures reported by the receiver are returned
+// as *HookError.
+func (c *Client) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		content, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(content)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.URL, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var reply struct {
+			Error *HookError `json:"error"`
+		}
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		if json.Unmarshal(body, &reply) == nil && reply.Error != nil {
+			reply.Error.Status = resp.StatusCode
+			return reply.Error
+		}
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
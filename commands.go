@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// commands are run instead of the receiver when named by the
+// first argument, with the remaining arguments
+var commands = map[string]func(args []string) error{}
+
+// runCommand runs the command named by the first argument,
+// reporting whether there was one
+func runCommand() bool {
+	if len(os.Args) < 2 {
+		return false
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		return false
+	}
+	err := cmd(os.Args[2:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+	return true
+}
+
+// commandNames lists the commands for the usage message
+func commandNames() string {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
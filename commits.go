@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// revisionLabel is the OCI annotation of the commit an image was built from
+const revisionLabel = "org.opencontainers.image.revision"
+
+// Commit is the source commit a deployed image was built from
+type Commit struct {
+	SHA     string `json:"sha"`
+	Message string `json:"message,omitempty"`
+	Author  string `json:"author,omitempty"`
+	URL     string `json:"url,omitempty"`
+}
+
+// ForgeConfig is the Git forge commits of a container's
+// image are looked up in
+type ForgeConfig struct {
+	// Type is github (default), gitlab or gitea
+	Type string `json:"type"`
+	// URL is the base URL of the forge, required for gitea
+	// and defaulting to the public instance otherwise
+	URL string `json:"url"`
+	// Repository is the owner/name of the repository
+	Repository string `json:"repository"`
+	// Token authenticates requests, FORGE_TOKEN if empty
+	Token string `json:"token"`
+}
+
+func (c *ForgeConfig) validate() error {
+	if c.Repository == "" {
+		return errors.New("forge needs a repository")
+	}
+	switch c.Type {
+	case "", "github":
+		c.Type = "github"
+		if c.URL == "" {
+			c.URL = "https://api.github.com"
+		}
+	case "gitlab":
+		if c.URL == "" {
+			c.URL = "https://gitlab.com"
+		}
+	case "gitea":
+		if c.URL == "" {
+			return errors.New("forge gitea needs a url")
+		}
+	default:
+		return fmt.Errorf("unknown forge type %q", c.Type)
+	}
+	c.URL = strings.TrimSuffix(c.URL, "/")
+	if c.Token == "" {
+		c.Token = os.Getenv("FORGE_TOKEN")
+	}
+	return nil
+}
+
+var forgeClient = &http.Client{Timeout: 10 * time.Second}
+
+// lookupCommit returns the commit sha from the forge. Only the
+// SHA is returned if the lookup fails, as it is still useful.
+func (c *ForgeConfig) lookupCommit(sha string) *Commit {
+	commit := &Commit{SHA: sha}
+	var err error
+	switch c.Type {
+	case "github", "gitea":
+		path := "/repos/" + c.Repository + "/commits/" + url.PathEscape(sha)
+		if c.Type == "gitea" {
+			path = "/api/v1/repos/" + c.Repository + "/git/commits/" + url.PathEscape(sha)
+		}
+		var reply struct {
+			HTMLURL string `json:"html_url"`
+			Commit  struct {
+				Message string `json:"message"`
+				Author  struct {
+					Name string `json:"name"`
+				} `json:"author"`
+			} `json:"commit"`
+		}
+		auth := ""
+		if c.Token != "" {
+			auth = "token " + c.Token
+		}
+		err = githubRequest(forgeClient, "GET", c.URL+path, auth, nil, &reply)
+		commit.Message, commit.Author, commit.URL = reply.Commit.Message, reply.Commit.Author.Name, reply.HTMLURL
+	case "gitlab":
+		var reply struct {
+			Message    string `json:"message"`
+			AuthorName string `json:"author_name"`
+			WebURL     string `json:"web_url"`
+		}
+		err = gitlabRequest(c, "/api/v4/projects/"+url.PathEscape(c.Repository)+"/repository/commits/"+url.PathEscape(sha), &reply)
+		commit.Message, commit.Author, commit.URL = reply.Message, reply.AuthorName, reply.WebURL
+	}
+	if err != nil {
+		log.Printf("Failed to look up commit %s: %v", sha, err)
+	}
+	commit.Message = strings.TrimSpace(commit.Message)
+
+	return commit
+}
+
+func gitlabRequest(c *ForgeConfig, path string, out interface{}) error {
+	req, err := http.NewRequest("GET", c.URL+path, nil)
+	if err != nil {
+		return err
+	}
+	if c.Token != "" {
+		req.Header.Set("PRIVATE-TOKEN", c.Token)
+	}
+	resp, err := forgeClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("gitlab GET %s: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,788 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// Config is the structure of the JSON configuration file
+type Config struct {
+	// Version of the configuration schema, 1 if empty.
+	// Older versions are migrated when loaded.
+	Version int            `json:"version"`
+	Tenants []TenantConfig `json:"tenants"`
+	Audit   AuditConfig    `json:"audit"`
+	// HostOptions are the options of Docker hosts by endpoint,
+	// with the empty endpoint being the daemon from the environment
+	HostOptions map[string]HostOptions `json:"host_options"`
+	Proxy       *ProxyConfig           `json:"proxy"`
+	// Alerting pages on-call when deploys of any container fail
+	Alerting *AlertingConfig `json:"alerting"`
+	// Policy is checked against the images of all containers
+	Policy *PolicyConfig `json:"policy"`
+	// Plugins are external programs parsing webhooks,
+	// deploying containers or receiving notifications
+	Plugins []PluginConfig `json:"plugins"`
+	// Anomalies detects spikes in the pushes to repositories
+	Anomalies *AnomalyConfig `json:"anomalies"`
+	// ReplayProtection rejects webhooks that look replayed
+	ReplayProtection *ReplayConfig `json:"replay_protection"`
+	// Lockout locks out addresses failing to authenticate too often
+	Lockout *LockoutConfig `json:"lockout"`
+	// AccessLog logs every request in the Apache combined format
+	AccessLog *LogFileConfig `json:"access_log"`
+	// Log is a file the log is written to, besides stderr
+	Log *LogFileConfig `json:"log"`
+	// Loki is pushed the log
+	Loki *LokiConfig `json:"loki"`
+	// SLO are the targets for the deploys of every repository
+	SLO *SLOConfig `json:"slo"`
+	// Certificates are watched for renewals
+	Certificates *CertificatesConfig `json:"certificates"`
+	// Listeners are the addresses the receiver serves on,
+	// 0.0.0.0:8080 serving everything if empty
+	Listeners []ListenerConfig `json:"listeners"`
+	// Server tunes the HTTP servers of the listeners
+	Server *ServerConfig `json:"server"`
+	// HA coordinates the receiver with others run for redundancy
+	HA *HAConfig `json:"ha"`
+}
+
+// TenantConfig is the configuration of a team sharing the receiver.
+// A tenant's webhooks and API tokens may only touch its own containers.
+type TenantConfig struct {
+	Name string `json:"name"`
+	// WebhookSecret must be passed in the secret query parameter
+	// of the tenant's webhook URL. Empty disables the check.
+	WebhookSecret string `json:"webhook_secret"`
+	// APITokens authenticate requests to the management API
+	APITokens []APIToken `json:"api_tokens"`
+	// Signing lets CI authenticate POST /api/deploy by signing it
+	Signing *SigningConfig `json:"signing"`
+	// Hosts lists the Docker daemon endpoints the tenant's containers
+	// may run on. Empty only allows the daemon from the environment.
+	Hosts      []string          `json:"hosts"`
+	Containers []ContainerConfig `json:"containers"`
+	// Rollouts roll out the pushes to repositories whose
+	// containers run on several hosts in stages
+	Rollouts []RolloutConfig `json:"rollouts"`
+}
+
+// ContainerConfig describes a container redeployed on pushes to Repository
+type ContainerConfig struct {
+	Name       string `json:"name"`
+	Repository string `json:"repository"`
+	// Tag is the tag pulled on redeploy, latest if empty
+	Tag string `json:"tag"`
+	// Host is the Docker daemon endpoint, the one
+	// from the environment if empty
+	Host string   `json:"host"`
+	Cmd  []string `json:"cmd"`
+	Env  []string `json:"env"`
+	// Ports maps container ports to host ports
+	Ports map[string]string `json:"ports"`
+	// Mounts are bind mounts in the host:container[:options] format
+	Mounts []string `json:"mounts"`
+	// TargetURL is reported to Docker Hub in the callback
+	TargetURL string `json:"target_url"`
+	// AutoRestart restarts the container from the last deployed
+	// image if it dies or is removed outside of a deploy
+	AutoRestart bool `json:"auto_restart"`
+	// RemediateDrift redeploys the container when it
+	// is found to differ from this configuration
+	RemediateDrift bool `json:"remediate_drift"`
+	// PromoteTo names a container of the same tenant that the deployed
+	// digest is promoted to once this container passes its smoke tests.
+	// The target is then no longer deployed by webhooks directly.
+	PromoteTo string           `json:"promote_to"`
+	SmokeTest *SmokeTestConfig `json:"smoke_test"`
+	// Rollback recreates the container from the previous
+	// image if the deploy fails after it was stopped
+	Rollback bool `json:"rollback"`
+	// KeepOld is the number of replaced containers kept stopped,
+	// so rolling back only needs to start one. 0 removes them.
+	KeepOld int `json:"keep_old"`
+
+	// Strategy is one of recreate (default), blue_green, rolling or
+	// canary. All but recreate run the old and new container side by
+	// side, so they can't publish ports and require a Network.
+	Strategy string `json:"strategy"`
+	// Network is the Docker network the container is connected to
+	Network string `json:"network"`
+	// NetworkAliases are shared by the old and new container during
+	// rolling and canary deploys, so both receive traffic
+	NetworkAliases []string `json:"network_aliases"`
+	// CanaryDuration is how long a canary must stay healthy, 5m if empty
+	CanaryDuration string `json:"canary_duration"`
+	// Mirror is a registry mirror or pull-through cache tags are
+	// pulled from before falling back to the registry, e.g.
+	// mirror.internal:5000
+	Mirror string `json:"mirror"`
+	// SnapshotDir is where the image of the replaced container is
+	// saved before a deploy, so it can be rolled back to even if it
+	// is gone from the registry. Empty disables snapshots.
+	SnapshotDir string `json:"snapshot_dir"`
+	// SnapshotKeep is the number of snapshots kept, 3 if zero
+	SnapshotKeep int `json:"snapshot_keep"`
+	// LoadBalancer drains the container before it is stopped
+	LoadBalancer *LoadBalancerConfig `json:"load_balancer"`
+	// DependsOn names containers of the same tenant this container
+	// is deployed after, once they are healthy, when a push
+	// deploys both
+	DependsOn []string `json:"depends_on"`
+	// Group names the concurrency group of the container. Deploys of
+	// containers of the same group, e.g. sharing a database, never
+	// overlap.
+	Group string `json:"group"`
+	// Registration registers the container in service
+	// discovery after every deploy
+	Registration *RegistrationConfig `json:"registration"`
+	// DNS is pointed at the container after every deploy
+	DNS *DNSConfig `json:"dns"`
+	// CDNPurge are the caches purged after every deploy
+	CDNPurge []CDNPurgeConfig `json:"cdn_purge"`
+	// Release records deploys in an error tracker
+	Release *ReleaseConfig `json:"release"`
+	// StatusPage announces deploys and failures on a status page
+	StatusPage *StatusPageConfig `json:"status_page"`
+	// PullOrder is when the recreate strategy pulls the new image,
+	// before_stop (default) or after_stop the old container
+	PullOrder string `json:"pull_order"`
+
+	// Engine is the container engine behind Host, docker (default),
+	// podman, containerd, nomad, plugin or artifact. With podman and no Host, the
+	// local Podman socket is used. With nomad, the container is the task
+	// configured in Nomad. With plugin, the named Plugin deploys the
+	// container. With artifact, it's no container at all but the
+	// Artifact passed with pushes, extracted to a directory. With
+	// containerd, nerdctl runs the container in Namespace, and Host
+	// is the containerd socket, nerdctl's default if empty.
+	Engine    string          `json:"engine"`
+	Namespace string          `json:"namespace"`
+	Nomad     *NomadConfig    `json:"nomad"`
+	Plugin    string          `json:"plugin"`
+	Artifact  *ArtifactConfig `json:"artifact"`
+	// Platform is the os[/architecture] the pulled image must be built
+	// for, e.g. windows/amd64. Empty accepts whatever the daemon pulled.
+	Platform string `json:"platform"`
+	// SizeBudget is the size, e.g. 500MB, the image should stay under.
+	// Bigger images are still deployed, but notified about.
+	SizeBudget string `json:"size_budget"`
+	// SBOM fetches and stores the SBOM of deployed images
+	SBOM *SBOMConfig `json:"sbom"`
+	// BaseImage checks whether the base image of the running
+	// image was updated upstream
+	BaseImage *BaseImageConfig `json:"base_image"`
+	// AllowedPushers are the accounts, as path.Match patterns, whose
+	// pushes may deploy the container. Empty allows everyone.
+	AllowedPushers []string `json:"allowed_pushers"`
+	// Schedules run actions on the container on cron schedules
+	Schedules []ScheduleConfig `json:"schedules"`
+	// OnCertRenewal overrides the action of the certificates
+	// watch: reload, restart or ignore
+	OnCertRenewal string `json:"on_cert_renewal"`
+	// OnConflict is what to do about a container of the same name
+	// the receiver didn't create: abort (default) the deploy, rename
+	// and stop it, or adopt it, replacing it like its own
+	OnConflict string `json:"on_conflict"`
+	// ConfigUpdate updates the configuration in place on
+	// pushes signaling a configuration change
+	ConfigUpdate *ConfigUpdateConfig `json:"config_update"`
+	// Queue bounds the deploys waiting for the one in progress
+	Queue *QueueConfig `json:"queue"`
+	// Chaos injects faults into the deploys when run with -chaos
+	Chaos *ChaosConfig `json:"chaos"`
+	// When is a condition pushes must meet to deploy the container, in
+	// a subset of CEL, e.g. tag.startsWith("v") && now.getHours() < 17
+	When string `json:"when"`
+
+	// GitHub reports deploys as deployments of a GitHub repository
+	GitHub *GitHubConfig `json:"github"`
+	// Forge is where the commits of the org.opencontainers.image.revision
+	// label of deployed images are looked up
+	Forge *ForgeConfig `json:"forge"`
+
+	sizeBudget uint64
+	when       *whenExpr
+}
+
+// APIToken is a management API token and the role it grants
+type APIToken struct {
+	Token string `json:"token"`
+	// Role is one of viewer, deployer or admin, viewer if empty
+	Role Role `json:"role"`
+
+	// plain is set for tokens written as plain strings,
+	// from before tokens had roles
+	plain bool
+}
+
+// UnmarshalJSON also accepts the plain string tokens from before
+// tokens had roles, which could do anything and so are admin tokens
+func (t *APIToken) UnmarshalJSON(b []byte) error {
+	var token string
+	if json.Unmarshal(b, &token) == nil {
+		*t = APIToken{Token: token, Role: RoleAdmin, plain: true}
+		return nil
+	}
+	type apiToken APIToken
+	return json.Unmarshal(b, (*apiToken)(t))
+}
+
+// DefaultTenant is the tenant served on the unqualified webhook URL
+const DefaultTenant = "default"
+
+// defaultConfig is used when no configuration file is given
+func defaultConfig() *Config {
+	return &Config{
+		Tenants: []TenantConfig{{
+			Name: DefaultTenant,
+			Containers: []ContainerConfig{{
+				Name:       "app",
+				Repository: "jfbrandhorst/grpcweb-example",
+				Tag:        "latest",
+				Cmd: []string{
+					"--host",
+					"demo.jbrandhorst.com",
+				},
+				Ports: map[string]string{
+					"443": "443",
+				},
+				TargetURL: "https://demo.jbrandhorst.com",
+			}},
+		}},
+	}
+}
+
+// LoadConfig reads and validates the configuration file at path, with
+// the overlay of env merged on top if set. Without a path, the
+// configuration is taken from the environment, if set, or the
+// default configuration is returned.
+func LoadConfig(path, env string) (*Config, error) {
+	if path == "" {
+		cfg, err := configFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		if cfg == nil {
+			return defaultConfig(), nil
+		}
+		err = cfg.validate()
+		if err != nil {
+			return nil, fmt.Errorf("invalid config from environment: %v", err)
+		}
+		return cfg, nil
+	}
+
+	content, err := readConfigTree(path, env)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	err = json.Unmarshal(content, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	err = cfg.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid config %s: %v", path, err)
+	}
+
+	return cfg, nil
+}
+
+func (c *Config) validate() error {
+	if c.Proxy != nil {
+		err := c.Proxy.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.Alerting != nil {
+		err := c.Alerting.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.Policy != nil {
+		err := c.Policy.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.Anomalies != nil {
+		err := c.Anomalies.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.ReplayProtection != nil {
+		err := c.ReplayProtection.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.Lockout != nil {
+		err := c.Lockout.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.AccessLog != nil {
+		err := c.AccessLog.validate()
+		if err != nil {
+			return fmt.Errorf("access log: %v", err)
+		}
+	}
+	if c.Log != nil {
+		err := c.Log.validate()
+		if err != nil {
+			return fmt.Errorf("log: %v", err)
+		}
+	}
+	if c.Loki != nil {
+		err := c.Loki.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.SLO != nil {
+		err := c.SLO.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.Certificates != nil {
+		err := c.Certificates.validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.HA != nil {
+		err := c.HA.validate()
+		if err != nil {
+			return err
+		}
+	}
+	for i := range c.Listeners {
+		err := c.Listeners[i].validate()
+		if err != nil {
+			return err
+		}
+	}
+	if c.Server != nil {
+		err := c.Server.validate()
+		if err != nil {
+			return err
+		}
+	}
+	plugins := map[string]bool{}
+	for i := range c.Plugins {
+		err := c.Plugins[i].validate()
+		if err != nil {
+			return err
+		}
+		if plugins[c.Plugins[i].Name] {
+			return fmt.Errorf("duplicate plugin %q", c.Plugins[i].Name)
+		}
+		plugins[c.Plugins[i].Name] = true
+	}
+	for host, o := range c.HostOptions {
+		err := o.validate()
+		if err != nil {
+			return fmt.Errorf("host %q: %v", host, err)
+		}
+		c.HostOptions[host] = o
+	}
+
+	tenants := map[string]bool{}
+	containers := map[string]string{}
+	for ti := range c.Tenants {
+		t := &c.Tenants[ti]
+		if t.Name == "" {
+			return fmt.Errorf("tenant %d has no name", ti)
+		}
+		if tenants[t.Name] {
+			return fmt.Errorf("duplicate tenant %q", t.Name)
+		}
+		tenants[t.Name] = true
+
+		for i := range t.APITokens {
+			tok := &t.APITokens[i]
+			if tok.Token == "" {
+				return fmt.Errorf("tenant %q: api token %d is empty", t.Name, i)
+			}
+			if tok.plain {
+				log.Warnf("Tenant %q: api token %d has no role, it is an admin token", t.Name, i)
+			}
+			if tok.Role == "" {
+				tok.Role = RoleViewer
+			}
+			if _, ok := roleRank[tok.Role]; !ok {
+				return fmt.Errorf("tenant %q: api token %d has unknown role %q", t.Name, i, tok.Role)
+			}
+		}
+
+		if t.Signing != nil {
+			err := t.Signing.validate()
+			if err != nil {
+				return fmt.Errorf("tenant %q: %v", t.Name, err)
+			}
+		}
+
+		for i := range t.Rollouts {
+			err := t.Rollouts[i].validate()
+			if err != nil {
+				return fmt.Errorf("tenant %q: %v", t.Name, err)
+			}
+			if t.rollout(t.Rollouts[i].Repository) != &t.Rollouts[i] {
+				return fmt.Errorf("tenant %q: repository %q has several rollouts", t.Name, t.Rollouts[i].Repository)
+			}
+		}
+
+		for ci := range t.Containers {
+			ct := &t.Containers[ci]
+			if ct.Name == "" || ct.Repository == "" {
+				return fmt.Errorf("tenant %q: container %d needs a name and repository", t.Name, ci)
+			}
+			// Container names are global on a host, so two tenants
+			// sharing one would be able to replace each others containers.
+			if owner, ok := containers[ct.Name]; ok {
+				return fmt.Errorf("tenant %q: container %q is already managed by tenant %q", t.Name, ct.Name, owner)
+			}
+			containers[ct.Name] = t.Name
+			if ct.Host != "" && !contains(t.Hosts, ct.Host) {
+				return fmt.Errorf("tenant %q: container %q uses host %q not allowed for the tenant", t.Name, ct.Name, ct.Host)
+			}
+			err := ct.load()
+			if err != nil {
+				return fmt.Errorf("tenant %q: %v", t.Name, err)
+			}
+			if ct.Engine == EnginePlugin && !plugins[ct.Plugin] {
+				return fmt.Errorf("tenant %q: container %q: engine plugin needs a configured plugin, not %q", t.Name, ct.Name, ct.Plugin)
+			}
+			if c.Policy != nil && ct.SBOM == nil {
+				for _, rule := range c.Policy.rulesFor(ct.Name) {
+					if rule.needsSBOM() {
+						return fmt.Errorf("tenant %q: container %q: policy rule %q checks the SBOM, but the container has no sbom", t.Name, ct.Name, rule.Name)
+					}
+				}
+			}
+		}
+
+		for _, ct := range t.Containers {
+			for _, name := range ct.DependsOn {
+				if _, ok := t.container(name); !ok || name == ct.Name {
+					return fmt.Errorf("tenant %q: container %q depends on unknown container %q", t.Name, ct.Name, name)
+				}
+			}
+			err := t.checkDependencyCycle(ct, nil)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, ct := range t.Containers {
+			seen := map[string]bool{}
+			for c := ct; c.PromoteTo != ""; {
+				if seen[c.Name] {
+					return fmt.Errorf("tenant %q: container %q has a promotion cycle", t.Name, ct.Name)
+				}
+				seen[c.Name] = true
+				next, ok := t.container(c.PromoteTo)
+				if !ok {
+					return fmt.Errorf("tenant %q: container %q promotes to unknown container %q", t.Name, ct.Name, c.PromoteTo)
+				}
+				if next.Repository != ct.Repository {
+					return fmt.Errorf("tenant %q: container %q promotes to %q of another repository", t.Name, ct.Name, next.Name)
+				}
+				c = next
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *ContainerConfig) validateStrategy() error {
+	if _, ok := strategies[c.Strategy]; !ok {
+		return fmt.Errorf("unknown strategy %q", c.Strategy)
+	}
+	switch c.PullOrder {
+	case "", PullBeforeStop, PullAfterStop:
+	default:
+		return fmt.Errorf("unknown pull order %q", c.PullOrder)
+	}
+	if c.KeepOld < 0 {
+		return fmt.Errorf("invalid keep_old %d", c.KeepOld)
+	}
+	if c.Strategy == "" || c.Strategy == "recreate" {
+		return nil
+	}
+
+	if len(c.Ports) > 0 {
+		return fmt.Errorf("strategy %s can't publish ports", c.Strategy)
+	}
+	if c.Network == "" {
+		return fmt.Errorf("strategy %s requires a network", c.Strategy)
+	}
+	switch c.Strategy {
+	case "blue_green":
+		if len(c.NetworkAliases) > 0 {
+			return errors.New("strategy blue_green reaches the container by name, network aliases would route traffic to it before the switch")
+		}
+	case "canary":
+		if c.CanaryDuration == "" {
+			c.CanaryDuration = "5m"
+		}
+		_, err := time.ParseDuration(c.CanaryDuration)
+		if err != nil {
+			return fmt.Errorf("invalid canary duration: %v", err)
+		}
+		fallthrough
+	case "rolling":
+		if len(c.NetworkAliases) == 0 {
+			return fmt.Errorf("strategy %s requires network aliases shared by the old and new container", c.Strategy)
+		}
+	}
+
+	return nil
+}
+
+// checkDependencyCycle fails if the container depends on
+// itself through the containers it depends on
+func (t *TenantConfig) checkDependencyCycle(c ContainerConfig, path []string) error {
+	for _, name := range path {
+		if name == c.Name {
+			return fmt.Errorf("tenant %q: containers have a dependency cycle: %s", t.Name, strings.Join(append(path, c.Name), " -> "))
+		}
+	}
+	for _, name := range c.DependsOn {
+		dep, _ := t.container(name)
+		err := t.checkDependencyCycle(dep, append(path[:len(path):len(path)], c.Name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *TenantConfig) container(name string) (ContainerConfig, bool) {
+	for _, c := range t.Containers {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return ContainerConfig{}, false
+}
+
+// Tenant returns the tenant with the given name
+func (c *Config) Tenant(name string) (*TenantConfig, bool) {
+	for i := range c.Tenants {
+		if c.Tenants[i].Name == name {
+			return &c.Tenants[i], true
+		}
+	}
+	return nil, false
+}
+
+// TenantForToken returns the tenant owning the API token
+// and the role the token grants
+func (c *Config) TenantForToken(token string) (*TenantConfig, Role, bool) {
+	for i := range c.Tenants {
+		for _, t := range c.Tenants[i].APITokens {
+			if subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 {
+				return &c.Tenants[i], t.Role, true
+			}
+		}
+	}
+	return nil, "", false
+}
+
+// HasAPITokens reports whether any tenant has API tokens configured,
+// in which case the management API requires authentication
+func (c *Config) HasAPITokens() bool {
+	for _, t := range c.Tenants {
+		if len(t.APITokens) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// load validates the container and sets what's derived from its
+// configuration, as on the receiver's agents getting it over the wire
+func (ct *ContainerConfig) load() error {
+	if ct.Tag == "" {
+		ct.Tag = "latest"
+	}
+	if ct.SnapshotKeep == 0 {
+		ct.SnapshotKeep = 3
+	}
+	err := ct.validateStrategy()
+	if err != nil {
+		return fmt.Errorf("container %q: %v", ct.Name, err)
+	}
+	switch ct.Engine {
+	case "", EngineDocker, EnginePodman:
+	case EngineNomad:
+		if ct.Nomad == nil {
+			return fmt.Errorf("container %q: engine nomad needs a nomad job", ct.Name)
+		}
+		err := ct.Nomad.validate()
+		if err != nil {
+			return fmt.Errorf("container %q: %v", ct.Name, err)
+		}
+		if ct.Strategy != "" || ct.Host != "" {
+			return fmt.Errorf("container %q: nomad jobs are rolled out by nomad, strategy and host can't be set", ct.Name)
+		}
+	case EnginePlugin:
+		if ct.Strategy != "" || ct.Host != "" {
+			return fmt.Errorf("container %q: plugins deploy containers themselves, strategy and host can't be set", ct.Name)
+		}
+	case EngineArtifact:
+		if ct.Artifact == nil {
+			return fmt.Errorf("container %q: engine artifact needs an artifact", ct.Name)
+		}
+		err := ct.Artifact.validate()
+		if err != nil {
+			return fmt.Errorf("container %q: %v", ct.Name, err)
+		}
+		if ct.Strategy != "" || ct.Host != "" {
+			return fmt.Errorf("container %q: artifacts are extracted on the receiver's host, strategy and host can't be set", ct.Name)
+		}
+	case EngineContainerd:
+	default:
+		return fmt.Errorf("container %q has unknown engine %q", ct.Name, ct.Engine)
+	}
+	if ct.GitHub != nil {
+		err := ct.GitHub.validate()
+		if err != nil {
+			return fmt.Errorf("container %q: %v", ct.Name, err)
+		}
+	}
+	if ct.LoadBalancer != nil {
+		err := ct.LoadBalancer.validate()
+		if err != nil {
+			return fmt.Errorf("container %q: %v", ct.Name, err)
+		}
+	}
+	if ct.Registration != nil {
+		err := ct.Registration.validate(ct.Name)
+		if err != nil {
+			return fmt.Errorf("container %q: %v", ct.Name, err)
+		}
+	}
+	if ct.DNS != nil {
+		err := ct.DNS.validate(ct.Host)
+		if err != nil {
+			return fmt.Errorf("container %q: %v", ct.Name, err)
+		}
+	}
+	for i := range ct.CDNPurge {
+		err := ct.CDNPurge[i].validate()
+		if err != nil {
+			return fmt.Errorf("container %q: %v", ct.Name, err)
+		}
+	}
+	if ct.Release != nil {
+		err := ct.Release.validate()
+		if err != nil {
+			return fmt.Errorf("container %q: %v", ct.Name, err)
+		}
+	}
+	if ct.StatusPage != nil {
+		err := ct.StatusPage.validate()
+		if err != nil {
+			return fmt.Errorf("container %q: %v", ct.Name, err)
+		}
+	}
+	if ct.Forge != nil {
+		err := ct.Forge.validate()
+		if err != nil {
+			return fmt.Errorf("container %q: %v", ct.Name, err)
+		}
+	}
+	if ct.SizeBudget != "" {
+		var err error
+		ct.sizeBudget, err = parseBytes(ct.SizeBudget)
+		if err != nil {
+			return fmt.Errorf("container %q: size budget: %v", ct.Name, err)
+		}
+	}
+	switch ct.OnConflict {
+	case "":
+		ct.OnConflict = ConflictAbort
+	case ConflictAbort, ConflictRename, ConflictAdopt:
+	default:
+		return fmt.Errorf("container %q: unknown conflict resolution %q", ct.Name, ct.OnConflict)
+	}
+	switch ct.OnCertRenewal {
+	case "", CertReload, CertRestart, CertIgnore:
+	default:
+		return fmt.Errorf("container %q: unknown certificate renewal action %q", ct.Name, ct.OnCertRenewal)
+	}
+	if ct.ConfigUpdate != nil {
+		err := ct.ConfigUpdate.validate()
+		if err != nil {
+			return fmt.Errorf("container %q: %v", ct.Name, err)
+		}
+	}
+	if ct.Queue != nil {
+		err := ct.Queue.validate()
+		if err != nil {
+			return fmt.Errorf("container %q: %v", ct.Name, err)
+		}
+	}
+	if ct.Chaos != nil {
+		err := ct.Chaos.validate()
+		if err != nil {
+			return fmt.Errorf("container %q: %v", ct.Name, err)
+		}
+	}
+	if ct.BaseImage != nil {
+		err := ct.BaseImage.validate()
+		if err != nil {
+			return fmt.Errorf("container %q: %v", ct.Name, err)
+		}
+	}
+	for i := range ct.Schedules {
+		err := ct.Schedules[i].validate()
+		if err != nil {
+			return fmt.Errorf("container %q: %v", ct.Name, err)
+		}
+	}
+	for _, pattern := range ct.AllowedPushers {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return fmt.Errorf("container %q: invalid allowed pusher %q", ct.Name, pattern)
+		}
+	}
+	if ct.When != "" {
+		var err error
+		ct.when, err = compileWhen(ct.When)
+		if err != nil {
+			return fmt.Errorf("container %q: %v", ct.Name, err)
+		}
+	}
+	if ct.Platform != "" && strings.Count(ct.Platform, "/") > 1 {
+		return fmt.Errorf("container %q: platform %q is not in the os[/architecture] format", ct.Name, ct.Platform)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// ActionExec is the action of deployments updating the
+// configuration of the running container in place
+const ActionExec = "exec"
+
+// PhaseExec runs the configuration update in the container
+const PhaseExec = Phase("exec")
+
+// CodeExecFailed is used when the configuration update fails
+const CodeExecFailed = ErrorCode("exec_failed")
+
+// ConfigUpdateConfig updates the configuration of the running container
+// in place, by running a command in it instead of recreating it, on
+// pushes signaling a configuration rather than an image change
+type ConfigUpdateConfig struct {
+	// Repository, e.g. of a configuration artifact, whose pushes
+	// signal a configuration change
+	Repository string `json:"repository"`
+	// Tags of the container's repository signaling a configuration
+	// change, as path.Match patterns, e.g. config-*
+	Tags []string `json:"tags"`
+	// Exec is the command run in the container, e.g. ["kill", "-HUP", "1"].
+	// ${REPOSITORY} and ${TAG}, escaped as $${TAG} in the configuration
+	// so they aren't interpolated on load, are replaced with the push.
+	Exec []string `json:"exec"`
+	// User the command is run as, the container's if empty
+	User string `json:"user"`
+	// Timeout of the command, 1m if empty
+	Timeout string `json:"timeout"`
+
+	timeout time.Duration
+}
+
+func (c *ConfigUpdateConfig) validate() error {
+	if len(c.Exec) == 0 {
+		return errors.New("config update: no exec command")
+	}
+	if c.Repository == "" && len(c.Tags) == 0 {
+		return errors.New("config update: needs a repository or tags")
+	}
+	for _, pattern := range c.Tags {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return fmt.Errorf("config update: invalid tag pattern %q", pattern)
+		}
+	}
+	c.timeout = time.Minute
+	if c.Timeout != "" {
+		var err error
+		c.timeout, err = time.ParseDuration(c.Timeout)
+		if err != nil || c.timeout <= 0 {
+			return fmt.Errorf("config update: invalid timeout %q", c.Timeout)
+		}
+	}
+	return nil
+}
+
+// signaledBy reports whether a push of tag to repo signals a
+// configuration change of the container of repository
+func (c *ConfigUpdateConfig) signaledBy(repository, repo, tag string) bool {
+	if c == nil {
+		return false
+	}
+	if c.Repository != "" && repo == c.Repository {
+		return true
+	}
+	if repo != repository {
+		return false
+	}
+	for _, pattern := range c.Tags {
+		if ok, _ := path.Match(pattern, tag); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// enqueuePush enqueues the deploy of a push of tag to repo, which updates
+// the configuration in place if the push signals a configuration change
+func (d *Deployer) enqueuePush(repo, tag string, payload *WebhookPayload) *Deployment {
+	dep := d.enqueue(tag, payload)
+	if d.container.ConfigUpdate.signaledBy(d.container.Repository, repo, tag) {
+		d.mu.Lock()
+		dep.Action = ActionExec
+		dep.Repository = repo
+		d.mu.Unlock()
+	}
+	return dep
+}
+
+// execConfigUpdate runs the configuration update command in the
+// running container, failing the deploy if it exits non-zero
+func (d *Deployer) execConfigUpdate(dep *Deployment) *HookError {
+	cfg := d.container.ConfigUpdate
+	return d.phase(PhaseExec, func() error {
+		vars := map[string]string{"REPOSITORY": dep.Repository, "TAG": dep.Tag}
+		var cmd []string
+		for _, arg := range cfg.Exec {
+			cmd = append(cmd, os.Expand(arg, func(name string) string { return vars[name] }))
+		}
+		d.logger().Printf("Updating the configuration of %q with %v", d.container.Name, cmd)
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.timeout)
+		defer cancel()
+		exec, err := d.client.CreateExec(docker.CreateExecOptions{
+			Container:    d.container.Name,
+			Cmd:          cmd,
+			User:         cfg.User,
+			AttachStdout: true,
+			AttachStderr: true,
+			Context:      ctx,
+		})
+		if err != nil {
+			return serverError(CodeExecFailed, PhaseExec, err)
+		}
+		var output bytes.Buffer
+		err = d.client.StartExec(exec.ID, docker.StartExecOptions{
+			OutputStream: &output,
+			ErrorStream:  &output,
+			Context:      ctx,
+		})
+		if ctx.Err() != nil {
+			err = fmt.Errorf("%v timed out after %s", cmd, cfg.timeout)
+		}
+		out := output.String()
+		if len(out) > maxTestOutput {
+			out = out[len(out)-maxTestOutput:]
+		}
+		dep.ExecOutput = out
+		if err != nil {
+			return serverError(CodeExecFailed, PhaseExec, err)
+		}
+
+		inspect, err := d.client.InspectExec(exec.ID)
+		if err != nil {
+			return serverError(CodeExecFailed, PhaseExec, err)
+		}
+		if inspect.ExitCode != 0 {
+			return serverError(CodeExecFailed, PhaseExec, fmt.Errorf("%v exited with code %d", cmd, inspect.ExitCode))
+		}
+		return nil
+	})
+}
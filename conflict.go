@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// PhaseConflict resolves a name conflict with a
+// container not managed by the receiver
+const PhaseConflict = Phase("conflict")
+
+// CodeNameConflict is used when the name of the container
+// is taken by a container not managed by the receiver
+const CodeNameConflict = ErrorCode("name_conflict")
+
+// Allowed values of the on_conflict of a container
+const (
+	ConflictAbort  = "abort"
+	ConflictRename = "rename"
+	ConflictAdopt  = "adopt"
+)
+
+// Labels of the containers created by the receiver
+const (
+	containerLabel = "docker-webhook-receiver.container"
+	tenantLabel    = "docker-webhook-receiver.tenant"
+)
+
+// managed reports whether the receiver created the container. Containers
+// created before they were labeled are recognized by their image.
+func (d *Deployer) managed(c *docker.Container) bool {
+	if c.Config == nil {
+		return false
+	}
+	if name, ok := c.Config.Labels[containerLabel]; ok {
+		return name == d.container.Name && c.Config.Labels[tenantLabel] == d.tenant
+	}
+	d.mu.Lock()
+	ours := d.imageID != "" && c.Image == d.imageID ||
+		d.baseline != nil && c.ID == d.baseline.ContainerID
+	d.mu.Unlock()
+	if ours {
+		return true
+	}
+	repos := []string{d.repository()}
+	if d.container.Mirror != "" {
+		repos = append(repos, d.mirrorRepository())
+	}
+	for _, repo := range repos {
+		if c.Config.Image == repo || strings.HasPrefix(c.Config.Image, repo+":") || strings.HasPrefix(c.Config.Image, repo+"@") {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveConflict resolves the conflict with the existing container of
+// the same name, if the receiver doesn't manage it, as configured by
+// on_conflict. It returns whether the container is to be replaced.
+func (d *Deployer) resolveConflict(old *docker.Container) (bool, *HookError) {
+	if d.managed(old) {
+		return true, nil
+	}
+	image := old.Config.Image
+	switch d.container.OnConflict {
+	case ConflictAdopt:
+		d.logger().Printf("Adopting container %q running %s, which wasn't created by the receiver", d.container.Name, image)
+		return true, nil
+	case ConflictRename:
+		renamed := d.container.Name + "-conflict-" + strconv.FormatInt(time.Now().Unix(), 10)
+		herr := d.phase(PhaseConflict, func() error {
+			err := d.client.RenameContainer(docker.RenameContainerOptions{ID: old.ID, Name: renamed})
+			if err != nil {
+				return err
+			}
+			// It may hold the host ports of the container
+			err = d.client.StopContainer(old.ID, 10)
+			if _, ok := err.(*docker.ContainerNotRunning); ok {
+				return nil
+			}
+			return err
+		})
+		if herr != nil {
+			return false, herr
+		}
+		d.logger().Printf("Renamed container %q running %s, which wasn't created by the receiver, to %q", d.container.Name, image, renamed)
+		return false, nil
+	default:
+		return false, &HookError{
+			Code: CodeNameConflict,
+			Message: fmt.Sprintf("container %q running %s, created %s, wasn't created by the receiver; "+
+				"remove it, or set on_conflict to rename or adopt to have it replaced", d.container.Name, image, old.Created.Format(time.RFC3339)),
+			Phase:  PhaseConflict,
+			Status: http.StatusConflict,
+		}
+	}
+}
@@ -0,0 +1,741 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// EngineContainerd runs containers with nerdctl, the Docker compatible
+// CLI of containerd, on hosts that don't run dockerd
+const EngineContainerd = "containerd"
+
+// containerdRoot is the data root of containerd, reported as the
+// Docker root dir, as nerdctl doesn't report it
+const containerdRoot = "/var/lib/containerd"
+
+// nerdctlPoll is how often the containers are listed
+// for changes, as containerd doesn't serve Docker events
+var nerdctlPoll = 5 * time.Second
+
+// nerdctlClient implements DockerClient by running nerdctl in a
+// containerd namespace. Docker-compatible inspections are decoded into
+// the same types as the Docker API's.
+type nerdctlClient struct {
+	// address is the containerd socket, nerdctl's default if empty
+	address   string
+	namespace string
+	// run runs nerdctl with the arguments, returning its
+	// stderr in the error if it isn't written to stderr
+	run func(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer, args ...string) error
+
+	mu    sync.Mutex
+	execs map[string]*nerdctlExec
+}
+
+// nerdctlExec is a command created with CreateExec
+type nerdctlExec struct {
+	opts     docker.CreateExecOptions
+	exitCode int
+}
+
+// newNerdctlClient returns a client of the containerd at address,
+// a unix:// endpoint or path, in the namespace, default if empty
+func newNerdctlClient(address, namespace string) (*nerdctlClient, error) {
+	_, err := exec.LookPath("nerdctl")
+	if err != nil {
+		return nil, fmt.Errorf("the containerd engine needs nerdctl: %v", err)
+	}
+	if namespace == "" {
+		namespace = "default"
+	}
+	return &nerdctlClient{
+		address:   strings.TrimPrefix(address, "unix://"),
+		namespace: namespace,
+		run:       runNerdctl,
+		execs:     map[string]*nerdctlExec{},
+	}, nil
+}
+
+// nerdctlError is a failed nerdctl command
+type nerdctlError struct {
+	command string
+	stderr  string
+	err     error
+}
+
+func (e *nerdctlError) Error() string {
+	if e.stderr == "" {
+		return fmt.Sprintf("nerdctl %s: %v", e.command, e.err)
+	}
+	return fmt.Sprintf("nerdctl %s: %s", e.command, e.stderr)
+}
+
+func (e *nerdctlError) Unwrap() error {
+	return e.err
+}
+
+// notFound reports whether the command failed for a missing object
+func (e *nerdctlError) notFound() bool {
+	s := strings.ToLower(e.stderr)
+	return strings.Contains(s, "no such") || strings.Contains(s, "not found")
+}
+
+func runNerdctl(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer, args ...string) error {
+	cmd := exec.CommandContext(ctx, "nerdctl", args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, stdout, stderr
+	var captured bytes.Buffer
+	if stderr == nil {
+		cmd.Stderr = &captured
+	}
+	err := cmd.Run()
+	if err != nil {
+		return &nerdctlError{stderr: strings.TrimSpace(captured.String()), err: err}
+	}
+	return nil
+}
+
+// nerdctl runs the nerdctl command in the namespace, returning its output
+func (c *nerdctlClient) nerdctl(args ...string) ([]byte, error) {
+	var out bytes.Buffer
+	err := c.stream(context.Background(), nil, &out, nil, args...)
+	return out.Bytes(), err
+}
+
+// stream runs the nerdctl command in the namespace with the streams
+func (c *nerdctlClient) stream(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer, args ...string) error {
+	global := []string{"--namespace", c.namespace}
+	if c.address != "" {
+		global = append(global, "--address", c.address)
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	err := c.run(ctx, stdin, stdout, stderr, append(global, args...)...)
+	var nerr *nerdctlError
+	if errors.As(err, &nerr) {
+		nerr.command = args[0]
+	}
+	return err
+}
+
+// notFound reports whether err is a nerdctl command failing for a missing object
+func notFound(err error) bool {
+	var nerr *nerdctlError
+	return errors.As(err, &nerr) && nerr.notFound()
+}
+
+// Endpoint implements DockerClient
+func (c *nerdctlClient) Endpoint() string {
+	return "containerd://" + c.address + "?namespace=" + c.namespace
+}
+
+// AddEventListener implements DockerClient by listing the containers
+// every nerdctlPoll, sending start, die and destroy events for the
+// changes since the last listing
+func (c *nerdctlClient) AddEventListener(listener chan<- *docker.APIEvents) error {
+	last, err := c.inspectAll()
+	if err != nil {
+		return err
+	}
+	go func() {
+		for range time.Tick(nerdctlPoll) {
+			current, err := c.inspectAll()
+			if err != nil {
+				log.Printf("Failed to list the containers of %s: %v", c.Endpoint(), err)
+				continue
+			}
+			for _, ev := range containerChanges(last, current, time.Now()) {
+				listener <- ev
+			}
+			last = current
+		}
+	}()
+	return nil
+}
+
+// containerChanges returns the events of the containers
+// changing from the last listing to the current one
+func containerChanges(last, current []docker.Container, now time.Time) []*docker.APIEvents {
+	before := map[string]docker.Container{}
+	for _, c := range last {
+		before[c.ID] = c
+	}
+	event := func(action string, c docker.Container) *docker.APIEvents {
+		attributes := map[string]string{"name": strings.TrimPrefix(c.Name, "/")}
+		if action == "die" {
+			attributes["exitCode"] = strconv.Itoa(c.State.ExitCode)
+		}
+		return &docker.APIEvents{
+			Type:     "container",
+			Action:   action,
+			Actor:    docker.APIActor{ID: c.ID, Attributes: attributes},
+			Time:     now.Unix(),
+			TimeNano: now.UnixNano(),
+		}
+	}
+
+	var events []*docker.APIEvents
+	for _, c := range current {
+		prev, ok := before[c.ID]
+		delete(before, c.ID)
+		switch {
+		case c.State.Running && (!ok || !prev.State.Running):
+			events = append(events, event("start", c))
+		case !c.State.Running && ok && prev.State.Running:
+			events = append(events, event("die", c))
+		}
+	}
+	for _, c := range last {
+		if _, removed := before[c.ID]; removed {
+			events = append(events, event("destroy", c))
+		}
+	}
+	return events
+}
+
+// inspectAll inspects all containers of the namespace
+func (c *nerdctlClient) inspectAll() ([]docker.Container, error) {
+	out, err := c.nerdctl("ps", "--all", "--quiet", "--no-trunc")
+	if err != nil {
+		return nil, err
+	}
+	ids := strings.Fields(string(out))
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	out, err = c.nerdctl(append([]string{"container", "inspect", "--mode=dockercompat"}, ids...)...)
+	if err != nil {
+		return nil, err
+	}
+	var containers []docker.Container
+	return containers, json.Unmarshal(out, &containers)
+}
+
+// InspectContainer implements DockerClient
+func (c *nerdctlClient) InspectContainer(id string) (*docker.Container, error) {
+	out, err := c.nerdctl("container", "inspect", "--mode=dockercompat", id)
+	if notFound(err) {
+		return nil, &docker.NoSuchContainer{ID: id}
+	}
+	if err != nil {
+		return nil, err
+	}
+	var containers []*docker.Container
+	err = json.Unmarshal(out, &containers)
+	if err != nil {
+		return nil, err
+	}
+	if len(containers) == 0 {
+		return nil, &docker.NoSuchContainer{ID: id}
+	}
+	return containers[0], nil
+}
+
+// CreateContainer implements DockerClient, passing the options
+// nerdctl has flags for. Network aliases are left out.
+func (c *nerdctlClient) CreateContainer(opts docker.CreateContainerOptions) (*docker.Container, error) {
+	if opts.Config == nil {
+		return nil, errors.New("no container config")
+	}
+	out, err := c.nerdctl(createArgs(opts)...)
+	if err != nil {
+		return nil, err
+	}
+	return c.InspectContainer(strings.TrimSpace(string(out)))
+}
+
+// createArgs returns the nerdctl create command of the options
+func createArgs(opts docker.CreateContainerOptions) []string {
+	args := []string{"create"}
+	flag := func(name, value string) {
+		if value != "" {
+			args = append(args, name, value)
+		}
+	}
+	config := opts.Config
+	flag("--name", opts.Name)
+	flag("--user", config.User)
+	flag("--workdir", config.WorkingDir)
+	flag("--hostname", config.Hostname)
+	for _, env := range config.Env {
+		flag("--env", env)
+	}
+	var labels []string
+	for k, v := range config.Labels {
+		labels = append(labels, k+"="+v)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		flag("--label", label)
+	}
+	entrypoint := config.Entrypoint
+	cmd := config.Cmd
+	if len(entrypoint) > 0 {
+		flag("--entrypoint", entrypoint[0])
+		cmd = append(append([]string{}, entrypoint[1:]...), cmd...)
+	}
+	if hc := config.Healthcheck; hc != nil && len(hc.Test) > 0 {
+		switch hc.Test[0] {
+		case "NONE":
+			args = append(args, "--no-healthcheck")
+		case "CMD", "CMD-SHELL":
+			flag("--health-cmd", strings.Join(hc.Test[1:], " "))
+		}
+		if hc.Interval > 0 {
+			flag("--health-interval", hc.Interval.String())
+		}
+		if hc.Timeout > 0 {
+			flag("--health-timeout", hc.Timeout.String())
+		}
+		if hc.Retries > 0 {
+			flag("--health-retries", strconv.Itoa(hc.Retries))
+		}
+	}
+
+	if host := opts.HostConfig; host != nil {
+		var ports []string
+		for port, bindings := range host.PortBindings {
+			for _, b := range bindings {
+				p := b.HostPort + ":" + string(port)
+				if b.HostIP != "" {
+					p = b.HostIP + ":" + p
+				}
+				ports = append(ports, p)
+			}
+		}
+		sort.Strings(ports)
+		for _, p := range ports {
+			flag("--publish", p)
+		}
+		for _, bind := range host.Binds {
+			flag("--volume", bind)
+		}
+		if host.NetworkMode != "default" {
+			flag("--network", host.NetworkMode)
+		}
+		if name := host.RestartPolicy.Name; name != "" && name != "no" {
+			if host.RestartPolicy.MaximumRetryCount > 0 {
+				name += ":" + strconv.Itoa(host.RestartPolicy.MaximumRetryCount)
+			}
+			flag("--restart", name)
+		}
+		if host.Memory > 0 {
+			flag("--memory", strconv.FormatInt(host.Memory, 10))
+		}
+		if host.CPUQuota > 0 && host.CPUPeriod > 0 {
+			flag("--cpus", strconv.FormatFloat(float64(host.CPUQuota)/float64(host.CPUPeriod), 'f', -1, 64))
+		}
+		if host.Privileged {
+			args = append(args, "--privileged")
+		}
+		if host.ReadonlyRootfs {
+			args = append(args, "--read-only")
+		}
+		for _, cap := range host.CapAdd {
+			flag("--cap-add", cap)
+		}
+		for _, cap := range host.CapDrop {
+			flag("--cap-drop", cap)
+		}
+		for _, h := range host.ExtraHosts {
+			flag("--add-host", h)
+		}
+		for _, dns := range host.DNS {
+			flag("--dns", dns)
+		}
+		flag("--log-driver", host.LogConfig.Type)
+		for k, v := range host.LogConfig.Config {
+			flag("--log-opt", k+"="+v)
+		}
+	}
+
+	args = append(args, config.Image)
+	return append(args, cmd...)
+}
+
+// StartContainer implements DockerClient
+func (c *nerdctlClient) StartContainer(id string, hostConfig *docker.HostConfig) error {
+	container, err := c.InspectContainer(id)
+	if err != nil {
+		return err
+	}
+	if container.State.Running {
+		return &docker.ContainerAlreadyRunning{ID: id}
+	}
+	_, err = c.nerdctl("start", id)
+	return err
+}
+
+// StopContainer implements DockerClient
+func (c *nerdctlClient) StopContainer(id string, timeout uint) error {
+	container, err := c.InspectContainer(id)
+	if err != nil {
+		return err
+	}
+	if !container.State.Running {
+		return &docker.ContainerNotRunning{ID: id}
+	}
+	_, err = c.nerdctl("stop", "--time", strconv.Itoa(int(timeout)), id)
+	return err
+}
+
+// RestartContainer implements DockerClient
+func (c *nerdctlClient) RestartContainer(id string, timeout uint) error {
+	_, err := c.nerdctl("restart", "--time", strconv.Itoa(int(timeout)), id)
+	if notFound(err) {
+		return &docker.NoSuchContainer{ID: id}
+	}
+	return err
+}
+
+// KillContainer implements DockerClient
+func (c *nerdctlClient) KillContainer(opts docker.KillContainerOptions) error {
+	container, err := c.InspectContainer(opts.ID)
+	if err != nil {
+		return err
+	}
+	if !container.State.Running {
+		return &docker.ContainerNotRunning{ID: opts.ID}
+	}
+	args := []string{"kill"}
+	if opts.Signal != 0 {
+		args = append(args, "--signal", strconv.Itoa(int(opts.Signal)))
+	}
+	_, err = c.nerdctl(append(args, opts.ID)...)
+	return err
+}
+
+// CreateExec implements DockerClient, keeping the command
+// to run when it is started
+func (c *nerdctlClient) CreateExec(opts docker.CreateExecOptions) (*docker.Exec, error) {
+	_, err := c.InspectContainer(opts.Container)
+	if err != nil {
+		return nil, err
+	}
+	id := newID()
+	c.mu.Lock()
+	c.execs[id] = &nerdctlExec{opts: opts}
+	c.mu.Unlock()
+	return &docker.Exec{ID: id}, nil
+}
+
+// StartExec implements DockerClient, running the command. Like with
+// Docker, it failing is only reported by InspectExec.
+func (c *nerdctlClient) StartExec(id string, opts docker.StartExecOptions) error {
+	c.mu.Lock()
+	e, ok := c.execs[id]
+	c.mu.Unlock()
+	if !ok {
+		return &docker.NoSuchExec{ID: id}
+	}
+
+	args := []string{"exec"}
+	if e.opts.User != "" {
+		args = append(args, "--user", e.opts.User)
+	}
+	if opts.InputStream != nil {
+		args = append(args, "--interactive")
+	}
+	args = append(append(args, e.opts.Container), e.opts.Cmd...)
+	stdout, stderr := opts.OutputStream, opts.ErrorStream
+	if stdout == nil {
+		stdout = io.Discard
+	}
+	if stderr == nil {
+		stderr = io.Discard
+	}
+	err := c.stream(opts.Context, opts.InputStream, stdout, stderr, args...)
+
+	var exitErr interface{ ExitCode() int }
+	if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+		c.mu.Lock()
+		e.exitCode = exitErr.ExitCode()
+		c.mu.Unlock()
+		return nil
+	}
+	return err
+}
+
+// InspectExec implements DockerClient, forgetting the finished command
+func (c *nerdctlClient) InspectExec(id string) (*docker.ExecInspect, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.execs[id]
+	if !ok {
+		return nil, &docker.NoSuchExec{ID: id}
+	}
+	delete(c.execs, id)
+	return &docker.ExecInspect{
+		ID:          id,
+		ExitCode:    e.exitCode,
+		ContainerID: e.opts.Container,
+	}, nil
+}
+
+// RemoveContainer implements DockerClient
+func (c *nerdctlClient) RemoveContainer(opts docker.RemoveContainerOptions) error {
+	args := []string{"rm"}
+	if opts.Force {
+		args = append(args, "--force")
+	}
+	if opts.RemoveVolumes {
+		args = append(args, "--volumes")
+	}
+	_, err := c.nerdctl(append(args, opts.ID)...)
+	if notFound(err) {
+		return &docker.NoSuchContainer{ID: opts.ID}
+	}
+	return err
+}
+
+// RenameContainer implements DockerClient
+func (c *nerdctlClient) RenameContainer(opts docker.RenameContainerOptions) error {
+	_, err := c.nerdctl("rename", opts.ID, opts.Name)
+	if notFound(err) {
+		return &docker.NoSuchContainer{ID: opts.ID}
+	}
+	return err
+}
+
+// ListContainers implements DockerClient. Only the name
+// and label filters are supported.
+func (c *nerdctlClient) ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
+	containers, err := c.inspectAll()
+	if err != nil {
+		return nil, err
+	}
+	var names []*regexp.Regexp
+	for key, values := range opts.Filters {
+		switch key {
+		case "name":
+			for _, v := range values {
+				re, err := regexp.Compile(v)
+				if err != nil {
+					return nil, fmt.Errorf("invalid name filter %q: %v", v, err)
+				}
+				names = append(names, re)
+			}
+		case "label":
+		default:
+			return nil, fmt.Errorf("the containerd engine can't filter containers by %s", key)
+		}
+	}
+
+	var list []docker.APIContainers
+	for _, container := range containers {
+		if !opts.All && !container.State.Running {
+			continue
+		}
+		name := "/" + strings.TrimPrefix(container.Name, "/")
+		if !matchesAll(names, name) || !hasLabels(container.Config, opts.Filters["label"]) {
+			continue
+		}
+		ac := docker.APIContainers{
+			ID:      container.ID,
+			Image:   container.Image,
+			Names:   []string{name},
+			Created: container.Created.Unix(),
+			State:   container.State.StateString(),
+			Status:  container.State.String(),
+		}
+		if container.Config != nil {
+			ac.Image, ac.Labels = container.Config.Image, container.Config.Labels
+		}
+		list = append(list, ac)
+	}
+	return list, nil
+}
+
+// matchesAll reports whether the name matches all of the patterns
+func matchesAll(patterns []*regexp.Regexp, name string) bool {
+	for _, re := range patterns {
+		if !re.MatchString(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasLabels reports whether the config has all label filters,
+// each a label name or name=value
+func hasLabels(config *docker.Config, filters []string) bool {
+	for _, f := range filters {
+		if config == nil {
+			return false
+		}
+		k, v, withValue := strings.Cut(f, "=")
+		got, ok := config.Labels[k]
+		if !ok || withValue && got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// WaitContainer implements DockerClient
+func (c *nerdctlClient) WaitContainer(id string) (int, error) {
+	out, err := c.nerdctl("wait", id)
+	if notFound(err) {
+		return 0, &docker.NoSuchContainer{ID: id}
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(out)))
+}
+
+// Logs implements DockerClient
+func (c *nerdctlClient) Logs(opts docker.LogsOptions) error {
+	args := []string{"logs"}
+	if opts.Follow {
+		args = append(args, "--follow")
+	}
+	if opts.Timestamps {
+		args = append(args, "--timestamps")
+	}
+	if opts.Since > 0 {
+		args = append(args, "--since", time.Unix(opts.Since, 0).UTC().Format(time.RFC3339))
+	}
+	if opts.Tail != "" && opts.Tail != "all" {
+		args = append(args, "--tail", opts.Tail)
+	}
+	stdout, stderr := io.Discard, io.Discard
+	if opts.Stdout && opts.OutputStream != nil {
+		stdout = opts.OutputStream
+	}
+	if opts.Stderr && opts.ErrorStream != nil {
+		stderr = opts.ErrorStream
+	}
+	err := c.stream(opts.Context, nil, stdout, stderr, append(args, opts.Container)...)
+	if opts.Context != nil && opts.Context.Err() != nil {
+		// Stopped following
+		return nil
+	}
+	return err
+}
+
+// InspectImage implements DockerClient
+func (c *nerdctlClient) InspectImage(name string) (*docker.Image, error) {
+	out, err := c.nerdctl("image", "inspect", "--mode=dockercompat", name)
+	if notFound(err) {
+		return nil, docker.ErrNoSuchImage
+	}
+	if err != nil {
+		return nil, err
+	}
+	var images []*docker.Image
+	err = json.Unmarshal(out, &images)
+	if err != nil {
+		return nil, err
+	}
+	if len(images) == 0 {
+		return nil, docker.ErrNoSuchImage
+	}
+	return images[0], nil
+}
+
+// PullImage implements DockerClient. nerdctl logs into registries
+// itself, with nerdctl login on the host, so auth is ignored.
+func (c *nerdctlClient) PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error {
+	ref := opts.Repository
+	if opts.Tag != "" {
+		sep := ":"
+		if strings.HasPrefix(opts.Tag, "sha256:") {
+			sep = "@"
+		}
+		ref += sep + opts.Tag
+	}
+	args := []string{"pull", "--quiet"}
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var stdout io.Writer = io.Discard
+	if opts.OutputStream != nil && !opts.RawJSONStream {
+		stdout = opts.OutputStream
+	}
+	return c.stream(ctx, nil, stdout, nil, append(args, ref)...)
+}
+
+// TagImage implements DockerClient
+func (c *nerdctlClient) TagImage(name string, opts docker.TagImageOptions) error {
+	_, err := c.nerdctl("tag", name, opts.Repo+":"+opts.Tag)
+	if notFound(err) {
+		return docker.ErrNoSuchImage
+	}
+	return err
+}
+
+// LoadImage implements DockerClient, uncompressing
+// gzip compressed archives first
+func (c *nerdctlClient) LoadImage(opts docker.LoadImageOptions) error {
+	r := bufio.NewReader(opts.InputStream)
+	var in io.Reader = r
+	magic, _ := r.Peek(2)
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		in = gz
+	}
+	var stdout io.Writer = io.Discard
+	if opts.OutputStream != nil {
+		stdout = opts.OutputStream
+	}
+	return c.stream(opts.Context, in, stdout, nil, "load")
+}
+
+// Info implements DockerClient, reporting the data root of containerd
+func (c *nerdctlClient) Info() (*docker.DockerInfo, error) {
+	out, err := c.nerdctl("info", "--format", "{{json .}}")
+	if err != nil {
+		return nil, err
+	}
+	info := &docker.DockerInfo{}
+	err = json.Unmarshal(out, info)
+	if err != nil {
+		return nil, err
+	}
+	if info.DockerRootDir == "" {
+		info.DockerRootDir = containerdRoot
+	}
+	return info, nil
+}
+
+// PruneImages implements DockerClient, pruning dangling images.
+// nerdctl doesn't report the space reclaimed.
+func (c *nerdctlClient) PruneImages(opts docker.PruneImagesOptions) (*docker.PruneImagesResults, error) {
+	for key, values := range opts.Filters {
+		if key != "dangling" || len(values) != 1 || values[0] != "true" {
+			return nil, fmt.Errorf("the containerd engine can only prune dangling images")
+		}
+	}
+	_, err := c.nerdctl("image", "prune", "--force")
+	return &docker.PruneImagesResults{}, err
+}
+
+// ExportImage implements DockerClient
+func (c *nerdctlClient) ExportImage(opts docker.ExportImageOptions) error {
+	err := c.stream(opts.Context, nil, opts.OutputStream, nil, "save", opts.Name)
+	if notFound(err) {
+		return docker.ErrNoSuchImage
+	}
+	return err
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// exitError is a command exiting with the code
+type exitError int
+
+func (e exitError) Error() string { return fmt.Sprintf("exit status %d", int(e)) }
+func (e exitError) ExitCode() int { return int(e) }
+
+// fakeNerdctl answers nerdctl commands about one
+// container, app, running or not
+type fakeNerdctl struct {
+	running bool
+	calls   []string
+}
+
+func (f *fakeNerdctl) run(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer, args ...string) error {
+	if len(args) < 2 || args[0] != "--namespace" || args[1] != "prod" {
+		return fmt.Errorf("not run in the namespace: %v", args)
+	}
+	args = args[2:]
+	f.calls = append(f.calls, strings.Join(args, " "))
+	switch strings.Join(args[:2], " ") {
+	case "container inspect":
+		if args[len(args)-1] != "app" {
+			return &nerdctlError{stderr: "no such container: " + args[len(args)-1], err: exitError(1)}
+		}
+		fmt.Fprintf(stdout, `[{"Id": "abc", "Name": "app", "Image": "sha256:1", "Config": {"Image": "example/app:v1", "Labels": {"tenant": "web"}}, "State": {"Running": %v, "ExitCode": 0}}]`, f.running)
+	case "exec app":
+		fmt.Fprintln(stdout, "reloading")
+		return exitError(3)
+	}
+	return nil
+}
+
+func newFakeNerdctlClient(f *fakeNerdctl) *nerdctlClient {
+	return &nerdctlClient{namespace: "prod", run: f.run, execs: map[string]*nerdctlExec{}}
+}
+
+func TestNerdctlClient(t *testing.T) {
+	f := &fakeNerdctl{}
+	c := newFakeNerdctlClient(f)
+
+	container, err := c.InspectContainer("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if container.ID != "abc" || container.Config.Labels["tenant"] != "web" {
+		t.Errorf("got %+v, want the Docker compatible inspection", container)
+	}
+	_, err = c.InspectContainer("gone")
+	if _, ok := err.(*docker.NoSuchContainer); !ok {
+		t.Errorf("inspecting a missing container: got %v, want NoSuchContainer", err)
+	}
+	err = c.StopContainer("app", 10)
+	if _, ok := err.(*docker.ContainerNotRunning); !ok {
+		t.Errorf("stopping a stopped container: got %v, want ContainerNotRunning", err)
+	}
+
+	f.running = true
+	err = c.StopContainer("app", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := f.calls[len(f.calls)-1]; last != "stop --time 10 app" {
+		t.Errorf("got %q, want stop --time 10 app", last)
+	}
+
+	exec, err := c.CreateExec(docker.CreateExecOptions{Container: "app", Cmd: []string{"kill", "-HUP", "1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	err = c.StartExec(exec.ID, docker.StartExecOptions{OutputStream: &out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inspect, err := c.InspectExec(exec.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inspect.ExitCode != 3 || out.String() != "reloading\n" {
+		t.Errorf("exec exited %d with %q, want 3 with its output", inspect.ExitCode, out.String())
+	}
+}
+
+func TestNerdctlCreateArgs(t *testing.T) {
+	args := createArgs(docker.CreateContainerOptions{
+		Name: "app",
+		Config: &docker.Config{
+			Image:      "example/app:v1",
+			Entrypoint: []string{"/bin/app", "--verbose"},
+			Cmd:        []string{"serve"},
+			Env:        []string{"PORT=8080"},
+			Labels:     map[string]string{tenantLabel: "web", containerLabel: "app"},
+		},
+		HostConfig: &docker.HostConfig{
+			PortBindings:  map[docker.Port][]docker.PortBinding{"8080/tcp": {{HostIP: "127.0.0.1", HostPort: "80"}}},
+			Binds:         []string{"/srv/data:/data:ro"},
+			NetworkMode:   "web",
+			RestartPolicy: docker.RestartPolicy{Name: "on-failure", MaximumRetryCount: 3},
+		},
+	})
+	want := []string{
+		"create", "--name", "app", "--env", "PORT=8080",
+		"--label", containerLabel + "=app", "--label", tenantLabel + "=web",
+		"--entrypoint", "/bin/app",
+		"--publish", "127.0.0.1:80:8080/tcp", "--volume", "/srv/data:/data:ro",
+		"--network", "web", "--restart", "on-failure:3",
+		"example/app:v1", "--verbose", "serve",
+	}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("got\n%q\nwant\n%q", args, want)
+	}
+}
+
+func TestNerdctlContainerChanges(t *testing.T) {
+	container := func(id string, running bool, exitCode int) docker.Container {
+		return docker.Container{ID: id, Name: id, State: docker.State{Running: running, ExitCode: exitCode}}
+	}
+	last := []docker.Container{container("app", true, 0), container("worker", true, 0), container("cron", false, 0)}
+	current := []docker.Container{container("app", false, 137), container("cron", true, 0), container("web", true, 0)}
+
+	var got []string
+	for _, ev := range containerChanges(last, current, time.Now()) {
+		got = append(got, ev.Action+" "+ev.Actor.Attributes["name"]+" "+ev.Actor.Attributes["exitCode"])
+	}
+	want := []string{"die app 137", "start cron ", "start web ", "destroy worker "}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// instantiateTemplates replaces the containers of the config tree
+// referring to a template of the top level templates object with the
+// template, its ${name} and ${name:-default} variables replaced by the
+// container's vars, and the container's other fields merged on top.
+// Variables not in vars are left for interpolate.
+func instantiateTemplates(tree interface{}) (interface{}, error) {
+	root, ok := tree.(map[string]interface{})
+	if !ok {
+		return tree, nil
+	}
+	templates, _ := root["templates"].(map[string]interface{})
+	delete(root, "templates")
+
+	tenants, _ := root["tenants"].([]interface{})
+	for _, t := range tenants {
+		tenant, ok := t.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		containers, _ := tenant["containers"].([]interface{})
+		for i, c := range containers {
+			container, ok := c.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			name, ok := container["template"].(string)
+			if !ok {
+				continue
+			}
+			template, ok := templates[name]
+			if !ok {
+				return nil, fmt.Errorf("container %v uses unknown template %q", container["name"], name)
+			}
+			vars, _ := container["vars"].(map[string]interface{})
+			delete(container, "template")
+			delete(container, "vars")
+			containers[i] = mergeJSON(substitute(deepCopyJSON(template), vars), container)
+		}
+	}
+	return root, nil
+}
+
+// substitute replaces the variables of v in all strings of v. A string
+// consisting of a single variable is replaced by its value as is, so
+// numbers, booleans and lists can be passed. The same goes for its
+// default, if valid JSON and the variable isn't in the environment.
+func substitute(v interface{}, vars map[string]interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = substitute(e, vars)
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = substitute(e, vars)
+		}
+	case string:
+		if m := variable.FindStringSubmatchIndex(t); m != nil && m[0] == 0 && m[1] == len(t) && !strings.HasPrefix(t, "$$") {
+			name := t[m[2]:m[3]]
+			if value, ok := vars[name]; ok {
+				return value
+			}
+			var value interface{}
+			if _, ok := os.LookupEnv(name); !ok && m[4] != -1 && json.Unmarshal([]byte(t[m[6]:m[7]]), &value) == nil {
+				return value
+			}
+		}
+		return variable.ReplaceAllStringFunc(t, func(match string) string {
+			m := variable.FindStringSubmatch(match)
+			value, ok := vars[m[1]]
+			// Escaped variables are unescaped by interpolate
+			if !ok || strings.HasPrefix(match, "$$") {
+				return match
+			}
+			if s, ok := value.(string); ok {
+				return s
+			}
+			content, _ := json.Marshal(value)
+			return string(content)
+		})
+	}
+	return v
+}
+
+// deepCopyJSON copies a decoded JSON value, so
+// it can be modified without affecting v
+func deepCopyJSON(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			c[k] = deepCopyJSON(e)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(t))
+		for i, e := range t {
+			c[i] = deepCopyJSON(e)
+		}
+		return c
+	}
+	return v
+}
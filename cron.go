@@ -0,0 +1,339 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Actions of a schedule
+const (
+	ScheduleRedeploy = "redeploy"
+	ScheduleRestart  = "restart"
+)
+
+// ScheduleConfig runs an action on the container on a cron schedule
+type ScheduleConfig struct {
+	// Cron is a standard five field cron expression, e.g. "0 3 * * *"
+	// for every night at 3, or one of @hourly, @daily, @weekly,
+	// @monthly and @yearly
+	Cron string `json:"cron"`
+	// TimeZone the schedule is in, the local one if empty
+	TimeZone string `json:"time_zone"`
+	// Action is redeploy (default), pulling and deploying the
+	// configured tag, or restart, restarting the running container
+	Action string `json:"action"`
+	// SkipIfDeployedWithin, e.g. 6h, skips the action if
+	// the container was deployed that recently
+	SkipIfDeployedWithin string `json:"skip_if_deployed_within"`
+
+	cron     *cronSchedule
+	skipIf   time.Duration
+	location *time.Location
+}
+
+func (c *ScheduleConfig) validate() error {
+	var err error
+	c.cron, err = parseCron(c.Cron)
+	if err != nil {
+		return fmt.Errorf("schedule %q: %v", c.Cron, err)
+	}
+	c.location = time.Local
+	if c.TimeZone != "" {
+		c.location, err = time.LoadLocation(c.TimeZone)
+		if err != nil {
+			return fmt.Errorf("schedule %q: %v", c.Cron, err)
+		}
+	}
+	if c.cron.next(time.Now().In(c.location)).IsZero() {
+		return fmt.Errorf("schedule %q never fires", c.Cron)
+	}
+	switch c.Action {
+	case "":
+		c.Action = ScheduleRedeploy
+	case ScheduleRedeploy, ScheduleRestart:
+	default:
+		return fmt.Errorf("schedule %q: unknown action %q", c.Cron, c.Action)
+	}
+	if c.SkipIfDeployedWithin != "" {
+		c.skipIf, err = time.ParseDuration(c.SkipIfDeployedWithin)
+		if err != nil || c.skipIf < 0 {
+			return fmt.Errorf("schedule %q: invalid skip if deployed within %q", c.Cron, c.SkipIfDeployedWithin)
+		}
+	}
+	return nil
+}
+
+// cronSchedule is a parsed cron expression, with the
+// allowed values of each field set
+type cronSchedule struct {
+	minute, hour, dom, month, dow [61]bool
+	// domAny and dowAny are whether the day fields are *, as a day
+	// matches either of them if both are restricted
+	domAny, dowAny bool
+}
+
+var cronMacros = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+// parseCron parses a five field cron expression
+func parseCron(expr string) (*cronSchedule, error) {
+	if macro, ok := cronMacros[expr]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, errors.New("cron expressions have five fields")
+	}
+	s := &cronSchedule{
+		domAny: fields[2] == "*",
+		dowAny: fields[4] == "*",
+	}
+	for i, f := range []struct {
+		set      *[61]bool
+		min, max int
+	}{
+		{&s.minute, 0, 59},
+		{&s.hour, 0, 23},
+		{&s.dom, 1, 31},
+		{&s.month, 1, 12},
+		{&s.dow, 0, 7},
+	} {
+		err := parseCronField(fields[i], f.set, f.min, f.max)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// 7 is Sunday too
+	if s.dow[7] {
+		s.dow[0] = true
+	}
+	return s, nil
+}
+
+// parseCronField sets the values allowed by the comma
+// separated list of *, n, n-m and either with a /step
+func parseCronField(field string, set *[61]bool, min, max int) error {
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rng = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return fmt.Errorf("invalid step in %q", part)
+			}
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			var err error
+			bounds := strings.SplitN(rng, "-", 2)
+			lo, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				hi, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return fmt.Errorf("invalid value %q", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return nil
+}
+
+// next returns the first time after t the schedule fires,
+// or the zero time if it never does
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// Every schedule fires within 5 years, even on February 29th
+	end := t.AddDate(5, 0, 0)
+	for t.Before(end) {
+		switch {
+		case !s.month[t.Month()]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case !s.hour[t.Hour()]:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case !s.minute[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom, dow := s.dom[t.Day()], s.dow[t.Weekday()]
+	switch {
+	case s.domAny:
+		return dow
+	case s.dowAny:
+		return dom
+	}
+	return dom || dow
+}
+
+// ScheduleStatus is the state of a schedule of a container
+type ScheduleStatus struct {
+	Container string     `json:"container"`
+	Tenant    string     `json:"tenant"`
+	Cron      string     `json:"cron"`
+	Action    string     `json:"action"`
+	Next      time.Time  `json:"next"`
+	LastRun   *time.Time `json:"last_run,omitempty"`
+	// LastResult is success, error or skipped
+	LastResult string `json:"last_result,omitempty"`
+	// LastMessage explains an error or skip
+	LastMessage string `json:"last_message,omitempty"`
+}
+
+// schedule is a schedule of a container, run by the Scheduler
+type schedule struct {
+	d   *Deployer
+	cfg *ScheduleConfig
+
+	mu     sync.Mutex
+	status ScheduleStatus
+}
+
+// Scheduler runs the scheduled actions of the containers
+type Scheduler struct {
+	schedules []*schedule
+}
+
+// NewScheduler returns a scheduler for the schedules of the deployers
+func NewScheduler(deployers Deployers) *Scheduler {
+	s := &Scheduler{}
+	for _, d := range deployers {
+		for i := range d.container.Schedules {
+			cfg := &d.container.Schedules[i]
+			s.schedules = append(s.schedules, &schedule{
+				d:   d,
+				cfg: cfg,
+				status: ScheduleStatus{
+					Container: d.container.Name,
+					Tenant:    d.tenant,
+					Cron:      cfg.Cron,
+					Action:    cfg.Action,
+				},
+			})
+		}
+	}
+	return s
+}
+
+// Run runs every schedule in the background
+func (s *Scheduler) Run() {
+	for _, sc := range s.schedules {
+		go sc.run()
+	}
+}
+
+func (sc *schedule) run() {
+	for {
+		next := sc.cfg.cron.next(time.Now().In(sc.cfg.location))
+		sc.mu.Lock()
+		sc.status.Next = next
+		sc.mu.Unlock()
+		if next.IsZero() {
+			log.Printf("Schedule %q of %q never fires", sc.cfg.Cron, sc.d.container.Name)
+			return
+		}
+		time.Sleep(time.Until(next))
+
+		result, msg := sc.fire()
+		now := time.Now()
+		sc.mu.Lock()
+		sc.status.LastRun = &now
+		sc.status.LastResult, sc.status.LastMessage = result, msg
+		sc.mu.Unlock()
+	}
+}
+
+// fire runs the action, unless the container is being or
+// was recently deployed
+func (sc *schedule) fire() (result, msg string) {
+	d := sc.d
+	if !d.coordinator.Leader() {
+		msg = "not the leader of the HA group"
+		log.Printf("Skipped scheduled %s of %q: %s", sc.cfg.Action, d.container.Name, msg)
+		return "skipped", msg
+	}
+	if d.busy() {
+		msg = "a deploy is in progress"
+		log.Printf("Skipped scheduled %s of %q: %s", sc.cfg.Action, d.container.Name, msg)
+		return "skipped", msg
+	}
+	if _, last := d.Pending(); last != nil && sc.cfg.skipIf > 0 {
+		if since := time.Since(last.FinishedAt); since < sc.cfg.skipIf {
+			msg = fmt.Sprintf("deployed %s ago", since.Round(time.Second))
+			log.Printf("Skipped scheduled %s of %q: %s", sc.cfg.Action, d.container.Name, msg)
+			return "skipped", msg
+		}
+	}
+
+	log.Printf("Running scheduled %s of %q", sc.cfg.Action, d.container.Name)
+	switch sc.cfg.Action {
+	case ScheduleRestart:
+		err := d.restartContainer()
+		if err != nil {
+			log.Printf("Scheduled restart of %q failed: %v", d.container.Name, err)
+			return string(Error), err.Error()
+		}
+	default:
+		herr := d.Deploy(d.container.Tag)
+		if herr != nil {
+			log.Printf("Scheduled redeploy of %q failed: %v", d.container.Name, herr)
+			return string(Error), herr.Message
+		}
+	}
+	return string(Success), ""
+}
+
+// Statuses returns the schedules of the containers of the deployers
+func (s *Scheduler) Statuses(deployers Deployers) []ScheduleStatus {
+	statuses := []ScheduleStatus{}
+	for _, sc := range s.schedules {
+		if _, ok := deployers.Container(sc.d.container.Name); !ok {
+			continue
+		}
+		sc.mu.Lock()
+		statuses = append(statuses, sc.status)
+		sc.mu.Unlock()
+	}
+	return statuses
+}
+
+// SchedulesHandler serves the schedules of the containers on GET /api/schedules
+type SchedulesHandler struct {
+	deployers Deployers
+	scheduler *Scheduler
+}
+
+func (h *SchedulesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.scheduler.Statuses(h.deployers.ForTenant(requestTenant(r))))
+}
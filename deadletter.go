@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxDeadLetters is the number of dead letters kept,
+// the oldest are dropped beyond it
+const maxDeadLetters = 1000
+
+// deadLettersKey is the key of the dead letters in the state store
+const deadLettersKey = "dead-letters.json"
+
+// deadLetterCount is the number of dead letters of each tenant
+var deadLetterCount = NewGaugeVec(
+	"webhook_dead_letters",
+	"Webhooks whose processing failed and that wait to be retried or purged.",
+	"tenant",
+)
+
+// undeadCodes are the errors of webhooks rejected on purpose,
+// which retrying can't fix, so they aren't dead-lettered
+var undeadCodes = []ErrorCode{
+	CodeUnauthorized,
+	CodeUntrustedOrigin,
+	CodeReplayedPayload,
+	CodeUnexpectedPusher,
+	CodeFilterRejected,
+	CodeCoalesced,
+}
+
+// DeadLetter is a webhook whose processing failed, kept with
+// its payload so it can be retried once the problem is fixed
+type DeadLetter struct {
+	ID         string `json:"id"`
+	Tenant     string `json:"tenant"`
+	Repository string `json:"repository,omitempty"`
+	Tag        string `json:"tag,omitempty"`
+	// Attempts counts the deliveries and retries that failed
+	Attempts      int       `json:"attempts"`
+	FirstFailedAt time.Time `json:"first_failed_at"`
+	LastFailedAt  time.Time `json:"last_failed_at"`
+	// Error is the last failure
+	Error *HookError `json:"error"`
+	// Deployments are the deployments of the last attempt
+	Deployments []string        `json:"deployments,omitempty"`
+	Payload     *WebhookPayload `json:"payload"`
+
+	// hash identifies redeliveries of the payload
+	hash string
+}
+
+// DeadLetters are the failed webhooks, persisted in
+// the state store if there is one
+type DeadLetters struct {
+	mu      sync.Mutex
+	store   StateStore
+	letters []*DeadLetter
+	// tenants are those counted, reset to 0 once they have none
+	tenants map[string]bool
+}
+
+// NewDeadLetters loads the dead letters persisted in the
+// store. A nil store keeps them in memory only.
+func NewDeadLetters(store StateStore) (*DeadLetters, error) {
+	q := &DeadLetters{store: store, tenants: map[string]bool{}}
+	if store == nil {
+		return q, nil
+	}
+	content, err := store.Get(deadLettersKey)
+	if err != nil || content == nil {
+		return q, err
+	}
+	err = json.Unmarshal(content, &q.letters)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", deadLettersKey, err)
+	}
+	for _, l := range q.letters {
+		l.hash = payloadHash(l.Payload)
+	}
+	q.count()
+	return q, nil
+}
+
+// payloadHash identifies the payload among those of its tenant
+func payloadHash(payload *WebhookPayload) string {
+	sum := sha256.Sum256([]byte(payload.Tenant + "\x00" + payload.Plugin + "\x00" + payload.Body))
+	return hex.EncodeToString(sum[:])
+}
+
+// Add records the failure to process the webhook. A redelivered
+// payload updates the dead letter of its earlier failure. Webhooks
+// that failed before they were verified aren't kept, as retries skip
+// the verification.
+func (q *DeadLetters) Add(payload *WebhookPayload, hook *DockerHubWebhook, deployments []*Deployment, herr *HookError) {
+	if q == nil || payload.Body == "" || !hook.verified {
+		return
+	}
+	for _, code := range undeadCodes {
+		if herr.Code == code {
+			return
+		}
+	}
+
+	hash := payloadHash(payload)
+	now := time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var letter *DeadLetter
+	for _, l := range q.letters {
+		if l.hash == hash {
+			letter = l
+			break
+		}
+	}
+	if letter == nil {
+		letter = &DeadLetter{
+			ID:            newID(),
+			Tenant:        payload.Tenant,
+			FirstFailedAt: now,
+			Payload:       payload,
+			hash:          hash,
+		}
+		q.letters = append(q.letters, letter)
+		if len(q.letters) > maxDeadLetters {
+			q.letters = q.letters[len(q.letters)-maxDeadLetters:]
+		}
+	}
+	letter.Repository = hook.Repository.RepoName
+	letter.Tag = hook.PushData.Tag
+	letter.Attempts++
+	letter.LastFailedAt = now
+	letter.Error = herr
+	letter.Deployments = deploymentIDs(deployments)
+	log.Printf("Dead-lettered webhook %s for %s:%s after %d failed attempts", letter.ID, letter.Repository, letter.Tag, letter.Attempts)
+	q.save()
+}
+
+// List returns the dead letters of the tenant, oldest first
+func (q *DeadLetters) List(tenant string) []DeadLetter {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	letters := []DeadLetter{}
+	for _, l := range q.letters {
+		if tenant == "" || l.Tenant == tenant {
+			letters = append(letters, *l)
+		}
+	}
+	return letters
+}
+
+// Get returns the dead letter of the tenant
+func (q *DeadLetters) Get(tenant, id string) (DeadLetter, bool) {
+	for _, l := range q.List(tenant) {
+		if l.ID == id {
+			return l, true
+		}
+	}
+	return DeadLetter{}, false
+}
+
+// Remove removes the dead letters of the tenant with the
+// IDs, or all of the tenant's without IDs, returning their number
+func (q *DeadLetters) Remove(tenant string, ids ...string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var kept []*DeadLetter
+	for _, l := range q.letters {
+		if (tenant == "" || l.Tenant == tenant) && (len(ids) == 0 || contains(ids, l.ID)) {
+			continue
+		}
+		kept = append(kept, l)
+	}
+	removed := len(q.letters) - len(kept)
+	q.letters = kept
+	q.save()
+	return removed
+}
+
+// save persists the dead letters and updates their count. q.mu must be held.
+func (q *DeadLetters) save() {
+	q.count()
+	if q.store == nil {
+		return
+	}
+	content, err := json.Marshal(q.letters)
+	if err == nil {
+		err = q.store.Put(deadLettersKey, content)
+	}
+	if err != nil {
+		log.Printf("Failed to save dead letters: %v", err)
+	}
+}
+
+// count updates the metric of the dead letters. q.mu must be held.
+func (q *DeadLetters) count() {
+	counts := map[string]int{}
+	for _, l := range q.letters {
+		counts[l.Tenant]++
+		q.tenants[l.Tenant] = true
+	}
+	for tenant := range q.tenants {
+		deadLetterCount.Set(float64(counts[tenant]), tenant)
+	}
+}
+
+// DeadLettersHandler serves the dead letters of the tenant on GET
+// /api/dead-letters and purges them on DELETE. A single dead letter
+// is served on GET /api/dead-letters/{id}, retried on POST
+// /api/dead-letters/{id}/retry and purged on DELETE.
+type DeadLettersHandler struct {
+	deadLetters *DeadLetters
+	webhooks    *WebhookHandler
+}
+
+func (h *DeadLettersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tenant := requestTenant(r)
+	id := r.PathValue("id")
+	if id == "" {
+		if r.Method == http.MethodDelete {
+			n := h.deadLetters.Remove(tenant)
+			log.Printf("Purged %d dead letters", n)
+			writeJSON(w, http.StatusOK, map[string]int{"purged": n})
+			return
+		}
+		letters := h.deadLetters.List(tenant)
+		sort.Slice(letters, func(i, j int) bool {
+			return letters[i].LastFailedAt.After(letters[j].LastFailedAt)
+		})
+		writeJSON(w, http.StatusOK, letters)
+		return
+	}
+
+	letter, ok := h.deadLetters.Get(tenant, id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case r.Method == http.MethodDelete:
+		h.deadLetters.Remove(tenant, id)
+		log.Printf("Purged dead letter %s", id)
+		writeJSON(w, http.StatusOK, map[string]int{"purged": 1})
+	case r.Method == http.MethodPost:
+		h.retry(w, r, &letter)
+	default:
+		writeJSON(w, http.StatusOK, letter)
+	}
+}
+
+// retry processes the payload of the dead letter again, skipping
+// the Docker Hub callback like replays. It is removed if the retry
+// succeeds, and counts another attempt otherwise.
+func (h *DeadLettersHandler) retry(w http.ResponseWriter, r *http.Request, letter *DeadLetter) {
+	hook := DockerHubWebhook{}
+	deployments, herr := h.webhooks.process(letter.Payload, &hook, true)
+
+	entry := AuditEntry{
+		Remote:      r.RemoteAddr,
+		Tenant:      letter.Tenant,
+		Repository:  hook.Repository.RepoName,
+		Tag:         hook.PushData.Tag,
+		Pusher:      hook.PushData.Pusher,
+		Result:      Success,
+		Deployments: deploymentIDs(deployments),
+	}
+	if herr != nil {
+		entry.Result = Error
+		entry.Error = herr
+	}
+	h.webhooks.audit.Record(entry)
+
+	for _, dep := range deployments {
+		w.Header().Add("X-Deployment-Id", dep.ID)
+	}
+	if herr != nil {
+		h.deadLetters.Add(letter.Payload, &hook, deployments, herr)
+		log.Print(herr)
+		writeError(w, herr)
+		return
+	}
+	h.deadLetters.Remove(letter.Tenant, letter.ID)
+	log.Printf("Retried dead letter %s", letter.ID)
+	writeAck(w, deployments)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDeadLettersKeepVerifiedOnly(t *testing.T) {
+	q, err := NewDeadLetters(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	herr := serverError(CodeDockerError, PhasePull, errors.New("pull failed"))
+
+	forged := &DockerHubWebhook{}
+	forged.Repository.RepoName = "example/app"
+	q.Add(&WebhookPayload{Tenant: DefaultTenant, Body: `{"forged": true}`}, forged, nil, herr)
+	if letters := q.List(DefaultTenant); len(letters) != 0 {
+		t.Fatalf("unverified webhook dead-lettered: %+v", letters)
+	}
+
+	hook := &DockerHubWebhook{verified: true}
+	hook.Repository.RepoName = "example/app"
+	payload := &WebhookPayload{Tenant: DefaultTenant, Body: `{"verified": true}`}
+	q.Add(payload, hook, nil, herr)
+	q.Add(payload, hook, nil, herr)
+	letters := q.List(DefaultTenant)
+	if len(letters) != 1 || letters[0].Attempts != 2 {
+		t.Errorf("got %+v, want one letter after two attempts", letters)
+	}
+}
+
+func TestReadBodyTooLarge(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("x", maxWebhookBody+1)))
+	_, herr := readBody(w, r)
+	if herr == nil || herr.Status != http.StatusRequestEntityTooLarge {
+		t.Errorf("got %+v, want %d", herr, http.StatusRequestEntityTooLarge)
+	}
+
+	r = httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("x", maxWebhookBody)))
+	content, herr := readBody(w, r)
+	if herr != nil || len(content) != maxWebhookBody {
+		t.Errorf("got %d bytes, %v", len(content), herr)
+	}
+}
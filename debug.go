@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// toggleDebug switches logging between the info and debug levels
+func toggleDebug() {
+	level := logrus.DebugLevel
+	if logrus.GetLevel() == logrus.DebugLevel {
+		level = logrus.InfoLevel
+	}
+	logrus.SetLevel(level)
+	log.Printf("Log level set to %s", level)
+}
+
+// handlePprof serves the runtime profiles on /debug/pprof/ to admins
+func handlePprof(router *Router, cfg *Config) {
+	admin := requireRole(cfg, RoleAdmin)
+	router.Handle("GET /debug/pprof/", http.HandlerFunc(pprof.Index), admin)
+	router.Handle("GET /debug/pprof/cmdline", http.HandlerFunc(pprof.Cmdline), admin)
+	router.Handle("GET /debug/pprof/profile", http.HandlerFunc(pprof.Profile), admin)
+	router.Handle("GET /debug/pprof/symbol", http.HandlerFunc(pprof.Symbol), admin)
+	router.Handle("GET /debug/pprof/trace", http.HandlerFunc(pprof.Trace), admin)
+}
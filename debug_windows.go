@@ -0,0 +1,4 @@
+package main
+
+// watchDebugSignal does nothing, as there is no SIGUSR1 on Windows
+func watchDebugSignal() {}
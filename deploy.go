@@ -0,0 +1,795 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// PhaseHealthcheck waits for the new container to become healthy
+const PhaseHealthcheck = Phase("healthcheck")
+
+// CodeUnhealthy is used when the new container never becomes healthy
+const CodeUnhealthy = ErrorCode("unhealthy")
+
+// DockerClient is the part of the Docker API used by the receiver,
+// implemented by *docker.Client
+type DockerClient interface {
+	Endpoint() string
+	AddEventListener(listener chan<- *docker.APIEvents) error
+	InspectContainer(id string) (*docker.Container, error)
+	CreateContainer(opts docker.CreateContainerOptions) (*docker.Container, error)
+	StartContainer(id string, hostConfig *docker.HostConfig) error
+	StopContainer(id string, timeout uint) error
+	RestartContainer(id string, timeout uint) error
+	KillContainer(opts docker.KillContainerOptions) error
+	CreateExec(opts docker.CreateExecOptions) (*docker.Exec, error)
+	StartExec(id string, opts docker.StartExecOptions) error
+	InspectExec(id string) (*docker.ExecInspect, error)
+	RemoveContainer(opts docker.RemoveContainerOptions) error
+	RenameContainer(opts docker.RenameContainerOptions) error
+	ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error)
+	WaitContainer(id string) (int, error)
+	Logs(opts docker.LogsOptions) error
+	InspectImage(name string) (*docker.Image, error)
+	PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error
+	TagImage(name string, opts docker.TagImageOptions) error
+	LoadImage(opts docker.LoadImageOptions) error
+	Info() (*docker.DockerInfo, error)
+	PruneImages(opts docker.PruneImagesOptions) (*docker.PruneImagesResults, error)
+	ExportImage(opts docker.ExportImageOptions) error
+}
+
+// Deployer replaces the running container with one
+// created from the latest image
+type Deployer struct {
+	// client is nil for containers not run by a Docker API
+	client    DockerClient
+	notifier  Notifier
+	tenant    string
+	container ContainerConfig
+	strategy  Strategy
+	// hostOptions are the options of the Docker host
+	hostOptions HostOptions
+	// host is shared by the deployers of the Docker host, if
+	// deploys to it check for pressure
+	host *hostState
+	// group serializes the deploys of the containers
+	// of the concurrency group, if any
+	group *sync.Mutex
+	// rollout stages the deploys of pushes to the repository, if set
+	rollout *RolloutConfig
+
+	// SlowPhase is the duration after which a phase is reported
+	// as slow to the notifier. Zero disables the alert.
+	SlowPhase time.Duration
+	// HealthTimeout is how long to wait for the new
+	// container to become healthy
+	HealthTimeout time.Duration
+	// Chaos injects the faults of the container's chaos configuration
+	Chaos bool
+	// Events receives the lifecycle events of deploys, if set
+	Events *EventStream
+	// Checkpoints persists the progress of deploys, if set
+	Checkpoints *Checkpoints
+	// Baselines persists the baseline of the container once adopted, if set
+	Baselines *Baselines
+	// Pins persists the pin of the container, if set
+	Pins *Pins
+	// State persists the history of the container, if set
+	State StateStore
+	// cordons are the hosts excluded from deploys
+	cordons *Cordons
+	// coordinator locks deploys across the receivers of an HA group, if set
+	coordinator *Coordinator
+	// SBOMs stores the SBOMs of deployed images, if set
+	SBOMs *SBOMStore
+	// Audit records the policy decisions, if set
+	Audit *AuditLog
+	// SLOs measures the finished deploys, if set
+	SLOs   *SLOTracker
+	hooks  []LifecycleHook
+	policy []PolicyRule
+	// policyWebhooks are asked before every deploy
+	policyWebhooks []*PolicyWebhookConfig
+
+	// running serializes deploys of the container
+	running sync.Mutex
+	// progress is the checkpoint of the deploy in progress,
+	// only accessed by the goroutine running it
+	progress *Checkpoint
+
+	mu sync.Mutex
+	// queue holds the deploys in progress or waiting
+	queue   []*Deployment
+	current *Deployment
+	history []*Deployment
+	// imageID is the image the container was last created from
+	imageID string
+	// baseline is the spec of the container when it was adopted, if it was
+	baseline *Baseline
+	// pin holds deploys while the container is pinned
+	pin *Pin
+	// external is the last change to the container
+	// made outside the receiver, if any
+	external *ExternalEvent
+	// drift lists the differences from the configured
+	// spec found by the last drift check
+	drift []string
+	// restarting is set while the receiver restarts the container
+	restarting bool
+	// prepulled are the versions pulled ahead of their
+	// deploys, by when they were pulled
+	prepulled map[string]time.Time
+}
+
+// historySize is the number of deployments kept per container
+const historySize = 50
+
+// Deployment is the outcome of a single deploy
+type Deployment struct {
+	ID         string     `json:"id"`
+	Container  string     `json:"container"`
+	Repository string     `json:"repository"`
+	Tag        string     `json:"tag"`
+	Digest     string     `json:"digest,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt time.Time  `json:"finished_at"`
+	Result     HookState  `json:"result"`
+	Error      *HookError `json:"error,omitempty"`
+	// Action is exec for in-place configuration updates, adopt
+	// for adoptions, empty for deploys of the image
+	Action string `json:"action,omitempty"`
+	// ExecOutput is the output of the configuration
+	// update or the command run after extracting an artifact
+	ExecOutput string `json:"exec_output,omitempty"`
+	// Artifact is the artifact deployed by the artifact engine
+	Artifact *ArtifactRef `json:"artifact,omitempty"`
+
+	// Image is the ID of the deployed image, once pulled
+	Image string `json:"image,omitempty"`
+	// ImageSize is the size of the deployed image in bytes
+	ImageSize int64 `json:"image_size,omitempty"`
+	// ImageLayers is the number of layers of the deployed image
+	ImageLayers int `json:"image_layers,omitempty"`
+	// SBOM describes the SBOM of the deployed image, if fetched
+	SBOM *SBOMInfo `json:"sbom,omitempty"`
+	// PreviousImage is the image the replaced container ran
+	PreviousImage string `json:"previous_image,omitempty"`
+	RolledBack    bool   `json:"rolled_back,omitempty"`
+	// TestOutput is the output of the smoke test container
+	TestOutput string `json:"test_output,omitempty"`
+	// Labels are the OCI labels of the deployed image
+	Labels *ImageLabels `json:"labels,omitempty"`
+	// Commit is the source commit of the image, if labeled
+	Commit *Commit `json:"commit,omitempty"`
+	// Archive is the image archive loaded instead of pulling the image
+	Archive string `json:"archive,omitempty"`
+	// Snapshot is the archive the previous image was saved to
+	Snapshot string `json:"snapshot,omitempty"`
+	// Webhook is the payload that triggered the deploy, if any
+	Webhook *WebhookPayload `json:"-"`
+}
+
+// Finished reports whether the deployment has reached a final result
+func (dep *Deployment) Finished() bool {
+	return dep.Result != Queued && dep.Result != Running
+}
+
+// Deploy redeploys the container in response to a push of tag,
+// waiting for any deploy already in progress to finish first
+func (d *Deployer) Deploy(tag string) *HookError {
+	_, herr := d.run(tag, d.container.Tag, nil)
+	return herr
+}
+
+// run deploys version, a tag or digest of the repository,
+// in response to the webhook payload, if any
+func (d *Deployer) run(tag, version string, payload *WebhookPayload) (*Deployment, *HookError) {
+	dep := d.enqueue(tag, payload)
+	return dep, d.execute(dep, version)
+}
+
+// enqueue registers a deploy of tag, to be run by execute,
+// so it can be looked up while it waits for its turn
+func (d *Deployer) enqueue(tag string, payload *WebhookPayload) *Deployment {
+	dep := &Deployment{
+		ID:         newID(),
+		Container:  d.container.Name,
+		Repository: d.container.Repository,
+		Tag:        tag,
+		Result:     Queued,
+		Webhook:    payload,
+	}
+	d.mu.Lock()
+	d.queue = append(d.queue, dep)
+	d.mu.Unlock()
+	d.overflow(dep)
+	return dep
+}
+
+// execute runs the enqueued deploy of version, waiting for
+// any deploy already in progress to finish first
+func (d *Deployer) execute(dep *Deployment, version string) *HookError {
+	if dep.Archive == "" && dep.Action == "" {
+		d.warmPull(version)
+	}
+	d.running.Lock()
+	defer d.running.Unlock()
+	d.mu.Lock()
+	dropped := dep.Finished()
+	d.mu.Unlock()
+	if dropped {
+		// Dropped or coalesced while it waited
+		return dep.Error
+	}
+	if d.hold(dep, version) {
+		return nil
+	}
+	if herr := d.cordoned(); herr != nil {
+		d.skip(dep, herr)
+		return herr
+	}
+	if d.group != nil {
+		if !d.group.TryLock() {
+			log.WithField("deployment", dep.ID).Printf("Waiting for the deploy of another container of group %q to finish", d.container.Group)
+			d.group.Lock()
+		}
+		defer d.group.Unlock()
+	}
+	unlock, herr := d.lockDeploys()
+	if herr != nil {
+		d.skip(dep, herr)
+		return herr
+	}
+	defer unlock()
+
+	d.mu.Lock()
+	dep.StartedAt = time.Now()
+	dep.Result = Running
+	d.current = dep
+	d.mu.Unlock()
+	logger := log.WithField("deployment", dep.ID)
+	logger.Printf("Deploying %s to %q", d.imageRef(version), d.container.Name)
+	d.Events.Publish(StreamEvent{
+		Event:        EventDeployStarted,
+		Tenant:       d.tenant,
+		Container:    d.container.Name,
+		DeploymentID: dep.ID,
+	})
+	for _, h := range d.hooks {
+		h.DeployStarted(dep)
+	}
+	if d.Checkpoints != nil && dep.Action == "" {
+		d.progress = &Checkpoint{
+			DeploymentID:  dep.ID,
+			Tag:           dep.Tag,
+			Version:       version,
+			PreviousImage: dep.PreviousImage,
+			Archive:       dep.Archive,
+		}
+		d.checkpoint(StepBegun)
+	}
+
+	herr = d.askPolicyWebhooks(dep, version)
+	if herr == nil {
+		herr = d.waitForCapacity()
+		if herr == nil {
+			herr = d.deploy(dep, version)
+			d.releaseCapacity()
+		}
+	}
+	if d.progress != nil {
+		d.progress = nil
+		err := d.Checkpoints.Clear(d.container.Name)
+		if err != nil {
+			logger.Printf("Failed to clear checkpoint of %q: %v", d.container.Name, err)
+		}
+	}
+
+	d.mu.Lock()
+	dep.FinishedAt = time.Now()
+	dep.Result = Success
+	if herr != nil {
+		dep.Result = Error
+		dep.Error = herr
+	}
+	d.current = nil
+	d.deployed(version)
+	for i, q := range d.queue {
+		if q == dep {
+			d.queue = append(d.queue[:i:i], d.queue[i+1:]...)
+			break
+		}
+	}
+	if herr == nil {
+		d.external = nil
+	}
+	d.recordHistory(dep)
+	d.mu.Unlock()
+	d.saveHistory(dep)
+
+	if herr != nil {
+		logger.Printf("Deploy of %q failed: %v", d.container.Name, herr)
+	} else {
+		logger.Printf("Deployed %q", d.container.Name)
+	}
+	d.Events.Publish(StreamEvent{
+		Event:        EventDeployFinished,
+		Tenant:       d.tenant,
+		Container:    d.container.Name,
+		DeploymentID: dep.ID,
+		Deployment:   dep,
+	})
+	for _, h := range d.hooks {
+		h.DeployFinished(dep)
+	}
+	d.SLOs.Record(d.tenant, dep)
+
+	return herr
+}
+
+// deploy runs the strategy, failing the deploy if it panics
+func (d *Deployer) deploy(dep *Deployment, version string) (herr *HookError) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			herr = d.recovered(rec, PhaseInternal)
+		}
+	}()
+	if dep.Action == ActionExec {
+		return d.execConfigUpdate(dep)
+	}
+	return d.strategy.Deploy(d, dep, version)
+}
+
+// Pending returns the number of deploys in progress or waiting
+// and the most recently finished deploy, if any
+func (d *Deployer) Pending() (int, *Deployment) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.history) == 0 {
+		return len(d.queue), nil
+	}
+	return len(d.queue), d.history[len(d.history)-1]
+}
+
+// busy reports whether a deploy is in progress or waiting,
+// or the container is being restarted
+func (d *Deployer) busy() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.queue) > 0 || d.restarting
+}
+
+// restartContainer restarts the running container, without
+// it being reported as changed outside the receiver
+func (d *Deployer) restartContainer() error {
+	d.mu.Lock()
+	d.restarting = true
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		d.restarting = false
+		d.mu.Unlock()
+	}()
+	return d.client.RestartContainer(d.container.Name, 10)
+}
+
+// lookup returns the deployment with the given ID. Deploys that
+// haven't finished are returned as a snapshot of their progress.
+func (d *Deployer) lookup(id string) (*Deployment, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, dep := range d.queue {
+		if dep.ID == id {
+			// Only the fields not written by the strategy
+			// can be read while the deploy is running
+			return &Deployment{
+				ID:         dep.ID,
+				Container:  dep.Container,
+				Repository: dep.Repository,
+				Tag:        dep.Tag,
+				StartedAt:  dep.StartedAt,
+				Result:     dep.Result,
+				Archive:    dep.Archive,
+				Webhook:    dep.Webhook,
+			}, true
+		}
+	}
+	for _, dep := range d.history {
+		if dep.ID == id {
+			return dep, true
+		}
+	}
+	return nil, false
+}
+
+// History returns the finished deployments, oldest first
+func (d *Deployer) History() []*Deployment {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]*Deployment(nil), d.history...)
+}
+
+// repository returns the repository images are pulled from
+func (d *Deployer) repository() string {
+	if d.container.Engine == EnginePodman {
+		return qualifiedRepository(d.container.Repository)
+	}
+	return d.container.Repository
+}
+
+// imageRef returns the reference of version, a tag or digest
+func (d *Deployer) imageRef(version string) string {
+	if strings.HasPrefix(version, "sha256:") {
+		return d.repository() + "@" + version
+	}
+	return d.repository() + ":" + version
+}
+
+// createOptions returns the options used to create the container from image
+func (d *Deployer) createOptions(image string) docker.CreateContainerOptions {
+	return d.createOptionsNamed(d.container.Name, image)
+}
+
+// createOptionsNamed returns the options used to create
+// the container from image under another name
+func (d *Deployer) createOptionsNamed(name, image string) docker.CreateContainerOptions {
+	bindings := map[docker.Port][]docker.PortBinding{}
+	for containerPort, hostPort := range d.container.Ports {
+		bindings[docker.Port(containerPort)] = []docker.PortBinding{
+			{HostPort: hostPort},
+		}
+	}
+
+	opts := docker.CreateContainerOptions{
+		Name: name,
+		Config: &docker.Config{
+			Image:        image,
+			AttachStderr: true,
+			AttachStdout: true,
+			Cmd:          d.container.Cmd,
+			Env:          d.container.Env,
+			Labels: map[string]string{
+				containerLabel: d.container.Name,
+				tenantLabel:    d.tenant,
+			},
+		},
+		HostConfig: &docker.HostConfig{
+			PortBindings: bindings,
+			Binds:        d.container.Mounts,
+		},
+	}
+	if d.container.Network != "" {
+		opts.HostConfig.NetworkMode = d.container.Network
+		opts.NetworkingConfig = &docker.NetworkingConfig{
+			EndpointsConfig: map[string]*docker.EndpointConfig{
+				d.container.Network: {Aliases: d.container.NetworkAliases},
+			},
+		}
+	}
+	if baseline := d.adopted(); baseline != nil {
+		baseline.apply(&opts)
+	}
+
+	return opts
+}
+
+// phase runs fn as the named phase of the deploy, recording
+// how long it took and alerting if it was too slow. A panic
+// fails the phase, so the strategy can still roll back.
+func (d *Deployer) phase(p Phase, fn func() error) *HookError {
+	start := time.Now()
+	err := func() (err error) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				err = d.recovered(rec, p)
+			}
+		}()
+		err = d.injectFault(p)
+		if err != nil {
+			return err
+		}
+		return fn()
+	}()
+	took := time.Since(start)
+
+	id := d.currentID()
+	phaseDuration.Observe(took.Seconds(), string(p))
+	if d.SlowPhase > 0 && took > d.SlowPhase {
+		notify(d.notifier, Notification{
+			Event:        EventSlowPhase,
+			Container:    d.container.Name,
+			DeploymentID: id,
+			Phase:        p,
+			Message:      fmt.Sprintf("Phase %s took %s, exceeding %s", p, took, d.SlowPhase),
+		})
+	}
+
+	herr, ok := err.(*HookError)
+	if !ok && err != nil {
+		herr = serverError(CodeDockerError, p, err)
+	}
+	if step, ok := checkpointSteps[p]; ok && herr == nil {
+		d.checkpoint(step)
+	}
+
+	ev := StreamEvent{
+		Event:        EventPhaseFinished,
+		Tenant:       d.tenant,
+		Container:    d.container.Name,
+		DeploymentID: id,
+		Phase:        p,
+	}
+	if herr != nil {
+		ev.Error = herr.Message
+	}
+	d.Events.Publish(ev)
+
+	return herr
+}
+
+// currentID returns the ID of the deployment in progress, if any
+func (d *Deployer) currentID() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.current == nil {
+		return ""
+	}
+	return d.current.ID
+}
+
+// waitHealthy polls the container until it is running and, if it
+// has a health check, reports healthy
+func (d *Deployer) waitHealthy(id string) error {
+	deadline := time.Now().Add(d.HealthTimeout)
+	for {
+		c, err := d.client.InspectContainer(id)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case !c.State.Running && !c.State.Restarting:
+			return fmt.Errorf("container exited with code %d", c.State.ExitCode)
+		case c.State.Running && (c.State.Health.Status == "" || c.State.Health.Status == "healthy"):
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return errors.New("timed out waiting for container to become healthy")
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// Deployers are the deployers of all managed containers
+type Deployers []*Deployer
+
+// NewDeployers creates a deployer for every container in the configuration,
+// connecting to the Docker daemon each container is configured for.
+// Containers on agent hosts are dispatched through agents, which may
+// be nil if there are none.
+func NewDeployers(cfg *Config, notifier Notifier, agents *AgentHub) (Deployers, error) {
+	clients := map[string]DockerClient{}
+	hosts := map[string]*hostState{}
+	groups := map[string]*sync.Mutex{}
+	var ds Deployers
+	for _, t := range cfg.Tenants {
+		for _, c := range t.Containers {
+			d := &Deployer{
+				notifier:  notifier,
+				tenant:    t.Name,
+				container: c,
+				rollout:   t.rollout(c.Repository),
+			}
+			if c.Group != "" {
+				if groups[c.Group] == nil {
+					groups[c.Group] = &sync.Mutex{}
+				}
+				d.group = groups[c.Group]
+			}
+
+			switch {
+			case c.Engine == EngineNomad:
+				d.strategy = NomadJob{
+					cfg:    c.Nomad,
+					client: &http.Client{Timeout: 30 * time.Second},
+				}
+			case c.Engine == EnginePlugin:
+				p, _ := cfg.Plugin(c.Plugin)
+				d.strategy = PluginStrategy{plugin: p}
+			case c.Engine == EngineArtifact:
+				d.strategy = ArtifactStrategy{cfg: c.Artifact}
+			case strings.HasPrefix(c.Host, agentPrefix):
+				if agents == nil {
+					return nil, fmt.Errorf("container %q runs on %s, but agents are not enabled", c.Name, c.Host)
+				}
+				d.strategy = AgentStrategy{
+					hub:  agents,
+					name: strings.TrimPrefix(c.Host, agentPrefix),
+				}
+			default:
+				key := c.Engine + " " + c.Host + " " + c.Namespace
+				client, ok := clients[key]
+				if !ok {
+					var err error
+					client, err = newDockerClient(c.Host, c.Engine, c.Namespace)
+					if err != nil {
+						return nil, fmt.Errorf("failed to create docker client for %q: %v", c.Host, err)
+					}
+					client = limitPulls(client, c.Host, cfg.HostOptions[c.Host])
+					clients[key] = client
+				}
+				d.client = client
+				d.strategy = strategies[c.Strategy]
+				d.hostOptions = cfg.HostOptions[c.Host]
+				if d.hostOptions.guarded() {
+					if hosts[c.Host] == nil {
+						hosts[c.Host] = &hostState{}
+					}
+					d.host = hosts[c.Host]
+				}
+			}
+
+			if c.GitHub != nil {
+				github, err := NewGitHubReporter(c)
+				if err != nil {
+					return nil, fmt.Errorf("container %q: %v", c.Name, err)
+				}
+				d.hooks = append(d.hooks, github)
+			}
+			if c.Registration != nil {
+				if d.client == nil {
+					return nil, fmt.Errorf("container %q isn't run by a Docker daemon, it can't be registered", c.Name)
+				}
+				d.hooks = append(d.hooks, &ServiceRegistrar{cfg: c.Registration, d: d})
+			}
+			if c.ConfigUpdate != nil && d.client == nil {
+				return nil, fmt.Errorf("container %q isn't run by a Docker daemon, it can't be updated in place", c.Name)
+			}
+			for _, s := range c.Schedules {
+				if s.Action == ScheduleRestart && d.client == nil {
+					return nil, fmt.Errorf("container %q isn't run by a Docker daemon, it can't be restarted on a schedule", c.Name)
+				}
+			}
+			if c.DNS != nil {
+				if c.DNS.SRV != nil && d.client == nil {
+					return nil, fmt.Errorf("container %q isn't run by a Docker daemon, it can't have an SRV record", c.Name)
+				}
+				d.hooks = append(d.hooks, &DNSUpdater{cfg: c.DNS, d: d})
+			}
+			if len(c.CDNPurge) > 0 {
+				d.hooks = append(d.hooks, &CDNPurger{cfgs: c.CDNPurge})
+			}
+			if c.Release != nil {
+				d.hooks = append(d.hooks, &ReleaseTracker{cfg: c.Release})
+			}
+			if c.StatusPage != nil {
+				d.hooks = append(d.hooks, NewStatusPageReporter(c))
+			}
+			if cfg.Alerting != nil {
+				d.hooks = append(d.hooks, NewAlerter(cfg.Alerting, c.Name))
+			}
+			if cfg.Policy != nil {
+				d.policy = cfg.Policy.rulesFor(c.Name)
+				d.policyWebhooks = cfg.Policy.webhooksFor(c.Name)
+			}
+
+			ds = append(ds, d)
+		}
+	}
+
+	return ds, nil
+}
+
+// newDockerClient connects to the Docker API of the engine at host,
+// or the local one if host is empty. Containerd is run through nerdctl
+// in the namespace.
+func newDockerClient(host, engine, namespace string) (DockerClient, error) {
+	if engine == EngineContainerd {
+		return newNerdctlClient(host, namespace)
+	}
+	if host == "" && engine == EnginePodman {
+		var err error
+		host, err = podmanSocket()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if host == "" {
+		return docker.NewClientFromEnv()
+	}
+	return docker.NewClient(host)
+}
+
+// ForTenant returns the deployers of the tenant's containers.
+// An empty tenant returns all deployers.
+func (ds Deployers) ForTenant(tenant string) Deployers {
+	if tenant == "" {
+		return ds
+	}
+	var res Deployers
+	for _, d := range ds {
+		if d.tenant == tenant {
+			res = append(res, d)
+		}
+	}
+	return res
+}
+
+// Container returns the deployer of the named container
+func (ds Deployers) Container(name string) (*Deployer, bool) {
+	for _, d := range ds {
+		if d.container.Name == name {
+			return d, true
+		}
+	}
+	return nil, false
+}
+
+// Deployment returns the deployment with the given ID
+func (ds Deployers) Deployment(id string) (*Deployment, bool) {
+	for _, d := range ds {
+		dep, ok := d.lookup(id)
+		if ok {
+			return dep, true
+		}
+	}
+	return nil, false
+}
+
+// ByClient groups the deployers by the Docker daemon they deploy to
+func (ds Deployers) ByClient() map[DockerClient]Deployers {
+	res := map[DockerClient]Deployers{}
+	for _, d := range ds {
+		res[d.client] = append(res[d.client], d)
+	}
+	return res
+}
+
+// ForRepository returns the deployers of containers
+// running images from the repository
+func (ds Deployers) ForRepository(repo string) Deployers {
+	var res Deployers
+	for _, d := range ds {
+		if d.container.Repository == repo {
+			res = append(res, d)
+		}
+	}
+	return res
+}
+
+// crockford is the base32 alphabet of ULIDs
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newID returns a ULID, a random deployment ID that sorts by creation
+// time, so it can be used to correlate a deploy across the logs,
+// notifications, audit log and API
+func newID() string {
+	var b [16]byte
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	for i := 0; i < 6; i++ {
+		b[i] = byte(ms >> uint(40-8*i))
+	}
+	_, err := rand.Read(b[6:])
+	if err != nil {
+		panic(err)
+	}
+
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+	var id [26]byte
+	for i := len(id) - 1; i >= 0; i-- {
+		id[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(id[:])
+}
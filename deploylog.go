@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Limits of the deploy logs kept in memory
+const (
+	deployLogsKept    = 500
+	deployLogMaxLines = 2000
+)
+
+// DeployLogLine is a line logged during a deploy
+type DeployLogLine struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"message"`
+}
+
+// DeployLogs is a logrus hook capturing the lines logged with a
+// deployment field, so the log of a deploy can be served by the API.
+// The logs of the last deploys are kept in memory and, if a directory
+// is set, appended to a file per deploy in it.
+type DeployLogs struct {
+	dir string
+
+	mu    sync.Mutex
+	lines map[string][]DeployLogLine
+	// order lists the deployments in memory, oldest first
+	order []string
+}
+
+// NewDeployLogs returns the hook, persisting the logs in dir if not empty
+func NewDeployLogs(dir string) (*DeployLogs, error) {
+	if dir != "" {
+		err := os.MkdirAll(dir, 0o755)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &DeployLogs{
+		dir:   dir,
+		lines: map[string][]DeployLogLine{},
+	}, nil
+}
+
+// Levels implements logrus.Hook
+func (l *DeployLogs) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire implements logrus.Hook
+func (l *DeployLogs) Fire(entry *logrus.Entry) error {
+	id, ok := entry.Data["deployment"].(string)
+	if !ok || id == "" {
+		return nil
+	}
+	line := DeployLogLine{
+		Time:    entry.Time,
+		Level:   entry.Level.String(),
+		Message: entry.Message,
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lines, ok := l.lines[id]
+	if !ok {
+		l.order = append(l.order, id)
+		if len(l.order) > deployLogsKept {
+			delete(l.lines, l.order[0])
+			l.order = l.order[1:]
+		}
+	}
+	if len(lines) < deployLogMaxLines {
+		l.lines[id] = append(lines, line)
+	}
+
+	if l.dir == "" {
+		return nil
+	}
+	// Logging the failure would recurse
+	f, err := os.OpenFile(l.path(id), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(&line)
+}
+
+func (l *DeployLogs) path(id string) string {
+	return filepath.Join(l.dir, filepath.Base(id)+".log")
+}
+
+// Get returns the log of the deployment, reading it from
+// its file if it is no longer in memory
+func (l *DeployLogs) Get(id string) ([]DeployLogLine, error) {
+	l.mu.Lock()
+	lines, ok := l.lines[id]
+	lines = append([]DeployLogLine(nil), lines...)
+	l.mu.Unlock()
+	if ok || l.dir == "" {
+		return lines, nil
+	}
+
+	f, err := os.Open(l.path(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var line DeployLogLine
+		err := json.Unmarshal(scanner.Bytes(), &line)
+		if err != nil {
+			return nil, fmt.Errorf("corrupt log of %s: %v", id, err)
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// logger returns the logger of the container, tagged with its
+// repository and the deployment in progress, if any
+func (d *Deployer) logger() *logrus.Entry {
+	fields := logrus.Fields{
+		"container":  d.container.Name,
+		"repository": d.container.Repository,
+	}
+	if id := d.currentID(); id != "" {
+		fields["deployment"] = id
+	}
+	return log.WithFields(fields)
+}
+
+// DeployLogHandler serves the lines logged during a deploy
+// on GET /api/deployments/{id}/log
+type DeployLogHandler struct {
+	deployers Deployers
+	logs      *DeployLogs
+}
+
+func (h *DeployLogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	// Deployments no longer in the history are only served unscoped
+	tenant := requestTenant(r)
+	if _, ok := h.deployers.ForTenant(tenant).Deployment(id); !ok && tenant != "" {
+		http.NotFound(w, r)
+		return
+	}
+	lines, err := h.logs.Get(id)
+	if err != nil {
+		writeError(w, serverError(CodeInternal, PhaseInternal, err))
+		return
+	}
+	if lines == nil {
+		if _, ok := h.deployers.Deployment(id); !ok {
+			http.NotFound(w, r)
+			return
+		}
+		lines = []DeployLogLine{}
+	}
+	writeJSON(w, http.StatusOK, lines)
+}
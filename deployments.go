@@ -0,0 +1,198 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+// HistoryHandler serves the deployment history of the
+// tenant's containers, most recent first
+type HistoryHandler struct {
+	deployers Deployers
+}
+
+func (h *HistoryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	deployments := []*Deployment{}
+	for _, d := range h.deployers.ForTenant(requestTenant(r)) {
+		deployments = append(deployments, d.SharedHistory()...)
+	}
+	sort.Slice(deployments, func(i, j int) bool {
+		return deployments[i].StartedAt.After(deployments[j].StartedAt)
+	})
+
+	writeJSON(w, http.StatusOK, deployments)
+}
+
+// TriggerHandler redeploys a container on
+// POST /api/containers/{name}/deploy
+type TriggerHandler struct {
+	deployers Deployers
+	audit     *AuditLog
+}
+
+func (h *TriggerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d, ok := h.deployers.ForTenant(requestTenant(r)).Container(r.PathValue("name"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	herr := d.queueFull()
+	if herr == nil {
+		herr = d.Deploy(d.container.Tag)
+	}
+
+	entry := AuditEntry{
+		Remote:     r.RemoteAddr,
+		Tenant:     d.tenant,
+		Repository: d.container.Repository,
+		Tag:        d.container.Tag,
+		Result:     Success,
+	}
+	if herr != nil {
+		entry.Result = Error
+		entry.Error = herr
+	}
+	h.audit.Record(entry)
+
+	if herr != nil {
+		log.Print(herr)
+		writeError(w, herr)
+		return
+	}
+
+	_, last := d.Pending()
+	writeJSON(w, http.StatusOK, last)
+}
+
+// ReplayHandler re-runs the webhook that triggered a deployment on
+// POST /api/deployments/{id}/replay, skipping the Docker Hub callback
+type ReplayHandler struct {
+	deployers Deployers
+	webhooks  *WebhookHandler
+}
+
+func (h *ReplayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	dep, ok := h.deployers.ForTenant(requestTenant(r)).Deployment(r.PathValue("id"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if dep.Webhook == nil {
+		http.Error(w, "deployment was not triggered by a webhook", http.StatusConflict)
+		return
+	}
+
+	hook := DockerHubWebhook{}
+	deployments, herr := h.webhooks.process(dep.Webhook, &hook, true)
+
+	entry := AuditEntry{
+		Remote:      r.RemoteAddr,
+		Tenant:      dep.Webhook.Tenant,
+		Repository:  hook.Repository.RepoName,
+		Tag:         hook.PushData.Tag,
+		Pusher:      hook.PushData.Pusher,
+		Result:      Success,
+		ReplayOf:    dep.ID,
+		Deployments: deploymentIDs(deployments),
+	}
+	if herr != nil {
+		entry.Result = Error
+		entry.Error = herr
+	}
+	h.webhooks.audit.Record(entry)
+
+	for _, dep := range deployments {
+		w.Header().Add("X-Deployment-Id", dep.ID)
+	}
+	if herr != nil {
+		log.Print(herr)
+		writeError(w, herr)
+		return
+	}
+
+	writeAck(w, deployments)
+}
+
+// DeploymentHandler serves a single deployment, including
+// unfinished ones, on GET /api/deployments/{id}
+type DeploymentHandler struct {
+	deployers Deployers
+}
+
+func (h *DeploymentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	dep, ok := h.deployers.ForTenant(requestTenant(r)).Deployment(r.PathValue("id"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, dep)
+}
+
+// maxWait bounds the timeout of the wait endpoint
+const maxWait = 30 * time.Minute
+
+// WaitHandler serves a deployment once it has finished on
+// GET /api/deployments/{id}/wait?timeout=300s, so CI jobs can gate
+// on a rollout. Deployments not finished within the timeout (5m by
+// default) are served as they are with 202 Accepted.
+type WaitHandler struct {
+	deployers Deployers
+	events    *EventStream
+}
+
+func (h *WaitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	timeout := 5 * time.Minute
+	if t := r.URL.Query().Get("timeout"); t != "" {
+		var err error
+		timeout, err = time.ParseDuration(t)
+		if err != nil || timeout < 0 {
+			http.Error(w, "invalid timeout", http.StatusBadRequest)
+			return
+		}
+		if timeout > maxWait {
+			timeout = maxWait
+		}
+	}
+
+	// Subscribe before the lookup so the end of the deploy can't be missed
+	events, cancel := h.events.Subscribe(requestTenant(r))
+	defer cancel()
+
+	id := r.PathValue("id")
+	deployers := h.deployers.ForTenant(requestTenant(r))
+	dep, ok := deployers.Deployment(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	// The stream drops events for slow subscribers, so look
+	// the deployment up again every now and then
+	recheck := time.NewTicker(5 * time.Second)
+	defer recheck.Stop()
+	for !dep.Finished() {
+		select {
+		case ev := <-events:
+			if ev.Event != EventDeployFinished || ev.DeploymentID != id {
+				continue
+			}
+			dep = ev.Deployment
+		case <-recheck.C:
+			if latest, ok := deployers.Deployment(id); ok {
+				dep = latest
+			}
+		case <-deadline.C:
+			writeJSON(w, http.StatusAccepted, dep)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, dep)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// ImageDiff is what changed between the image a deploy replaced
+// and the one it deployed
+type ImageDiff struct {
+	Previous *ImageInfo `json:"previous"`
+	Current  *ImageInfo `json:"current"`
+	// SizeChange is the growth of the image in bytes
+	SizeChange   int64         `json:"size_change"`
+	Labels       []ValueChange `json:"labels,omitempty"`
+	Env          []ValueChange `json:"env,omitempty"`
+	PortsAdded   []string      `json:"ports_added,omitempty"`
+	PortsRemoved []string      `json:"ports_removed,omitempty"`
+}
+
+// ImageInfo describes one side of an ImageDiff
+type ImageInfo struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	Size    int64     `json:"size"`
+}
+
+// ValueChange is a label or environment variable that was added,
+// removed or changed. Old is empty for added values, New for removed ones.
+type ValueChange struct {
+	Name string `json:"name"`
+	Old  string `json:"old,omitempty"`
+	New  string `json:"new,omitempty"`
+}
+
+// diffImages compares the configuration of two images
+func diffImages(prev, cur *docker.Image) *ImageDiff {
+	diff := &ImageDiff{
+		Previous:   &ImageInfo{ID: prev.ID, Created: prev.Created, Size: prev.Size},
+		Current:    &ImageInfo{ID: cur.ID, Created: cur.Created, Size: cur.Size},
+		SizeChange: cur.Size - prev.Size,
+	}
+	prevConfig, curConfig := prev.Config, cur.Config
+	if prevConfig == nil {
+		prevConfig = &docker.Config{}
+	}
+	if curConfig == nil {
+		curConfig = &docker.Config{}
+	}
+	diff.Labels = diffValues(prevConfig.Labels, curConfig.Labels)
+	diff.Env = diffValues(envMap(prevConfig.Env), envMap(curConfig.Env))
+	for port := range curConfig.ExposedPorts {
+		if _, ok := prevConfig.ExposedPorts[port]; !ok {
+			diff.PortsAdded = append(diff.PortsAdded, string(port))
+		}
+	}
+	for port := range prevConfig.ExposedPorts {
+		if _, ok := curConfig.ExposedPorts[port]; !ok {
+			diff.PortsRemoved = append(diff.PortsRemoved, string(port))
+		}
+	}
+	sort.Strings(diff.PortsAdded)
+	sort.Strings(diff.PortsRemoved)
+	return diff
+}
+
+// diffValues returns the changes from prev to cur, sorted by name
+func diffValues(prev, cur map[string]string) []ValueChange {
+	var changes []ValueChange
+	for name, value := range cur {
+		if old, ok := prev[name]; !ok || old != value {
+			changes = append(changes, ValueChange{Name: name, Old: old, New: value})
+		}
+	}
+	for name, old := range prev {
+		if _, ok := cur[name]; !ok {
+			changes = append(changes, ValueChange{Name: name, Old: old})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+	return changes
+}
+
+// envMap parses NAME=value environment variables
+func envMap(env []string) map[string]string {
+	res := map[string]string{}
+	for _, e := range env {
+		name, value, _ := strings.Cut(e, "=")
+		res[name] = value
+	}
+	return res
+}
+
+// deployerOf returns the deployment and the deployer that ran it
+func (ds Deployers) deployerOf(id string) (*Deployer, *Deployment, bool) {
+	for _, d := range ds {
+		dep, ok := d.lookup(id)
+		if ok {
+			return d, dep, true
+		}
+	}
+	return nil, nil, false
+}
+
+// DiffHandler serves the changes between the image a deployment
+// replaced and the one it deployed on GET /api/deployments/{id}/diff
+type DiffHandler struct {
+	deployers Deployers
+}
+
+func (h *DiffHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d, dep, ok := h.deployers.ForTenant(requestTenant(r)).deployerOf(r.PathValue("id"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if d.client == nil {
+		http.Error(w, "container is not run by a Docker daemon the receiver talks to", http.StatusConflict)
+		return
+	}
+	if dep.PreviousImage == "" || dep.Image == "" {
+		http.Error(w, "deployment has no previous or new image", http.StatusConflict)
+		return
+	}
+
+	prev, err := d.client.InspectImage(dep.PreviousImage)
+	if err == nil {
+		var cur *docker.Image
+		cur, err = d.client.InspectImage(dep.Image)
+		if err == nil {
+			writeJSON(w, http.StatusOK, diffImages(prev, cur))
+			return
+		}
+	}
+	if err == docker.ErrNoSuchImage {
+		http.Error(w, "image was removed from the host", http.StatusGone)
+		return
+	}
+	writeError(w, serverError(CodeDockerError, PhaseInternal, err))
+}
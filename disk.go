@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// PhasePreflight checks the host can take the deploy before pulling
+const PhasePreflight = Phase("preflight")
+
+// CodeLowDisk is used when the Docker data root is too full to pull
+const CodeLowDisk = ErrorCode("low_disk")
+
+// EventLowDisk is sent when a deploy is refused for lack of disk space
+const EventLowDisk = Event("low_disk")
+
+// freeDiskBytes is the free space of the Docker data root by host
+var freeDiskBytes = NewGaugeVec(
+	"webhook_docker_free_disk_bytes",
+	"Free space of the Docker data root, as of the last deploy.",
+	"host",
+)
+
+// parseBytes parses a size like 512MB or 5GB, in powers of 1024
+func parseBytes(size string) (uint64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "IB"), "B")
+	multiplier := uint64(1)
+	if n := len(s); n > 0 {
+		if i := strings.IndexByte("KMGT", s[n-1]); i >= 0 {
+			multiplier = 1 << (10 * uint(i+1))
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return uint64(n * float64(multiplier)), nil
+}
+
+// checkDisk refuses the deploy if the Docker data root has less
+// free space than configured for the host, pruning dangling
+// images first if allowed
+func (d *Deployer) checkDisk() *HookError {
+	if d.hostOptions.minFreeDisk == 0 {
+		return nil
+	}
+	return d.phase(PhasePreflight, func() error {
+		free, err := d.freeDisk()
+		if err != nil {
+			return err
+		}
+		if free < d.hostOptions.minFreeDisk && d.hostOptions.PruneOnLowDisk {
+			d.logger().Printf("Only %d MiB free on the Docker host of %q, pruning dangling images", free>>20, d.container.Name)
+			_, err := d.client.PruneImages(docker.PruneImagesOptions{
+				Filters: map[string][]string{"dangling": {"true"}},
+			})
+			if err != nil {
+				d.logger().Printf("Failed to prune images: %v", err)
+			}
+			free, err = d.freeDisk()
+			if err != nil {
+				return err
+			}
+		}
+		if free >= d.hostOptions.minFreeDisk {
+			return nil
+		}
+
+		herr := serverError(CodeLowDisk, PhasePreflight, fmt.Errorf("only %d MiB free on the Docker data root, %s required", free>>20, d.hostOptions.MinFreeDisk))
+		notify(d.notifier, Notification{
+			Event:        EventLowDisk,
+			Container:    d.container.Name,
+			DeploymentID: d.currentID(),
+			Phase:        PhasePreflight,
+			Message:      fmt.Sprintf("Deploy of %s refused: %s", d.container.Name, herr.Message),
+		})
+		return herr
+	})
+}
+
+// freeDisk returns the free space of the Docker data root, as
+// seen by the receiver at the configured data root path or the
+// one reported by the daemon
+func (d *Deployer) freeDisk() (uint64, error) {
+	path := d.hostOptions.DataRoot
+	if path == "" {
+		info, err := d.client.Info()
+		if err != nil {
+			return 0, err
+		}
+		path = info.DockerRootDir
+	}
+	free, err := freeDiskSpace(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to check free space of %s: %v", path, err)
+	}
+	freeDiskBytes.Set(float64(free), d.container.Host)
+	return free, nil
+}
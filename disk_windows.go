@@ -0,0 +1,8 @@
+package main
+
+import "errors"
+
+// freeDiskSpace is not implemented on Windows
+func freeDiskSpace(path string) (uint64, error) {
+	return 0, errors.New("checking free disk space is not supported on windows")
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// DNSConfig is the DNS record pointed at the container after every deploy
+type DNSConfig struct {
+	// Type is cloudflare, route53 or rfc2136
+	Type string `json:"type"`
+	// Name is the fully qualified name of the record
+	Name string `json:"name"`
+	// Address the A or AAAA record points at, the host of the
+	// container's Docker daemon if empty
+	Address string `json:"address"`
+	// SRV makes the record an SRV record instead
+	SRV *SRVConfig `json:"srv"`
+	// TTL of the record, 60 seconds if zero
+	TTL int `json:"ttl"`
+
+	Cloudflare *CloudflareDNSConfig `json:"cloudflare"`
+	Route53    *Route53Config       `json:"route53"`
+	RFC2136    *RFC2136Config       `json:"rfc2136"`
+}
+
+// SRVConfig points an SRV record at the port a container port is published on
+type SRVConfig struct {
+	// Target is the host name the port is published on
+	Target        string `json:"target"`
+	ContainerPort int    `json:"container_port"`
+}
+
+// CloudflareDNSConfig is a zone managed by Cloudflare
+type CloudflareDNSConfig struct {
+	ZoneID string `json:"zone_id"`
+	// Token is an API token allowed to edit the zone's
+	// DNS, CLOUDFLARE_API_TOKEN if empty
+	Token   string `json:"token"`
+	Proxied bool   `json:"proxied"`
+}
+
+// Route53Config is a zone hosted by AWS Route 53
+type Route53Config struct {
+	HostedZoneID string         `json:"hosted_zone_id"`
+	Credentials  AWSCredentials `json:"credentials"`
+}
+
+func (c *DNSConfig) validate(host string) error {
+	if c.Name == "" {
+		return errors.New("dns needs a name")
+	}
+	if c.TTL == 0 {
+		c.TTL = 60
+	}
+	if c.SRV != nil {
+		if c.SRV.Target == "" || c.SRV.ContainerPort <= 0 {
+			return errors.New("dns srv needs a target and container port")
+		}
+	} else if c.Address == "" {
+		u, err := url.Parse(host)
+		if err != nil || u.Scheme == "unix" || u.Hostname() == "" {
+			return errors.New("dns needs an address for containers on the local Docker daemon")
+		}
+		c.Address = u.Hostname()
+	}
+
+	switch c.Type {
+	case "cloudflare":
+		if c.Cloudflare == nil || c.Cloudflare.ZoneID == "" {
+			return errors.New("dns cloudflare needs a zone id")
+		}
+		if c.Cloudflare.Token == "" {
+			c.Cloudflare.Token = os.Getenv("CLOUDFLARE_API_TOKEN")
+		}
+		if c.Cloudflare.Token == "" {
+			return errors.New("dns cloudflare needs a token")
+		}
+	case "route53":
+		if c.Route53 == nil || c.Route53.HostedZoneID == "" {
+			return errors.New("dns route53 needs a hosted zone id")
+		}
+		return c.Route53.Credentials.validate()
+	case "rfc2136":
+		if c.RFC2136 == nil || c.RFC2136.Server == "" || c.RFC2136.Zone == "" {
+			return errors.New("dns rfc2136 needs a server and zone")
+		}
+		return c.RFC2136.validate()
+	default:
+		return fmt.Errorf("unknown dns type %q", c.Type)
+	}
+	return nil
+}
+
+// dnsRecord is the content of a record
+type dnsRecord struct {
+	// Type is A, AAAA or SRV
+	Type string
+	// Value is the IP of A and AAAA records
+	// and the target of SRV records
+	Value string
+	Port  int
+}
+
+// String formats the record as in zone files
+func (r dnsRecord) String() string {
+	if r.Type == "SRV" {
+		return fmt.Sprintf("0 0 %d %s.", r.Port, strings.TrimSuffix(r.Value, "."))
+	}
+	return r.Value
+}
+
+// DNSUpdater points the DNS record at the container
+// after every successful deploy
+type DNSUpdater struct {
+	cfg *DNSConfig
+	d   *Deployer
+}
+
+// DeployStarted implements LifecycleHook
+func (u *DNSUpdater) DeployStarted(*Deployment) {}
+
+// DeployFinished implements LifecycleHook
+func (u *DNSUpdater) DeployFinished(dep *Deployment) {
+	if dep.Result != Success {
+		return
+	}
+	go func() {
+		record, err := u.record()
+		if err == nil {
+			err = u.update(record)
+		}
+		if err != nil {
+			log.WithField("deployment", dep.ID).Printf("Failed to update DNS record %s: %v", u.cfg.Name, err)
+			return
+		}
+		log.WithField("deployment", dep.ID).Printf("Pointed DNS record %s at %s", u.cfg.Name, record)
+	}()
+}
+
+// record returns the record pointing at the running container
+func (u *DNSUpdater) record() (dnsRecord, error) {
+	if u.cfg.SRV == nil {
+		ip := net.ParseIP(u.cfg.Address)
+		if ip == nil {
+			ips, err := net.LookupIP(u.cfg.Address)
+			if err != nil {
+				return dnsRecord{}, err
+			}
+			ip = ips[0]
+		}
+		if ip.To4() != nil {
+			return dnsRecord{Type: "A", Value: ip.String()}, nil
+		}
+		return dnsRecord{Type: "AAAA", Value: ip.String()}, nil
+	}
+
+	c, err := u.d.client.InspectContainer(u.d.container.Name)
+	if err != nil {
+		return dnsRecord{}, err
+	}
+	port := docker.Port(strconv.Itoa(u.cfg.SRV.ContainerPort) + "/tcp")
+	if c.NetworkSettings == nil || len(c.NetworkSettings.Ports[port]) == 0 {
+		return dnsRecord{}, fmt.Errorf("container port %s isn't published", port)
+	}
+	hostPort, err := strconv.Atoi(c.NetworkSettings.Ports[port][0].HostPort)
+	if err != nil {
+		return dnsRecord{}, err
+	}
+	return dnsRecord{Type: "SRV", Value: u.cfg.SRV.Target, Port: hostPort}, nil
+}
+
+func (u *DNSUpdater) update(record dnsRecord) error {
+	switch u.cfg.Type {
+	case "cloudflare":
+		return u.cfg.Cloudflare.update(u.cfg.Name, u.cfg.TTL, record)
+	case "route53":
+		return u.cfg.Route53.update(u.cfg.Name, u.cfg.TTL, record)
+	default:
+		return u.cfg.RFC2136.update(u.cfg.Name, u.cfg.TTL, record)
+	}
+}
+
+var cloudflareClient = &http.Client{Timeout: 30 * time.Second}
+
+// update replaces the record with the name and type of the
+// record, creating it if there is none
+func (c *CloudflareDNSConfig) update(name string, ttl int, record dnsRecord) error {
+	base := "https://api.cloudflare.com/client/v4/zones/" + url.PathEscape(c.ZoneID) + "/dns_records"
+	auth := "Bearer " + c.Token
+	var existing struct {
+		Result []struct {
+			ID string `json:"id"`
+		} `json:"result"`
+	}
+	query := url.Values{"type": {record.Type}, "name": {name}}
+	err := cloudflareRequest("GET", base+"?"+query.Encode(), auth, nil, &existing)
+	if err != nil {
+		return err
+	}
+
+	body := map[string]interface{}{
+		"type": record.Type,
+		"name": name,
+		"ttl":  ttl,
+	}
+	if record.Type == "SRV" {
+		body["data"] = map[string]interface{}{
+			"priority": 0,
+			"weight":   0,
+			"port":     record.Port,
+			"target":   record.Value,
+		}
+	} else {
+		body["content"] = record.Value
+		body["proxied"] = c.Proxied
+	}
+	if len(existing.Result) == 0 {
+		return cloudflareRequest("POST", base, auth, body, nil)
+	}
+	return cloudflareRequest("PUT", base+"/"+url.PathEscape(existing.Result[0].ID), auth, body, nil)
+}
+
+// cloudflareRequest is githubRequest for the Cloudflare API,
+// which reports failures in the body as well
+func cloudflareRequest(method, url, auth string, in, out interface{}) error {
+	var reply json.RawMessage
+	err := githubRequest(cloudflareClient, method, url, auth, in, &reply)
+	if err != nil {
+		return err
+	}
+	var status struct {
+		Success bool `json:"success"`
+		Errors  []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	err = json.Unmarshal(reply, &status)
+	if err != nil {
+		return err
+	}
+	if !status.Success {
+		var msgs []string
+		for _, e := range status.Errors {
+			msgs = append(msgs, e.Message)
+		}
+		return fmt.Errorf("cloudflare %s: %s", method, strings.Join(msgs, "; "))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(reply, out)
+}
+
+type route53Change struct {
+	XMLName xml.Name `xml:"https://route53.amazonaws.com/doc/2013-04-01/ ChangeResourceRecordSetsRequest"`
+	Action  string   `xml:"ChangeBatch>Changes>Change>Action"`
+	Name    string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>Name"`
+	Type    string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>Type"`
+	TTL     int      `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>TTL"`
+	Value   string   `xml:"ChangeBatch>Changes>Change>ResourceRecordSet>ResourceRecords>ResourceRecord>Value"`
+}
+
+// update upserts the record
+func (c *Route53Config) update(name string, ttl int, record dnsRecord) error {
+	body, err := xml.Marshal(route53Change{
+		Action: "UPSERT",
+		Name:   name,
+		Type:   record.Type,
+		TTL:    ttl,
+		Value:  record.String(),
+	})
+	if err != nil {
+		return err
+	}
+	zone := strings.TrimPrefix(c.HostedZoneID, "/hostedzone/")
+	// Route 53 is a global service signed for us-east-1
+	_, err = c.Credentials.awsRequest(awsClient, "POST", "https://route53.amazonaws.com/2013-04-01/hostedzone/"+zone+"/rrset",
+		"application/xml", append([]byte(xml.Header), body...), "route53", "us-east-1")
+	return err
+}
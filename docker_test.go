@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// fakeDocker is an in-memory Docker daemon implementing the calls
+// deploys make. Calls it doesn't implement panic.
+type fakeDocker struct {
+	DockerClient
+
+	mu         sync.Mutex
+	containers map[string]*docker.Container
+	images     map[string]*docker.Image
+	nextID     int
+	// calls lists the calls made, e.g. "PullImage example/app:v2"
+	calls []string
+	// fail makes the calls of the method fail with the error
+	fail map[string]error
+	// crashing images exit as soon as they are started
+	crashing map[string]bool
+	// dying images exit after being inspected the given number of times
+	dying map[string]int
+}
+
+func newFakeDocker() *fakeDocker {
+	return &fakeDocker{
+		containers: map[string]*docker.Container{},
+		images:     map[string]*docker.Image{},
+		fail:       map[string]error{},
+		crashing:   map[string]bool{},
+		dying:      map[string]int{},
+	}
+}
+
+// addImage makes the image available under ref, returning its ID
+func (f *fakeDocker) addImage(ref string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	id := "sha256:" + strconv.Itoa(f.nextID)
+	img := &docker.Image{ID: id, OS: "linux", Architecture: "amd64"}
+	f.images[ref] = img
+	f.images[id] = img
+	return id
+}
+
+// call records the call, returning the error it should fail with
+func (f *fakeDocker) call(method, arg string) error {
+	f.calls = append(f.calls, method+" "+arg)
+	return f.fail[method]
+}
+
+// container returns the container with the name or ID. f.mu must be held.
+func (f *fakeDocker) container(id string) (*docker.Container, error) {
+	if c, ok := f.containers[id]; ok {
+		return c, nil
+	}
+	for _, c := range f.containers {
+		if c.ID == id {
+			return c, nil
+		}
+	}
+	return nil, &docker.NoSuchContainer{ID: id}
+}
+
+// running returns the image of the running container named name
+func (f *fakeDocker) running(t *testing.T, name string) string {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, ok := f.containers[name]
+	if !ok || !c.State.Running {
+		t.Fatalf("%s isn't running", name)
+	}
+	return c.Image
+}
+
+// names returns the names of all containers
+func (f *fakeDocker) names() map[string]bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	names := map[string]bool{}
+	for name := range f.containers {
+		names[name] = true
+	}
+	return names
+}
+
+func (f *fakeDocker) Info() (*docker.DockerInfo, error) {
+	return &docker.DockerInfo{}, nil
+}
+
+func (f *fakeDocker) InspectContainer(id string) (*docker.Container, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.container(id)
+	if err != nil {
+		return nil, err
+	}
+	if n, ok := f.dying[c.Image]; ok && c.State.Running {
+		if n == 0 {
+			c.State.Running = false
+			c.State.ExitCode = 137
+		}
+		f.dying[c.Image] = n - 1
+	}
+	copied := *c
+	return &copied, nil
+}
+
+func (f *fakeDocker) CreateContainer(opts docker.CreateContainerOptions) (*docker.Container, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.call("CreateContainer", opts.Name)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := f.containers[opts.Name]; ok {
+		return nil, docker.ErrContainerAlreadyExists
+	}
+	img, ok := f.images[opts.Config.Image]
+	if !ok {
+		return nil, docker.ErrNoSuchImage
+	}
+	f.nextID++
+	c := &docker.Container{
+		ID:     "c" + strconv.Itoa(f.nextID),
+		Name:   opts.Name,
+		Image:  img.ID,
+		Config: opts.Config,
+	}
+	f.containers[opts.Name] = c
+	return c, nil
+}
+
+func (f *fakeDocker) StartContainer(id string, hostConfig *docker.HostConfig) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.call("StartContainer", id)
+	if err != nil {
+		return err
+	}
+	c, err := f.container(id)
+	if err != nil {
+		return err
+	}
+	c.State.Running = !f.crashing[c.Image]
+	if !c.State.Running {
+		c.State.ExitCode = 1
+	}
+	return nil
+}
+
+func (f *fakeDocker) StopContainer(id string, timeout uint) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.call("StopContainer", id)
+	if err != nil {
+		return err
+	}
+	c, err := f.container(id)
+	if err != nil {
+		return err
+	}
+	if !c.State.Running {
+		return &docker.ContainerNotRunning{ID: id}
+	}
+	c.State.Running = false
+	return nil
+}
+
+func (f *fakeDocker) RemoveContainer(opts docker.RemoveContainerOptions) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.call("RemoveContainer", opts.ID)
+	if err != nil {
+		return err
+	}
+	c, err := f.container(opts.ID)
+	if err != nil {
+		return err
+	}
+	if c.State.Running && !opts.Force {
+		return fmt.Errorf("container %s is running", c.Name)
+	}
+	delete(f.containers, c.Name)
+	return nil
+}
+
+func (f *fakeDocker) RenameContainer(opts docker.RenameContainerOptions) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.call("RenameContainer", opts.ID+" "+opts.Name)
+	if err != nil {
+		return err
+	}
+	c, err := f.container(opts.ID)
+	if err != nil {
+		return err
+	}
+	if _, ok := f.containers[opts.Name]; ok {
+		return docker.ErrContainerAlreadyExists
+	}
+	delete(f.containers, c.Name)
+	c.Name = opts.Name
+	f.containers[opts.Name] = c
+	return nil
+}
+
+func (f *fakeDocker) PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ref := opts.Repository + ":" + opts.Tag
+	err := f.call("PullImage", ref)
+	if err != nil {
+		return err
+	}
+	if _, ok := f.images[ref]; !ok {
+		return fmt.Errorf("manifest for %s not found", ref)
+	}
+	return nil
+}
+
+func (f *fakeDocker) InspectImage(name string) (*docker.Image, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	img, ok := f.images[name]
+	if !ok {
+		return nil, docker.ErrNoSuchImage
+	}
+	return img, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// EventDrift is sent when a container no longer matches its configuration
+const EventDrift = Event("drift")
+
+// containerDrift is 1 for containers that don't match their configuration
+var containerDrift = NewGaugeVec(
+	"webhook_container_drift",
+	"Whether the running container differs from its configured spec.",
+	"container",
+)
+
+// WatchDrift compares every managed container against its configured
+// spec each interval, reporting drift and optionally redeploying
+func WatchDrift(deployers Deployers, interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, d := range deployers {
+			if d.busy() || !d.coordinator.Leader() {
+				continue
+			}
+			d.checkDrift()
+		}
+	}
+}
+
+func (d *Deployer) checkDrift() {
+	drift, err := d.Drift()
+	if err != nil {
+		log.Printf("Failed to check drift of %q: %v", d.container.Name, err)
+		return
+	}
+
+	d.mu.Lock()
+	wasDrifted := len(d.drift) > 0
+	d.drift = drift
+	d.mu.Unlock()
+
+	if len(drift) == 0 {
+		containerDrift.Set(0, d.container.Name)
+		return
+	}
+	containerDrift.Set(1, d.container.Name)
+
+	if !wasDrifted {
+		log.Printf("Container %q drifted from its spec: %s", d.container.Name, strings.Join(drift, "; "))
+		notify(d.notifier, Notification{
+			Event:     EventDrift,
+			Container: d.container.Name,
+			Message:   fmt.Sprintf("Container %s drifted from its spec: %s", d.container.Name, strings.Join(drift, "; ")),
+		})
+	}
+
+	if d.container.RemediateDrift {
+		log.Printf("Redeploying %q to remediate drift", d.container.Name)
+		herr := d.Deploy(d.container.Tag)
+		if herr != nil {
+			log.Printf("Failed to remediate drift of %q: %v", d.container.Name, herr)
+			return
+		}
+		d.mu.Lock()
+		d.drift = nil
+		d.mu.Unlock()
+		containerDrift.Set(0, d.container.Name)
+	}
+}
+
+// Drift returns the differences between the running
+// container and its configured spec
+func (d *Deployer) Drift() ([]string, error) {
+	c, err := d.client.InspectContainer(d.container.Name)
+	if _, ok := err.(*docker.NoSuchContainer); ok {
+		return []string{"container is missing"}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var drift []string
+
+	d.mu.Lock()
+	want := d.imageID
+	d.mu.Unlock()
+	if want == "" {
+		// Nothing deployed since startup, compare against the local image
+		img, err := d.client.InspectImage(d.imageRef(d.container.Tag))
+		if err != nil {
+			return nil, err
+		}
+		want = img.ID
+	}
+	if c.Image != want {
+		drift = append(drift, fmt.Sprintf("image is %s, want %s", shortID(c.Image), shortID(want)))
+	}
+
+	// What is configured, or taken from the baseline of adopted containers
+	spec := d.createOptions("")
+
+	// The image may add variables of its own
+	for _, env := range spec.Config.Env {
+		if !contains(c.Config.Env, env) {
+			drift = append(drift, fmt.Sprintf("env %q is missing", env))
+		}
+	}
+
+	if got, want := portBindings(c.HostConfig.PortBindings), portBindings(spec.HostConfig.PortBindings); got != want {
+		drift = append(drift, fmt.Sprintf("ports are [%s], want [%s]", got, want))
+	}
+
+	got := append([]string(nil), c.HostConfig.Binds...)
+	wantMounts := append([]string(nil), spec.HostConfig.Binds...)
+	sort.Strings(got)
+	sort.Strings(wantMounts)
+	if strings.Join(got, " ") != strings.Join(wantMounts, " ") {
+		drift = append(drift, fmt.Sprintf("mounts are %v, want %v", got, wantMounts))
+	}
+
+	return drift, nil
+}
+
+// portBindings formats the bindings as a sorted
+// list of container:host port pairs
+func portBindings(bindings map[docker.Port][]docker.PortBinding) string {
+	var pairs []string
+	for port, bs := range bindings {
+		for _, b := range bs {
+			pairs = append(pairs, fmt.Sprintf("%s:%s", normalizePort(string(port)), b.HostPort))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// normalizePort adds the default protocol to a port
+func normalizePort(port string) string {
+	if !strings.Contains(port, "/") {
+		return port + "/tcp"
+	}
+	return port
+}
+
+// shortID shortens an image ID for display
+func shortID(id string) string {
+	id = strings.TrimPrefix(id, "sha256:")
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
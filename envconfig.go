@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// configFromEnv returns the configuration from the CONFIG_JSON
+// environment variable or, for a single tenant, the WEBHOOK_
+// environment variables, so the receiver can run without a
+// configuration file. It returns nil if neither is set.
+func configFromEnv() (*Config, error) {
+	if content, ok := os.LookupEnv("CONFIG_JSON"); ok {
+		var v interface{}
+		err := json.Unmarshal([]byte(content), &v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CONFIG_JSON: %v", err)
+		}
+		changes, err := migrateConfig(v)
+		if err != nil {
+			return nil, fmt.Errorf("CONFIG_JSON: %v", err)
+		}
+		for _, change := range changes {
+			log.Warnf("CONFIG_JSON: %s, set version %d to silence this", change, configVersion)
+		}
+		v, err = interpolate(v)
+		if err != nil {
+			return nil, fmt.Errorf("CONFIG_JSON: %v", err)
+		}
+		interpolated, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		cfg := &Config{}
+		err = json.Unmarshal(interpolated, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CONFIG_JSON: %v", err)
+		}
+		return cfg, nil
+	}
+
+	if _, ok := os.LookupEnv("WEBHOOK_REPO_0_NAME"); !ok {
+		return nil, nil
+	}
+
+	tenant := TenantConfig{
+		Name:          DefaultTenant,
+		WebhookSecret: os.Getenv("WEBHOOK_SECRET"),
+	}
+	for _, role := range []Role{RoleViewer, RoleDeployer, RoleAdmin} {
+		token := os.Getenv("WEBHOOK_" + strings.ToUpper(string(role)) + "_TOKEN")
+		if token != "" {
+			tenant.APITokens = append(tenant.APITokens, APIToken{Token: token, Role: role})
+		}
+	}
+	if hosts := os.Getenv("WEBHOOK_HOSTS"); hosts != "" {
+		tenant.Hosts = strings.Split(hosts, ",")
+	}
+
+	for i := 0; ; i++ {
+		prefix := "WEBHOOK_REPO_" + strconv.Itoa(i) + "_"
+		name, ok := os.LookupEnv(prefix + "NAME")
+		if !ok {
+			break
+		}
+		env := func(key string) string {
+			return os.Getenv(prefix + key)
+		}
+
+		c := ContainerConfig{
+			Name:      name,
+			Host:      env("HOST"),
+			Cmd:       strings.Fields(env("CMD")),
+			Env:       list(env("ENV")),
+			Mounts:    list(env("MOUNTS")),
+			TargetURL: env("TARGET_URL"),
+			Strategy:  env("STRATEGY"),
+			Network:   env("NETWORK"),
+			Engine:    env("ENGINE"),
+			Platform:  env("PLATFORM"),
+			PromoteTo: env("PROMOTE_TO"),
+		}
+		c.Repository, c.Tag = splitImage(env("IMAGE"))
+		if tag := env("TAG"); tag != "" {
+			c.Tag = tag
+		}
+		for _, p := range list(env("PORTS")) {
+			// host:container, like docker run -p
+			host, container, ok := strings.Cut(p, ":")
+			if !ok {
+				return nil, fmt.Errorf("%sPORTS: %q is not in the host:container format", prefix, p)
+			}
+			if c.Ports == nil {
+				c.Ports = map[string]string{}
+			}
+			c.Ports[container] = host
+		}
+		for key, b := range map[string]*bool{
+			"AUTO_RESTART":    &c.AutoRestart,
+			"REMEDIATE_DRIFT": &c.RemediateDrift,
+			"ROLLBACK":        &c.Rollback,
+		} {
+			if v := env(key); v != "" {
+				var err error
+				*b, err = strconv.ParseBool(v)
+				if err != nil {
+					return nil, fmt.Errorf("%s%s: %v", prefix, key, err)
+				}
+			}
+		}
+		tenant.Containers = append(tenant.Containers, c)
+	}
+
+	return &Config{Tenants: []TenantConfig{tenant}}, nil
+}
+
+// list splits a comma separated list, ignoring empty entries
+func list(s string) []string {
+	var l []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			l = append(l, e)
+		}
+	}
+	return l
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// ErrorCode classifies a failure so it can be alerted on
+type ErrorCode string
+
+// Allowed values of ErrorCode
+const (
+	CodeReadBody        = ErrorCode("read_body")
+	CodeInvalidPayload  = ErrorCode("invalid_payload")
+	CodeUntrustedOrigin = ErrorCode("untrusted_origin")
+	CodeCallbackFailed  = ErrorCode("callback_failed")
+	CodeDockerError     = ErrorCode("docker_error")
+	CodeInternal        = ErrorCode("internal")
+)
+
+// Phase names the step of the webhook handling that failed
+type Phase string
+
+// Phases of handling a webhook, in order
+const (
+	PhaseRead     = Phase("read")
+	PhaseDecode   = Phase("decode")
+	PhaseVerify   = Phase("verify")
+	PhaseCallback = Phase("callback")
+	PhaseStop     = Phase("stop")
+	PhaseRemove   = Phase("remove")
+	PhasePull     = Phase("pull")
+	PhaseCreate   = Phase("create")
+	PhaseStart    = Phase("start")
+)
+
+// HookError is the error model returned to the webhook sender
+// and recorded in the audit log
+type HookError struct {
+	Code      ErrorCode `json:"code"`
+	Message   string    `json:"message"`
+	Phase     Phase     `json:"phase"`
+	Retryable bool      `json:"retryable"`
+	// Details lists specifics, e.g. the missing fields of a payload
+	Details []string `json:"details,omitempty"`
+	// RetryAfter is the number of seconds to wait before retrying,
+	// sent in the Retry-After header too
+	RetryAfter int `json:"retry_after,omitempty"`
+
+	// Status is the HTTP status code to reply with
+	Status int `json:"-"`
+}
+
+func (e *HookError) Error() string {
+	return fmt.Sprintf("%s: %s (%s)", e.Phase, e.Message, e.Code)
+}
+
+// clientError returns a HookError for a request that
+// will never succeed if sent again
+func clientError(code ErrorCode, phase Phase, err error) *HookError {
+	return &HookError{
+		Code:    code,
+		Message: err.Error(),
+		Phase:   phase,
+		Status:  http.StatusBadRequest,
+	}
+}
+
+// serverError returns a HookError for a failure on our side
+// or in a dependency, which may go away if the request is retried
+func serverError(code ErrorCode, phase Phase, err error) *HookError {
+	return &HookError{
+		Code:      code,
+		Message:   err.Error(),
+		Phase:     phase,
+		Retryable: true,
+		Status:    http.StatusInternalServerError,
+	}
+}
+
+// writeError replies to the request with the JSON encoded error
+func writeError(w http.ResponseWriter, herr *HookError) {
+	w.Header().Set("Content-Type", "application/json")
+	if herr.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(herr.RetryAfter))
+	}
+	w.WriteHeader(herr.Status)
+	err := json.NewEncoder(w).Encode(struct {
+		Error *HookError `json:"error"`
+	}{herr})
+	if err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Events sent when a managed container is changed outside the receiver
+const (
+	EventContainerLost     = Event("container_lost")
+	EventContainerRestored = Event("container_restored")
+)
+
+// ExternalEvent is a change to a managed container
+// not made by the receiver
+type ExternalEvent struct {
+	Action   string    `json:"action"`
+	Time     time.Time `json:"time"`
+	ExitCode *int      `json:"exit_code,omitempty"`
+}
+
+// WatchEvents subscribes to the events of every Docker daemon with managed
+// containers and reconciles the deployers with changes made outside the
+// receiver, e.g. a container crashing or being removed by hand.
+func WatchEvents(deployers Deployers) error {
+	for client, ds := range deployers.ByClient() {
+		events := make(chan *docker.APIEvents, 16)
+		err := client.AddEventListener(events)
+		if err != nil {
+			return fmt.Errorf("failed to listen for events on %s: %v", client.Endpoint(), err)
+		}
+
+		go func(ds Deployers) {
+			for ev := range events {
+				handleEvent(ds, ev)
+			}
+		}(ds)
+	}
+
+	return nil
+}
+
+func handleEvent(ds Deployers, ev *docker.APIEvents) {
+	if ev.Type != "container" {
+		return
+	}
+	d, ok := ds.Container(ev.Actor.Attributes["name"])
+	if !ok || d.busy() || d.cordoned() != nil {
+		// Not managed, changed by our own deploy or during maintenance
+		return
+	}
+
+	switch ev.Action {
+	case "start":
+		d.mu.Lock()
+		d.external = nil
+		d.mu.Unlock()
+	case "die", "destroy":
+		ext := &ExternalEvent{
+			Action: ev.Action,
+			Time:   time.Unix(0, ev.TimeNano),
+		}
+		if code, err := strconv.Atoi(ev.Actor.Attributes["exitCode"]); err == nil {
+			ext.ExitCode = &code
+		}
+		d.mu.Lock()
+		d.external = ext
+		d.mu.Unlock()
+
+		log.Printf("Container %q received %q outside of a deploy", d.container.Name, ev.Action)
+		notify(d.notifier, Notification{
+			Event:     EventContainerLost,
+			Container: d.container.Name,
+			Message:   fmt.Sprintf("Container %s received %s outside of a deploy", d.container.Name, ev.Action),
+		})
+
+		if d.container.AutoRestart && d.coordinator.Leader() {
+			go d.restore()
+		}
+	}
+}
+
+// restore starts the container again, recreating it from
+// the last deployed image if it has been removed
+func (d *Deployer) restore() {
+	d.running.Lock()
+	defer d.running.Unlock()
+
+	err := d.restoreContainer()
+	if err != nil {
+		log.Printf("Failed to restore container %q: %v", d.container.Name, err)
+		notify(d.notifier, Notification{
+			Event:     EventContainerLost,
+			Container: d.container.Name,
+			Message:   fmt.Sprintf("Failed to restore container %s: %v", d.container.Name, err),
+		})
+		return
+	}
+
+	log.Printf("Restored container %q", d.container.Name)
+	notify(d.notifier, Notification{
+		Event:     EventContainerRestored,
+		Container: d.container.Name,
+		Message:   fmt.Sprintf("Container %s was restored", d.container.Name),
+	})
+}
+
+func (d *Deployer) restoreContainer() error {
+	id := d.container.Name
+	c, err := d.client.InspectContainer(id)
+	switch err.(type) {
+	case nil:
+		if c.State.Running {
+			return nil
+		}
+	case *docker.NoSuchContainer:
+		d.mu.Lock()
+		image := d.imageID
+		d.mu.Unlock()
+		if image == "" {
+			image = d.imageRef(d.container.Tag)
+		}
+
+		c, err = d.client.CreateContainer(d.createOptions(image))
+		if err != nil {
+			return err
+		}
+		id = c.ID
+	default:
+		return err
+	}
+
+	return d.client.StartContainer(id, nil)
+}
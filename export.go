@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+func init() {
+	commands["export"] = exportCommand
+}
+
+// redacted replaces secrets in exported configuration
+const redacted = "REDACTED"
+
+// ConfigExport is the effective configuration with the deployed state
+type ConfigExport struct {
+	// Config is the configuration with all defaults applied
+	// and secrets redacted
+	Config   interface{}         `json:"config"`
+	Deployed []DeployedContainer `json:"deployed"`
+}
+
+// DeployedContainer is what a container currently runs
+type DeployedContainer struct {
+	Tenant    string `json:"tenant"`
+	Container string `json:"container"`
+	Running   bool   `json:"running"`
+	Image     string `json:"image,omitempty"`
+	ImageID   string `json:"image_id,omitempty"`
+	Digest    string `json:"digest,omitempty"`
+}
+
+// ConfigHandler serves the configuration of the request's
+// tenant, or all of it for an unscoped request, on /api/config
+type ConfigHandler struct {
+	cfg       *Config
+	deployers Deployers
+}
+
+func (h *ConfigHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tenant := requestTenant(r)
+	var scoped interface{} = h.cfg
+	if tenant != "" {
+		t, _ := h.cfg.Tenant(tenant)
+		// Hosts and integrations shared by all tenants are left out
+		scoped = &Config{Tenants: []TenantConfig{*t}}
+	}
+	content, err := json.Marshal(scoped)
+	if err != nil {
+		writeError(w, serverError(CodeInternal, PhaseInternal, err))
+		return
+	}
+	var tree interface{}
+	err = json.Unmarshal(content, &tree)
+	if err != nil {
+		writeError(w, serverError(CodeInternal, PhaseInternal, err))
+		return
+	}
+
+	export := ConfigExport{
+		Config:   redact("", tree),
+		Deployed: []DeployedContainer{},
+	}
+	for _, d := range h.deployers.ForTenant(tenant) {
+		status := d.Status()
+		export.Deployed = append(export.Deployed, DeployedContainer{
+			Tenant:    status.Tenant,
+			Container: status.Name,
+			Running:   status.Running,
+			Image:     status.Image,
+			ImageID:   status.ImageID,
+			Digest:    status.Digest,
+		})
+	}
+	writeJSON(w, http.StatusOK, &export)
+}
+
+// secretKey reports whether the values of the JSON key are secrets
+func secretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range []string{"token", "secret", "password"} {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return key == "key" || strings.HasSuffix(key, "_key")
+}
+
+// redact replaces the secrets in v, the value of key: strings of
+// secret keys, secret environment variables, and the passwords of URLs
+func redact(key string, v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = redact(k, e)
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = redact(key, e)
+		}
+	case string:
+		if t == "" {
+			return t
+		}
+		if secretKey(key) {
+			return redacted
+		}
+		if key == "env" {
+			if name, _, ok := strings.Cut(t, "="); ok && secretKey(name) {
+				return name + "=" + redacted
+			}
+			return t
+		}
+		if u, err := url.Parse(t); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), redacted)
+				return u.String()
+			}
+		}
+	}
+	return v
+}
+
+// exportCommand prints the effective configuration and
+// deployed state of a running receiver
+func exportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	newClient := apiFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: docker-webhook-receiver export -url https://deploy.example.com [-token ADMIN_TOKEN]")
+		fmt.Fprintln(fs.Output(), "Prints the effective configuration, with secrets redacted, and the deployed images.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	export, err := c.Config()
+	if err != nil {
+		return err
+	}
+	out, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LifecycleHook is told about the start and end of every deploy of a
+// container. Hooks are called synchronously and must not block.
+type LifecycleHook interface {
+	DeployStarted(dep *Deployment)
+	DeployFinished(dep *Deployment)
+}
+
+// GitHubConfig reports the deploys of a container
+// as deployments of a GitHub repository
+type GitHubConfig struct {
+	// Repository is the owner/name of the repository
+	Repository string `json:"repository"`
+	// Environment is the environment deployed to, production if empty
+	Environment string `json:"environment"`
+	// Ref is the git ref deployed, the pushed tag if empty
+	Ref string `json:"ref"`
+	// Token is a personal access token, GITHUB_TOKEN if
+	// empty and not authenticating as an App
+	Token string           `json:"token"`
+	App   *GitHubAppConfig `json:"app"`
+	// APIURL is the GitHub Enterprise API, https://api.github.com if empty
+	APIURL string `json:"api_url"`
+}
+
+// GitHubAppConfig authenticates as an installation of a GitHub App
+type GitHubAppConfig struct {
+	AppID          int64  `json:"app_id"`
+	InstallationID int64  `json:"installation_id"`
+	PrivateKeyFile string `json:"private_key_file"`
+}
+
+func (c *GitHubConfig) validate() error {
+	if strings.Count(c.Repository, "/") != 1 {
+		return fmt.Errorf("github repository %q is not in the owner/name format", c.Repository)
+	}
+	if c.Environment == "" {
+		c.Environment = "production"
+	}
+	if c.APIURL == "" {
+		c.APIURL = "https://api.github.com"
+	}
+	if c.App != nil {
+		if c.App.AppID == 0 || c.App.InstallationID == 0 || c.App.PrivateKeyFile == "" {
+			return errors.New("github app needs an app_id, installation_id and private_key_file")
+		}
+		return nil
+	}
+	if c.Token == "" {
+		c.Token = os.Getenv("GITHUB_TOKEN")
+	}
+	if c.Token == "" {
+		return errors.New("github needs a token or app")
+	}
+	return nil
+}
+
+// GitHubReporter creates a GitHub deployment for every deploy
+// and keeps its status up to date
+type GitHubReporter struct {
+	cfg       *GitHubConfig
+	targetURL string
+	client    *http.Client
+	key       *rsa.PrivateKey
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+	// finished passes the result of a deploy to the
+	// goroutine reporting it, by deployment ID
+	finished map[string]chan *Deployment
+}
+
+// NewGitHubReporter returns a reporter for the container, reading
+// the private key of the GitHub App if configured
+func NewGitHubReporter(c ContainerConfig) (*GitHubReporter, error) {
+	g := &GitHubReporter{
+		cfg:       c.GitHub,
+		targetURL: c.TargetURL,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		token:     c.GitHub.Token,
+		finished:  map[string]chan *Deployment{},
+	}
+	if c.GitHub.App != nil {
+		var err error
+		g.key, err = readRSAKey(c.GitHub.App.PrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read github app key: %v", err)
+		}
+	}
+	return g, nil
+}
+
+// DeployStarted implements LifecycleHook
+func (g *GitHubReporter) DeployStarted(dep *Deployment) {
+	finished := make(chan *Deployment, 1)
+	g.mu.Lock()
+	g.finished[dep.ID] = finished
+	g.mu.Unlock()
+
+	ref := g.cfg.Ref
+	if ref == "" {
+		ref = dep.Tag
+	}
+	id := dep.ID
+	go func() {
+		ghID, err := g.createDeployment(ref, id)
+		if err == nil {
+			err = g.setStatus(ghID, "in_progress", "Deploying "+ref)
+		}
+		if err != nil {
+			log.Printf("Failed to report deployment %s to GitHub: %v", id, err)
+		}
+
+		dep := <-finished
+		if err != nil {
+			return
+		}
+		state, description := "success", "Deployed "+ref
+		if dep.Result != Success {
+			state, description = "failure", dep.Error.Message
+		}
+		err = g.setStatus(ghID, state, description)
+		if err != nil {
+			log.Printf("Failed to report deployment %s to GitHub: %v", id, err)
+		}
+	}()
+}
+
+// DeployFinished implements LifecycleHook
+func (g *GitHubReporter) DeployFinished(dep *Deployment) {
+	g.mu.Lock()
+	finished, ok := g.finished[dep.ID]
+	delete(g.finished, dep.ID)
+	g.mu.Unlock()
+	if ok {
+		finished <- dep
+	}
+}
+
+func (g *GitHubReporter) createDeployment(ref, id string) (int64, error) {
+	var created struct {
+		ID int64 `json:"id"`
+	}
+	err := g.do("POST", "/repos/"+g.cfg.Repository+"/deployments", map[string]interface{}{
+		"ref":               ref,
+		"environment":       g.cfg.Environment,
+		"auto_merge":        false,
+		"required_contexts": []string{},
+		"description":       "docker-webhook-receiver deployment " + id,
+		"payload":           map[string]string{"deployment_id": id},
+	}, &created)
+	return created.ID, err
+}
+
+func (g *GitHubReporter) setStatus(ghID int64, state, description string) error {
+	if len(description) > 140 {
+		// The limit of GitHub
+		description = description[:137] + "..."
+	}
+	return g.do("POST", fmt.Sprintf("/repos/%s/deployments/%d/statuses", g.cfg.Repository, ghID), map[string]interface{}{
+		"state":           state,
+		"description":     description,
+		"environment_url": g.targetURL,
+	}, nil)
+}
+
+func (g *GitHubReporter) do(method, path string, in, out interface{}) error {
+	token, err := g.authToken()
+	if err != nil {
+		return err
+	}
+	return githubRequest(g.client, method, g.cfg.APIURL+path, "token "+token, in, out)
+}
+
+// authToken returns the configured token or, for Apps,
+// a fresh installation token
+func (g *GitHubReporter) authToken() (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.key == nil || time.Until(g.tokenExpiry) > time.Minute {
+		return g.token, nil
+	}
+
+	jwt, err := appJWT(g.cfg.App.AppID, g.key)
+	if err != nil {
+		return "", err
+	}
+	var installation struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	err = githubRequest(g.client, "POST", fmt.Sprintf("%s/app/installations/%d/access_tokens", g.cfg.APIURL, g.cfg.App.InstallationID), "Bearer "+jwt, nil, &installation)
+	if err != nil {
+		return "", fmt.Errorf("failed to create installation token: %v", err)
+	}
+	g.token, g.tokenExpiry = installation.Token, installation.ExpiresAt
+	return g.token, nil
+}
+
+func githubRequest(client *http.Client, method, url, auth string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		content, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(content)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("github %s %s: %s: %s", method, req.URL.Path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// appJWT returns the RS256 signed JWT authenticating as the GitHub App
+func appJWT(appID int64, key *rsa.PrivateKey) (string, error) {
+	now := time.Now()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]int64{
+		// Allow for clock drift, as recommended by GitHub
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": appID,
+	})
+	if err != nil {
+		return "", err
+	}
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// readRSAKey reads a PEM encoded PKCS1 or PKCS8 RSA private key
+func readRSAKey(path string) (*rsa.PrivateKey, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("key in %s is not an RSA key", path)
+	}
+	return rsaKey, nil
+}
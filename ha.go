@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PhaseCoordinate waits for the other receivers to finish
+// deploying the container
+const PhaseCoordinate = Phase("coordinate")
+
+// CodeCoordination is used when the lock of a
+// container can't be taken in Consul
+const CodeCoordination = ErrorCode("coordination_error")
+
+// haLeader is 1 on the receiver that runs the background jobs
+var haLeader = NewGaugeVec(
+	"webhook_ha_leader",
+	"Whether this receiver is the leader of its HA group.",
+)
+
+// HAConfig coordinates receivers run side by side for redundancy
+// through the sessions and locks of Consul. Every receiver accepts
+// webhooks and API calls, but a container is only deployed by one
+// at a time, and only the leader runs the background jobs.
+type HAConfig struct {
+	Consul *ConsulConfig `json:"consul"`
+	// Prefix of the Consul keys of the locks,
+	// docker-webhook-receiver if empty
+	Prefix string `json:"prefix"`
+	// TTL of the Consul session, after which the locks of a receiver
+	// that stopped renewing it are released, 15s if empty
+	TTL string `json:"ttl"`
+	// Instance names the receiver in the locks it holds,
+	// the hostname if empty
+	Instance string `json:"instance"`
+
+	ttl time.Duration
+}
+
+func (c *HAConfig) validate() error {
+	if c.Consul == nil {
+		return errors.New("ha needs consul")
+	}
+	c.Consul.defaults()
+	if c.Prefix == "" {
+		c.Prefix = "docker-webhook-receiver"
+	}
+	c.Prefix = strings.Trim(c.Prefix, "/")
+	c.ttl = 15 * time.Second
+	if c.TTL != "" {
+		var err error
+		c.ttl, err = time.ParseDuration(c.TTL)
+		if err != nil || c.ttl < 10*time.Second || c.ttl > 24*time.Hour {
+			return fmt.Errorf("ha: invalid ttl %q, must be between 10s and 24h", c.TTL)
+		}
+	}
+	if c.Instance == "" {
+		c.Instance, _ = os.Hostname()
+	}
+	return nil
+}
+
+// Coordinator holds the Consul session of the receiver,
+// through which it takes the locks of deploys and leadership
+type Coordinator struct {
+	cfg *HAConfig
+
+	mu      sync.Mutex
+	session string
+	leader  bool
+}
+
+// NewCoordinator creates the session of the receiver and
+// campaigns for leadership once, so it is known at startup
+func NewCoordinator(cfg *HAConfig) (*Coordinator, error) {
+	c := &Coordinator{cfg: cfg}
+	haLeader.Set(0)
+	err := c.createSession()
+	if err != nil {
+		return nil, err
+	}
+	c.campaign()
+	return c, nil
+}
+
+// Run renews the session and campaigns for leadership until the
+// receiver exits. A lost session, e.g. while Consul was unreachable
+// for longer than the TTL, is replaced.
+func (c *Coordinator) Run() {
+	for range time.Tick(c.cfg.ttl / 2) {
+		c.mu.Lock()
+		session := c.session
+		c.mu.Unlock()
+		err := c.cfg.Consul.request("PUT", "/v1/session/renew/"+session, nil, nil)
+		if err != nil {
+			log.Printf("Failed to renew Consul session %s, the locks of its deploys may have been released: %v", session, err)
+			c.setLeader(false)
+			err = c.createSession()
+			if err != nil {
+				log.Printf("Failed to create Consul session: %v", err)
+				continue
+			}
+		}
+		c.campaign()
+	}
+}
+
+func (c *Coordinator) createSession() error {
+	var created struct {
+		ID string
+	}
+	err := c.cfg.Consul.request("PUT", "/v1/session/create", map[string]string{
+		"Name":     "docker-webhook-receiver " + c.cfg.Instance,
+		"TTL":      c.cfg.ttl.String(),
+		"Behavior": "release",
+	}, &created)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.session = created.ID
+	c.mu.Unlock()
+	return nil
+}
+
+// acquire tries to take the lock of key with the session
+func (c *Coordinator) acquire(key string) (bool, error) {
+	c.mu.Lock()
+	session := c.session
+	c.mu.Unlock()
+	var acquired bool
+	err := c.cfg.Consul.request("PUT", "/v1/kv/"+c.cfg.Prefix+"/"+key+"?acquire="+session, c.cfg.Instance, &acquired)
+	return acquired, err
+}
+
+// release releases the lock of key held by the session
+func (c *Coordinator) release(key string) error {
+	c.mu.Lock()
+	session := c.session
+	c.mu.Unlock()
+	return c.cfg.Consul.request("PUT", "/v1/kv/"+c.cfg.Prefix+"/"+key+"?release="+session, nil, nil)
+}
+
+// campaign takes or keeps the leader lock, if it is free
+func (c *Coordinator) campaign() {
+	leader, err := c.acquire("leader")
+	if err != nil {
+		log.Printf("Failed to campaign for leadership: %v", err)
+	}
+	c.setLeader(leader)
+}
+
+func (c *Coordinator) setLeader(leader bool) {
+	c.mu.Lock()
+	changed := c.leader != leader
+	c.leader = leader
+	c.mu.Unlock()
+	if !changed {
+		return
+	}
+	if leader {
+		log.Printf("Became the leader of the HA group as %s", c.cfg.Instance)
+		haLeader.Set(1)
+	} else {
+		log.Printf("No longer the leader of the HA group")
+		haLeader.Set(0)
+	}
+}
+
+// Leader reports whether the receiver runs the background jobs,
+// which is always the case without HA
+func (c *Coordinator) Leader() bool {
+	if c == nil {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.leader
+}
+
+// Lock takes the deploy lock of the container of the tenant,
+// waiting for other receivers holding it to release it, and
+// returns a function releasing it
+func (c *Coordinator) Lock(tenant, container string) (func(), error) {
+	key := "deploys/" + url.PathEscape(container)
+	if tenant != "" {
+		key = "deploys/" + url.PathEscape(tenant) + "/" + url.PathEscape(container)
+	}
+	waiting := false
+	for {
+		acquired, err := c.acquire(key)
+		if err != nil {
+			return nil, err
+		}
+		if acquired {
+			break
+		}
+		if !waiting {
+			log.Printf("Waiting for another receiver to finish deploying %q", container)
+			waiting = true
+		}
+		time.Sleep(time.Second)
+	}
+	return func() {
+		err := c.release(key)
+		if err != nil {
+			log.Printf("Failed to release the deploy lock of %q, it is released when the session expires: %v", container, err)
+		}
+	}, nil
+}
+
+// lockDeploys takes the deploy lock of the container with HA,
+// returning a function releasing it
+func (d *Deployer) lockDeploys() (func(), *HookError) {
+	if d.coordinator == nil {
+		return func() {}, nil
+	}
+	unlock, err := d.coordinator.Lock(d.tenant, d.container.Name)
+	if err != nil {
+		herr := serverError(CodeCoordination, PhaseCoordinate, err)
+		herr.Status = http.StatusServiceUnavailable
+		return nil, herr
+	}
+	return unlock, nil
+}
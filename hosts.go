@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// PhaseCordon checks the host of the container isn't cordoned
+const PhaseCordon = Phase("cordon")
+
+// CodeHostCordoned is used for deploys to a cordoned host
+const CodeHostCordoned = ErrorCode("host_cordoned")
+
+// localHost names the daemon from the environment in the hosts API
+const localHost = "local"
+
+// Cordon excludes a host from deploys during maintenance
+type Cordon struct {
+	// Host is the endpoint of the host, local for the daemon from the environment
+	Host   string    `json:"host"`
+	Since  time.Time `json:"since"`
+	Reason string    `json:"reason,omitempty"`
+	// Stopped are the containers stopped by draining the host
+	Stopped []string `json:"stopped,omitempty"`
+}
+
+// cordonsKey is the key of the cordons in the state store
+const cordonsKey = "cordons.json"
+
+// Cordons are the cordoned hosts, persisted in
+// the state store if there is one
+type Cordons struct {
+	mu    sync.Mutex
+	store StateStore
+	hosts map[string]*Cordon
+}
+
+// NewCordons loads the cordons persisted in the
+// store. A nil store keeps them in memory only.
+func NewCordons(store StateStore) (*Cordons, error) {
+	c := &Cordons{store: store, hosts: map[string]*Cordon{}}
+	if store == nil {
+		return c, nil
+	}
+	content, err := store.Get(cordonsKey)
+	if err != nil || content == nil {
+		return c, err
+	}
+	var cordons []*Cordon
+	err = json.Unmarshal(content, &cordons)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", cordonsKey, err)
+	}
+	for _, cordon := range cordons {
+		c.hosts[cordon.Host] = cordon
+	}
+	return c, nil
+}
+
+// Get returns a copy of the cordon of the host, nil if it isn't cordoned
+func (c *Cordons) Get(host string) *Cordon {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cordon, ok := c.hosts[host]
+	if !ok {
+		return nil
+	}
+	cp := *cordon
+	cp.Stopped = append([]string(nil), cordon.Stopped...)
+	return &cp
+}
+
+// Set cordons the host, replacing any previous cordon
+func (c *Cordons) Set(cordon *Cordon) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hosts[cordon.Host] = cordon
+	return c.save()
+}
+
+// Clear uncordons the host
+func (c *Cordons) Clear(host string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.hosts, host)
+	return c.save()
+}
+
+// save persists the cordons. c.mu must be held.
+func (c *Cordons) save() error {
+	if c.store == nil {
+		return nil
+	}
+	cordons := []*Cordon{}
+	for _, cordon := range c.hosts {
+		cordons = append(cordons, cordon)
+	}
+	content, err := json.Marshal(cordons)
+	if err != nil {
+		return err
+	}
+	return c.store.Put(cordonsKey, content)
+}
+
+// cordoned returns the deploy error if the host of the container is cordoned
+func (d *Deployer) cordoned() *HookError {
+	cordon := d.cordons.Get(hostName(d.container.Host))
+	if cordon == nil {
+		return nil
+	}
+	herr := serverError(CodeHostCordoned, PhaseCordon, fmt.Errorf("host %s of %q is cordoned since %s: %s", hostName(d.container.Host), d.container.Name, cordon.Since.Format(time.RFC3339), cordon.Reason))
+	herr.Status = http.StatusServiceUnavailable
+	return herr
+}
+
+// Uncordoned returns the deployers whose host isn't cordoned,
+// logging the deploys left out
+func (ds Deployers) Uncordoned(repo, tag string) Deployers {
+	var res Deployers
+	for _, d := range ds {
+		if d.cordoned() != nil {
+			log.Printf("Not deploying %s:%s to %q, host %s is cordoned", repo, tag, d.container.Name, hostName(d.container.Host))
+			continue
+		}
+		res = append(res, d)
+	}
+	return res
+}
+
+// hostName returns the name of the host in the hosts API
+func hostName(host string) string {
+	if host == "" {
+		return localHost
+	}
+	return host
+}
+
+// stopForMaintenance takes the container out of its load
+// balancer and stops it, if it is run by a Docker API
+func (d *Deployer) stopForMaintenance() error {
+	if d.client == nil {
+		return errors.New("not run by a Docker API")
+	}
+	d.running.Lock()
+	defer d.running.Unlock()
+
+	herr := d.drain()
+	if herr != nil {
+		return herr
+	}
+	err := d.client.StopContainer(d.container.Name, 10)
+	switch err.(type) {
+	case nil, *docker.ContainerNotRunning, *docker.NoSuchContainer:
+		return nil
+	}
+	d.enable()
+	return err
+}
+
+// startAfterMaintenance starts the container stopped by
+// stopForMaintenance and puts it back into its load balancer
+func (d *Deployer) startAfterMaintenance() error {
+	d.running.Lock()
+	defer d.running.Unlock()
+
+	err := d.client.StartContainer(d.container.Name, nil)
+	if _, ok := err.(*docker.ContainerAlreadyRunning); !ok && err != nil {
+		return err
+	}
+	d.enable()
+	return nil
+}
+
+// HostStatus is a host of the containers in the hosts API
+type HostStatus struct {
+	Host       string   `json:"host"`
+	Containers []string `json:"containers"`
+	Cordon     *Cordon  `json:"cordon,omitempty"`
+}
+
+// CordonRequest is the body of POST /api/hosts/cordon
+type CordonRequest struct {
+	Reason string `json:"reason"`
+	// Drain stops the containers on the host, taking them
+	// out of their load balancers first
+	Drain bool `json:"drain"`
+}
+
+// HostsHandler serves the hosts of the tenant's containers on GET
+// /api/hosts, and cordons and uncordons the host of the host query
+// parameter on POST and DELETE /api/hosts/cordon, as hosts contain
+// slashes. Cordons apply to the containers of all tenants, so only
+// hosts whose containers all belong to the tenant can be cordoned
+// with a tenant's token.
+type HostsHandler struct {
+	deployers Deployers
+	cordons   *Cordons
+	audit     *AuditLog
+}
+
+func (h *HostsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		h.list(w, r)
+		return
+	}
+
+	name := r.URL.Query().Get("host")
+	if name == "" {
+		writeError(w, clientError(CodeInvalidPayload, PhaseCordon, errors.New("missing host")))
+		return
+	}
+	host := name
+	if host == localHost {
+		host = ""
+	}
+	var onHost Deployers
+	for _, d := range h.deployers {
+		if d.container.Host == host {
+			onHost = append(onHost, d)
+		}
+	}
+	if len(onHost) == 0 || len(onHost.ForTenant(requestTenant(r))) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if len(onHost.ForTenant(requestTenant(r))) != len(onHost) {
+		herr := clientError(CodeUnauthorized, PhaseCordon, fmt.Errorf("host %s also runs containers of other tenants", name))
+		herr.Status = http.StatusForbidden
+		writeError(w, herr)
+		return
+	}
+
+	var cordon *Cordon
+	var err error
+	if r.Method == http.MethodDelete {
+		cordon, err = h.uncordon(name, onHost)
+	} else {
+		req := &CordonRequest{}
+		if r.ContentLength != 0 {
+			err = json.NewDecoder(r.Body).Decode(req)
+			if err != nil {
+				writeError(w, clientError(CodeInvalidPayload, PhaseDecode, err))
+				return
+			}
+		}
+		cordon, err = h.cordon(name, req, onHost)
+	}
+
+	entry := AuditEntry{
+		Remote: r.RemoteAddr,
+		Tenant: requestTenant(r),
+		Result: Success,
+	}
+	var herr *HookError
+	if err != nil {
+		herr = serverError(CodeInternal, PhaseCordon, err)
+		entry.Result, entry.Error = Error, herr
+	}
+	h.audit.Record(entry)
+
+	if herr != nil {
+		writeError(w, herr)
+		return
+	}
+	if cordon == nil {
+		writeError(w, &HookError{Code: CodeInvalidPayload, Message: "host isn't cordoned", Phase: PhaseCordon, Status: http.StatusNotFound})
+		return
+	}
+	writeJSON(w, http.StatusOK, cordon)
+}
+
+// cordon cordons the host and, if the request asks for it, stops the
+// containers on it. Containers that fail to stop are logged and left
+// running, the host stays cordoned.
+func (h *HostsHandler) cordon(host string, req *CordonRequest, onHost Deployers) (*Cordon, error) {
+	cordon := h.cordons.Get(host)
+	if cordon == nil {
+		cordon = &Cordon{Host: host, Since: time.Now()}
+	}
+	if req.Reason != "" {
+		cordon.Reason = req.Reason
+	}
+	err := h.cordons.Set(cordon)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Cordoned host %s: %s", host, cordon.Reason)
+	if !req.Drain {
+		return cordon, nil
+	}
+
+	for _, d := range onHost {
+		if contains(cordon.Stopped, d.container.Name) {
+			continue
+		}
+		err := d.stopForMaintenance()
+		if err != nil {
+			log.Printf("Failed to stop %q to drain host %s: %v", d.container.Name, host, err)
+			continue
+		}
+		log.Printf("Stopped %q to drain host %s", d.container.Name, host)
+		cordon.Stopped = append(cordon.Stopped, d.container.Name)
+	}
+	return cordon, h.cordons.Set(cordon)
+}
+
+// uncordon uncordons the host, starting the containers the drain
+// stopped again. It returns the removed cordon, nil if there was none.
+func (h *HostsHandler) uncordon(host string, onHost Deployers) (*Cordon, error) {
+	cordon := h.cordons.Get(host)
+	if cordon == nil {
+		return nil, nil
+	}
+	err := h.cordons.Clear(host)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Uncordoned host %s", host)
+	for _, d := range onHost {
+		if !contains(cordon.Stopped, d.container.Name) {
+			continue
+		}
+		err := d.startAfterMaintenance()
+		if err != nil {
+			log.Printf("Failed to start %q after draining host %s: %v", d.container.Name, host, err)
+		}
+	}
+	return cordon, nil
+}
+
+// list serves the hosts of the tenant's containers
+func (h *HostsHandler) list(w http.ResponseWriter, r *http.Request) {
+	byHost := map[string]*HostStatus{}
+	hosts := []*HostStatus{}
+	for _, d := range h.deployers.ForTenant(requestTenant(r)) {
+		hs, ok := byHost[d.container.Host]
+		if !ok {
+			hs = &HostStatus{
+				Host:   hostName(d.container.Host),
+				Cordon: h.cordons.Get(hostName(d.container.Host)),
+			}
+			byHost[d.container.Host] = hs
+			hosts = append(hosts, hs)
+		}
+		hs.Containers = append(hs.Containers, d.container.Name)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].Host < hosts[j].Host
+	})
+	writeJSON(w, http.StatusOK, hosts)
+}
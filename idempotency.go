@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// idempotencyTTL is how long the outcome of a request is remembered
+const idempotencyTTL = 24 * time.Hour
+
+type idempotentResult struct {
+	done        chan struct{}
+	expires     time.Time
+	deployments []*Deployment
+	herr        *HookError
+}
+
+// IdempotencyCache remembers the outcome of requests by their
+// Idempotency-Key, so retried deliveries don't deploy twice
+type IdempotencyCache struct {
+	mu      sync.Mutex
+	results map[string]*idempotentResult
+}
+
+// NewIdempotencyCache returns an empty cache
+func NewIdempotencyCache() *IdempotencyCache {
+	return &IdempotencyCache{
+		results: map[string]*idempotentResult{},
+	}
+}
+
+// Do runs fn unless it already ran for the key, in which case the
+// outcome of that run is returned and replayed is set. A request
+// arriving while the first one is still running waits for it.
+func (c *IdempotencyCache) Do(key string, fn func() ([]*Deployment, *HookError)) (deployments []*Deployment, herr *HookError, replayed bool) {
+	c.mu.Lock()
+	now := time.Now()
+	for k, r := range c.results {
+		if !r.expires.IsZero() && now.After(r.expires) {
+			delete(c.results, k)
+		}
+	}
+	r, ok := c.results[key]
+	if !ok {
+		r = &idempotentResult{done: make(chan struct{})}
+		c.results[key] = r
+	}
+	c.mu.Unlock()
+
+	if ok {
+		<-r.done
+		return r.deployments, r.herr, true
+	}
+
+	defer func() {
+		// Don't leave waiting requests hanging if fn panics
+		if rec := recover(); rec != nil {
+			c.mu.Lock()
+			delete(c.results, key)
+			c.mu.Unlock()
+			r.herr = serverError(CodePanic, PhaseInternal, fmt.Errorf("internal error: %v", rec))
+			close(r.done)
+			panic(rec)
+		}
+	}()
+	r.deployments, r.herr = fn()
+	c.mu.Lock()
+	r.expires = time.Now().Add(idempotencyTTL)
+	c.mu.Unlock()
+	close(r.done)
+
+	return r.deployments, r.herr, false
+}
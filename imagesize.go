@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// EventOverBudget is sent when a deployed image is bigger
+// than the size budget of its container
+const EventOverBudget = Event("over_budget")
+
+// Size and layers of the deployed images
+var (
+	imageSizeBytes = NewGaugeVec(
+		"webhook_image_size_bytes",
+		"Size of the last deployed image.",
+		"container",
+	)
+	imageLayers = NewGaugeVec(
+		"webhook_image_layers",
+		"Number of layers of the last deployed image.",
+		"container",
+	)
+)
+
+// recordSize records the size and layers of the pulled image,
+// notifying if it is over the size budget of the container
+func (d *Deployer) recordSize(dep *Deployment, img *docker.Image) {
+	dep.ImageSize = img.Size
+	if img.RootFS != nil {
+		dep.ImageLayers = len(img.RootFS.Layers)
+	}
+	imageSizeBytes.Set(float64(dep.ImageSize), d.container.Name)
+	imageLayers.Set(float64(dep.ImageLayers), d.container.Name)
+
+	budget := d.container.sizeBudget
+	if budget == 0 || uint64(dep.ImageSize) <= budget {
+		return
+	}
+	msg := fmt.Sprintf("Image of %s is %d MiB, over its budget of %s", d.container.Name, dep.ImageSize>>20, d.container.SizeBudget)
+	d.logger().Print(msg)
+	notify(d.notifier, Notification{
+		Event:        EventOverBudget,
+		Container:    d.container.Name,
+		DeploymentID: dep.ID,
+		Phase:        PhasePull,
+		Message:      msg,
+		Labels:       dep.Labels,
+		Commit:       dep.Commit,
+	})
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	commands["import"] = importCommand
+}
+
+// ImportedContainer is a container stanza written by the import
+// command, with the fields of ContainerConfig that can be read
+// from a running container or compose service
+type ImportedContainer struct {
+	Name       string            `json:"name"`
+	Repository string            `json:"repository"`
+	Tag        string            `json:"tag,omitempty"`
+	Host       string            `json:"host,omitempty"`
+	Cmd        []string          `json:"cmd,omitempty"`
+	Env        []string          `json:"env,omitempty"`
+	Ports      map[string]string `json:"ports,omitempty"`
+	Mounts     []string          `json:"mounts,omitempty"`
+	Network    string            `json:"network,omitempty"`
+}
+
+// importCommand prints the config stanzas of existing containers
+// or the services of a compose file
+func importCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	containers := fs.String("container", "", "Comma separated names of the containers to import")
+	host := fs.String("host", "", "Docker daemon endpoint of the containers, the one from the environment if empty")
+	engine := fs.String("engine", EngineDocker, "Container engine of the host, docker, podman or containerd")
+	namespace := fs.String("namespace", "", "Containerd namespace of the containers, default if empty")
+	compose := fs.String("compose", "", "Compose file whose services are imported instead")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: docker-webhook-receiver import -container app[,worker] | -compose docker-compose.yml")
+		fmt.Fprintln(fs.Output(), "Prints the containers stanza of a tenant configuring the containers.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var imported []ImportedContainer
+	var err error
+	switch {
+	case *compose != "":
+		imported, err = importCompose(*compose)
+	case *containers != "":
+		imported, err = importContainers(strings.Split(*containers, ","), *host, *engine, *namespace)
+	default:
+		fs.Usage()
+		return errors.New("need -container or -compose")
+	}
+	if err != nil {
+		return err
+	}
+
+	out, err := json.MarshalIndent(map[string]interface{}{"containers": imported}, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+func importContainers(names []string, host, engine, namespace string) ([]ImportedContainer, error) {
+	client, err := newDockerClient(host, engine, namespace)
+	if err != nil {
+		return nil, err
+	}
+	var imported []ImportedContainer
+	for _, name := range names {
+		c, err := client.InspectContainer(strings.TrimSpace(name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect %q: %v", name, err)
+		}
+		ic := ImportedContainer{
+			Name:   strings.TrimPrefix(c.Name, "/"),
+			Host:   host,
+			Cmd:    c.Config.Cmd,
+			Env:    c.Config.Env,
+			Mounts: c.HostConfig.Binds,
+		}
+		ic.Repository, ic.Tag = splitImage(c.Config.Image)
+		if i := strings.Index(ic.Repository, "@"); i >= 0 {
+			// Pinned to a digest, the tag to follow is up to the user
+			ic.Repository = ic.Repository[:i]
+		}
+
+		// Leave out what the image sets, so it can change with the image
+		img, err := client.InspectImage(c.Image)
+		if err == nil && img.Config != nil {
+			ic.Env = nil
+			for _, env := range c.Config.Env {
+				if !contains(img.Config.Env, env) {
+					ic.Env = append(ic.Env, env)
+				}
+			}
+			if strings.Join(img.Config.Cmd, " ") == strings.Join(c.Config.Cmd, " ") {
+				ic.Cmd = nil
+			}
+		}
+
+		for port, bindings := range c.HostConfig.PortBindings {
+			if len(bindings) > 0 {
+				if ic.Ports == nil {
+					ic.Ports = map[string]string{}
+				}
+				ic.Ports[string(port)] = bindings[0].HostPort
+			}
+		}
+		switch mode := c.HostConfig.NetworkMode; mode {
+		case "", "default", "bridge", "host", "none":
+		default:
+			ic.Network = mode
+		}
+		imported = append(imported, ic)
+	}
+	return imported, nil
+}
+
+// composeProject is the canonical JSON form of a compose file,
+// as printed by docker compose config
+type composeProject struct {
+	Services map[string]struct {
+		ContainerName string            `json:"container_name"`
+		Image         string            `json:"image"`
+		Command       composeCommand    `json:"command"`
+		Environment   map[string]string `json:"environment"`
+		Ports         []struct {
+			Target    int    `json:"target"`
+			Published string `json:"published"`
+			Protocol  string `json:"protocol"`
+		} `json:"ports"`
+		Volumes []struct {
+			Type     string `json:"type"`
+			Source   string `json:"source"`
+			Target   string `json:"target"`
+			ReadOnly bool   `json:"read_only"`
+		} `json:"volumes"`
+		Networks map[string]interface{} `json:"networks"`
+	} `json:"services"`
+	// Networks and Volumes map the names used by services
+	// to the names of the Docker objects
+	Networks map[string]struct {
+		Name string `json:"name"`
+	} `json:"networks"`
+	Volumes map[string]struct {
+		Name string `json:"name"`
+	} `json:"volumes"`
+}
+
+// composeCommand is a command given as a list or a string,
+// which compose splits into arguments without a shell
+type composeCommand []string
+
+func (c *composeCommand) UnmarshalJSON(content []byte) error {
+	var s string
+	if json.Unmarshal(content, &s) == nil {
+		*c = strings.Fields(s)
+		return nil
+	}
+	return json.Unmarshal(content, (*[]string)(c))
+}
+
+// importCompose imports the services of the compose file, which
+// is normalized by docker compose config if the docker CLI is
+// available, and otherwise must already be in its JSON form
+func importCompose(path string) ([]ImportedContainer, error) {
+	content, err := exec.Command("docker", "compose", "-f", path, "config", "--format", "json").Output()
+	if err != nil {
+		var readErr error
+		content, readErr = os.ReadFile(path)
+		if readErr != nil {
+			return nil, readErr
+		}
+		if !bytes.HasPrefix(bytes.TrimSpace(content), []byte("{")) {
+			return nil, fmt.Errorf("failed to run docker compose config, needed for YAML compose files: %v", err)
+		}
+	}
+	var project composeProject
+	err = json.Unmarshal(content, &project)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	var names []string
+	for name := range project.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var imported []ImportedContainer
+	for _, name := range names {
+		svc := project.Services[name]
+		if svc.Image == "" {
+			return nil, fmt.Errorf("service %q is built instead of pulled, it can't be deployed from a registry", name)
+		}
+		ic := ImportedContainer{
+			Name: name,
+			Cmd:  svc.Command,
+		}
+		if svc.ContainerName != "" {
+			ic.Name = svc.ContainerName
+		}
+		ic.Repository, ic.Tag = splitImage(svc.Image)
+		for k, v := range svc.Environment {
+			ic.Env = append(ic.Env, k+"="+v)
+		}
+		sort.Strings(ic.Env)
+		for _, p := range svc.Ports {
+			if p.Published == "" {
+				continue
+			}
+			if ic.Ports == nil {
+				ic.Ports = map[string]string{}
+			}
+			protocol := p.Protocol
+			if protocol == "" {
+				protocol = "tcp"
+			}
+			ic.Ports[strconv.Itoa(p.Target)+"/"+protocol] = p.Published
+		}
+		for _, v := range svc.Volumes {
+			source := v.Source
+			switch v.Type {
+			case "bind":
+			case "volume":
+				if vol, ok := project.Volumes[source]; ok && vol.Name != "" {
+					source = vol.Name
+				}
+			default:
+				continue
+			}
+			mount := source + ":" + v.Target
+			if v.ReadOnly {
+				mount += ":ro"
+			}
+			ic.Mounts = append(ic.Mounts, mount)
+		}
+		var networks []string
+		for network := range svc.Networks {
+			networks = append(networks, network)
+		}
+		sort.Strings(networks)
+		for _, network := range networks {
+			// Only one network is supported, prefer the
+			// ones not added by compose
+			if ic.Network == "" || network != "default" {
+				ic.Network = network
+			}
+		}
+		if n, ok := project.Networks[ic.Network]; ok && n.Name != "" {
+			ic.Network = n.Name
+		}
+		imported = append(imported, ic)
+	}
+	return imported, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// keptPrefix is the prefix of the names of the old containers
+// kept for rollbacks, which end in the time they were replaced
+func (d *Deployer) keptPrefix() string {
+	return d.container.Name + "-old-"
+}
+
+// keep renames the stopped old container id to keep it for rollbacks,
+// removing the kept containers beyond the keep_old of the container
+func (d *Deployer) keep(id string) error {
+	name := d.keptPrefix() + strconv.FormatInt(time.Now().UnixMilli(), 10)
+	err := d.client.RenameContainer(docker.RenameContainerOptions{ID: id, Name: name})
+	if err != nil {
+		return err
+	}
+	d.logger().Printf("Kept the old container of %q as %q", d.container.Name, name)
+
+	kept, err := d.kept()
+	if err != nil {
+		d.logger().Printf("Failed to list the old containers of %q: %v", d.container.Name, err)
+		return nil
+	}
+	for i := d.container.KeepOld; i < len(kept); i++ {
+		d.discard(kept[i].ID)
+	}
+	return nil
+}
+
+// kept returns the old containers kept for rollbacks, newest first
+func (d *Deployer) kept() ([]docker.APIContainers, error) {
+	prefix := "/" + d.keptPrefix()
+	cs, err := d.client.ListContainers(docker.ListContainersOptions{
+		All:     true,
+		Filters: map[string][]string{"name": {"^" + regexp.QuoteMeta(prefix)}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var kept []docker.APIContainers
+	when := map[string]int64{}
+	for _, c := range cs {
+		for _, name := range c.Names {
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			t, err := strconv.ParseInt(strings.TrimPrefix(name, prefix), 10, 64)
+			if err == nil {
+				kept = append(kept, c)
+				when[c.ID] = t
+				break
+			}
+		}
+	}
+	sort.Slice(kept, func(i, j int) bool {
+		return when[kept[i].ID] > when[kept[j].ID]
+	})
+	return kept, nil
+}
+
+// restoreKept replaces the container with the newest kept
+// container running image, returning false if there is none
+func (d *Deployer) restoreKept(image string) (bool, error) {
+	if d.container.KeepOld == 0 {
+		return false, nil
+	}
+	kept, err := d.kept()
+	if err != nil {
+		return false, err
+	}
+	for _, k := range kept {
+		c, err := d.client.InspectContainer(k.ID)
+		if err != nil || c.Image != image {
+			continue
+		}
+		err = d.client.RemoveContainer(docker.RemoveContainerOptions{
+			ID:    d.container.Name,
+			Force: true,
+		})
+		if _, ok := err.(*docker.NoSuchContainer); !ok && err != nil {
+			return false, err
+		}
+		err = d.client.RenameContainer(docker.RenameContainerOptions{ID: c.ID, Name: d.container.Name})
+		if err != nil {
+			return false, err
+		}
+		d.mu.Lock()
+		d.imageID = image
+		d.mu.Unlock()
+		return true, d.client.StartContainer(c.ID, nil)
+	}
+	return false, nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import "github.com/fsouza/go-dockerclient"
+
+// ImageLabels are the OCI annotations describing an image
+type ImageLabels struct {
+	Version     string `json:"version,omitempty"`
+	Revision    string `json:"revision,omitempty"`
+	Created     string `json:"created,omitempty"`
+	Description string `json:"description,omitempty"`
+	Source      string `json:"source,omitempty"`
+	// BaseName and BaseDigest identify the base image
+	BaseName   string `json:"base_name,omitempty"`
+	BaseDigest string `json:"base_digest,omitempty"`
+}
+
+// imageLabels returns the OCI labels of the image, or nil if it has none
+func imageLabels(img *docker.Image) *ImageLabels {
+	if img.Config == nil {
+		return nil
+	}
+	l := img.Config.Labels
+	labels := &ImageLabels{
+		Version:     l["org.opencontainers.image.version"],
+		Revision:    l[revisionLabel],
+		Created:     l["org.opencontainers.image.created"],
+		Description: l["org.opencontainers.image.description"],
+		Source:      l["org.opencontainers.image.source"],
+		BaseName:    l["org.opencontainers.image.base.name"],
+		BaseDigest:  l["org.opencontainers.image.base.digest"],
+	}
+	if *labels == (ImageLabels{}) {
+		return nil
+	}
+	return labels
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// What a listener serves
+const (
+	// ServeWebhooks are the webhooks and badges
+	ServeWebhooks = "webhooks"
+	// ServeAPI is the management API, including profiles
+	ServeAPI = "api"
+	// ServeMetrics is the Prometheus endpoint
+	ServeMetrics = "metrics"
+)
+
+// ServerConfig tunes the HTTP servers of all listeners
+type ServerConfig struct {
+	// ReadHeaderTimeout is how long clients may take to send
+	// the request headers, 10s if empty
+	ReadHeaderTimeout string `json:"read_header_timeout"`
+	// ReadTimeout is how long clients may take to send
+	// the whole request, 1m if empty
+	ReadTimeout string `json:"read_timeout"`
+	// WriteTimeout is how long writing the reply may take, unlimited if
+	// empty. Streams and requests waiting for deploys are exempt.
+	WriteTimeout string `json:"write_timeout"`
+	// IdleTimeout is how long keep-alive connections are
+	// kept open between requests, 2m if empty
+	IdleTimeout string `json:"idle_timeout"`
+	// MaxHeaderSize limits the size of the request headers, 64KB if empty
+	MaxHeaderSize string `json:"max_header_size"`
+	// HTTP2 serves HTTP/2 on TLS listeners, true if empty
+	HTTP2 *bool `json:"http2"`
+	// TrustedProxies are the CIDRs of the reverse proxies in front of
+	// the receiver, whose X-Forwarded-For names the client
+	TrustedProxies []string `json:"trusted_proxies"`
+
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	maxHeaderSize     uint64
+	trustedProxies    []*net.IPNet
+}
+
+func (c *ServerConfig) validate() error {
+	timeouts := []struct {
+		name, value string
+		def         time.Duration
+		d           *time.Duration
+	}{
+		{"read header timeout", c.ReadHeaderTimeout, 10 * time.Second, &c.readHeaderTimeout},
+		{"read timeout", c.ReadTimeout, time.Minute, &c.readTimeout},
+		{"write timeout", c.WriteTimeout, 0, &c.writeTimeout},
+		{"idle timeout", c.IdleTimeout, 2 * time.Minute, &c.idleTimeout},
+	}
+	for _, t := range timeouts {
+		*t.d = t.def
+		if t.value != "" {
+			var err error
+			*t.d, err = time.ParseDuration(t.value)
+			if err != nil || *t.d <= 0 {
+				return fmt.Errorf("server: invalid %s %q", t.name, t.value)
+			}
+		}
+	}
+	c.maxHeaderSize = 64 << 10
+	if c.MaxHeaderSize != "" {
+		var err error
+		c.maxHeaderSize, err = parseBytes(c.MaxHeaderSize)
+		if err != nil || c.maxHeaderSize == 0 || c.maxHeaderSize > math.MaxInt32 {
+			return fmt.Errorf("server: invalid max header size %q", c.MaxHeaderSize)
+		}
+	}
+	c.trustedProxies = nil
+	for _, cidr := range c.TrustedProxies {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("server: trusted proxies: %v", err)
+		}
+		c.trustedProxies = append(c.trustedProxies, network)
+	}
+	return nil
+}
+
+// trusted reports whether the host is a trusted proxy
+func (c *ServerConfig) trusted(host string) bool {
+	ip := net.ParseIP(host)
+	for _, network := range c.trustedProxies {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddress stores the address of the client in the request
+// context, taken from X-Forwarded-For for requests of trusted proxies
+func (c *ServerConfig) clientAddress(h http.Handler) http.Handler {
+	if len(c.trustedProxies) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := remoteHost(r.RemoteAddr)
+		if c.trusted(client) {
+			// Each proxy appends the address it got the request
+			// from, so the client is the last one not a proxy.
+			// Anything before it may be made up by the client.
+			forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+			for i := len(forwarded) - 1; i >= 0 && c.trusted(client); i-- {
+				addr := strings.TrimSpace(forwarded[i])
+				if net.ParseIP(addr) == nil {
+					break
+				}
+				client = addr
+			}
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientKey, client)))
+	})
+}
+
+// clientHost returns the address of the client of the request,
+// behind the trusted proxies, if any
+func clientHost(r *http.Request) string {
+	if host, ok := r.Context().Value(clientKey).(string); ok {
+		return host
+	}
+	return remoteHost(r.RemoteAddr)
+}
+
+// serverDefaults returns the server config, or the defaults
+// if there's none, which still protect against slow clients
+func serverDefaults(c *ServerConfig) *ServerConfig {
+	if c == nil {
+		c = &ServerConfig{}
+		c.validate()
+	}
+	return c
+}
+
+// newServer returns a server tuned by the config
+func (c *ServerConfig) newServer(addr string, h http.Handler, tlsConfig *tls.Config) *http.Server {
+	protocols := &http.Protocols{}
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(c.HTTP2 == nil || *c.HTTP2)
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: c.readHeaderTimeout,
+		ReadTimeout:       c.readTimeout,
+		WriteTimeout:      c.writeTimeout,
+		IdleTimeout:       c.idleTimeout,
+		MaxHeaderBytes:    int(c.maxHeaderSize),
+		Protocols:         protocols,
+	}
+}
+
+// longRunning lifts the write timeout of requests streaming
+// or waiting for deploys
+func longRunning(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		if err != nil && !errors.Is(err, http.ErrNotSupported) {
+			log.Printf("Failed to lift the write timeout of %s: %v", r.URL.Path, err)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// defaultListener serves everything if no listeners are configured
+var defaultListener = ListenerConfig{Address: "0.0.0.0:8080"}
+
+// ListenerConfig is an address the receiver serves some or all of its
+// endpoints on, e.g. webhooks publicly and the API on localhost only
+type ListenerConfig struct {
+	// Address to listen on, e.g. :8080 or 127.0.0.1:8081
+	Address string `json:"address"`
+	// Serve lists what is served: webhooks, api and metrics.
+	// Empty serves everything.
+	Serve []string `json:"serve"`
+	// TLSCert and TLSKey serve HTTPS instead of HTTP
+	TLSCert string `json:"tls_cert"`
+	TLSKey  string `json:"tls_key"`
+	// ClientCA requires clients to present a certificate signed by it
+	ClientCA string `json:"client_ca"`
+	// AllowedNetworks are the CIDRs clients may connect
+	// from, e.g. 10.0.0.0/8. Empty allows everyone.
+	AllowedNetworks []string `json:"allowed_networks"`
+
+	// SocketMode and SocketGroup are the permissions and group of
+	// Unix sockets, 0660 and the receiver's group if empty
+	SocketMode  string `json:"socket_mode"`
+	SocketGroup string `json:"socket_group"`
+	// Role is granted to requests without an API token on Unix
+	// sockets, e.g. admin for the CLI on the host. Empty
+	// requires tokens like any other listener.
+	Role Role `json:"role"`
+
+	socketMode os.FileMode
+	networks   []*net.IPNet
+}
+
+// unixPrefix starts the addresses of Unix sockets
+const unixPrefix = "unix:"
+
+// socket returns the path of the Unix socket, if the listener is one
+func (c *ListenerConfig) socket() (string, bool) {
+	if !strings.HasPrefix(c.Address, unixPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(c.Address, unixPrefix), true
+}
+
+func (c *ListenerConfig) validate() error {
+	if c.Address == "" {
+		return errors.New("listeners need an address")
+	}
+	for _, s := range c.Serve {
+		switch s {
+		case ServeWebhooks, ServeAPI, ServeMetrics:
+		default:
+			return fmt.Errorf("listener %s: can't serve %q", c.Address, s)
+		}
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return fmt.Errorf("listener %s: needs both a TLS certificate and key", c.Address)
+	}
+	if c.ClientCA != "" && c.TLSCert == "" {
+		return fmt.Errorf("listener %s: a client CA needs TLS", c.Address)
+	}
+	if _, ok := c.socket(); ok {
+		if c.TLSCert != "" || len(c.AllowedNetworks) > 0 {
+			return fmt.Errorf("listener %s: Unix sockets are protected by their permissions, not TLS or networks", c.Address)
+		}
+		mode := c.SocketMode
+		if mode == "" {
+			mode = "0660"
+		}
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || m > 0o777 {
+			return fmt.Errorf("listener %s: invalid socket mode %q", c.Address, c.SocketMode)
+		}
+		c.socketMode = os.FileMode(m)
+	} else if c.Role != "" || c.SocketMode != "" || c.SocketGroup != "" {
+		return fmt.Errorf("listener %s: only Unix sockets can grant a role or have a socket mode and group", c.Address)
+	}
+	if _, ok := roleRank[c.Role]; c.Role != "" && !ok {
+		return fmt.Errorf("listener %s: unknown role %q", c.Address, c.Role)
+	}
+	c.networks = nil
+	for _, cidr := range c.AllowedNetworks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("listener %s: %v", c.Address, err)
+		}
+		c.networks = append(c.networks, network)
+	}
+	return nil
+}
+
+// purpose returns what serving the path is part of
+func purpose(path string) string {
+	switch {
+	case path == "/metrics":
+		return ServeMetrics
+	case strings.HasPrefix(path, "/api/"), strings.HasPrefix(path, "/debug/"):
+		return ServeAPI
+	default:
+		return ServeWebhooks
+	}
+}
+
+// serves reports whether the listener serves the purpose
+func (c *ListenerConfig) serves(p string) bool {
+	return len(c.Serve) == 0 || contains(c.Serve, p)
+}
+
+// allowed reports whether the client at addr may connect
+func (c *ListenerConfig) allowed(addr string) bool {
+	if len(c.networks) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	for _, network := range c.networks {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// handler only passes the requests the listener serves,
+// from the networks it allows
+func (c *ListenerConfig) handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !c.allowed(r.RemoteAddr) {
+			log.Printf("Rejected %s on %s from %s outside the allowed networks", r.URL.Path, c.Address, r.RemoteAddr)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if !c.serves(purpose(r.URL.Path)) {
+			http.NotFound(w, r)
+			return
+		}
+		if c.Role != "" {
+			r = r.WithContext(context.WithValue(r.Context(), listenerRoleKey, c.Role))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// tlsConfig returns the TLS config of the listener, nil without TLS
+func (c *ListenerConfig) tlsConfig() (*tls.Config, error) {
+	if c.TLSCert == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.ClientCA != "" {
+		ca, err := os.ReadFile(c.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", c.ClientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// listenUnix creates the Unix socket of the listener, replacing a stale
+// one. The socket is created in a directory only the receiver can enter
+// and moved into place once it has its mode and group, so nobody can
+// connect to it in between.
+func (c *ListenerConfig) listenUnix(path string) (net.Listener, error) {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".socket-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "sock")
+	ln, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	// It would unlink the temporary path, which is gone by then
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	err = os.Chmod(tmp, c.socketMode)
+	if err == nil && c.SocketGroup != "" {
+		gid, perr := strconv.Atoi(c.SocketGroup)
+		if perr != nil {
+			var g *user.Group
+			g, err = user.LookupGroup(c.SocketGroup)
+			if err == nil {
+				gid, err = strconv.Atoi(g.Gid)
+			}
+		}
+		if err == nil {
+			err = os.Chown(tmp, -1, gid)
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// Serve serves h on every listener, the default one if there are none,
+// until one of them fails
+func Serve(listeners []ListenerConfig, server *ServerConfig, h http.Handler) error {
+	if len(listeners) == 0 {
+		listeners = []ListenerConfig{defaultListener}
+	}
+	server = serverDefaults(server)
+	servers := make([]*http.Server, len(listeners))
+	sockets := make([]net.Listener, len(listeners))
+	for i := range listeners {
+		l := &listeners[i]
+		tlsConfig, err := l.tlsConfig()
+		if err != nil {
+			return fmt.Errorf("listener %s: %v", l.Address, err)
+		}
+		servers[i] = server.newServer(l.Address, l.handler(server.clientAddress(h)), tlsConfig)
+		if path, ok := l.socket(); ok {
+			sockets[i], err = l.listenUnix(path)
+			if err != nil {
+				return fmt.Errorf("listener %s: %v", l.Address, err)
+			}
+		}
+	}
+
+	errs := make(chan error, len(listeners))
+	for i, srv := range servers {
+		l, socket := &listeners[i], sockets[i]
+		go func(server *http.Server) {
+			serves := "everything"
+			if len(l.Serve) > 0 {
+				serves = strings.Join(l.Serve, ", ")
+			}
+			if socket != nil {
+				log.Printf("Serving %s on %s", serves, l.Address)
+				errs <- server.Serve(socket)
+				return
+			}
+			if server.TLSConfig != nil {
+				log.Printf("Serving %s on https://%s", serves, l.Address)
+				errs <- server.ListenAndServeTLS("", "")
+				return
+			}
+			log.Printf("Serving %s on http://%s", serves, l.Address)
+			errs <- server.ListenAndServe()
+		}(srv)
+	}
+	return <-errs
+}
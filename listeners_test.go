@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "receiver.sock")
+	// Stale socket of an earlier run
+	err := os.WriteFile(path, nil, 0o666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &ListenerConfig{Address: "unix:" + path, SocketMode: "0600"}
+	err = l.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := l.listenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0o600 {
+		t.Errorf("got mode %s, want a socket with 0600", info.Mode())
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Errorf("got %v, %v, want only the socket left in its directory", entries, err)
+	}
+
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("connecting to the moved socket: %v", err)
+	}
+	conn.Close()
+}
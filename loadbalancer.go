@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Phases taking the container out of its load balancer while
+// it is replaced and putting it back afterwards
+const (
+	PhaseDrain  = Phase("drain")
+	PhaseEnable = Phase("enable")
+)
+
+// LoadBalancer takes a container out of an upstream load
+// balancer, so its connections are drained before it is stopped
+type LoadBalancer interface {
+	Drain() error
+	Enable() error
+}
+
+// LoadBalancerConfig is the load balancer in front of a container
+type LoadBalancerConfig struct {
+	// Type is haproxy, alb or consul
+	Type string `json:"type"`
+	// DrainTime is how long to wait for connections to drain
+	// before stopping the container, 10s if empty
+	DrainTime string `json:"drain_time"`
+
+	HAProxy *HAProxyConfig `json:"haproxy"`
+	ALB     *ALBConfig     `json:"alb"`
+	Consul  *ConsulConfig  `json:"consul"`
+
+	drainTime time.Duration
+}
+
+func (c *LoadBalancerConfig) validate() error {
+	c.drainTime = 10 * time.Second
+	if c.DrainTime != "" {
+		var err error
+		c.drainTime, err = time.ParseDuration(c.DrainTime)
+		if err != nil {
+			return fmt.Errorf("invalid drain time: %v", err)
+		}
+	}
+	switch c.Type {
+	case "haproxy":
+		if c.HAProxy == nil || c.HAProxy.Socket == "" || c.HAProxy.Backend == "" || c.HAProxy.Server == "" {
+			return errors.New("load balancer haproxy needs a socket, backend and server")
+		}
+	case "alb":
+		if c.ALB == nil || c.ALB.Region == "" || c.ALB.TargetGroupARN == "" || c.ALB.TargetID == "" {
+			return errors.New("load balancer alb needs a region, target group arn and target id")
+		}
+		return c.ALB.Credentials.validate()
+	case "consul":
+		if c.Consul == nil || c.Consul.ServiceID == "" {
+			return errors.New("load balancer consul needs a service id")
+		}
+		c.Consul.defaults()
+		return nil
+	default:
+		return fmt.Errorf("unknown load balancer type %q", c.Type)
+	}
+	return nil
+}
+
+// loadBalancer returns the configured load balancer
+func (c *LoadBalancerConfig) loadBalancer() LoadBalancer {
+	switch c.Type {
+	case "haproxy":
+		return c.HAProxy
+	case "alb":
+		return c.ALB
+	default:
+		return c.Consul
+	}
+}
+
+// drain takes the container out of its load balancer, if it has
+// one, and waits for its connections to drain
+func (d *Deployer) drain() *HookError {
+	lb := d.container.LoadBalancer
+	if lb == nil {
+		return nil
+	}
+	return d.phase(PhaseDrain, func() error {
+		err := lb.loadBalancer().Drain()
+		if err != nil {
+			return err
+		}
+		time.Sleep(lb.drainTime)
+		return nil
+	})
+}
+
+// enable puts the container back into its load balancer. A failure
+// is logged but doesn't fail the deploy, which already succeeded or
+// failed on its own.
+func (d *Deployer) enable() {
+	lb := d.container.LoadBalancer
+	if lb == nil {
+		return
+	}
+	herr := d.phase(PhaseEnable, lb.loadBalancer().Enable)
+	if herr != nil {
+		d.logger().Printf("Failed to put %q back into its load balancer: %v", d.container.Name, herr)
+	}
+}
+
+// HAProxyConfig is a server of an HAProxy backend,
+// managed through the runtime API
+type HAProxyConfig struct {
+	// Socket is the runtime API address, a unix socket
+	// path or host:port
+	Socket  string `json:"socket"`
+	Backend string `json:"backend"`
+	Server  string `json:"server"`
+}
+
+// Drain implements LoadBalancer
+func (c *HAProxyConfig) Drain() error {
+	return c.setState("drain")
+}
+
+// Enable implements LoadBalancer
+func (c *HAProxyConfig) Enable() error {
+	return c.setState("ready")
+}
+
+func (c *HAProxyConfig) setState(state string) error {
+	network := "tcp"
+	if strings.HasPrefix(c.Socket, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, c.Socket, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	_, err = fmt.Fprintf(conn, "set server %s/%s state %s\n", c.Backend, c.Server, state)
+	if err != nil {
+		return err
+	}
+	// Success is an empty reply, anything else is an error message
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if reply = strings.TrimSpace(reply); reply != "" {
+		return fmt.Errorf("haproxy: %s", reply)
+	}
+	if err != nil && err.Error() != "EOF" {
+		return err
+	}
+	return nil
+}
+
+// ALBConfig is a target of an AWS application load balancer target group
+type ALBConfig struct {
+	Region         string `json:"region"`
+	TargetGroupARN string `json:"target_group_arn"`
+	// TargetID is the instance ID or IP address of the target
+	TargetID string `json:"target_id"`
+	// Port is the port of the target, the target group's if zero
+	Port        int            `json:"port"`
+	Credentials AWSCredentials `json:"credentials"`
+}
+
+// Drain implements LoadBalancer. The ALB stops routing new requests to
+// the target immediately and drains it for the deregistration delay.
+func (c *ALBConfig) Drain() error {
+	return c.call("DeregisterTargets")
+}
+
+// Enable implements LoadBalancer
+func (c *ALBConfig) Enable() error {
+	return c.call("RegisterTargets")
+}
+
+var awsClient = &http.Client{Timeout: 30 * time.Second}
+
+func (c *ALBConfig) call(action string) error {
+	form := url.Values{
+		"Action":              {action},
+		"Version":             {"2015-12-01"},
+		"TargetGroupArn":      {c.TargetGroupARN},
+		"Targets.member.1.Id": {c.TargetID},
+	}
+	if c.Port != 0 {
+		form.Set("Targets.member.1.Port", strconv.Itoa(c.Port))
+	}
+	_, err := c.Credentials.awsRequest(awsClient, "POST", "https://elasticloadbalancing."+c.Region+".amazonaws.com/",
+		"application/x-www-form-urlencoded", []byte(form.Encode()), "elasticloadbalancing", c.Region)
+	return err
+}
+
+// ConsulConfig is a service registered with the local Consul agent,
+// which is put into maintenance mode while the container is replaced
+type ConsulConfig struct {
+	// Address of the Consul HTTP API, CONSUL_HTTP_ADDR or
+	// http://127.0.0.1:8500 if empty
+	Address   string `json:"address"`
+	ServiceID string `json:"service_id"`
+	// Token is sent as ACL token, CONSUL_HTTP_TOKEN if empty
+	Token string `json:"token"`
+}
+
+func (c *ConsulConfig) defaults() {
+	if c.Address == "" {
+		c.Address = os.Getenv("CONSUL_HTTP_ADDR")
+	}
+	if c.Address == "" {
+		c.Address = "http://127.0.0.1:8500"
+	}
+	if !strings.Contains(c.Address, "://") {
+		c.Address = "http://" + c.Address
+	}
+	if c.Token == "" {
+		c.Token = os.Getenv("CONSUL_HTTP_TOKEN")
+	}
+}
+
+// Drain implements LoadBalancer
+func (c *ConsulConfig) Drain() error {
+	return c.maintenance(true)
+}
+
+// Enable implements LoadBalancer
+func (c *ConsulConfig) Enable() error {
+	return c.maintenance(false)
+}
+
+func (c *ConsulConfig) maintenance(enable bool) error {
+	query := url.Values{"enable": {strconv.FormatBool(enable)}}
+	if enable {
+		query.Set("reason", "Redeploying with docker-webhook-receiver")
+	}
+	return c.request("PUT", "/v1/agent/service/maintenance/"+url.PathEscape(c.ServiceID)+"?"+query.Encode(), nil, nil)
+}
+
+var consulClient = &http.Client{Timeout: 10 * time.Second}
+
+// request sends the request with in as JSON body to the Consul API,
+// decoding the reply into out, either if not nil
+func (c *ConsulConfig) request(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		content, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(content)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.Address, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	if c.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+	resp, err := consulClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("consul %s %s: %s: %s", method, req.URL.Path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CodeLockedOut is used for requests from addresses locked
+// out after failing to authenticate too often
+const CodeLockedOut = ErrorCode("locked_out")
+
+// LockoutConfig locks out addresses failing to authenticate too often
+type LockoutConfig struct {
+	// MaxFailures within Window lock an address out, 5 if zero
+	MaxFailures int `json:"max_failures"`
+	// Window is 10m if empty
+	Window string `json:"window"`
+	// Duration of a lockout, 15m if empty
+	Duration string `json:"duration"`
+
+	window, duration time.Duration
+}
+
+func (c *LockoutConfig) validate() error {
+	if c.MaxFailures == 0 {
+		c.MaxFailures = 5
+	}
+	if c.MaxFailures < 0 {
+		return fmt.Errorf("lockout: invalid max failures %d", c.MaxFailures)
+	}
+	var err error
+	c.window = 10 * time.Minute
+	if c.Window != "" {
+		c.window, err = time.ParseDuration(c.Window)
+		if err != nil || c.window <= 0 {
+			return fmt.Errorf("lockout: invalid window %q", c.Window)
+		}
+	}
+	c.duration = 15 * time.Minute
+	if c.Duration != "" {
+		c.duration, err = time.ParseDuration(c.Duration)
+		if err != nil || c.duration <= 0 {
+			return fmt.Errorf("lockout: invalid duration %q", c.Duration)
+		}
+	}
+	return nil
+}
+
+// AuthFailures logs failed authentications, in a format fail2ban can
+// match, and locks out addresses failing too often when configured
+type AuthFailures struct {
+	// cfg is nil if lockouts are disabled
+	cfg *LockoutConfig
+	// w is the auth log, if any
+	w io.Writer
+
+	mu       sync.Mutex
+	failures map[string][]time.Time
+	locked   map[string]time.Time
+}
+
+// authFailures records the failed authentications of the server
+var authFailures = &AuthFailures{}
+
+// NewAuthFailures returns AuthFailures locking addresses out as configured,
+// if cfg isn't nil, and appending to the auth log at path, if set
+func NewAuthFailures(cfg *LockoutConfig, path string) (*AuthFailures, error) {
+	a := &AuthFailures{
+		cfg:      cfg,
+		failures: map[string][]time.Time{},
+		locked:   map[string]time.Time{},
+	}
+	if path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		a.w = f
+	}
+	if cfg != nil {
+		go func() {
+			for now := range time.Tick(time.Minute) {
+				a.sweep(now)
+			}
+		}()
+	}
+	return a, nil
+}
+
+// sweep forgets the failures outside the window and the expired
+// lockouts, so addresses seen once don't stay in memory
+func (a *AuthFailures) sweep(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for host, failures := range a.failures {
+		if now.Sub(failures[len(failures)-1]) >= a.cfg.window {
+			delete(a.failures, host)
+		}
+	}
+	for host, until := range a.locked {
+		if !now.Before(until) {
+			delete(a.locked, host)
+		}
+	}
+}
+
+// fail records a failed authentication of the request
+func (a *AuthFailures) fail(r *http.Request, reason string) {
+	host := clientHost(r)
+	log.Warnf("Authentication failure from %s on %s: %s", host, r.URL.Path, reason)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	if a.w != nil {
+		fmt.Fprintf(a.w, "%s authentication failure from %s on %s: %s\n", now.UTC().Format(time.RFC3339), host, r.URL.Path, reason)
+	}
+	if a.cfg == nil {
+		return
+	}
+
+	var recent []time.Time
+	for _, t := range a.failures[host] {
+		if now.Sub(t) < a.cfg.window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	a.failures[host] = recent
+	if len(recent) >= a.cfg.MaxFailures {
+		delete(a.failures, host)
+		a.locked[host] = now.Add(a.cfg.duration)
+		log.Warnf("Locked out %s for %s after %d authentication failures", host, a.cfg.duration, len(recent))
+		if a.w != nil {
+			fmt.Fprintf(a.w, "%s locked out %s for %s\n", now.UTC().Format(time.RFC3339), host, a.cfg.duration)
+		}
+	}
+}
+
+// lockedOut returns how long the address of the request remains
+// locked out, 0 if it isn't
+func (a *AuthFailures) lockedOut(r *http.Request) time.Duration {
+	host := clientHost(r)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	until, ok := a.locked[host]
+	if !ok {
+		return 0
+	}
+	left := time.Until(until)
+	if left <= 0 {
+		delete(a.locked, host)
+		return 0
+	}
+	return left
+}
+
+// rejectLockedOut replies 429 to requests from locked out addresses
+func rejectLockedOut(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		left := authFailures.lockedOut(r)
+		if left > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(left.Seconds()))))
+			herr := clientError(CodeLockedOut, PhaseVerify, errors.New("locked out for failing to authenticate too often"))
+			herr.Status = http.StatusTooManyRequests
+			writeError(w, herr)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// proxied returns a request from remote forwarded for the addresses
+func proxied(remote string, forwardedFor ...string) *http.Request {
+	r := httptest.NewRequest("GET", "/api/status", nil)
+	r.RemoteAddr = remote
+	for _, f := range forwardedFor {
+		r.Header.Add("X-Forwarded-For", f)
+	}
+	return r
+}
+
+func TestClientAddress(t *testing.T) {
+	server := &ServerConfig{TrustedProxies: []string{"10.0.0.0/8"}}
+	err := server.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name string
+		r    *http.Request
+		want string
+	}{
+		{"direct", proxied("192.0.2.1:1234"), "192.0.2.1"},
+		{"direct claiming a client", proxied("192.0.2.1:1234", "198.51.100.7"), "192.0.2.1"},
+		{"trusted proxy", proxied("10.0.0.2:1234", "198.51.100.7"), "198.51.100.7"},
+		{"chained proxies", proxied("10.0.0.2:1234", "198.51.100.7, 10.0.0.3"), "198.51.100.7"},
+		{"several headers", proxied("10.0.0.2:1234", "198.51.100.7", "10.0.0.3"), "198.51.100.7"},
+		{"spoofed by the client", proxied("10.0.0.2:1234", "203.0.113.9, 198.51.100.7"), "198.51.100.7"},
+		{"invalid address", proxied("10.0.0.2:1234", "garbage"), "10.0.0.2"},
+		{"proxy without header", proxied("10.0.0.2:1234"), "10.0.0.2"},
+	} {
+		var got string
+		server.clientAddress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = clientHost(r)
+		})).ServeHTTP(httptest.NewRecorder(), tt.r)
+		if got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLockoutBehindProxy(t *testing.T) {
+	server := &ServerConfig{TrustedProxies: []string{"10.0.0.0/8"}}
+	err := server.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &LockoutConfig{MaxFailures: 2}
+	err = cfg.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAuthFailures(cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Resolves the client like Serve does
+	serve := func(r *http.Request, fn func(r *http.Request)) {
+		server.clientAddress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fn(r)
+		})).ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	for i := 0; i < 2; i++ {
+		serve(proxied("10.0.0.2:1234", "198.51.100.7"), func(r *http.Request) {
+			a.fail(r, "invalid API token")
+		})
+	}
+	serve(proxied("10.0.0.2:1234", "198.51.100.7"), func(r *http.Request) {
+		if a.lockedOut(r) == 0 {
+			t.Error("failing client isn't locked out")
+		}
+	})
+	serve(proxied("10.0.0.2:1234", "198.51.100.8"), func(r *http.Request) {
+		if a.lockedOut(r) != 0 {
+			t.Error("other client behind the proxy is locked out")
+		}
+	})
+}
+
+func TestAuthFailuresSweep(t *testing.T) {
+	cfg := &LockoutConfig{MaxFailures: 2, Window: "1m", Duration: "5m"}
+	err := cfg.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAuthFailures(cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.fail(proxied("192.0.2.1:1234"), "invalid API token")
+	a.fail(proxied("192.0.2.2:1234"), "invalid API token")
+	a.fail(proxied("192.0.2.2:1234"), "invalid API token")
+
+	now := time.Now()
+	a.sweep(now)
+	if len(a.failures) != 1 || len(a.locked) != 1 {
+		t.Fatalf("swept recent entries: %d failures, %d lockouts", len(a.failures), len(a.locked))
+	}
+	a.sweep(now.Add(2 * time.Minute))
+	if len(a.failures) != 0 || len(a.locked) != 1 {
+		t.Errorf("got %d failures, %d lockouts after the window, want 0 and 1", len(a.failures), len(a.locked))
+	}
+	a.sweep(now.Add(6 * time.Minute))
+	if len(a.locked) != 0 {
+		t.Errorf("got %d lockouts after they expired", len(a.locked))
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// LogsHandler streams the output of a container as plain text on
+// GET /api/containers/{name}/logs. The since (RFC 3339), tail and
+// follow query parameters work like those of docker logs.
+type LogsHandler struct {
+	deployers Deployers
+}
+
+func (h *LogsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d, ok := h.deployers.ForTenant(requestTenant(r)).Container(r.PathValue("name"))
+	if !ok || d.client == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	opts := docker.LogsOptions{
+		Context:    r.Context(),
+		Container:  d.container.Name,
+		Stdout:     true,
+		Stderr:     true,
+		Timestamps: true,
+		Tail:       "all",
+	}
+	query := r.URL.Query()
+	if since := query.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			http.Error(w, "invalid since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts.Since = t.Unix()
+	}
+	if tail := query.Get("tail"); tail != "" {
+		if _, err := strconv.Atoi(tail); err != nil {
+			http.Error(w, "invalid tail: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts.Tail = tail
+	}
+	opts.Follow, _ = strconv.ParseBool(query.Get("follow"))
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	out := &flushWriter{w: w}
+	opts.OutputStream, opts.ErrorStream = out, out
+	err := d.client.Logs(opts)
+	if err != nil && r.Context().Err() == nil {
+		log.Printf("Failed to stream logs of %q: %v", d.container.Name, err)
+	}
+}
+
+// flushWriter flushes every write to the client, and serializes
+// the writes of stdout and stderr
+type flushWriter struct {
+	mu sync.Mutex
+	w  http.ResponseWriter
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	n, err := fw.w.Write(p)
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
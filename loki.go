@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// lokiBatchSize is the number of lines pushed at once
+	lokiBatchSize = 1000
+	// lokiMaxBuffered bounds the lines waiting to be pushed while
+	// Loki is unreachable, the oldest being dropped
+	lokiMaxBuffered = 10000
+)
+
+// lokiLabels maps the log fields sent as labels to their label names
+var lokiLabels = map[string]string{
+	"repository": "repo",
+	"container":  "container",
+	"deployment": "deploy_id",
+}
+
+// LokiConfig pushes the log to Grafana Loki
+type LokiConfig struct {
+	// URL of Loki, e.g. http://loki:3100
+	URL string `json:"url"`
+	// Username and Password authenticate with basic auth, if set
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// TenantID is sent as X-Scope-OrgID to multi-tenant Lokis
+	TenantID string `json:"tenant_id"`
+	// Labels are added to all lines, e.g. the host
+	Labels map[string]string `json:"labels"`
+	// BatchWait is how long lines are collected before being
+	// pushed, 1s if empty
+	BatchWait string `json:"batch_wait"`
+
+	batchWait time.Duration
+}
+
+func (c *LokiConfig) validate() error {
+	if c.URL == "" {
+		return errors.New("loki needs a url")
+	}
+	c.batchWait = time.Second
+	if c.BatchWait != "" {
+		var err error
+		c.batchWait, err = time.ParseDuration(c.BatchWait)
+		if err != nil || c.batchWait <= 0 {
+			return fmt.Errorf("loki: invalid batch wait %q", c.BatchWait)
+		}
+	}
+	return nil
+}
+
+type lokiLine struct {
+	labels map[string]string
+	time   time.Time
+	line   string
+}
+
+// LokiHook is a logrus hook pushing the log to Loki in batches
+type LokiHook struct {
+	cfg       *LokiConfig
+	formatter logrus.Formatter
+	client    *http.Client
+
+	mu      sync.Mutex
+	lines   []lokiLine
+	dropped int
+	wake    chan struct{}
+}
+
+// NewLokiHook returns a hook pushing to Loki in the background
+func NewLokiHook(cfg *LokiConfig) *LokiHook {
+	h := &LokiHook{
+		cfg: cfg,
+		formatter: &logrus.TextFormatter{
+			DisableColors:    true,
+			DisableTimestamp: true,
+		},
+		client: &http.Client{Timeout: 10 * time.Second},
+		wake:   make(chan struct{}, 1),
+	}
+	go h.run()
+	return h
+}
+
+// Levels implements logrus.Hook
+func (h *LokiHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire implements logrus.Hook
+func (h *LokiHook) Fire(entry *logrus.Entry) error {
+	line, err := h.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	labels := map[string]string{
+		"job":   "docker-webhook-receiver",
+		"level": entry.Level.String(),
+	}
+	for k, v := range h.cfg.Labels {
+		labels[k] = v
+	}
+	for field, label := range lokiLabels {
+		if v, ok := entry.Data[field].(string); ok && v != "" {
+			labels[label] = v
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.lines) >= lokiMaxBuffered {
+		h.lines = h.lines[1:]
+		h.dropped++
+	}
+	h.lines = append(h.lines, lokiLine{
+		labels: labels,
+		time:   entry.Time,
+		line:   strings.TrimRight(string(line), " \n"),
+	})
+	if len(h.lines) >= lokiBatchSize {
+		select {
+		case h.wake <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// run pushes the collected lines every batch wait, or as soon as a
+// batch is full. Failed batches are retried with the next one.
+func (h *LokiHook) run() {
+	ticker := time.NewTicker(h.cfg.batchWait)
+	for {
+		select {
+		case <-ticker.C:
+		case <-h.wake:
+		}
+		h.mu.Lock()
+		n := len(h.lines)
+		if n > lokiBatchSize {
+			n = lokiBatchSize
+		}
+		batch := h.lines[:n:n]
+		h.lines = h.lines[n:]
+		dropped := h.dropped
+		h.dropped = 0
+		h.mu.Unlock()
+		if len(batch) == 0 {
+			continue
+		}
+
+		// Logging the failures would feed them back into the hook
+		if dropped > 0 {
+			fmt.Fprintf(os.Stderr, "Dropped %d log lines Loki couldn't take\n", dropped)
+		}
+		err := h.push(batch)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to push %d log lines to Loki: %v\n", len(batch), err)
+			h.mu.Lock()
+			h.lines = append(batch, h.lines...)
+			if over := len(h.lines) - lokiMaxBuffered; over > 0 {
+				h.lines = h.lines[over:]
+				h.dropped += over
+			}
+			h.mu.Unlock()
+		}
+	}
+}
+
+// push sends the lines to Loki, grouped into streams by their labels
+func (h *LokiHook) push(lines []lokiLine) error {
+	type stream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	streams := map[string]*stream{}
+	var keys []string
+	for _, l := range lines {
+		key := labelKey(l.labels)
+		s, ok := streams[key]
+		if !ok {
+			s = &stream{Stream: l.labels}
+			streams[key] = s
+			keys = append(keys, key)
+		}
+		s.Values = append(s.Values, [2]string{strconv.FormatInt(l.time.UnixNano(), 10), l.line})
+	}
+	var body struct {
+		Streams []*stream `json:"streams"`
+	}
+	for _, key := range keys {
+		body.Streams = append(body.Streams, streams[key])
+	}
+	content, err := json.Marshal(&body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(h.cfg.URL, "/")+"/loki/api/v1/push", bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.cfg.Username != "" {
+		req.SetBasicAuth(h.cfg.Username, h.cfg.Password)
+	}
+	if h.cfg.TenantID != "" {
+		req.Header.Set("X-Scope-OrgID", h.cfg.TenantID)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("loki replied %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// labelKey identifies the label set
+func labelKey(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+strconv.Quote(v))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -1,24 +1,17 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"crypto/tls"
 	"flag"
-	"io/ioutil"
+	"fmt"
 	"net/http"
-	"strings"
+	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/fsouza/go-dockerclient"
 )
 
-// ContainerName is the name of the container to restart
-const ContainerName = "app"
-
-// ContainerRepository is the container repository to use
-const ContainerRepository = "jfbrandhorst/grpcweb-example"
-
 // DockerHubWebhook is the structure of the JSON sent by a DockerHub Webhook
 type DockerHubWebhook struct {
 	PushData struct {
@@ -28,7 +21,12 @@ type DockerHubWebhook struct {
 		Pusher   string   `json:"pusher"`
 	} `json:"push_data"`
 	CallbackURL string `json:"callback_url"`
-	Repository  struct {
+	// artifact is the artifact to deploy, as parsed by a plugin
+	artifact *ArtifactRef
+	// verified is set once the webhook is known to be genuine,
+	// by the callback or the plugin that parsed it
+	verified   bool
+	Repository struct {
 		Status          string `json:"status"`
 		Description     string `json:"description"`
 		IsTrusted       bool   `json:"is_trusted"`
@@ -54,6 +52,9 @@ const (
 	Success = HookState("success")
 	Failure = HookState("failure")
 	Error   = HookState("error")
+	// Queued and Running are the states of unfinished deployments
+	Queued  = HookState("queued")
+	Running = HookState("running")
 )
 
 // DockerCallback is the structure of the callback reply
@@ -64,144 +65,317 @@ type DockerCallback struct {
 	TargetURL   string    `json:"target_url"`
 }
 
-// WebhookHandler handles requests
-type WebhookHandler struct {
-	client *docker.Client
+var log *logrus.Logger
+
+func init() {
+	log = logrus.StandardLogger()
+	logrus.SetLevel(logrus.InfoLevel)
+	logrus.SetFormatter(&logrus.TextFormatter{
+		ForceColors:     true,
+		FullTimestamp:   true,
+		TimestampFormat: time.RFC1123,
+		DisableSorting:  true,
+	})
 }
 
-func (h *WebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	content, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		log.Print(err)
-		w.WriteHeader(http.StatusBadRequest)
+var (
+	configPath    = flag.String("config", "", "JSON configuration file (defaults to redeploying jfbrandhorst/grpcweb-example)")
+	environment   = flag.String("env", "", "Environment whose overlay, e.g. config.production.json, is merged into the config")
+	auditLogPath  = flag.String("audit-log", "", "File to append the JSON audit log to")
+	notifyURL     = flag.String("notify-url", "", "URL to post JSON notifications to")
+	slowPhase     = flag.Duration("slow-phase", 0, "Notify when a deploy phase takes longer than this (0 disables)")
+	healthTimeout = flag.Duration("health-timeout", 30*time.Second, "Time to wait for a new container to become healthy")
+	strictHooks   = flag.Bool("reject-unknown-fields", false, "Reject webhook payloads with unknown fields")
+	reconcile     = flag.Bool("reconcile", false, "Redeploy containers that are missing or outdated at startup")
+	driftInterval = flag.Duration("drift-interval", 0, "How often to check containers for drift from their config (0 disables)")
+	archiveDir    = flag.String("archive-dir", "", "Directory of image archives that may be deployed through /api/deploy (empty disables archives on disk)")
+	archiveURLs   = flag.String("archive-urls", "", "Comma-separated URL prefixes image archives may be downloaded from through /api/deploy (empty disables downloads)")
+	stateDir      = flag.String("state-dir", "", "Directory to persist the progress of deploys in, so interrupted deploys are resumed (empty disables)")
+	stateStore    = flag.String("state-store", "", "redis:// or rediss:// URL of a Redis to keep the state shared with other receivers in instead of -state-dir, like pins, history and the audit log")
+	agentListen   = flag.String("agent-listen", "", "Address to accept remote agents on with mutual TLS, e.g. :8443 (empty disables)")
+	agentServer   = flag.String("agent-server", "", "Run as an agent of the receiver with this URL instead of receiving webhooks")
+	tlsCert       = flag.String("tls-cert", "", "Certificate presented to agents or, in agent mode, the receiver")
+	tlsKey        = flag.String("tls-key", "", "Key of -tls-cert")
+	tlsCA         = flag.String("tls-ca", "", "CA that signed the certificates of the agents and receiver")
+	debugLog      = flag.Bool("debug", false, "Log at debug level, also toggled by SIGUSR1")
+	servePprof    = flag.Bool("pprof", false, "Serve runtime profiles to admin tokens on /debug/pprof/")
+	authLogPath   = flag.String("auth-log", "", "File to append failed authentications to, for fail2ban")
+	chaos         = flag.Bool("chaos", false, "Inject the faults of the containers' chaos configuration into their deploys, to rehearse rollbacks and alerting")
+)
+
+func main() {
+	if runCommand() {
 		return
 	}
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] | %s <command> [flags]\nCommands: %s\n", os.Args[0], os.Args[0], commandNames())
+		flag.PrintDefaults()
+	}
+	flag.Parse()
 
-	hook := DockerHubWebhook{}
-	err = json.Unmarshal(content, &hook)
-	if err != nil {
-		log.Print(err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
+	if *debugLog {
+		logrus.SetLevel(logrus.DebugLevel)
 	}
+	watchDebugSignal()
 
-	if !strings.HasPrefix(hook.CallbackURL, "https://registry.hub.docker.com/u/jfbrandhorst/grpcweb-example") {
-		log.Print("Got request not from docker hub")
-		w.WriteHeader(http.StatusBadRequest)
-		return
+	var notifier Notifier = nopNotifier{}
+	if *notifyURL != "" {
+		notifier = &WebhookNotifier{
+			URL:    *notifyURL,
+			Client: &http.Client{Timeout: 10 * time.Second},
+		}
 	}
 
-	reply := DockerCallback{
-		State:       Success,
-		Description: "Redeploy was successful",
-		Context:     "docker-webhook-receiver",
-		TargetURL:   "https://demo.jbrandhorst.com",
+	var tlsConfig *tls.Config
+	if *agentListen != "" || *agentServer != "" {
+		var err error
+		tlsConfig, err = loadTLS(*tlsCert, *tlsKey, *tlsCA)
+		if err != nil {
+			log.Fatal("Failed to load agent TLS config:", err)
+		}
 	}
-	respBytes, err := json.Marshal(&reply)
-	if err != nil {
-		log.Print(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+
+	if *agentServer != "" {
+		agent := &Agent{
+			Server: *agentServer,
+			Client: &http.Client{
+				Timeout: agentPollTimeout + 30*time.Second,
+				Transport: &http.Transport{
+					Proxy:           http.ProxyFromEnvironment,
+					TLSClientConfig: tlsConfig,
+				},
+			},
+			Notifier:      notifier,
+			SlowPhase:     *slowPhase,
+			HealthTimeout: *healthTimeout,
+		}
+		log.Print("Running as agent of ", *agentServer)
+		agent.Run()
 	}
 
-	_, err = http.Post(hook.CallbackURL, "application/json", bytes.NewReader(respBytes))
+	cfg, err := LoadConfig(*configPath, *environment)
 	if err != nil {
-		log.Print(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		log.Fatal("Failed to load config:", err)
+	}
+	if cfg.Log != nil {
+		logFile, err := OpenRotatingFile(cfg.Log)
+		if err != nil {
+			log.Fatal("Failed to open log file:", err)
+		}
+		logrus.AddHook(newFileLogHook(logFile))
+	}
+	if cfg.Loki != nil {
+		logrus.AddHook(NewLokiHook(cfg.Loki))
+	}
+	if cfg.Proxy != nil {
+		useProxy(cfg.Proxy)
+	}
+	for i := range cfg.Plugins {
+		if cfg.Plugins[i].Notify {
+			notifier = multiNotifier{notifier, PluginNotifier{plugin: &cfg.Plugins[i]}}
+		}
+	}
+	if *servePprof && !cfg.HasAPITokens() {
+		log.Fatal("-pprof needs API tokens, so the profiles aren't public")
 	}
 
-	// At this point we can be sure this was a genuine request, because
-	// the CallbackURL worked.
-	err = h.client.StopContainer(ContainerName, 5)
+	if *auditLogPath != "" {
+		cfg.Audit.File = *auditLogPath
+	}
+	audit, err := NewAuditLog(cfg.Audit)
 	if err != nil {
-		log.Print(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		log.Fatal("Failed to open audit log:", err)
+	}
+	authFailures, err = NewAuthFailures(cfg.Lockout, *authLogPath)
+	if err != nil {
+		log.Fatal("Failed to open auth log:", err)
 	}
 
-	err = h.client.RemoveContainer(docker.RemoveContainerOptions{
-		ID:            ContainerName,
-		RemoveVolumes: true,
-	})
+	var agents *AgentHub
+	if *agentListen != "" {
+		agents = NewAgentHub()
+		server := serverDefaults(cfg.Server).newServer(*agentListen, agents.Routes(), tlsConfig)
+		go func() {
+			log.Printf("Accepting agents on https://%s", *agentListen)
+			log.Fatal(server.ListenAndServeTLS("", ""))
+		}()
+	}
+
+	deployers, err := NewDeployers(cfg, notifier, agents)
 	if err != nil {
-		log.Print(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		log.Fatal("Failed to create deployers:", err)
+	}
+	events := NewEventStream()
+	var slos *SLOTracker
+	if cfg.SLO != nil {
+		slos = NewSLOTracker(cfg.SLO, notifier)
+	}
+	for _, d := range deployers {
+		d.SlowPhase = *slowPhase
+		d.HealthTimeout = *healthTimeout
+		d.Chaos = *chaos
+		if d.container.Chaos != nil && !*chaos {
+			log.Printf("Ignoring the chaos configuration of %q without -chaos", d.container.Name)
+		} else if d.container.Chaos != nil {
+			log.Warnf("Injecting faults into the deploys of %q", d.container.Name)
+		}
+		d.Events = events
+		d.Audit = audit
+		d.SLOs = slos
+	}
+
+	var coordinator *Coordinator
+	if cfg.HA != nil {
+		coordinator, err = NewCoordinator(cfg.HA)
+		if err != nil {
+			log.Fatal("Failed to join the HA group:", err)
+		}
+		go coordinator.Run()
+	}
+	for _, d := range deployers {
+		d.coordinator = coordinator
 	}
 
-	err = h.client.PullImage(docker.PullImageOptions{
-		Repository: ContainerRepository,
-		Tag:        "latest",
-	}, docker.AuthConfiguration{})
+	err = WatchEvents(deployers.Docker())
 	if err != nil {
-		log.Print(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		log.Fatal("Failed to watch docker events:", err)
 	}
 
-	container, err := h.client.CreateContainer(docker.CreateContainerOptions{
-		Name: ContainerName,
-		Config: &docker.Config{
-			Image:        ContainerRepository,
-			AttachStderr: true,
-			AttachStdout: true,
-			Cmd: []string{
-				"--host",
-				"demo.jbrandhorst.com",
-			},
-		},
-		HostConfig: &docker.HostConfig{
-			PortBindings: map[docker.Port][]docker.PortBinding{
-				docker.Port("443"): []docker.PortBinding{
-					{HostPort: "443"},
-				},
-			},
-		},
-	})
+	logDir := ""
+	if *stateDir != "" {
+		logDir = filepath.Join(*stateDir, "logs")
+	}
+	deployLogs, err := NewDeployLogs(logDir)
 	if err != nil {
-		log.Print(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		log.Fatal("Failed to create deploy log dir:", err)
 	}
+	logrus.AddHook(deployLogs)
 
-	err = h.client.StartContainer(container.ID, nil)
+	sbomDir := ""
+	if *stateDir != "" {
+		sbomDir = filepath.Join(*stateDir, "sbom")
+	}
+	sboms, err := NewSBOMStore(sbomDir)
 	if err != nil {
-		log.Print(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		log.Fatal("Failed to create SBOM dir:", err)
+	}
+	for _, d := range deployers {
+		d.SBOMs = sboms
 	}
 
-	log.Print("Container restarted successfully")
-	w.WriteHeader(http.StatusOK)
-}
+	if *stateDir != "" {
+		// Checkpoints are of the deploys of this receiver,
+		// so they stay on its disk with a state store
+		checkpoints, err := NewCheckpoints(*stateDir)
+		if err != nil {
+			log.Fatal("Failed to create state dir:", err)
+		}
+		for _, d := range deployers.Docker() {
+			d.Checkpoints = checkpoints
+		}
+	}
 
-var log *logrus.Logger
+	var state StateStore
+	if *stateDir != "" || *stateStore != "" {
+		state, err = NewStateStore(*stateDir, *stateStore)
+		if err != nil {
+			log.Fatal("Failed to open state store:", err)
+		}
+		baselines := NewBaselines(state)
+		for _, d := range deployers.Docker() {
+			d.Baselines = baselines
+			d.loadBaseline()
+		}
+		pins := NewPins(state)
+		for _, d := range deployers {
+			d.Pins = pins
+			d.State = state
+			d.loadPin()
+			d.loadHistory()
+		}
+	}
+	if *stateStore != "" {
+		audit.AddSink(&stateSink{store: state})
+	}
 
-func init() {
-	log = logrus.StandardLogger()
-	logrus.SetLevel(logrus.InfoLevel)
-	logrus.SetFormatter(&logrus.TextFormatter{
-		ForceColors:     true,
-		FullTimestamp:   true,
-		TimestampFormat: time.RFC1123,
-		DisableSorting:  true,
-	})
-}
+	cordons, err := NewCordons(state)
+	if err != nil {
+		log.Fatal("Failed to load cordons:", err)
+	}
+	for _, d := range deployers {
+		d.cordons = cordons
+	}
 
-func main() {
-	flag.Parse()
+	go func() {
+		// Before reconciling, so resumed deploys aren't redeployed
+		ResumeInterrupted(deployers.Docker())
+		Reconcile(deployers.Docker(), *reconcile)
+	}()
 
-	client, err := docker.NewClientFromEnv()
-	if err != nil {
-		log.Fatal("Failed to create docker client:", err)
+	if *driftInterval > 0 {
+		go WatchDrift(deployers.Docker(), *driftInterval)
+	}
+	scheduler := NewScheduler(deployers)
+	scheduler.Run()
+	WatchBaseImages(deployers)
+	if cfg.Certificates != nil {
+		go WatchCertificates(cfg.Certificates, deployers)
 	}
 
 	handler := &WebhookHandler{
-		client: client,
+		cfg:                 cfg,
+		deployers:           deployers,
+		audit:               audit,
+		idempotency:         NewIdempotencyCache(),
+		RejectUnknownFields: *strictHooks,
+	}
+	if cfg.Anomalies != nil {
+		handler.rates = NewPushRates(cfg.Anomalies)
+	}
+	if cfg.ReplayProtection != nil {
+		handler.replays = NewReplayGuard(cfg.ReplayProtection)
+	}
+	handler.deadLetters, err = NewDeadLetters(state)
+	if err != nil {
+		log.Fatal("Failed to load dead letters:", err)
+	}
+
+	router := NewRouter(recoverPanics, securityHeaders, rejectLockedOut)
+	if cfg.AccessLog != nil {
+		accessLog, err := OpenRotatingFile(cfg.AccessLog)
+		if err != nil {
+			log.Fatal("Failed to open access log:", err)
+		}
+		router.AccessLog = accessLog
+	}
+	router.Handle("/docker-webhook", handler, requireJSONPost, longRunning)
+	router.Handle("/docker-webhook/{tenant}", handler, requireJSONPost, longRunning)
+	router.Handle("POST /hooks/{plugin}", handler, longRunning)
+	router.Handle("POST /hooks/{plugin}/{tenant}", handler, longRunning)
+	router.Handle("GET /metrics", metrics)
+	router.Handle("GET /badge/{repo...}", &BadgeHandler{
+		deployers: deployers,
+	})
+	router.Handle("GET /api/openapi.json", http.HandlerFunc(serveOpenAPI))
+	handleAPI(router, &apiServer{
+		cfg:         cfg,
+		deployers:   deployers,
+		webhooks:    handler,
+		events:      events,
+		slos:        slos,
+		deployLogs:  deployLogs,
+		sboms:       sboms,
+		audit:       audit,
+		cordons:     cordons,
+		scheduler:   scheduler,
+		agents:      agents,
+		archiveDir:  *archiveDir,
+		archiveURLs: list(*archiveURLs),
+	})
+
+	if *servePprof {
+		handlePprof(router, cfg)
 	}
 
-	http.HandleFunc("/docker-webhook", handler.ServeHTTP)
-	log.Print("Serving on http://0.0.0.0:8080")
-	log.Fatal(http.ListenAndServe("0.0.0.0:8080", nil))
+	log.Fatal(Serve(cfg.Listeners, cfg.Server, router))
 }
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Collector is a metric that can write itself in the
+// Prometheus text exposition format
+type Collector interface {
+	Collect(w io.Writer)
+}
+
+// Registry serves the registered collectors on the metrics endpoint
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+// Register adds the collector to the registry
+func (r *Registry) Register(c Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, c := range r.collectors {
+		c.Collect(w)
+	}
+}
+
+// metrics is the registry served on /metrics
+var metrics = &Registry{}
+
+// labelString formats the label pairs as {name="value",...}
+func labelString(names, values []string, extra ...string) string {
+	pairs := make([]string, 0, len(names)+len(extra)/2)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+type histogram struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// HistogramVec is a histogram partitioned by label values
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+// NewHistogramVec creates and registers a histogram.
+// The buckets must be sorted in increasing order.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  map[string]*histogram{},
+	}
+	metrics.Register(h)
+	return h
+}
+
+// Observe records the value in the series identified by the label values
+func (h *HistogramVec) Observe(value float64, labels ...string) {
+	key := strings.Join(labels, "\xff")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{
+			labels: labels,
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if value <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+// Collect implements Collector
+func (h *HistogramVec) Collect(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", h.name, h.help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", h.name)
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := h.series[k]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.labels, s.labels, "le", fmt.Sprint(upper)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.labels, s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", h.name, labelString(h.labels, s.labels), s.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelString(h.labels, s.labels), s.count)
+	}
+}
+
+// phaseDuration records how long each deploy phase took
+var phaseDuration = NewHistogramVec(
+	"webhook_deploy_phase_duration_seconds",
+	"Time taken by each phase of a deploy.",
+	[]float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+	"phase",
+)
+
+type gauge struct {
+	labels []string
+	value  float64
+}
+
+// GaugeVec is a gauge partitioned by label values
+type GaugeVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*gauge
+}
+
+// NewGaugeVec creates and registers a gauge
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		series: map[string]*gauge{},
+	}
+	metrics.Register(g)
+	return g
+}
+
+// Set sets the value of the series identified by the label values
+func (g *GaugeVec) Set(value float64, labels ...string) {
+	key := strings.Join(labels, "\xff")
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s, ok := g.series[key]
+	if !ok {
+		s = &gauge{labels: labels}
+		g.series[key] = s
+	}
+	s.value = value
+}
+
+// Collect implements Collector
+func (g *GaugeVec) Collect(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", g.name, g.help)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", g.name)
+	keys := make([]string, 0, len(g.series))
+	for k := range g.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := g.series[k]
+		fmt.Fprintf(w, "%s%s %g\n", g.name, labelString(g.labels, s.labels), s.value)
+	}
+}
+
+// CounterVec is a counter partitioned by label values
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*gauge
+}
+
+// NewCounterVec creates and registers a counter
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		series: map[string]*gauge{},
+	}
+	metrics.Register(c)
+	return c
+}
+
+// Inc increments the series identified by the label values
+func (c *CounterVec) Inc(labels ...string) {
+	key := strings.Join(labels, "\xff")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.series[key]
+	if !ok {
+		s = &gauge{labels: labels}
+		c.series[key] = s
+	}
+	s.value++
+}
+
+// Collect implements Collector
+func (c *CounterVec) Collect(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", c.name, c.help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", c.name)
+	keys := make([]string, 0, len(c.series))
+	for k := range c.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := c.series[k]
+		fmt.Fprintf(w, "%s%s %g\n", c.name, labelString(c.labels, s.labels), s.value)
+	}
+}
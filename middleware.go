@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Codes for requests rejected before reaching a webhook handler
+const (
+	CodeMethodNotAllowed     = ErrorCode("method_not_allowed")
+	CodeUnsupportedMediaType = ErrorCode("unsupported_media_type")
+)
+
+// requireJSONPost only passes POST requests with a JSON body on to h,
+// replying 405 or 415 to anything else
+func requireJSONPost(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			herr := clientError(CodeMethodNotAllowed, PhaseRead, errors.New("webhooks must be sent with POST"))
+			herr.Status = http.StatusMethodNotAllowed
+			writeError(w, herr)
+			return
+		}
+
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+			herr := clientError(CodeUnsupportedMediaType, PhaseRead, errors.New("webhooks must have Content-Type application/json"))
+			herr.Status = http.StatusUnsupportedMediaType
+			writeError(w, herr)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// safeMethod reports whether requests with the method only read
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// crossSite reports whether a browser sent the request from a page of
+// another origin, which could make the requests of a logged in user or
+// of a listener granting a role. Browsers set Sec-Fetch-Site, or else
+// Origin or Referer; requests with none of them aren't from a browser.
+func crossSite(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return false
+	case "":
+	default:
+		return true
+	}
+	source := r.Header.Get("Origin")
+	if source == "" {
+		source = r.Header.Get("Referer")
+	}
+	if source == "" {
+		return false
+	}
+	u, err := url.Parse(source)
+	return err != nil || !strings.EqualFold(u.Host, r.Host)
+}
+
+// securityHeaders sets headers keeping browsers from sniffing, framing
+// or running anything served. Nothing served is HTML, so nothing needs
+// to load scripts or styles.
+func securityHeaders(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		header.Set("Content-Security-Policy", "default-src 'none'; frame-ancestors 'none'")
+		header.Set("X-Content-Type-Options", "nosniff")
+		header.Set("X-Frame-Options", "DENY")
+		header.Set("Referrer-Policy", "no-referrer")
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+func init() {
+	commands["migrate-config"] = migrateConfigCommand
+}
+
+// configVersion is the version of the configuration schema
+// the receiver reads, bumped by every breaking change to it.
+// Version 1 is the first with a configuration file, the
+// receivers before it redeployed a container built into them.
+const configVersion = 1
+
+// configMigration upgrades a configuration file from the
+// previous version, returning descriptions of the changes
+type configMigration func(cfg map[string]interface{}) []string
+
+// configMigrations upgrade version i+1 to i+2
+var configMigrations = []configMigration{}
+
+// releasedConfig is the configuration file of version 1 doing what
+// the receivers without one did, which defaultConfig still does
+func releasedConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"version": configVersion,
+		"tenants": []interface{}{
+			map[string]interface{}{
+				"name": DefaultTenant,
+				"containers": []interface{}{
+					map[string]interface{}{
+						"name":       "app",
+						"repository": "jfbrandhorst/grpcweb-example",
+						"tag":        "latest",
+						"cmd":        []interface{}{"--host", "demo.jbrandhorst.com"},
+						"ports":      map[string]interface{}{"443": "443"},
+						"target_url": "https://demo.jbrandhorst.com",
+					},
+				},
+			},
+		},
+	}
+}
+
+// migrateConfig upgrades the parsed configuration file in place to
+// configVersion, returning what changed. Files without a version
+// are version 1.
+func migrateConfig(v interface{}) ([]string, error) {
+	cfg, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("configuration isn't an object")
+	}
+	version := 1
+	switch n := cfg["version"].(type) {
+	case nil:
+	case float64:
+		version = int(n)
+		if float64(version) != n {
+			return nil, fmt.Errorf("invalid version %v", n)
+		}
+	case json.Number:
+		var err error
+		version, err = strconv.Atoi(n.String())
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %v", n)
+		}
+	default:
+		return nil, fmt.Errorf("invalid version %v", n)
+	}
+	if version < 1 || version > configVersion {
+		return nil, fmt.Errorf("unsupported version %d, this receiver reads versions up to %d", version, configVersion)
+	}
+
+	var changes []string
+	for ; version < configVersion; version++ {
+		changes = append(changes, configMigrations[version-1](cfg)...)
+	}
+	cfg["version"] = configVersion
+	return changes, nil
+}
+
+// readConfigFile reads a configuration file like readJSONFile,
+// migrating it to configVersion
+func readConfigFile(path string) (interface{}, error) {
+	v, err := readJSONFile(path)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := migrateConfig(v)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for _, change := range changes {
+		log.Warnf("%s: %s, run migrate-config to update the file", path, change)
+	}
+	return v, nil
+}
+
+// migrateConfigCommand migrates configuration files to configVersion,
+// printing the result or rewriting the files. Without files, it prints
+// the configuration file of the receivers that had none.
+func migrateConfigCommand(args []string) error {
+	fs := flag.NewFlagSet("migrate-config", flag.ExitOnError)
+	write := fs.Bool("w", false, "Rewrite the files, keeping the originals as .bak, instead of printing the result")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: docker-webhook-receiver migrate-config [-w] [config.json config.production.json ...]")
+		fmt.Fprintf(fs.Output(), "Migrates configuration files to version %d. Without files, prints\n", configVersion)
+		fmt.Fprintln(fs.Output(), "the configuration of receivers from before configuration files.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		if *write {
+			return errors.New("-w needs configuration files to rewrite")
+		}
+		return writeConfig(os.Stdout, releasedConfig())
+	}
+	if fs.NArg() > 1 && !*write {
+		return errors.New("-w is needed to migrate several files")
+	}
+	for _, path := range fs.Args() {
+		err := migrateConfigFile(path, *write)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// migrateConfigFile migrates the file, as it is on disk
+// without templates expanded or variables interpolated
+func migrateConfigFile(path string, write bool) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(content))
+	// Keeps numbers as written
+	dec.UseNumber()
+	var v interface{}
+	err = dec.Decode(&v)
+	if err != nil {
+		return fmt.Errorf("not plain JSON, templates must be migrated by hand: %v", err)
+	}
+	if m, ok := v.(map[string]interface{}); ok && fmt.Sprint(m["version"]) == strconv.Itoa(configVersion) {
+		fmt.Fprintf(os.Stderr, "%s is at version %d already\n", path, configVersion)
+		return nil
+	}
+	changes, err := migrateConfig(v)
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	err = writeConfig(&out, v)
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path, change)
+	}
+	if !write {
+		_, err = os.Stdout.Write(out.Bytes())
+		return err
+	}
+	err = os.WriteFile(path+".bak", content, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(path, out.Bytes(), info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Migrated %s to version %d, the original is %s.bak\n", path, configVersion, path)
+	return nil
+}
+
+// writeConfig writes the configuration as indented JSON
+func writeConfig(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
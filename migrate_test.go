@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReleasedConfig(t *testing.T) {
+	var out bytes.Buffer
+	err := writeConfig(&out, releasedConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "config.json")
+	err = os.WriteFile(path, out.Bytes(), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := defaultConfig()
+	want.Version = configVersion
+	err = want.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("got %+v, want the default %+v", cfg.Tenants, want.Tenants)
+	}
+}
+
+func TestMigrateConfig(t *testing.T) {
+	for _, tt := range []struct {
+		config, err string
+	}{
+		{`{"tenants": []}`, ""},
+		{`{"version": 1, "tenants": []}`, ""},
+		{`{"version": 0}`, "unsupported version 0"},
+		{`{"version": 2}`, "unsupported version 2"},
+		{`{"version": 1.5}`, "invalid version"},
+		{`{"version": "1"}`, "invalid version"},
+		{`[]`, "isn't an object"},
+	} {
+		var v interface{}
+		err := json.Unmarshal([]byte(tt.config), &v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		changes, err := migrateConfig(v)
+		if tt.err == "" {
+			if err != nil || len(changes) != 0 || v.(map[string]interface{})["version"] != configVersion {
+				t.Errorf("%s: got %v, %v, %v", tt.config, v, changes, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got %v, want %q", tt.config, err, tt.err)
+		}
+	}
+}
+
+func TestMigrateConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	original := []byte(`{"tenants": [{"name": "default", "api_tokens": ["s3cr3t"], "containers": [{"name": "app", "repository": "example/app", "keep_old": 2}]}]}`)
+	err := os.WriteFile(path, original, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = migrateConfigFile(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup, err := os.ReadFile(path + ".bak")
+	if err != nil || !bytes.Equal(backup, original) {
+		t.Errorf("got backup %s, %v", backup, err)
+	}
+	cfg, err := LoadConfig(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Version != configVersion || cfg.Tenants[0].Containers[0].KeepOld != 2 {
+		t.Errorf("got %+v", cfg)
+	}
+	if tok := cfg.Tenants[0].APITokens; len(tok) != 1 || tok[0].Role != RoleAdmin {
+		t.Errorf("got tokens %+v, want the plain token as admin", tok)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// mirrorRepository returns the repository in the mirror of the
+// container, the path of the repository under the mirror
+func (d *Deployer) mirrorRepository() string {
+	repo := qualifiedRepository(d.container.Repository)
+	path := strings.SplitN(repo, "/", 2)[1]
+	return strings.TrimSuffix(d.container.Mirror, "/") + "/" + path
+}
+
+// pull pulls version of the repository, from the mirror of the
+// container if it has one, falling back to the registry if the
+// mirror fails. Digests are always pulled from the registry, as
+// images pulled from the mirror can only be tagged with the
+// name of the repository.
+func (d *Deployer) pull(version string) error {
+	if d.container.Mirror != "" && !strings.HasPrefix(version, "sha256:") {
+		err := d.pullMirror(version)
+		if err == nil {
+			return nil
+		}
+		d.logger().Printf("Failed to pull %s from mirror %s, pulling from the registry: %v", d.imageRef(version), d.container.Mirror, err)
+	}
+
+	return d.client.PullImage(docker.PullImageOptions{
+		Repository: d.repository(),
+		Tag:        version,
+	}, docker.AuthConfiguration{})
+}
+
+// pullMirror pulls tag from the mirror and tags it as the
+// repository's, so the rest of the deploy doesn't need
+// to know where it came from
+func (d *Deployer) pullMirror(tag string) error {
+	mirrored := d.mirrorRepository()
+	err := d.client.PullImage(docker.PullImageOptions{
+		Repository: mirrored,
+		Tag:        tag,
+	}, docker.AuthConfiguration{})
+	if err != nil {
+		return err
+	}
+	return d.client.TagImage(mirrored+":"+tag, docker.TagImageOptions{
+		Repo:  d.repository(),
+		Tag:   tag,
+		Force: true,
+	})
+}
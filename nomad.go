@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// EngineNomad deploys by updating the image of a Nomad job's task
+const EngineNomad = "nomad"
+
+// Phases of a Nomad deploy
+const (
+	// PhaseSubmit registers the updated job with Nomad
+	PhaseSubmit = Phase("submit")
+	// PhaseRollout waits for Nomad to place and verify the new allocations
+	PhaseRollout = Phase("rollout")
+)
+
+// NomadConfig is the Nomad job task a container is deployed as
+type NomadConfig struct {
+	// Address of the Nomad HTTP API, NOMAD_ADDR or
+	// http://127.0.0.1:4646 if empty
+	Address string `json:"address"`
+	// Token is sent as the ACL token, NOMAD_TOKEN if empty
+	Token     string `json:"token"`
+	Namespace string `json:"namespace"`
+	Job       string `json:"job"`
+	// Group is the task group of the task, the
+	// only group of the job if empty
+	Group string `json:"group"`
+	Task  string `json:"task"`
+	// Timeout is how long to wait for the rollout, 10m if empty
+	Timeout string `json:"timeout"`
+}
+
+func (c *NomadConfig) validate() error {
+	if c.Job == "" || c.Task == "" {
+		return errors.New("nomad needs a job and task")
+	}
+	if c.Address == "" {
+		c.Address = os.Getenv("NOMAD_ADDR")
+	}
+	if c.Address == "" {
+		c.Address = "http://127.0.0.1:4646"
+	}
+	if c.Token == "" {
+		c.Token = os.Getenv("NOMAD_TOKEN")
+	}
+	if c.Timeout == "" {
+		c.Timeout = "10m"
+	}
+	_, err := time.ParseDuration(c.Timeout)
+	if err != nil {
+		return fmt.Errorf("invalid nomad timeout: %v", err)
+	}
+	return nil
+}
+
+// NomadJob is the strategy of containers run by Nomad. It sets the image
+// of the task and resubmits the job, leaving the rollout (and rolling back,
+// with auto_revert in the job's update block) to Nomad.
+type NomadJob struct {
+	cfg    *NomadConfig
+	client *http.Client
+}
+
+// Deploy implements Strategy
+func (n NomadJob) Deploy(d *Deployer, dep *Deployment, version string) *HookError {
+	var evalID string
+	herr := d.phase(PhaseSubmit, func() error {
+		var job map[string]interface{}
+		err := n.do("GET", "/v1/job/"+url.PathEscape(n.cfg.Job), nil, &job)
+		if err != nil {
+			return err
+		}
+
+		config, err := n.taskConfig(job)
+		if err != nil {
+			return err
+		}
+		if prev, ok := config["image"].(string); ok {
+			dep.PreviousImage = prev
+		}
+		config["image"] = d.imageRef(version)
+
+		var resp struct {
+			EvalID string
+		}
+		err = n.do("POST", "/v1/job/"+url.PathEscape(n.cfg.Job), map[string]interface{}{"Job": job}, &resp)
+		evalID = resp.EvalID
+		return err
+	})
+	if herr != nil {
+		return herr
+	}
+
+	herr = d.phase(PhaseRollout, func() error {
+		return n.waitRollout(evalID)
+	})
+	if herr != nil {
+		herr.Code = CodeUnhealthy
+	}
+	return herr
+}
+
+// taskConfig returns the driver config of the configured task in job
+func (n NomadJob) taskConfig(job map[string]interface{}) (map[string]interface{}, error) {
+	groups, _ := job["TaskGroups"].([]interface{})
+	for _, g := range groups {
+		group, _ := g.(map[string]interface{})
+		if n.cfg.Group != "" && group["Name"] != n.cfg.Group {
+			continue
+		}
+		if n.cfg.Group == "" && len(groups) > 1 {
+			return nil, fmt.Errorf("job %q has several task groups, configure the group", n.cfg.Job)
+		}
+
+		tasks, _ := group["Tasks"].([]interface{})
+		for _, t := range tasks {
+			task, _ := t.(map[string]interface{})
+			if task["Name"] != n.cfg.Task {
+				continue
+			}
+			config, ok := task["Config"].(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("task %q has no driver config", n.cfg.Task)
+			}
+			return config, nil
+		}
+	}
+
+	return nil, fmt.Errorf("job %q has no task %q", n.cfg.Job, n.cfg.Task)
+}
+
+// waitRollout waits for the evaluation of the new job version to
+// place its allocations and for the resulting deployment to finish
+func (n NomadJob) waitRollout(evalID string) error {
+	timeout, _ := time.ParseDuration(n.cfg.Timeout)
+	deadline := time.Now().Add(timeout)
+
+	var deploymentID string
+	for {
+		var eval struct {
+			Status            string
+			StatusDescription string
+			DeploymentID      string
+			FailedTGAllocs    map[string]interface{}
+		}
+		err := n.do("GET", "/v1/evaluation/"+url.PathEscape(evalID), nil, &eval)
+		if err != nil {
+			return err
+		}
+		if len(eval.FailedTGAllocs) > 0 {
+			return errors.New("nomad failed to place the new allocations")
+		}
+		if eval.Status == "complete" {
+			deploymentID = eval.DeploymentID
+			break
+		}
+		if eval.Status != "pending" && eval.Status != "blocked" {
+			return fmt.Errorf("nomad evaluation %s: %s", eval.Status, eval.StatusDescription)
+		}
+		if time.Now().After(deadline) {
+			return errors.New("timed out waiting for nomad to evaluate the job")
+		}
+		time.Sleep(2 * time.Second)
+	}
+
+	if deploymentID == "" {
+		// Jobs without an update block are not rolled out in a deployment
+		return nil
+	}
+
+	for {
+		var deployment struct {
+			Status            string
+			StatusDescription string
+		}
+		err := n.do("GET", "/v1/deployment/"+url.PathEscape(deploymentID), nil, &deployment)
+		if err != nil {
+			return err
+		}
+		switch deployment.Status {
+		case "successful":
+			return nil
+		case "failed", "cancelled":
+			return fmt.Errorf("nomad deployment %s: %s", deployment.Status, deployment.StatusDescription)
+		}
+		if time.Now().After(deadline) {
+			return errors.New("timed out waiting for the nomad deployment")
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// do calls the Nomad API, encoding in as the request body and
+// decoding the response into out
+func (n NomadJob) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		content, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(content)
+	}
+
+	u := strings.TrimSuffix(n.cfg.Address, "/") + path
+	if n.cfg.Namespace != "" {
+		u += "?namespace=" + url.QueryEscape(n.cfg.Namespace)
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return err
+	}
+	if n.cfg.Token != "" {
+		req.Header.Set("X-Nomad-Token", n.cfg.Token)
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("nomad %s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Docker returns the deployers of containers run by a Docker API,
+// which can be inspected and watched for events
+func (ds Deployers) Docker() Deployers {
+	var res Deployers
+	for _, d := range ds {
+		if d.client != nil {
+			res = append(res, d)
+		}
+	}
+	return res
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Event names a kind of notification
+type Event string
+
+// Allowed values of Event
+const (
+	EventSlowPhase = Event("slow_phase")
+)
+
+// Notification is sent to the notifier when something
+// noteworthy happens during a deploy
+type Notification struct {
+	Event     Event     `json:"event"`
+	Time      time.Time `json:"time"`
+	Container string    `json:"container"`
+	// DeploymentID is the deployment the notification is about, if any
+	DeploymentID string `json:"deployment_id,omitempty"`
+	Phase        Phase  `json:"phase,omitempty"`
+	Message      string `json:"message"`
+	// Labels are the OCI labels of the deployed image, if any
+	Labels *ImageLabels `json:"labels,omitempty"`
+	// Commit is the source commit of the deployed image, if known
+	Commit *Commit `json:"commit,omitempty"`
+}
+
+// Notifier delivers notifications
+type Notifier interface {
+	Notify(n Notification) error
+}
+
+// WebhookNotifier posts notifications as JSON to a URL
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+// Notify implements Notifier
+func (wn *WebhookNotifier) Notify(n Notification) error {
+	content, err := json.Marshal(&n)
+	if err != nil {
+		return err
+	}
+
+	resp, err := wn.Client.Post(wn.URL, "application/json", bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("notification rejected with status %s", resp.Status)
+	}
+
+	return nil
+}
+
+type nopNotifier struct{}
+
+func (nopNotifier) Notify(Notification) error { return nil }
+
+// multiNotifier delivers notifications to all of its notifiers
+type multiNotifier []Notifier
+
+// Notify implements Notifier
+func (m multiNotifier) Notify(n Notification) error {
+	var errs []string
+	for _, notifier := range m {
+		err := notifier.Notify(n)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// notify sends the notification in the background,
+// logging any failure to deliver it
+func notify(notifier Notifier, n Notification) {
+	if n.Time.IsZero() {
+		n.Time = time.Now()
+	}
+	go func() {
+		err := notifier.Notify(n)
+		if err != nil {
+			log.Print("Failed to send notification: ", err)
+		}
+	}()
+}
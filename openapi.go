@@ -0,0 +1,21 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec describes the management API. The client
+// package must be updated along with it.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// serveOpenAPI serves the OpenAPI specification of the API
+func serveOpenAPI(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, err := w.Write(openAPISpec)
+	if err != nil {
+		log.Print(err)
+	}
+}
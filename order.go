@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CodeDependencyFailed is used for deploys skipped because a
+// container they depend on failed to deploy
+const CodeDependencyFailed = ErrorCode("dependency_failed")
+
+// PhaseDependencies is waiting for the deploys of the
+// containers a container depends on
+const PhaseDependencies = Phase("dependencies")
+
+// runOrdered runs the pipelines of the deployers, each already
+// enqueued as the deployment of the same index, in parallel. Each
+// waits for the deploys of the deployers it depends on, which only
+// pass after their container became healthy. Deploys depending on a
+// container that failed to deploy are failed without running. It
+// returns the deployments of all pipelines and the first failure.
+func (ds Deployers) runOrdered(deployers Deployers, enqueued []*Deployment, tag string, payload *WebhookPayload) ([]*Deployment, *HookError) {
+	type result struct {
+		deployments []*Deployment
+		herr        *HookError
+	}
+	results := make([]result, len(deployers))
+	index := map[string]int{}
+	done := make([]chan struct{}, len(deployers))
+	for i, d := range deployers {
+		index[d.container.Name] = i
+		done[i] = make(chan struct{})
+	}
+
+	var wg sync.WaitGroup
+	for i, d := range deployers {
+		wg.Add(1)
+		go func(i int, d *Deployer) {
+			defer wg.Done()
+			defer close(done[i])
+			for _, name := range d.container.DependsOn {
+				j, ok := index[name]
+				if !ok {
+					// Not deployed by this push
+					continue
+				}
+				<-done[j]
+				if results[j].herr != nil {
+					herr := serverError(CodeDependencyFailed, PhaseDependencies, fmt.Errorf("dependency %q failed to deploy", name))
+					d.skip(enqueued[i], herr)
+					results[i] = result{[]*Deployment{enqueued[i]}, herr}
+					return
+				}
+			}
+			deployments, herr := ds.runPipeline(d, enqueued[i], tag, payload)
+			results[i] = result{deployments, herr}
+		}(i, d)
+	}
+	wg.Wait()
+
+	var deployments []*Deployment
+	var first *HookError
+	for _, r := range results {
+		deployments = append(deployments, r.deployments...)
+		if first == nil {
+			first = r.herr
+		}
+	}
+	return deployments, first
+}
+
+// skip fails the enqueued deploy without running it
+func (d *Deployer) skip(dep *Deployment, herr *HookError) {
+	d.mu.Lock()
+	if dep.Finished() {
+		d.mu.Unlock()
+		return
+	}
+	dep.StartedAt = time.Now()
+	dep.FinishedAt = dep.StartedAt
+	dep.Result = Error
+	dep.Error = herr
+	for i, q := range d.queue {
+		if q == dep {
+			d.queue = append(d.queue[:i:i], d.queue[i+1:]...)
+			break
+		}
+	}
+	d.recordHistory(dep)
+	d.mu.Unlock()
+	d.saveHistory(dep)
+
+	log.WithField("deployment", dep.ID).Printf("Skipped deploy of %q: %s", d.container.Name, herr.Message)
+	d.Events.Publish(StreamEvent{
+		Event:        EventDeployFinished,
+		Tenant:       d.tenant,
+		Container:    d.container.Name,
+		DeploymentID: dep.ID,
+		Deployment:   dep,
+	})
+}
+
+// combinedState is the state of a set of deployments: the first
+// of error, failure, running and queued any is in, success otherwise
+func combinedState(deployments []*Deployment) HookState {
+	for _, state := range []HookState{Error, Failure, Running, Queued} {
+		for _, dep := range deployments {
+			if dep.Result == state {
+				return state
+			}
+		}
+	}
+	return Success
+}
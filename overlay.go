@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// overlayPath returns the path of the overlay of the config file
+// for the environment, e.g. config.production.json for config.json
+func overlayPath(path, env string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + env + ext
+}
+
+// readConfigTree reads the config file with the overlay of the
+// environment, if any, both migrated to the current version and
+// merged, container templates
+// instantiated and environment variables interpolated,
+// returning the resulting JSON
+func readConfigTree(path, env string) ([]byte, error) {
+	base, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if env != "" {
+		overlay, err := readConfigFile(overlayPath(path, env))
+		if err != nil {
+			return nil, err
+		}
+		base = mergeJSON(base, overlay)
+	}
+
+	base, err = instantiateTemplates(base)
+	if err != nil {
+		return nil, err
+	}
+	base, err = interpolate(base)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(base)
+}
+
+func readJSONFile(path string) (interface{}, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	content, err = expandTemplate(path, filepath.Dir(path), content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to expand %s: %v", path, err)
+	}
+	var v interface{}
+	err = json.Unmarshal(content, &v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return v, nil
+}
+
+// mergeJSON merges overlay into base. Objects are merged key by key,
+// with null removing the key. Lists of named objects, like tenants and
+// containers, are merged by name, other values are replaced.
+func mergeJSON(base, overlay interface{}) interface{} {
+	switch o := overlay.(type) {
+	case map[string]interface{}:
+		b, ok := base.(map[string]interface{})
+		if !ok {
+			return o
+		}
+		for k, v := range o {
+			if v == nil {
+				delete(b, k)
+				continue
+			}
+			b[k] = mergeJSON(b[k], v)
+		}
+		return b
+	case []interface{}:
+		b, ok := base.([]interface{})
+		if !ok || !named(b) || !named(o) {
+			return o
+		}
+		for _, ov := range o {
+			name := ov.(map[string]interface{})["name"]
+			found := false
+			for i, bv := range b {
+				if bv.(map[string]interface{})["name"] == name {
+					b[i] = mergeJSON(bv, ov)
+					found = true
+					break
+				}
+			}
+			if !found {
+				b = append(b, ov)
+			}
+		}
+		return b
+	default:
+		return overlay
+	}
+}
+
+// named reports whether the list only contains objects with a name
+func named(list []interface{}) bool {
+	for _, v := range list {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		if _, ok := m["name"].(string); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// variable matches ${NAME} and ${NAME:-default}, as well as
+// $${NAME}, which escapes a literal ${NAME}
+var variable = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// interpolate replaces variables in all strings of v with the
+// value of the environment variable or the default. Variables
+// that are unset without a default are an error. Escaped
+// variables are unescaped, e.g. for placeholders replaced later.
+func interpolate(v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			var err error
+			t[k], err = interpolate(e)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		for i, e := range t {
+			var err error
+			t[i], err = interpolate(e)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case string:
+		var missing []string
+		s := variable.ReplaceAllStringFunc(t, func(match string) string {
+			if strings.HasPrefix(match, "$$") {
+				return match[1:]
+			}
+			m := variable.FindStringSubmatch(match)
+			if value, ok := os.LookupEnv(m[1]); ok {
+				return value
+			}
+			if m[2] == "" {
+				missing = append(missing, m[1])
+			}
+			return m[3]
+		})
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("environment variables %s are not set", strings.Join(missing, ", "))
+		}
+		return s, nil
+	}
+	return v, nil
+}
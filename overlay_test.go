@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// readmeExample returns the first example in the language
+// of the README containing s
+func readmeExample(t *testing.T, lang, s string) string {
+	t.Helper()
+	content, err := os.ReadFile("README.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, block := range strings.Split(string(content), "```"+lang+"\n")[1:] {
+		block = block[:strings.Index(block, "```")]
+		if strings.Contains(block, s) {
+			return block
+		}
+	}
+	t.Fatalf("no README example with %s", s)
+	return ""
+}
+
+func TestInterpolate(t *testing.T) {
+	t.Setenv("TAG", "v2")
+	t.Setenv("EMPTY", "")
+	for s, want := range map[string]string{
+		"${TAG}":                "v2",
+		"app:${TAG}":            "app:v2",
+		"${EMPTY:-default}":     "",
+		"${UNSET_VAR:-default}": "default",
+		"$${TAG}":               "${TAG}",
+		"app:$${TAG}-${TAG}":    "app:${TAG}-v2",
+		"$${UNSET_VAR}":         "${UNSET_VAR}",
+		"$TAG":                  "$TAG",
+	} {
+		got, err := interpolate(s)
+		if err != nil || got != want {
+			t.Errorf("%s: got %v, %v, want %s", s, got, err, want)
+		}
+	}
+
+	_, err := interpolate([]interface{}{"${UNSET_VAR}"})
+	if err == nil {
+		t.Error("unset variable without default interpolated")
+	}
+}
+
+func TestLoadConfigUpdateExample(t *testing.T) {
+	// Must not be baked into the command
+	t.Setenv("TAG", "from-the-environment")
+	path := filepath.Join(t.TempDir(), "config.json")
+	container := readmeExample(t, "json", `"config_update"`)
+	err := os.WriteFile(path, []byte(`{"version": 1, "tenants": [{"name": "default", "containers": [`+container+`]}]}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := cfg.Tenants[0].Containers[0].ConfigUpdate
+	want := []string{"/usr/local/bin/reload-config", "${TAG}"}
+	if update == nil || !reflect.DeepEqual(update.Exec, want) {
+		t.Fatalf("got config update %+v, want exec %q", update, want)
+	}
+}
+
+func TestSubstituteKeepsEscapes(t *testing.T) {
+	got := substitute("$${service}-${service}", map[string]interface{}{"service": "billing"})
+	if got != "$${service}-billing" {
+		t.Errorf("got %v", got)
+	}
+	got = substitute("$${keep}", map[string]interface{}{"keep": 5})
+	if got != "$${keep}" {
+		t.Errorf("got %v", got)
+	}
+}
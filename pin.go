@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Held is the state of deploys held while their container is pinned
+const Held = HookState("held")
+
+// PhasePin pins a container to the image it runs
+const PhasePin = Phase("pin")
+
+// Pin holds a container at the image it ran when it was pinned.
+// Deploys of pinned containers are recorded, but not run until
+// the container is unpinned.
+type Pin struct {
+	Image    string    `json:"image"`
+	Digest   string    `json:"digest,omitempty"`
+	PinnedAt time.Time `json:"pinned_at"`
+	// Held are the IDs of the deploys held since the container was pinned
+	Held []string `json:"held,omitempty"`
+	// Released is the deploy of the last held version
+	// started by unpinning the container, if any
+	Released string `json:"released,omitempty"`
+
+	// last is the last held deploy and version, run when unpinned
+	last        *Deployment
+	lastVersion string
+}
+
+// storedPin is a pin as kept in the state store, with the last held
+// deploy, so any receiver sharing the store can release it
+type storedPin struct {
+	*Pin
+	Last        *Deployment `json:"last,omitempty"`
+	LastVersion string      `json:"last_version,omitempty"`
+	// LastWebhook is the payload of Last, left out of deployments
+	LastWebhook *WebhookPayload `json:"last_webhook,omitempty"`
+}
+
+// Pins stores the pin of each pinned container in the state store
+type Pins struct {
+	store StateStore
+}
+
+// NewPins stores pins in the store
+func NewPins(store StateStore) *Pins {
+	return &Pins{store: store}
+}
+
+func (p *Pins) key(container string) string {
+	return container + ".pin.json"
+}
+
+// Save replaces the pin of the container
+func (p *Pins) Save(container string, pin *Pin) error {
+	stored := storedPin{Pin: pin, Last: pin.last, LastVersion: pin.lastVersion}
+	if pin.last != nil {
+		stored.LastWebhook = pin.last.Webhook
+	}
+	content, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	return p.store.Put(p.key(container), content)
+}
+
+// Load returns the pin of the container, nil if it isn't pinned
+func (p *Pins) Load(container string) (*Pin, error) {
+	content, err := p.store.Get(p.key(container))
+	if err != nil || content == nil {
+		return nil, err
+	}
+	stored := storedPin{Pin: &Pin{}}
+	err = json.Unmarshal(content, &stored)
+	if err != nil {
+		return nil, err
+	}
+	pin := stored.Pin
+	if stored.Last != nil {
+		stored.Last.Webhook = stored.LastWebhook
+		pin.last, pin.lastVersion = stored.Last, stored.LastVersion
+	}
+	return pin, nil
+}
+
+// Clear unpins the container
+func (p *Pins) Clear(container string) error {
+	return p.store.Delete(p.key(container))
+}
+
+// loadPin restores the pin of the container, if it is pinned
+func (d *Deployer) loadPin() {
+	if d.Pins == nil {
+		return
+	}
+	pin, err := d.Pins.Load(d.container.Name)
+	if err != nil {
+		log.Printf("Failed to load pin of %q: %v", d.container.Name, err)
+		return
+	}
+	if pin != nil {
+		log.Printf("Container %q is pinned to %s", d.container.Name, shortID(pin.Image))
+	}
+	d.mu.Lock()
+	d.pin = pin
+	d.mu.Unlock()
+}
+
+// refreshPin reloads the pin from the state store, where receivers
+// sharing the store may have pinned or unpinned the container, or
+// held deploys
+func (d *Deployer) refreshPin() {
+	if d.Pins == nil {
+		return
+	}
+	pin, err := d.Pins.Load(d.container.Name)
+	if err != nil {
+		d.logger().Printf("Failed to reload pin of %q, keeping the last known: %v", d.container.Name, err)
+		return
+	}
+	d.mu.Lock()
+	d.pin = pin
+	d.mu.Unlock()
+}
+
+// Pinned returns a copy of the pin of the container, nil if it isn't pinned
+func (d *Deployer) Pinned() *Pin {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.pin == nil {
+		return nil
+	}
+	pin := *d.pin
+	pin.Held = append([]string(nil), pin.Held...)
+	return &pin
+}
+
+// Pin pins the container to the image it runs
+func (d *Deployer) Pin() (*Pin, *HookError) {
+	d.running.Lock()
+	defer d.running.Unlock()
+	d.refreshPin()
+
+	if pin := d.Pinned(); pin != nil {
+		return pin, nil
+	}
+	pin := &Pin{PinnedAt: time.Now()}
+	if d.client != nil {
+		c, err := d.client.InspectContainer(d.container.Name)
+		if err != nil {
+			return nil, serverError(CodeDockerError, PhasePin, err)
+		}
+		pin.Image = c.Image
+		img, err := d.client.InspectImage(c.Image)
+		if err == nil {
+			pin.Digest = repoDigest(img, d.repository())
+		}
+	} else {
+		// Run by an orchestrator, only the deploys are known
+		for _, dep := range d.History() {
+			if dep.Result == Success && dep.Action == "" {
+				pin.Image, pin.Digest = dep.Image, dep.Digest
+			}
+		}
+	}
+	if pin.Image == "" && pin.Digest == "" {
+		herr := clientError(CodeInvalidPayload, PhasePin, fmt.Errorf("nothing is deployed to %q to pin it to", d.container.Name))
+		herr.Status = http.StatusConflict
+		return nil, herr
+	}
+
+	if d.Pins != nil {
+		err := d.Pins.Save(d.container.Name, pin)
+		if err != nil {
+			return nil, serverError(CodeInternal, PhasePin, err)
+		}
+	}
+	d.mu.Lock()
+	d.pin = pin
+	d.mu.Unlock()
+	d.logger().Printf("Pinned %q to %s", d.container.Name, shortID(pin.Image))
+	return d.Pinned(), nil
+}
+
+// Unpin unpins the container, deploying the last version held
+// while it was pinned, if any. It returns the removed pin, or
+// nil if the container wasn't pinned.
+func (d *Deployer) Unpin() (*Pin, *HookError) {
+	d.running.Lock()
+	defer d.running.Unlock()
+	d.refreshPin()
+
+	if d.Pins != nil {
+		err := d.Pins.Clear(d.container.Name)
+		if err != nil {
+			return nil, serverError(CodeInternal, PhasePin, err)
+		}
+	}
+	d.mu.Lock()
+	pin := d.pin
+	d.pin = nil
+	d.mu.Unlock()
+	if pin == nil {
+		return nil, nil
+	}
+	released := *pin
+	d.logger().Printf("Unpinned %q", d.container.Name)
+
+	if last := released.last; last != nil {
+		dep := d.enqueue(last.Tag, last.Webhook)
+		dep.Action, dep.Repository = last.Action, last.Repository
+		dep.Archive, dep.Artifact = last.Archive, last.Artifact
+		released.Released = dep.ID
+		go func() {
+			herr := d.execute(dep, released.lastVersion)
+			if herr != nil {
+				log.Print(herr)
+			}
+		}()
+	}
+	return &released, nil
+}
+
+// hold records the enqueued deploy of version as held instead of running
+// it if the container is pinned, returning whether it was held
+func (d *Deployer) hold(dep *Deployment, version string) bool {
+	d.refreshPin()
+	d.mu.Lock()
+	pin := d.pin
+	if pin == nil {
+		d.mu.Unlock()
+		return false
+	}
+	dep.StartedAt = time.Now()
+	dep.FinishedAt = dep.StartedAt
+	dep.Result = Held
+	pin.Held = append(pin.Held, dep.ID)
+	pin.last, pin.lastVersion = dep, version
+	for i, q := range d.queue {
+		if q == dep {
+			d.queue = append(d.queue[:i:i], d.queue[i+1:]...)
+			break
+		}
+	}
+	d.recordHistory(dep)
+	saved := *pin
+	d.mu.Unlock()
+	d.saveHistory(dep)
+
+	if d.Pins != nil {
+		err := d.Pins.Save(d.container.Name, &saved)
+		if err != nil {
+			d.logger().Printf("Failed to save pin of %q: %v", d.container.Name, err)
+		}
+	}
+	log.WithField("deployment", dep.ID).Printf("Held deploy of %s to %q, which is pinned to %s", d.imageRef(version), d.container.Name, shortID(pin.Image))
+	d.Events.Publish(StreamEvent{
+		Event:        EventDeployFinished,
+		Tenant:       d.tenant,
+		Container:    d.container.Name,
+		DeploymentID: dep.ID,
+		Deployment:   dep,
+	})
+	return true
+}
+
+// PinHandler pins a container on POST /api/containers/{name}/pin
+// and unpins it on DELETE
+type PinHandler struct {
+	deployers Deployers
+	audit     *AuditLog
+}
+
+func (h *PinHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d, ok := h.deployers.ForTenant(requestTenant(r)).Container(r.PathValue("name"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	var pin *Pin
+	var herr *HookError
+	if r.Method == http.MethodDelete {
+		pin, herr = d.Unpin()
+		if herr == nil && pin == nil {
+			herr = clientError(CodeInvalidPayload, PhasePin, errors.New("container isn't pinned"))
+			herr.Status = http.StatusNotFound
+		}
+	} else {
+		pin, herr = d.Pin()
+	}
+
+	entry := AuditEntry{
+		Remote:     r.RemoteAddr,
+		Tenant:     d.tenant,
+		Repository: d.container.Repository,
+		Tag:        d.container.Tag,
+		Result:     Success,
+	}
+	if pin != nil && pin.Released != "" {
+		entry.Deployments = []string{pin.Released}
+	}
+	if herr != nil {
+		entry.Result = Error
+		entry.Error = herr
+	}
+	h.audit.Record(entry)
+
+	if herr != nil {
+		writeError(w, herr)
+		return
+	}
+	writeJSON(w, http.StatusOK, pin)
+}
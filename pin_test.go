@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPinSharedStore(t *testing.T) {
+	store, err := NewDirStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pins := NewPins(store)
+	client := newFakeDocker()
+	v1 := client.addImage("example/app:v1")
+	v2 := client.addImage("example/app:v2")
+	// Two receivers deploying the same container, sharing the store
+	a := newTestDeployer(client, ContainerConfig{Tag: "v1"})
+	b := newTestDeployer(client, ContainerConfig{Tag: "v1"})
+	a.Pins, b.Pins = pins, pins
+
+	herr := a.Deploy("v1")
+	if herr != nil {
+		t.Fatal(herr)
+	}
+	_, herr = a.Pin()
+	if herr != nil {
+		t.Fatal(herr)
+	}
+
+	b.container.Tag = "v2"
+	dep, herr := b.run("v2", "v2", nil)
+	if herr != nil {
+		t.Fatal(herr)
+	}
+	if dep.Result != Held {
+		t.Fatalf("deploy on the other receiver got %s, want %s", dep.Result, Held)
+	}
+	if got := client.running(t, "app"); got != v1 {
+		t.Fatalf("running %s while pinned, want %s", got, v1)
+	}
+
+	// A third receiver, like one restarted since, unpins
+	c := newTestDeployer(client, ContainerConfig{Tag: "v1"})
+	c.Pins = pins
+	pin, herr := c.Unpin()
+	if herr != nil || pin == nil {
+		t.Fatalf("unpin: %v, %v", pin, herr)
+	}
+	if len(pin.Held) != 1 || pin.Held[0] != dep.ID {
+		t.Errorf("got held %v, want the deploy held by the other receiver", pin.Held)
+	}
+	if pin.Released == "" {
+		t.Fatal("unpinning released nothing, want the held deploy")
+	}
+	released := waitReleased(t, c, pin.Released)
+	if released.Result != Success || released.Tag != "v2" {
+		t.Errorf("released deploy of %s got %s, want v2 %s", released.Tag, released.Result, Success)
+	}
+	if got := client.running(t, "app"); got != v2 {
+		t.Errorf("running %s after unpinning, want %s", got, v2)
+	}
+	if pin, err := pins.Load("app"); err != nil || pin != nil {
+		t.Errorf("pin left in the store after unpinning: %v, %v", pin, err)
+	}
+}
+
+// waitReleased waits for the deploy released by unpinning to finish
+func waitReleased(t *testing.T, d *Deployer, id string) *Deployment {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, dep := range d.History() {
+			if dep.ID == id {
+				return dep
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("released deploy %s didn't finish", id)
+	return nil
+}
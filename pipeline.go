@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Events sent for each stage of a pipeline
+const (
+	EventStageSucceeded = Event("stage_succeeded")
+	EventStageFailed    = Event("stage_failed")
+)
+
+// runPipeline runs dep, already enqueued on d, and, if d is a stage
+// promoting to another container and passed its smoke tests, promotes
+// the deployed digest to the next stage. It returns the deployment of
+// every stage that was run.
+func (ds Deployers) runPipeline(d *Deployer, dep *Deployment, tag string, payload *WebhookPayload) ([]*Deployment, *HookError) {
+	herr := d.execute(dep, d.container.Tag)
+	deployments := []*Deployment{dep}
+	promoted := false
+	// Configuration updates and held deploys aren't promoted
+	for herr == nil && d.container.PromoteTo != "" && dep.Action == "" && dep.Result == Success {
+		notify(d.notifier, Notification{
+			Event:        EventStageSucceeded,
+			Container:    d.container.Name,
+			DeploymentID: dep.ID,
+			Labels:       dep.Labels,
+			Commit:       dep.Commit,
+			Message:      fmt.Sprintf("Stage %s passed, promoting %s to %s", d.container.Name, dep.Digest, d.container.PromoteTo),
+		})
+
+		next, ok := ds.ForTenant(d.tenant).Container(d.container.PromoteTo)
+		if !ok {
+			// Prevented by config validation
+			return deployments, serverError(CodeInternal, PhaseStart, fmt.Errorf("unknown stage %q", d.container.PromoteTo))
+		}
+		d = next
+
+		version := dep.Digest
+		if version == "" {
+			// Image not from a registry, fall back to the tag
+			version = tag
+		}
+		// Stages on air-gapped hosts load the archive again
+		archive, artifact := dep.Archive, dep.Artifact
+		dep = d.enqueue(tag, payload)
+		dep.Archive, dep.Artifact = archive, artifact
+		herr = d.execute(dep, version)
+		deployments = append(deployments, dep)
+		promoted = true
+	}
+
+	if herr != nil {
+		notify(d.notifier, Notification{
+			Event:        EventStageFailed,
+			Container:    d.container.Name,
+			DeploymentID: dep.ID,
+			Labels:       dep.Labels,
+			Commit:       dep.Commit,
+			Phase:        herr.Phase,
+			Message:      fmt.Sprintf("Stage %s failed: %s", d.container.Name, herr.Message),
+		})
+		return deployments, herr
+	}
+
+	if promoted {
+		notify(d.notifier, Notification{
+			Event:        EventStageSucceeded,
+			Container:    d.container.Name,
+			DeploymentID: dep.ID,
+			Labels:       dep.Labels,
+			Commit:       dep.Commit,
+			Message:      fmt.Sprintf("Stage %s deployed %s", d.container.Name, dep.Digest),
+		})
+	}
+
+	return deployments, nil
+}
+
+// ForPush returns the deployers redeployed by a push to the repository,
+// which are those of its containers that are not promotion targets, and
+// those updated in place on pushes to it
+func (ds Deployers) ForPush(repo string) Deployers {
+	targets := ds.PromotionTargets()
+	var res Deployers
+	for _, d := range ds {
+		switch {
+		case d.container.Repository == repo && !targets[d.container.Name]:
+		case d.container.ConfigUpdate != nil && d.container.ConfigUpdate.Repository == repo:
+		default:
+			continue
+		}
+		res = append(res, d)
+	}
+	return res
+}
+
+// PromotionTargets returns the names of the containers
+// only deployed by promotion from a previous stage
+func (ds Deployers) PromotionTargets() map[string]bool {
+	targets := map[string]bool{}
+	for _, d := range ds {
+		if d.container.PromoteTo != "" {
+			targets[d.container.PromoteTo] = true
+		}
+	}
+	return targets
+}
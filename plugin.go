@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+// EnginePlugin deploys the container with a plugin
+const EnginePlugin = "plugin"
+
+// PhasePlugin is the deploy run by a plugin
+const PhasePlugin = Phase("plugin")
+
+// CodePluginFailed is used when a plugin fails or can't be run
+const CodePluginFailed = ErrorCode("plugin_failed")
+
+// PhaseFilter runs the filter plugins on a webhook
+const PhaseFilter = Phase("filter")
+
+// CodeFilterRejected is used when a filter plugin rejects a webhook
+const CodeFilterRejected = ErrorCode("filter_rejected")
+
+// PluginConfig is an external program or Starlark script extending the
+// receiver. Plugins can parse the webhooks sent to /hooks/{name}, filter
+// all webhooks, deploy containers with the plugin engine and receive
+// notifications.
+type PluginConfig struct {
+	Name string `json:"name"`
+	// Command is run for every call, with a PluginRequest as JSON
+	// on stdin, and must write a PluginReply as JSON to stdout
+	Command []string `json:"command"`
+	// Script is a Starlark file to use instead of a command, with a
+	// function per request type taking the request and returning the reply
+	Script string `json:"script"`
+	// Env are extra NAME=value environment variables of the command
+	Env []string `json:"env"`
+	// Timeout of a call, 10m if empty
+	Timeout string `json:"timeout"`
+	// Notify sends every notification to the plugin
+	Notify bool `json:"notify"`
+	// Filter asks the plugin about every webhook before it is
+	// deployed. It can skip or reject the push, or change its tag.
+	Filter bool `json:"filter"`
+
+	timeout time.Duration
+	// script are the globals of the loaded Script
+	script starlark.StringDict
+}
+
+// PluginRequest is passed to a plugin
+type PluginRequest struct {
+	// Type is parse, filter, deploy or notify
+	Type string `json:"type"`
+
+	// Headers and Body are the webhook to parse or filter
+	Headers http.Header `json:"headers,omitempty"`
+	Body    string      `json:"body,omitempty"`
+	// Tenant, Repository and Pusher are the push to filter
+	Tenant     string `json:"tenant,omitempty"`
+	Repository string `json:"repository,omitempty"`
+	Pusher     string `json:"pusher,omitempty"`
+
+	// DeploymentID, Container, Tag and Version describe the deploy
+	DeploymentID string           `json:"deployment_id,omitempty"`
+	Container    *ContainerConfig `json:"container,omitempty"`
+	Tag          string           `json:"tag,omitempty"`
+	Version      string           `json:"version,omitempty"`
+
+	Notification *Notification `json:"notification,omitempty"`
+}
+
+// PluginReply is returned by a plugin
+type PluginReply struct {
+	// Error rejects the webhook or fails the deploy or notification
+	Error string `json:"error,omitempty"`
+
+	// Repository, Tag and Pusher are the push parsed from the
+	// webhook. Filters may reply with a Tag to deploy instead.
+	Repository string `json:"repository,omitempty"`
+	Tag        string `json:"tag,omitempty"`
+	Pusher     string `json:"pusher,omitempty"`
+	// Artifact is the artifact to deploy to containers with
+	// the artifact engine, if the push is of one
+	Artifact *ArtifactRef `json:"artifact,omitempty"`
+	// Skip, in reply to a filter, leaves the push undeployed
+	Skip   bool   `json:"skip,omitempty"`
+	Reason string `json:"reason,omitempty"`
+
+	// Digest and PreviousImage are recorded in the deployment
+	Digest        string `json:"digest,omitempty"`
+	PreviousImage string `json:"previous_image,omitempty"`
+}
+
+func (c *PluginConfig) validate() error {
+	if c.Name == "" || (len(c.Command) == 0) == (c.Script == "") {
+		return errors.New("plugins need a name and either a command or a script")
+	}
+	c.timeout = 10 * time.Minute
+	if c.Timeout != "" {
+		var err error
+		c.timeout, err = time.ParseDuration(c.Timeout)
+		if err != nil || c.timeout <= 0 {
+			return fmt.Errorf("plugin %q: invalid timeout %q", c.Name, c.Timeout)
+		}
+	}
+	if c.Script != "" {
+		return c.loadScript()
+	}
+	return nil
+}
+
+// call runs the plugin with the request. Only failing to run the
+// plugin is an error, the Error of the reply is left to the caller.
+func (c *PluginConfig) call(in *PluginRequest) (*PluginReply, error) {
+	if c.Script != "" {
+		return c.callScript(in)
+	}
+	content, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, c.Command[0], c.Command[1:]...)
+	cmd.Env = append(os.Environ(), c.Env...)
+	cmd.Stdin = bytes.NewReader(content)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("plugin %s timed out after %s", c.Name, c.timeout)
+	}
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > 1024 {
+			msg = msg[len(msg)-1024:]
+		}
+		return nil, fmt.Errorf("plugin %s: %v: %s", c.Name, err, msg)
+	}
+
+	reply := &PluginReply{}
+	err = json.Unmarshal(stdout.Bytes(), reply)
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s replied with invalid JSON: %v", c.Name, err)
+	}
+	return reply, nil
+}
+
+// Plugin returns the plugin with the given name
+func (c *Config) Plugin(name string) (*PluginConfig, bool) {
+	for i := range c.Plugins {
+		if c.Plugins[i].Name == name {
+			return &c.Plugins[i], true
+		}
+	}
+	return nil, false
+}
+
+// parsePlugin has the plugin the webhook was sent to parse it into hook
+func (h *WebhookHandler) parsePlugin(payload *WebhookPayload, hook *DockerHubWebhook) *HookError {
+	p, ok := h.cfg.Plugin(payload.Plugin)
+	if !ok {
+		herr := clientError(CodeInvalidPayload, PhaseDecode, fmt.Errorf("unknown plugin %q", payload.Plugin))
+		herr.Status = http.StatusNotFound
+		return herr
+	}
+	reply, err := p.call(&PluginRequest{
+		Type:    "parse",
+		Headers: payload.Headers,
+		Body:    payload.Body,
+	})
+	if err != nil {
+		return serverError(CodePluginFailed, PhaseDecode, err)
+	}
+	if reply.Error != "" {
+		return clientError(CodeInvalidPayload, PhaseDecode, errors.New(reply.Error))
+	}
+	if reply.Repository == "" || reply.Tag == "" {
+		return serverError(CodePluginFailed, PhaseDecode, fmt.Errorf("plugin %s returned no repository or tag", p.Name))
+	}
+	hook.Repository.RepoName = reply.Repository
+	hook.PushData.Tag = reply.Tag
+	hook.PushData.Pusher = reply.Pusher
+	hook.artifact = reply.Artifact
+	return nil
+}
+
+// filter asks the filter plugins about the push, which may change its
+// tag. It returns false if the push was skipped by one of them.
+func (h *WebhookHandler) filter(payload *WebhookPayload, hook *DockerHubWebhook) (bool, *HookError) {
+	for i := range h.cfg.Plugins {
+		p := &h.cfg.Plugins[i]
+		if !p.Filter {
+			continue
+		}
+		reply, err := p.call(&PluginRequest{
+			Type:       "filter",
+			Headers:    payload.Headers,
+			Body:       payload.Body,
+			Tenant:     payload.Tenant,
+			Repository: hook.Repository.RepoName,
+			Tag:        hook.PushData.Tag,
+			Pusher:     hook.PushData.Pusher,
+		})
+		if err != nil {
+			return false, serverError(CodePluginFailed, PhaseFilter, err)
+		}
+		if reply.Error != "" {
+			herr := clientError(CodeFilterRejected, PhaseFilter, fmt.Errorf("rejected by %s: %s", p.Name, reply.Error))
+			herr.Status = http.StatusForbidden
+			return false, herr
+		}
+		if reply.Skip {
+			log.Printf("Push of %s:%s skipped by %s: %s", hook.Repository.RepoName, hook.PushData.Tag, p.Name, reply.Reason)
+			return false, nil
+		}
+		if reply.Tag != "" {
+			hook.PushData.Tag = reply.Tag
+		}
+	}
+	return true, nil
+}
+
+// PluginStrategy is the strategy of containers deployed by a plugin
+type PluginStrategy struct {
+	plugin *PluginConfig
+}
+
+// Deploy implements Strategy
+func (s PluginStrategy) Deploy(d *Deployer, dep *Deployment, version string) *HookError {
+	return d.phase(PhasePlugin, func() error {
+		container := d.container
+		reply, err := s.plugin.call(&PluginRequest{
+			Type:         "deploy",
+			DeploymentID: dep.ID,
+			Container:    &container,
+			Tag:          dep.Tag,
+			Version:      version,
+		})
+		if err == nil && reply.Error != "" {
+			err = errors.New(reply.Error)
+		}
+		if err != nil {
+			return serverError(CodePluginFailed, PhasePlugin, err)
+		}
+		dep.Digest = reply.Digest
+		dep.PreviousImage = reply.PreviousImage
+		return nil
+	})
+}
+
+// PluginNotifier sends notifications to a plugin
+type PluginNotifier struct {
+	plugin *PluginConfig
+}
+
+// Notify implements Notifier
+func (n PluginNotifier) Notify(notification Notification) error {
+	reply, err := n.plugin.call(&PluginRequest{
+		Type:         "notify",
+		Notification: &notification,
+	})
+	if err == nil && reply.Error != "" {
+		err = errors.New(reply.Error)
+	}
+	return err
+}
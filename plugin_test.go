@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// scriptPlugin returns the validated plugin running the script
+func scriptPlugin(t *testing.T, script, timeout string) *PluginConfig {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "plugin.star")
+	err := os.WriteFile(path, []byte(script), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &PluginConfig{Name: "script", Script: path, Filter: true, Timeout: timeout}
+	err = p.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestScriptFilterExample(t *testing.T) {
+	p := scriptPlugin(t, readmeExample(t, "python", "def filter"), "")
+	h := &WebhookHandler{cfg: &Config{Plugins: []PluginConfig{*p}}}
+
+	for _, tt := range []struct {
+		tag, pusher string
+		deploy      bool
+		rejected    bool
+	}{
+		{"v1.2.3", "ci", true, false},
+		{"v1.2", "ci", false, false},
+		{"latest", "ci", false, false},
+		{"v1.2.3", "bob", false, true},
+	} {
+		hook := &DockerHubWebhook{}
+		hook.Repository.RepoName = "example/app"
+		hook.PushData.Tag = tt.tag
+		hook.PushData.Pusher = tt.pusher
+		deploy, herr := h.filter(&WebhookPayload{Tenant: DefaultTenant}, hook)
+		if deploy != tt.deploy || (herr != nil) != tt.rejected {
+			t.Errorf("%s by %s: got %v, %v", tt.tag, tt.pusher, deploy, herr)
+		}
+		if herr != nil && herr.Code != CodeFilterRejected {
+			t.Errorf("%s by %s: got code %s", tt.tag, tt.pusher, herr.Code)
+		}
+	}
+}
+
+func TestScriptCall(t *testing.T) {
+	p := scriptPlugin(t, `
+def filter(req):
+    body = json.decode(req["body"])
+    print("retagging", req["tag"])
+    return {"tag": body["branch"] + "-" + req["tag"]}
+`, "")
+	reply, err := p.call(&PluginRequest{Type: "filter", Tag: "v1", Body: `{"branch": "main"}`})
+	if err != nil || reply.Tag != "main-v1" {
+		t.Errorf("got %+v, %v", reply, err)
+	}
+
+	_, err = p.call(&PluginRequest{Type: "parse"})
+	if err == nil || !strings.Contains(err.Error(), "no parse function") {
+		t.Errorf("got %v for a missing function", err)
+	}
+}
+
+func TestScriptFailures(t *testing.T) {
+	for _, tt := range []struct {
+		script, timeout, err string
+	}{
+		{"def filter(req):\n    return req[\"missing\"]\n", "", "key \"missing\" not in dict"},
+		{"def filter(req):\n    return 1\n", "", "invalid reply"},
+		{"def filter(req):\n    return {\"skip\": len}\n", "", "returned dict"},
+		{"def filter(req):\n    for i in range(1 << 30):\n        pass\n", "10ms", "timed out after 10ms"},
+	} {
+		p := scriptPlugin(t, tt.script, tt.timeout)
+		_, err := p.call(&PluginRequest{Type: "filter"})
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got %v, want %q", tt.script, err, tt.err)
+		}
+	}
+}
+
+func TestScriptValidate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plugin.star")
+	err := os.WriteFile(path, []byte("def filter(req)\n    return None\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []PluginConfig{
+		{Name: "broken", Script: path},
+		{Name: "missing", Script: path + ".missing"},
+		{Name: "both", Script: path, Command: []string{"true"}},
+		{Name: "neither"},
+	} {
+		if p.validate() == nil {
+			t.Errorf("plugin %s validated", p.Name)
+		}
+	}
+}
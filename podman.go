@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Engines selectable with the engine field of a container
+const (
+	EngineDocker = "docker"
+	EnginePodman = "podman"
+)
+
+// podmanSocket returns the endpoint of the local Podman API socket,
+// preferring CONTAINER_HOST, then the rootless and the rootful socket
+func podmanSocket() (string, error) {
+	if host := os.Getenv("CONTAINER_HOST"); host != "" {
+		return host, nil
+	}
+
+	var candidates []string
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		candidates = append(candidates, filepath.Join(dir, "podman", "podman.sock"))
+	}
+	candidates = append(candidates, "/run/podman/podman.sock")
+	for _, c := range candidates {
+		if _, err := os.Stat(c); err == nil {
+			return "unix://" + c, nil
+		}
+	}
+
+	return "", fmt.Errorf("no podman socket found in %s, is podman.socket enabled?", strings.Join(candidates, ", "))
+}
+
+// qualifiedRepository returns the repository with the registry
+// Podman stores it under. Podman doesn't assume Docker Hub for short
+// names, and reports fully qualified names in RepoDigests.
+func qualifiedRepository(repo string) string {
+	domain := strings.SplitN(repo, "/", 2)[0]
+	if strings.ContainsAny(domain, ".:") || domain == "localhost" {
+		return repo
+	}
+	if !strings.Contains(repo, "/") {
+		return "docker.io/library/" + repo
+	}
+	return "docker.io/" + repo
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestQualifiedRepository(t *testing.T) {
+	for repo, want := range map[string]string{
+		"nginx":                        "docker.io/library/nginx",
+		"example/app":                  "docker.io/example/app",
+		"docker.io/example/app":        "docker.io/example/app",
+		"quay.io/example/app":          "quay.io/example/app",
+		"registry:5000/app":            "registry:5000/app",
+		"localhost/app":                "localhost/app",
+		"ghcr.io/example/team/app":     "ghcr.io/example/team/app",
+		"example/team/app":             "docker.io/example/team/app",
+		"registry.example.com:443/app": "registry.example.com:443/app",
+	} {
+		if got := qualifiedRepository(repo); got != want {
+			t.Errorf("%s: got %s, want %s", repo, got, want)
+		}
+	}
+}
+
+func TestPodmanSocket(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", dir)
+
+	t.Setenv("CONTAINER_HOST", "ssh://core@host/run/podman/podman.sock")
+	got, err := podmanSocket()
+	if err != nil || got != "ssh://core@host/run/podman/podman.sock" {
+		t.Errorf("with CONTAINER_HOST: got %q, %v", got, err)
+	}
+
+	t.Setenv("CONTAINER_HOST", "")
+	socket := filepath.Join(dir, "podman", "podman.sock")
+	err = os.MkdirAll(filepath.Dir(socket), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(socket, nil, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = podmanSocket()
+	if err != nil || got != "unix://"+socket {
+		t.Errorf("with a rootless socket: got %q, %v, want unix://%s", got, err, socket)
+	}
+}
+
+func TestPodmanDeploy(t *testing.T) {
+	client := newFakeDocker()
+	v1 := client.addImage("docker.io/example/app:v1")
+	client.images[v1].RepoDigests = []string{"docker.io/example/app@sha256:abc"}
+	d := newTestDeployer(client, ContainerConfig{Engine: EnginePodman})
+
+	dep := &Deployment{}
+	herr := d.strategy.Deploy(d, dep, "v1")
+	if herr != nil {
+		t.Fatal(herr)
+	}
+	if index(client.calls, "PullImage docker.io/example/app:v1") < 0 {
+		t.Errorf("calls %v don't pull the qualified repository", client.calls)
+	}
+	if got := client.running(t, "app"); got != v1 {
+		t.Errorf("running %s, want %s", got, v1)
+	}
+	if dep.Digest != "sha256:abc" {
+		t.Errorf("got digest %q from the qualified repo digest", dep.Digest)
+	}
+	if got := d.imageRef("sha256:abc"); got != "docker.io/example/app@sha256:abc" {
+		t.Errorf("got image ref %s", got)
+	}
+}
+
+func TestDockerDeployUnqualified(t *testing.T) {
+	client := newFakeDocker()
+	client.addImage("example/app:v1")
+	d := newTestDeployer(client, ContainerConfig{Engine: EngineDocker})
+
+	herr := d.strategy.Deploy(d, &Deployment{}, "v1")
+	if herr != nil {
+		t.Fatal(herr)
+	}
+	if index(client.calls, "PullImage example/app:v1") < 0 {
+		t.Errorf("calls %v don't pull the repository as configured", client.calls)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// PhasePolicy checks the pulled image against the policy
+const PhasePolicy = Phase("policy")
+
+// CodePolicyViolation is used when a deploy is blocked by the policy
+const CodePolicyViolation = ErrorCode("policy_violation")
+
+// PolicyConfig is the organization's policy on deployed images
+type PolicyConfig struct {
+	Rules []PolicyRule `json:"rules"`
+	// Webhooks are asked whether to go ahead with every deploy
+	Webhooks []PolicyWebhookConfig `json:"webhooks"`
+}
+
+// PolicyRule is checked against the labels, SBOM and
+// configuration of every pulled image it applies to
+type PolicyRule struct {
+	Name string `json:"name"`
+	// Containers are the names of the containers the rule applies
+	// to, as path.Match patterns. Empty applies to all containers.
+	Containers []string `json:"containers"`
+	// Action is deny (default), blocking the deploy, or warn
+	Action string `json:"action"`
+
+	// RequireLabels are the labels images must have
+	RequireLabels []string `json:"require_labels"`
+	// MaxSize is the size, e.g. 1GB, images must stay under
+	MaxSize string `json:"max_size"`
+	// DenyRoot denies images running as root
+	DenyRoot bool `json:"deny_root"`
+	// AllowedLicenses, if set, are the only licenses packages of
+	// the SBOM may have. DeniedLicenses are never allowed.
+	AllowedLicenses []string `json:"allowed_licenses"`
+	DeniedLicenses  []string `json:"denied_licenses"`
+	// DeniedPackages are the name or name@version of
+	// packages the SBOM must not contain
+	DeniedPackages []string `json:"denied_packages"`
+
+	maxSize uint64
+}
+
+// PolicyDecision is the outcome of checking an image against the policy
+type PolicyDecision struct {
+	Allowed    bool     `json:"allowed"`
+	Violations []string `json:"violations,omitempty"`
+	Warnings   []string `json:"warnings,omitempty"`
+}
+
+func (c *PolicyConfig) validate() error {
+	for i := range c.Webhooks {
+		err := c.Webhooks[i].validate()
+		if err != nil {
+			return err
+		}
+	}
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		if rule.Name == "" {
+			return fmt.Errorf("policy rule %d has no name", i)
+		}
+		switch rule.Action {
+		case "":
+			rule.Action = "deny"
+		case "deny", "warn":
+		default:
+			return fmt.Errorf("policy rule %q has unknown action %q", rule.Name, rule.Action)
+		}
+		for _, pattern := range rule.Containers {
+			_, err := path.Match(pattern, "")
+			if err != nil {
+				return fmt.Errorf("policy rule %q: invalid container pattern %q", rule.Name, pattern)
+			}
+		}
+		if rule.MaxSize != "" {
+			var err error
+			rule.maxSize, err = parseBytes(rule.MaxSize)
+			if err != nil {
+				return fmt.Errorf("policy rule %q: max size: %v", rule.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// rulesFor returns the rules applying to the container
+func (c *PolicyConfig) rulesFor(container string) []PolicyRule {
+	var rules []PolicyRule
+	for _, rule := range c.Rules {
+		if len(rule.Containers) == 0 {
+			rules = append(rules, rule)
+			continue
+		}
+		for _, pattern := range rule.Containers {
+			if ok, _ := path.Match(pattern, container); ok {
+				rules = append(rules, rule)
+				break
+			}
+		}
+	}
+	return rules
+}
+
+// webhooksFor returns the policy webhooks checking the container
+func (c *PolicyConfig) webhooksFor(container string) []*PolicyWebhookConfig {
+	var webhooks []*PolicyWebhookConfig
+	for i := range c.Webhooks {
+		if c.Webhooks[i].appliesTo(container) {
+			webhooks = append(webhooks, &c.Webhooks[i])
+		}
+	}
+	return webhooks
+}
+
+// needsSBOM reports whether the rule checks the SBOM of images
+func (r PolicyRule) needsSBOM() bool {
+	return len(r.AllowedLicenses) > 0 || len(r.DeniedLicenses) > 0 || len(r.DeniedPackages) > 0
+}
+
+// check returns the ways the image violates the rule
+func (r PolicyRule) check(img *docker.Image, pkgs []sbomPackage) []string {
+	var violations []string
+	config := img.Config
+	if config == nil {
+		config = &docker.Config{}
+	}
+	for _, label := range r.RequireLabels {
+		if _, ok := config.Labels[label]; !ok {
+			violations = append(violations, fmt.Sprintf("missing label %s", label))
+		}
+	}
+	if r.maxSize > 0 && uint64(img.Size) > r.maxSize {
+		violations = append(violations, fmt.Sprintf("image is %d MiB, over %s", img.Size>>20, r.MaxSize))
+	}
+	if r.DenyRoot {
+		user := strings.SplitN(config.User, ":", 2)[0]
+		if user == "" || user == "root" || user == "0" {
+			violations = append(violations, "image runs as root")
+		}
+	}
+	for _, pkg := range pkgs {
+		if contains(r.DeniedPackages, pkg.Name) || contains(r.DeniedPackages, pkg.Name+"@"+pkg.Version) {
+			violations = append(violations, fmt.Sprintf("package %s@%s is denied", pkg.Name, pkg.Version))
+		}
+		for _, license := range pkg.Licenses {
+			if contains(r.DeniedLicenses, license) ||
+				len(r.AllowedLicenses) > 0 && !contains(r.AllowedLicenses, license) {
+				violations = append(violations, fmt.Sprintf("package %s@%s has license %s", pkg.Name, pkg.Version, license))
+			}
+		}
+	}
+	return violations
+}
+
+// checkPolicy checks the pulled image against the rules of the
+// container, recording the decision in the audit log. Deploys of
+// images violating a deny rule are blocked.
+func (d *Deployer) checkPolicy(dep *Deployment, img *docker.Image, sbom []byte) *HookError {
+	if len(d.policy) == 0 {
+		return nil
+	}
+	return d.phase(PhasePolicy, func() error {
+		var pkgs []sbomPackage
+		for _, rule := range d.policy {
+			if rule.needsSBOM() {
+				if sbom == nil {
+					return serverError(CodeNoSBOM, PhasePolicy, fmt.Errorf("policy rule %q needs the SBOM of the image", rule.Name))
+				}
+				var err error
+				pkgs, err = parseSBOM(sbom)
+				if err != nil {
+					return serverError(CodeNoSBOM, PhasePolicy, err)
+				}
+				break
+			}
+		}
+
+		decision := PolicyDecision{Allowed: true}
+		for _, rule := range d.policy {
+			for _, v := range rule.check(img, pkgs) {
+				msg := rule.Name + ": " + v
+				if rule.Action == "warn" {
+					decision.Warnings = append(decision.Warnings, msg)
+				} else {
+					decision.Allowed = false
+					decision.Violations = append(decision.Violations, msg)
+				}
+			}
+		}
+
+		entry := AuditEntry{
+			Tenant:      d.tenant,
+			Repository:  d.container.Repository,
+			Tag:         dep.Tag,
+			Result:      Success,
+			Deployments: []string{dep.ID},
+			Policy:      &decision,
+		}
+		var herr *HookError
+		if !decision.Allowed {
+			herr = &HookError{
+				Code:    CodePolicyViolation,
+				Message: fmt.Sprintf("image %s violates the policy", d.imageRef(dep.Tag)),
+				Phase:   PhasePolicy,
+				Details: decision.Violations,
+				Status:  http.StatusForbidden,
+			}
+			entry.Result, entry.Error = Failure, herr
+		}
+		if d.Audit != nil {
+			d.Audit.Record(entry)
+		}
+		for _, w := range decision.Warnings {
+			d.logger().Printf("Policy warning for %s: %s", d.imageRef(dep.Tag), w)
+		}
+		if herr != nil {
+			return herr
+		}
+		return nil
+	})
+}
+
+// sbomPackage is a package listed in an SBOM
+type sbomPackage struct {
+	Name     string
+	Version  string
+	Licenses []string
+}
+
+// parseSBOM returns the packages of an SPDX or CycloneDX JSON document
+func parseSBOM(doc []byte) ([]sbomPackage, error) {
+	var sbom struct {
+		// SPDX
+		Packages []struct {
+			Name             string `json:"name"`
+			VersionInfo      string `json:"versionInfo"`
+			LicenseConcluded string `json:"licenseConcluded"`
+			LicenseDeclared  string `json:"licenseDeclared"`
+		} `json:"packages"`
+		// CycloneDX
+		Components []struct {
+			Name     string `json:"name"`
+			Version  string `json:"version"`
+			Licenses []struct {
+				License struct {
+					ID   string `json:"id"`
+					Name string `json:"name"`
+				} `json:"license"`
+				Expression string `json:"expression"`
+			} `json:"licenses"`
+		} `json:"components"`
+	}
+	err := json.Unmarshal(doc, &sbom)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SBOM: %v", err)
+	}
+	if sbom.Packages == nil && sbom.Components == nil {
+		return nil, errors.New("SBOM is neither SPDX nor CycloneDX")
+	}
+
+	var pkgs []sbomPackage
+	for _, p := range sbom.Packages {
+		license := p.LicenseConcluded
+		if license == "" || license == "NOASSERTION" {
+			license = p.LicenseDeclared
+		}
+		pkgs = append(pkgs, sbomPackage{Name: p.Name, Version: p.VersionInfo, Licenses: licenseIDs(license)})
+	}
+	for _, c := range sbom.Components {
+		pkg := sbomPackage{Name: c.Name, Version: c.Version}
+		for _, l := range c.Licenses {
+			switch {
+			case l.Expression != "":
+				pkg.Licenses = append(pkg.Licenses, licenseIDs(l.Expression)...)
+			case l.License.ID != "":
+				pkg.Licenses = append(pkg.Licenses, l.License.ID)
+			case l.License.Name != "":
+				pkg.Licenses = append(pkg.Licenses, l.License.Name)
+			}
+		}
+		pkgs = append(pkgs, pkg)
+	}
+	return pkgs, nil
+}
+
+// licenseIDs returns the licenses of an SPDX license expression,
+// which are checked one by one
+func licenseIDs(expr string) []string {
+	var ids []string
+	exception := false
+	for _, f := range strings.Fields(strings.NewReplacer("(", " ", ")", " ").Replace(expr)) {
+		switch {
+		case exception:
+			// The exception of the preceding WITH
+			exception = false
+		case f == "WITH":
+			exception = true
+		case f != "AND" && f != "OR" && f != "NOASSERTION" && f != "NONE":
+			ids = append(ids, f)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// Codes of deploys stopped by a policy webhook
+const (
+	CodePolicyDenied      = ErrorCode("policy_denied")
+	CodePolicyUnavailable = ErrorCode("policy_unavailable")
+)
+
+// PolicyWebhookConfig is an external endpoint deploys are
+// checked with before they start
+type PolicyWebhookConfig struct {
+	URL string `json:"url"`
+	// Token is sent as a bearer token, if set
+	Token string `json:"token"`
+	// Containers are the names of the containers checked, as
+	// path.Match patterns. Empty checks all containers.
+	Containers []string `json:"containers"`
+	// Timeout of the request, 10s if empty
+	Timeout string `json:"timeout"`
+	// FailOpen lets deploys proceed if the endpoint fails or times
+	// out. By default, they fail with the policy_unavailable code.
+	FailOpen bool `json:"fail_open"`
+
+	client *http.Client
+}
+
+// PolicyRequest is posted to policy webhooks
+type PolicyRequest struct {
+	DeploymentID string `json:"deployment_id"`
+	Tenant       string `json:"tenant"`
+	Container    string `json:"container"`
+	Repository   string `json:"repository"`
+	Tag          string `json:"tag"`
+	// Version is the tag or digest deployed
+	Version string `json:"version"`
+	Host    string `json:"host,omitempty"`
+	// Trigger is webhook if the deploy was triggered by one
+	Trigger string `json:"trigger,omitempty"`
+}
+
+// PolicyResponse is the reply of policy webhooks
+type PolicyResponse struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason"`
+}
+
+func (c *PolicyWebhookConfig) validate() error {
+	if !strings.HasPrefix(c.URL, "http://") && !strings.HasPrefix(c.URL, "https://") {
+		return fmt.Errorf("policy webhook url %q is not an http(s) URL", c.URL)
+	}
+	for _, pattern := range c.Containers {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return fmt.Errorf("policy webhook %s: invalid container pattern %q", c.URL, pattern)
+		}
+	}
+	timeout := 10 * time.Second
+	if c.Timeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(c.Timeout)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("policy webhook %s: invalid timeout %q", c.URL, c.Timeout)
+		}
+	}
+	c.client = &http.Client{Timeout: timeout}
+	return nil
+}
+
+// appliesTo reports whether the webhook checks the container
+func (c *PolicyWebhookConfig) appliesTo(container string) bool {
+	if len(c.Containers) == 0 {
+		return true
+	}
+	for _, pattern := range c.Containers {
+		if ok, _ := path.Match(pattern, container); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ask posts the deploy to the webhook, returning its decision
+func (c *PolicyWebhookConfig) ask(in *PolicyRequest) (*PolicyResponse, error) {
+	content, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", c.URL, bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("policy webhook replied %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	out := &PolicyResponse{}
+	err = json.NewDecoder(resp.Body).Decode(out)
+	if err != nil {
+		return nil, errors.New("policy webhook replied with invalid JSON")
+	}
+	return out, nil
+}
+
+// askPolicyWebhooks checks the deploy with the policy webhooks of
+// the container before it starts, recording their decisions in the
+// audit log. Deploys are only run if all of them allow it.
+func (d *Deployer) askPolicyWebhooks(dep *Deployment, version string) *HookError {
+	if len(d.policyWebhooks) == 0 {
+		return nil
+	}
+	in := &PolicyRequest{
+		DeploymentID: dep.ID,
+		Tenant:       d.tenant,
+		Container:    d.container.Name,
+		Repository:   d.container.Repository,
+		Tag:          dep.Tag,
+		Version:      version,
+		Host:         d.container.Host,
+	}
+	if dep.Webhook != nil {
+		in.Trigger = "webhook"
+	}
+	return d.phase(PhasePolicy, func() error {
+		for _, wh := range d.policyWebhooks {
+			decision := PolicyDecision{Allowed: true}
+			var herr *HookError
+			out, err := wh.ask(in)
+			switch {
+			case err != nil && wh.FailOpen:
+				d.logger().Printf("Policy webhook %s failed, deploying anyway: %v", wh.URL, err)
+				decision.Warnings = []string{wh.URL + ": " + err.Error()}
+			case err != nil:
+				herr = serverError(CodePolicyUnavailable, PhasePolicy, err)
+			case !out.Allow:
+				reason := out.Reason
+				if reason == "" {
+					reason = "denied"
+				}
+				herr = &HookError{
+					Code:    CodePolicyDenied,
+					Message: fmt.Sprintf("deploy denied by policy webhook %s: %s", wh.URL, reason),
+					Phase:   PhasePolicy,
+					Status:  http.StatusForbidden,
+				}
+			}
+
+			entry := AuditEntry{
+				Tenant:      d.tenant,
+				Repository:  d.container.Repository,
+				Tag:         dep.Tag,
+				Result:      Success,
+				Deployments: []string{dep.ID},
+				Policy:      &decision,
+			}
+			if herr != nil {
+				decision.Allowed = false
+				decision.Violations = []string{wh.URL + ": " + herr.Message}
+				entry.Result, entry.Error = Failure, herr
+			}
+			if d.Audit != nil {
+				d.Audit.Record(entry)
+			}
+			if herr != nil {
+				return herr
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CodeHostPressure is used when the host stayed
+// under pressure for too long to deploy
+const CodeHostPressure = ErrorCode("host_pressure")
+
+// EventHostPressure is sent when a deploy is deferred
+// because its host is under pressure
+const EventHostPressure = Event("host_pressure")
+
+// pressureRetry is how often a deferred deploy checks its host again
+const pressureRetry = 15 * time.Second
+
+// hostState is shared by the deployers of a Docker host
+type hostState struct {
+	mu sync.Mutex
+	// deploys is the number of deploys running on the host
+	deploys int
+}
+
+// underPressure returns why the host can't take another deploy,
+// or an empty string if it can. A slot for the deploy is taken
+// if it can.
+func (d *Deployer) underPressure() string {
+	o := d.hostOptions
+	proc := o.ProcRoot
+	if proc == "" {
+		proc = "/proc"
+	}
+
+	if o.MaxLoadPerCPU > 0 {
+		load, err := loadAverage(proc)
+		if err != nil {
+			d.logger().Printf("Failed to read load average: %v", err)
+		} else if perCPU := load / float64(runtime.NumCPU()); perCPU > o.MaxLoadPerCPU {
+			return fmt.Sprintf("load per CPU is %.2f, above %.2f", perCPU, o.MaxLoadPerCPU)
+		}
+	}
+	if o.minFreeMemory > 0 {
+		available, err := availableMemory(proc)
+		if err != nil {
+			d.logger().Printf("Failed to read available memory: %v", err)
+		} else if available < o.minFreeMemory {
+			return fmt.Sprintf("only %d MiB of memory available, %s required", available>>20, o.MinFreeMemory)
+		}
+	}
+
+	d.host.mu.Lock()
+	defer d.host.mu.Unlock()
+	if o.MaxDeploys > 0 && d.host.deploys >= o.MaxDeploys {
+		return fmt.Sprintf("%d deploys are running on the host", d.host.deploys)
+	}
+	d.host.deploys++
+	return ""
+}
+
+// waitForCapacity defers the deploy until its host is no longer
+// under pressure, failing if that takes longer than the timeout.
+// The slot taken must be given back with releaseCapacity.
+func (d *Deployer) waitForCapacity() *HookError {
+	if d.host == nil {
+		return nil
+	}
+	reason := d.underPressure()
+	if reason == "" {
+		return nil
+	}
+
+	return d.phase(PhasePreflight, func() error {
+		d.logger().Printf("Deferring deploy of %q: %s", d.container.Name, reason)
+		notify(d.notifier, Notification{
+			Event:        EventHostPressure,
+			Container:    d.container.Name,
+			DeploymentID: d.currentID(),
+			Phase:        PhasePreflight,
+			Message:      fmt.Sprintf("Deploy of %s deferred: %s", d.container.Name, reason),
+		})
+
+		deadline := time.Now().Add(d.hostOptions.pressureTimeout)
+		for time.Now().Before(deadline) {
+			time.Sleep(pressureRetry)
+			reason = d.underPressure()
+			if reason == "" {
+				return nil
+			}
+		}
+		return serverError(CodeHostPressure, PhasePreflight, fmt.Errorf("host still under pressure after %s: %s", d.hostOptions.pressureTimeout, reason))
+	})
+}
+
+// releaseCapacity gives back the slot taken by waitForCapacity
+func (d *Deployer) releaseCapacity() {
+	if d.host == nil {
+		return
+	}
+	d.host.mu.Lock()
+	d.host.deploys--
+	d.host.mu.Unlock()
+}
+
+// loadAverage returns the 1 minute load average
+func loadAverage(proc string) (float64, error) {
+	content, err := os.ReadFile(filepath.Join(proc, "loadavg"))
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("unexpected loadavg %q", content)
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+// availableMemory returns the memory available for new processes
+func availableMemory(proc string) (uint64, error) {
+	f, err := os.Open(filepath.Join(proc, "meminfo"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			return kb << 10, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("no MemAvailable in %s", f.Name())
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// direct is the destination proxy bypassing any proxy
+const direct = "direct"
+
+// ProxyConfig routes outbound requests, such as callbacks, notifications
+// and API calls, through HTTP proxies. Without it, the HTTP_PROXY,
+// HTTPS_PROXY and NO_PROXY environment variables are used.
+type ProxyConfig struct {
+	// URL is the proxy used for all requests not matching
+	// NoProxy or Destinations, if set
+	URL string `json:"url"`
+	// NoProxy lists hosts and domains reached without a proxy
+	NoProxy []string `json:"no_proxy"`
+	// Destinations maps hosts and domains to the proxy URL
+	// used for them, or direct to bypass any proxy
+	Destinations map[string]string `json:"destinations"`
+
+	proxy        *url.URL
+	destinations map[string]*url.URL
+}
+
+func (c *ProxyConfig) validate() error {
+	var err error
+	if c.URL != "" {
+		c.proxy, err = url.Parse(c.URL)
+		if err != nil {
+			return fmt.Errorf("invalid proxy url: %v", err)
+		}
+	}
+	c.destinations = map[string]*url.URL{}
+	for host, proxy := range c.Destinations {
+		if proxy == direct {
+			c.destinations[host] = nil
+			continue
+		}
+		c.destinations[host], err = url.Parse(proxy)
+		if err != nil {
+			return fmt.Errorf("invalid proxy url for %s: %v", host, err)
+		}
+	}
+	return nil
+}
+
+// Proxy returns the proxy for the request, as used by http.Transport
+func (c *ProxyConfig) Proxy(r *http.Request) (*url.URL, error) {
+	host := r.URL.Hostname()
+	if host == "localhost" {
+		return nil, nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil, nil
+	}
+
+	// The most specific destination wins
+	best := -1
+	var proxy *url.URL
+	for dest, p := range c.destinations {
+		if matchesHost(host, dest) && len(dest) > best {
+			best, proxy = len(dest), p
+		}
+	}
+	if best >= 0 {
+		return proxy, nil
+	}
+
+	if c.proxy == nil {
+		return http.ProxyFromEnvironment(r)
+	}
+	for _, np := range c.NoProxy {
+		if np == "*" || matchesHost(host, np) {
+			return nil, nil
+		}
+	}
+	return c.proxy, nil
+}
+
+// matchesHost reports whether host is pattern or, if pattern
+// is a domain, e.g. example.com or .example.com, in it
+func matchesHost(host, pattern string) bool {
+	pattern = strings.TrimPrefix(strings.ToLower(pattern), ".")
+	host = strings.ToLower(host)
+	return host == pattern || strings.HasSuffix(host, "."+pattern)
+}
+
+// useProxy routes the requests of the default transport, used by
+// all outbound requests of the receiver, through the proxy
+func useProxy(c *ProxyConfig) {
+	if t, ok := http.DefaultTransport.(*http.Transport); ok {
+		t.Proxy = c.Proxy
+	}
+}
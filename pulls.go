@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// HostOptions tune how the receiver uses a Docker host
+type HostOptions struct {
+	// PullConcurrency is the number of images pulled from the
+	// host at once, unlimited if zero
+	PullConcurrency int `json:"pull_concurrency"`
+	// PullBandwidth is the bytes per second, e.g. 5MB, images are
+	// pulled and loaded from the host with, unlimited if empty
+	PullBandwidth string `json:"pull_bandwidth"`
+	// PullWindow is the time of day, e.g. 01:00-05:00, pulls from the
+	// host may start in, any time if empty. Pulls wait for it to open.
+	PullWindow string `json:"pull_window"`
+	// MinFreeDisk is the free space, e.g. 5GB, the Docker data root
+	// must have for a deploy to start. Empty disables the check.
+	MinFreeDisk string `json:"min_free_disk"`
+	// DataRoot is the path the Docker data root is mounted at on
+	// the receiver's host, the daemon's data root if empty
+	DataRoot string `json:"data_root"`
+	// PruneOnLowDisk prunes dangling images before refusing a deploy
+	PruneOnLowDisk bool `json:"prune_on_low_disk"`
+
+	// Deploys are deferred while the host is under pressure: the
+	// 1 minute load average per CPU is above MaxLoadPerCPU, less
+	// memory than MinFreeMemory is available or MaxDeploys deploys
+	// are running on it. Zero values disable the checks.
+	MaxLoadPerCPU float64 `json:"max_load_per_cpu"`
+	MinFreeMemory string  `json:"min_free_memory"`
+	MaxDeploys    int     `json:"max_deploys"`
+	// PressureTimeout is how long a deploy is deferred before
+	// failing, 10m if empty
+	PressureTimeout string `json:"pressure_timeout"`
+	// ProcRoot is where the /proc of the host is mounted on
+	// the receiver's host, /proc if empty
+	ProcRoot string `json:"proc_root"`
+
+	pullBandwidth   uint64
+	pullWindow      *pullWindow
+	minFreeDisk     uint64
+	minFreeMemory   uint64
+	pressureTimeout time.Duration
+}
+
+// guarded reports whether deploys to the host check for pressure
+func (o HostOptions) guarded() bool {
+	return o.MaxLoadPerCPU > 0 || o.minFreeMemory > 0 || o.MaxDeploys > 0
+}
+
+func (o *HostOptions) validate() error {
+	if o.PullConcurrency < 0 {
+		return fmt.Errorf("pull concurrency %d is negative", o.PullConcurrency)
+	}
+	if o.PullBandwidth != "" {
+		var err error
+		o.pullBandwidth, err = parseBytes(o.PullBandwidth)
+		if err != nil || o.pullBandwidth == 0 {
+			return fmt.Errorf("invalid pull bandwidth %q", o.PullBandwidth)
+		}
+	}
+	if o.PullWindow != "" {
+		var err error
+		o.pullWindow, err = parsePullWindow(o.PullWindow)
+		if err != nil {
+			return err
+		}
+	}
+	if o.MinFreeDisk != "" {
+		var err error
+		o.minFreeDisk, err = parseBytes(o.MinFreeDisk)
+		if err != nil {
+			return fmt.Errorf("min free disk: %v", err)
+		}
+	}
+	if o.MinFreeMemory != "" {
+		var err error
+		o.minFreeMemory, err = parseBytes(o.MinFreeMemory)
+		if err != nil {
+			return fmt.Errorf("min free memory: %v", err)
+		}
+	}
+	if o.MaxLoadPerCPU < 0 || o.MaxDeploys < 0 {
+		return fmt.Errorf("max load and deploys must not be negative")
+	}
+	o.pressureTimeout = 10 * time.Minute
+	if o.PressureTimeout != "" {
+		var err error
+		o.pressureTimeout, err = time.ParseDuration(o.PressureTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid pressure timeout: %v", err)
+		}
+	}
+	return nil
+}
+
+// pullWindow is a time of day, as minutes since midnight, that
+// wraps around midnight if the end is before the start
+type pullWindow struct {
+	start, end int
+}
+
+func parsePullWindow(s string) (*pullWindow, error) {
+	from, to, ok := strings.Cut(s, "-")
+	start, err := time.Parse("15:04", strings.TrimSpace(from))
+	end, err2 := time.Parse("15:04", strings.TrimSpace(to))
+	if !ok || err != nil || err2 != nil || start.Equal(end) {
+		return nil, fmt.Errorf("invalid pull window %q, want e.g. 01:00-05:00", s)
+	}
+	return &pullWindow{
+		start: start.Hour()*60 + start.Minute(),
+		end:   end.Hour()*60 + end.Minute(),
+	}, nil
+}
+
+// until returns how long after now the window opens, 0 if it is open
+func (w *pullWindow) until(now time.Time) time.Duration {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	minute := int(now.Sub(midnight) / time.Minute)
+	open := minute >= w.start && minute < w.end
+	if w.end < w.start {
+		open = minute >= w.start || minute < w.end
+	}
+	if open {
+		return 0
+	}
+	opens := midnight.Add(time.Duration(w.start) * time.Minute)
+	if !opens.After(now) {
+		opens = opens.AddDate(0, 0, 1)
+	}
+	return opens.Sub(now)
+}
+
+// bandwidthBurst is how far ahead of the bandwidth transfers may get
+const bandwidthBurst = 100 * time.Millisecond
+
+// bandwidth paces the transfers of a host to a number of bytes per second
+type bandwidth struct {
+	rate float64
+
+	mu sync.Mutex
+	// done is when the bytes taken so far are transferred at the rate
+	done time.Time
+}
+
+// take waits until n more bytes can be transferred
+func (b *bandwidth) take(n int) {
+	b.mu.Lock()
+	now := time.Now()
+	if b.done.Before(now) {
+		b.done = now
+	}
+	b.done = b.done.Add(time.Duration(float64(n) / b.rate * float64(time.Second)))
+	wait := b.done.Sub(now) - bandwidthBurst
+	b.mu.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// throttledReader reads at most at the bandwidth
+type throttledReader struct {
+	r io.Reader
+	b *bandwidth
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	t.b.take(n)
+	return n, err
+}
+
+// pullLimiter limits the concurrency, bandwidth and time of day
+// of the pulls of a DockerClient, and the bandwidth of its loads
+type pullLimiter struct {
+	DockerClient
+	host string
+	// slots are the pulls that may run at once, unlimited if nil
+	slots     chan struct{}
+	bandwidth *bandwidth
+	window    *pullWindow
+}
+
+// limitPulls returns client pulling from host as its options allow
+func limitPulls(client DockerClient, host string, o HostOptions) DockerClient {
+	if o.PullConcurrency <= 0 && o.pullBandwidth == 0 && o.pullWindow == nil {
+		return client
+	}
+	l := &pullLimiter{
+		DockerClient: client,
+		host:         host,
+		window:       o.pullWindow,
+	}
+	if o.PullConcurrency > 0 {
+		l.slots = make(chan struct{}, o.PullConcurrency)
+	}
+	if o.pullBandwidth > 0 {
+		l.bandwidth = &bandwidth{rate: float64(o.pullBandwidth)}
+	}
+	return l
+}
+
+// PullImage implements DockerClient, waiting for the pull window and
+// a free slot first. The daemon downloads the image itself, so the
+// bytes downloaded, as reported by its progress, are paced by reading
+// the progress no faster than the bandwidth, and the pull returns once
+// they would have been transferred at it.
+func (l *pullLimiter) PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error {
+	if l.window != nil {
+		if wait := l.window.until(time.Now()); wait > 0 {
+			log.Printf("Waiting %s for the pull window of %q to pull %s:%s", wait.Round(time.Second), l.host, opts.Repository, opts.Tag)
+			time.Sleep(wait)
+		}
+	}
+	if l.slots != nil {
+		l.slots <- struct{}{}
+		defer func() { <-l.slots }()
+	}
+	if l.bandwidth == nil || opts.OutputStream != nil {
+		return l.DockerClient.PullImage(opts, auth)
+	}
+
+	r, w := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		l.paceProgress(r)
+	}()
+	opts.OutputStream, opts.RawJSONStream = w, true
+	err := l.DockerClient.PullImage(opts, auth)
+	w.Close()
+	<-done
+	return err
+}
+
+// paceProgress reads the JSON progress of a pull, taking the bytes
+// downloaded for each layer since its last progress from the bandwidth
+func (l *pullLimiter) paceProgress(r io.ReadCloser) {
+	// Unblock the pull if the progress can't be decoded
+	defer io.Copy(io.Discard, r)
+	dec := json.NewDecoder(r)
+	downloaded := map[string]int64{}
+	for {
+		var msg struct {
+			ID             string `json:"id"`
+			Status         string `json:"status"`
+			ProgressDetail struct {
+				Current int64 `json:"current"`
+			} `json:"progressDetail"`
+		}
+		if dec.Decode(&msg) != nil {
+			return
+		}
+		if msg.Status != "Downloading" || msg.ProgressDetail.Current <= downloaded[msg.ID] {
+			continue
+		}
+		l.bandwidth.take(int(msg.ProgressDetail.Current - downloaded[msg.ID]))
+		downloaded[msg.ID] = msg.ProgressDetail.Current
+	}
+}
+
+// LoadImage implements DockerClient, sending the images
+// no faster than the bandwidth
+func (l *pullLimiter) LoadImage(opts docker.LoadImageOptions) error {
+	if l.bandwidth != nil {
+		opts.InputStream = &throttledReader{r: opts.InputStream, b: l.bandwidth}
+	}
+	return l.DockerClient.LoadImage(opts)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+func TestPullWindow(t *testing.T) {
+	at := func(clock string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", "2026-10-16 "+clock, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	for _, tt := range []struct {
+		window string
+		now    string
+		want   time.Duration
+	}{
+		{"01:00-05:00", "03:00", 0},
+		{"01:00-05:00", "01:00", 0},
+		{"01:00-05:00", "05:00", 20 * time.Hour},
+		{"01:00-05:00", "00:30", 30 * time.Minute},
+		{"22:00-04:00", "23:30", 0},
+		{"22:00-04:00", "02:00", 0},
+		{"22:00-04:00", "12:00", 10 * time.Hour},
+	} {
+		w, err := parsePullWindow(tt.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := w.until(at(tt.now)); got != tt.want {
+			t.Errorf("%s at %s: opens in %s, want %s", tt.window, tt.now, got, tt.want)
+		}
+	}
+
+	for _, invalid := range []string{"01:00", "1am-5am", "01:00-01:00", "25:00-05:00"} {
+		o := HostOptions{PullWindow: invalid}
+		if o.validate() == nil {
+			t.Errorf("accepted pull window %q", invalid)
+		}
+	}
+}
+
+// progressDocker reports the pull of two layers of
+// size bytes each, downloaded in two steps
+type progressDocker struct {
+	*fakeDocker
+	size int64
+}
+
+func (p *progressDocker) PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error {
+	if opts.OutputStream != nil {
+		for _, layer := range []string{"a", "b"} {
+			for _, current := range []int64{p.size / 2, p.size} {
+				fmt.Fprintf(opts.OutputStream, `{"status":"Downloading","progressDetail":{"current":%d,"total":%d},"id":"%s"}`+"\r\n", current, p.size, layer)
+			}
+			fmt.Fprintf(opts.OutputStream, `{"status":"Download complete","progressDetail":{},"id":"%s"}`+"\r\n", layer)
+		}
+	}
+	return p.fakeDocker.PullImage(opts, auth)
+}
+
+func (p *progressDocker) LoadImage(opts docker.LoadImageOptions) error {
+	_, err := io.Copy(io.Discard, opts.InputStream)
+	return err
+}
+
+func TestPullBandwidth(t *testing.T) {
+	client := &progressDocker{fakeDocker: newFakeDocker(), size: 300 << 10}
+	client.addImage("example/app:v1")
+	o := HostOptions{PullBandwidth: "1MB"}
+	err := o.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	limited := limitPulls(client, "", o)
+
+	// 600KB at 1MB/s
+	start := time.Now()
+	err = limited.PullImage(docker.PullImageOptions{Repository: "example/app", Tag: "v1"}, docker.AuthConfiguration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("pulled 600KB in %s, want at least 500ms less the burst", elapsed)
+	}
+
+	// Another 300KB, after the pull used up the bandwidth
+	start = time.Now()
+	err = limited.LoadImage(docker.LoadImageOptions{InputStream: bytes.NewReader(make([]byte, 300<<10))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("loaded 300KB in %s, want at least 300ms less the burst", elapsed)
+	}
+}
+
+func TestPullLimiterUnlimited(t *testing.T) {
+	client := newFakeDocker()
+	if limitPulls(client, "", HostOptions{}) != DockerClient(client) {
+		t.Error("client without limits was wrapped")
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// EventUnexpectedPusher is sent when a push by an account
+// not allowed to deploy a container is rejected
+const EventUnexpectedPusher = Event("unexpected_pusher")
+
+// CodeUnexpectedPusher is used when no container of a push
+// allows its pusher to deploy it
+const CodeUnexpectedPusher = ErrorCode("unexpected_pusher")
+
+// pusherAllowed reports whether the pusher may deploy the container
+func (c *ContainerConfig) pusherAllowed(pusher string) bool {
+	if len(c.AllowedPushers) == 0 {
+		return true
+	}
+	for _, pattern := range c.AllowedPushers {
+		if ok, _ := path.Match(pattern, pusher); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPushers drops the deployers not allowing the pusher of the push,
+// notifying about each of them. It fails if none are left.
+func checkPushers(deployers Deployers, hook *DockerHubWebhook) (Deployers, *HookError) {
+	var allowed Deployers
+	var rejected []string
+	for _, d := range deployers {
+		if d.container.pusherAllowed(hook.PushData.Pusher) {
+			allowed = append(allowed, d)
+			continue
+		}
+		rejected = append(rejected, d.container.Name)
+		msg := fmt.Sprintf("Push of %s:%s by unexpected pusher %q was not deployed to %s", hook.Repository.RepoName, hook.PushData.Tag, hook.PushData.Pusher, d.container.Name)
+		log.Print(msg)
+		notify(d.notifier, Notification{
+			Event:     EventUnexpectedPusher,
+			Container: d.container.Name,
+			Phase:     PhaseVerify,
+			Message:   msg,
+		})
+	}
+	if len(allowed) == 0 {
+		herr := clientError(CodeUnexpectedPusher, PhaseVerify, fmt.Errorf("%q may not deploy %s", hook.PushData.Pusher, strings.Join(rejected, ", ")))
+		herr.Status = http.StatusForbidden
+		return nil, herr
+	}
+	return allowed, nil
+}
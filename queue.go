@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// PhaseQueue admits deploys to the deploy queue of the container
+const PhaseQueue = Phase("queue")
+
+// CodeQueueFull is used for deploys rejected or
+// dropped because the deploy queue was full
+const CodeQueueFull = ErrorCode("queue_full")
+
+// CodeCoalesced is used for deploys replaced by a later
+// push while they waited in a full deploy queue
+const CodeCoalesced = ErrorCode("coalesced")
+
+// Overflow policies of the deploy queue
+const (
+	// OverflowReject rejects new deploys with 503
+	OverflowReject = "reject"
+	// OverflowDropOldest drops the deploy waiting longest
+	OverflowDropOldest = "drop_oldest"
+	// OverflowCoalesce replaces every waiting deploy with the new one
+	OverflowCoalesce = "coalesce"
+)
+
+// queueOverflows counts the deploys finding the queue full
+var queueOverflows = NewCounterVec(
+	"webhook_queue_overflows_total",
+	"Deploys that found the deploy queue of their container full, by outcome: rejected, dropped or coalesced.",
+	"container", "outcome",
+)
+
+// QueueConfig bounds the deploys waiting for the one in
+// progress, e.g. when a CI loop pushes faster than they finish
+type QueueConfig struct {
+	// Max is the number of deploys that may wait
+	Max int `json:"max"`
+	// Overflow is what happens to a deploy once Max are waiting:
+	// reject (default), drop_oldest or coalesce
+	Overflow string `json:"overflow"`
+	// RetryAfter is sent with rejections, 30s if empty
+	RetryAfter string `json:"retry_after"`
+
+	retryAfter time.Duration
+}
+
+func (c *QueueConfig) validate() error {
+	if c.Max < 1 {
+		return errors.New("queue: max must be at least 1")
+	}
+	switch c.Overflow {
+	case "":
+		c.Overflow = OverflowReject
+	case OverflowReject, OverflowDropOldest, OverflowCoalesce:
+	default:
+		return fmt.Errorf("queue: unknown overflow policy %q", c.Overflow)
+	}
+	c.retryAfter = 30 * time.Second
+	if c.RetryAfter != "" {
+		var err error
+		c.retryAfter, err = time.ParseDuration(c.RetryAfter)
+		if err != nil || c.retryAfter < time.Second {
+			return fmt.Errorf("queue: invalid retry after %q", c.RetryAfter)
+		}
+	}
+	return nil
+}
+
+// waiting returns the deploys waiting for their turn, oldest first.
+// d.mu must be held.
+func (d *Deployer) waiting() []*Deployment {
+	var waiting []*Deployment
+	for _, dep := range d.queue {
+		if dep != d.current && dep.Result == Queued {
+			waiting = append(waiting, dep)
+		}
+	}
+	return waiting
+}
+
+// queueFull returns the error of a deploy the container's queue
+// rejects, nil if it is admitted
+func (d *Deployer) queueFull() *HookError {
+	q := d.container.Queue
+	if q == nil || q.Overflow != OverflowReject {
+		return nil
+	}
+	d.mu.Lock()
+	waiting := len(d.waiting())
+	d.mu.Unlock()
+	if waiting < q.Max {
+		return nil
+	}
+	queueOverflows.Inc(d.container.Name, "rejected")
+	herr := serverError(CodeQueueFull, PhaseQueue, fmt.Errorf("%d deploys of %q are waiting already", waiting, d.container.Name))
+	herr.Status = http.StatusServiceUnavailable
+	herr.RetryAfter = int(math.Ceil(q.retryAfter.Seconds()))
+	return herr
+}
+
+// admit returns the error of the first container whose queue
+// rejects the push, so it is deployed to all of them or none
+func (ds Deployers) admit(repo, tag string) *HookError {
+	for _, d := range ds {
+		herr := d.queueFull()
+		if herr != nil {
+			log.Printf("Rejected push of %s:%s, the deploy queue of %q is full", repo, tag, d.container.Name)
+			return herr
+		}
+	}
+	return nil
+}
+
+// overflow applies the policy of the container's queue after dep was
+// enqueued, skipping the waiting deploys it drops or replaces
+func (d *Deployer) overflow(dep *Deployment) {
+	q := d.container.Queue
+	if q == nil {
+		return
+	}
+	d.mu.Lock()
+	waiting := d.waiting()
+	d.mu.Unlock()
+	if len(waiting) <= q.Max {
+		return
+	}
+
+	switch q.Overflow {
+	case OverflowDropOldest:
+		oldest := waiting[0]
+		queueOverflows.Inc(d.container.Name, "dropped")
+		herr := serverError(CodeQueueFull, PhaseQueue, fmt.Errorf("dropped from the full deploy queue of %q by deployment %s", d.container.Name, dep.ID))
+		herr.Status = http.StatusServiceUnavailable
+		d.skip(oldest, herr)
+	case OverflowCoalesce:
+		for _, w := range waiting {
+			if w == dep {
+				continue
+			}
+			queueOverflows.Inc(d.container.Name, "coalesced")
+			d.skip(w, &HookError{
+				Code:    CodeCoalesced,
+				Message: fmt.Sprintf("replaced by deployment %s of %s", dep.ID, dep.Tag),
+				Phase:   PhaseQueue,
+				Status:  http.StatusConflict,
+			})
+		}
+	}
+}
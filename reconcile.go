@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Reconcile inspects every managed container at startup. Containers that
+// are missing, stopped or running an image other than the configured one
+// are logged and, if redeploy is set, redeployed so a fresh host converges
+// without waiting for the next push.
+func Reconcile(deployers Deployers, redeploy bool) {
+	for _, d := range deployers {
+		reason, err := d.reconcileReason()
+		if err != nil {
+			log.Printf("Failed to inspect %q: %v", d.container.Name, err)
+			continue
+		}
+		if reason == "" {
+			continue
+		}
+
+		if !redeploy || !d.coordinator.Leader() {
+			log.Printf("Container %q %s", d.container.Name, reason)
+			continue
+		}
+
+		log.Printf("Container %q %s, redeploying", d.container.Name, reason)
+		herr := d.Deploy(d.container.Tag)
+		if herr != nil {
+			log.Printf("Failed to redeploy %q: %v", d.container.Name, herr)
+		}
+	}
+}
+
+// reconcileReason returns why the container doesn't match its
+// configuration, or an empty string if it does
+func (d *Deployer) reconcileReason() (string, error) {
+	c, err := d.client.InspectContainer(d.container.Name)
+	if _, ok := err.(*docker.NoSuchContainer); ok {
+		return "is missing", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	image := d.imageRef(d.container.Tag)
+	img, err := d.client.InspectImage(image)
+	if err == docker.ErrNoSuchImage {
+		return fmt.Sprintf("image %s is not present", image), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if c.Image != img.ID {
+		return fmt.Sprintf("is running %s instead of %s", shortID(c.Image), image), nil
+	}
+
+	// The container is what we would have deployed,
+	// so track it like one of our own.
+	d.mu.Lock()
+	if d.imageID == "" {
+		d.imageID = c.Image
+	}
+	d.mu.Unlock()
+
+	if !c.State.Running {
+		return "is not running", nil
+	}
+
+	return "", nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// CodePanic is used when a deploy or request panicked
+const CodePanic = ErrorCode("panic")
+
+// PhaseInternal is reported for panics outside of a phase
+const PhaseInternal = Phase("internal")
+
+// EventPanic is sent when a deploy panicked
+const EventPanic = Event("panic")
+
+// recoverPanics replies with a 500 instead of dropping the
+// connection when h panics, logging the stack trace
+func recoverPanics(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+			log.Printf("Panic serving %s %s: %v\n%s", r.Method, r.URL.Path, rec, debug.Stack())
+			writeError(w, serverError(CodePanic, PhaseInternal, fmt.Errorf("internal error: %v", rec)))
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// recovered turns the panic of a deploy in phase p into an error,
+// so the deploy fails like any other instead of killing the receiver
+func (d *Deployer) recovered(rec interface{}, p Phase) *HookError {
+	herr := serverError(CodePanic, p, fmt.Errorf("panic: %v", rec))
+	herr.Retryable = false
+	id := d.currentID()
+	log.WithField("deployment", id).Printf("Panic deploying %q: %v\n%s", d.container.Name, rec, debug.Stack())
+	notify(d.notifier, Notification{
+		Event:        EventPanic,
+		Container:    d.container.Name,
+		DeploymentID: id,
+		Phase:        p,
+		Message:      fmt.Sprintf("Deploy of %s panicked in phase %s: %v", d.container.Name, p, rec),
+	})
+	return herr
+}
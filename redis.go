@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisTimeout bounds connecting to Redis and every command
+const redisTimeout = 5 * time.Second
+
+// RedisStore is a StateStore in Redis, so receivers run side by
+// side for redundancy share their state
+type RedisStore struct {
+	addr     string
+	username string
+	password string
+	db       int
+	tls      bool
+	// prefix is prepended to every key, so the
+	// Redis database can be shared with others
+	prefix string
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// redisError is an error reply of Redis
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// NewRedisStore connects to the Redis of the URL, e.g.
+// rediss://:password@redis:6379/2?prefix=receiver:
+func NewRedisStore(rawURL string) (*RedisStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("unsupported state store %q, need a redis:// or rediss:// URL", u.Scheme)
+	}
+	s := &RedisStore{
+		addr:   u.Host,
+		tls:    u.Scheme == "rediss",
+		prefix: "docker-webhook-receiver:",
+	}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		s.username = u.User.Username()
+		s.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		s.db, err = strconv.Atoi(db)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+	}
+	if prefix, ok := u.Query()["prefix"]; ok {
+		s.prefix = prefix[0]
+	}
+
+	_, err = s.do("PING")
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get implements StateStore
+func (s *RedisStore) Get(key string) ([]byte, error) {
+	reply, err := s.do("GET", s.prefix+key)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	return reply.([]byte), nil
+}
+
+// Put implements StateStore
+func (s *RedisStore) Put(key string, value []byte) error {
+	_, err := s.do("SET", s.prefix+key, string(value))
+	return err
+}
+
+// Delete implements StateStore
+func (s *RedisStore) Delete(key string) error {
+	_, err := s.do("DEL", s.prefix+key)
+	return err
+}
+
+// Append implements StateStore
+func (s *RedisStore) Append(key string, value []byte, max int) error {
+	_, err := s.do("RPUSH", s.prefix+key, string(value))
+	if err != nil {
+		return err
+	}
+	_, err = s.do("LTRIM", s.prefix+key, strconv.Itoa(-max), "-1")
+	return err
+}
+
+// List implements StateStore
+func (s *RedisStore) List(key string) ([][]byte, error) {
+	reply, err := s.do("LRANGE", s.prefix+key, "0", "-1")
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	var values [][]byte
+	for _, v := range reply.([]interface{}) {
+		if value, ok := v.([]byte); ok {
+			values = append(values, value)
+		}
+	}
+	return values, nil
+}
+
+// do runs the command, connecting first if needed. A command failing
+// on a broken connection is retried once on a new connection.
+func (s *RedisStore) do(args ...string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for attempt := 0; ; attempt++ {
+		if s.conn == nil {
+			err := s.dial()
+			if err != nil {
+				return nil, err
+			}
+		}
+		reply, err := s.roundTrip(args)
+		if _, ok := err.(redisError); ok || err == nil {
+			return reply, err
+		}
+		s.conn.Close()
+		s.conn = nil
+		if attempt > 0 {
+			return nil, err
+		}
+	}
+}
+
+// dial connects, authenticates and selects the database. s.mu must be held.
+func (s *RedisStore) dial() error {
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var conn net.Conn
+	var err error
+	if s.tls {
+		host, _, _ := net.SplitHostPort(s.addr)
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", s.addr)
+	}
+	if err != nil {
+		return err
+	}
+	s.conn, s.r = conn, bufio.NewReader(conn)
+
+	if s.password != "" {
+		args := []string{"AUTH", s.password}
+		if s.username != "" {
+			args = []string{"AUTH", s.username, s.password}
+		}
+		_, err = s.roundTrip(args)
+	}
+	if err == nil && s.db != 0 {
+		_, err = s.roundTrip([]string{"SELECT", strconv.Itoa(s.db)})
+	}
+	if err != nil {
+		conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+// roundTrip sends the command and reads its reply. s.mu must be held.
+func (s *RedisStore) roundTrip(args []string) (interface{}, error) {
+	s.conn.SetDeadline(time.Now().Add(redisTimeout))
+	var cmd strings.Builder
+	fmt.Fprintf(&cmd, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&cmd, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := io.WriteString(s.conn, cmd.String())
+	if err != nil {
+		return nil, err
+	}
+	return s.readReply()
+}
+
+// readReply reads a reply of the RESP protocol: a string,
+// an int64, a []byte, an []interface{} or nil
+func (s *RedisStore) readReply() (interface{}, error) {
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("invalid redis reply %q", line)
+	}
+	kind, value := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return value, nil
+	case '-':
+		return nil, redisError(value)
+	case ':':
+		return strconv.ParseInt(value, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		_, err = io.ReadFull(s.r, buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			values[i], err = s.readReply()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, errors.New("invalid redis reply " + strconv.Quote(line))
+}
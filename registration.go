@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RegistrationConfig registers the deployed container in service discovery
+type RegistrationConfig struct {
+	// Type is consul or etcd
+	Type string `json:"type"`
+	// Service is the name of the service, the container name if empty
+	Service string `json:"service"`
+	// Address is the address the service is reached at, e.g. the IP
+	// of the host for published ports. The container's IP on its
+	// network if empty.
+	Address string `json:"address"`
+	// Port is the port the service is reached at on Address
+	Port int      `json:"port"`
+	Tags []string `json:"tags"`
+	// CheckPath is the HTTP path Consul checks the health of
+	// the service on, no check if empty
+	CheckPath     string `json:"check_path"`
+	CheckInterval string `json:"check_interval"`
+
+	Consul *ConsulConfig `json:"consul"`
+	Etcd   *EtcdConfig   `json:"etcd"`
+}
+
+// EtcdConfig is the etcd cluster services are registered in,
+// through its v3 JSON gateway
+type EtcdConfig struct {
+	Endpoint string `json:"endpoint"`
+	// Prefix of the keys, /services if empty. Instances are
+	// stored at {prefix}/{service}/{instance}.
+	Prefix   string `json:"prefix"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func (c *RegistrationConfig) validate(container string) error {
+	if c.Service == "" {
+		c.Service = container
+	}
+	if c.Port <= 0 {
+		return errors.New("registration needs a port")
+	}
+	if c.CheckInterval == "" {
+		c.CheckInterval = "10s"
+	}
+	switch c.Type {
+	case "consul":
+		if c.Consul == nil {
+			c.Consul = &ConsulConfig{}
+		}
+		c.Consul.defaults()
+	case "etcd":
+		if c.Etcd == nil || c.Etcd.Endpoint == "" {
+			return errors.New("registration etcd needs an endpoint")
+		}
+		if c.Etcd.Prefix == "" {
+			c.Etcd.Prefix = "/services"
+		}
+		c.Etcd.Prefix = strings.TrimSuffix(c.Etcd.Prefix, "/")
+	default:
+		return fmt.Errorf("unknown registration type %q", c.Type)
+	}
+	return nil
+}
+
+// Instance is a registered container
+type Instance struct {
+	ID        string `json:"id"`
+	Service   string `json:"service"`
+	Address   string `json:"address"`
+	Port      int    `json:"port"`
+	Container string `json:"container"`
+	Image     string `json:"image"`
+}
+
+// ServiceRegistrar registers the container of a deployer after every
+// successful deploy and deregisters the instances it replaced
+type ServiceRegistrar struct {
+	cfg *RegistrationConfig
+	d   *Deployer
+}
+
+// DeployStarted implements LifecycleHook
+func (s *ServiceRegistrar) DeployStarted(*Deployment) {}
+
+// DeployFinished implements LifecycleHook
+func (s *ServiceRegistrar) DeployFinished(dep *Deployment) {
+	if dep.Result != Success && !dep.RolledBack {
+		return
+	}
+	go func() {
+		err := s.register()
+		if err != nil {
+			log.WithField("deployment", dep.ID).Printf("Failed to register %q in %s: %v", s.d.container.Name, s.cfg.Type, err)
+		}
+	}()
+}
+
+// register registers the running container, then deregisters
+// all other instances of the container
+func (s *ServiceRegistrar) register() error {
+	c, err := s.d.client.InspectContainer(s.d.container.Name)
+	if err != nil {
+		return err
+	}
+	inst := Instance{
+		ID:        s.d.container.Name + "-" + shortID(c.ID),
+		Service:   s.cfg.Service,
+		Address:   s.cfg.Address,
+		Port:      s.cfg.Port,
+		Container: s.d.container.Name,
+		Image:     c.Config.Image,
+	}
+	if inst.Address == "" && c.NetworkSettings != nil {
+		inst.Address = c.NetworkSettings.IPAddress
+		if n, ok := c.NetworkSettings.Networks[s.d.container.Network]; ok {
+			inst.Address = n.IPAddress
+		}
+	}
+	if inst.Address == "" {
+		return errors.New("container has no IP address, configure the address to register")
+	}
+
+	if s.cfg.Type == "consul" {
+		return s.registerConsul(inst)
+	}
+	return s.registerEtcd(inst)
+}
+
+func (s *ServiceRegistrar) registerConsul(inst Instance) error {
+	consul := s.cfg.Consul
+	service := map[string]interface{}{
+		"ID":      inst.ID,
+		"Name":    inst.Service,
+		"Address": inst.Address,
+		"Port":    inst.Port,
+		"Tags":    s.cfg.Tags,
+		"Meta": map[string]string{
+			"managed-by": "docker-webhook-receiver",
+			"container":  inst.Container,
+			"image":      inst.Image,
+		},
+	}
+	if s.cfg.CheckPath != "" {
+		service["Check"] = map[string]string{
+			"HTTP":     "http://" + inst.Address + ":" + strconv.Itoa(inst.Port) + s.cfg.CheckPath,
+			"Interval": s.cfg.CheckInterval,
+		}
+	}
+	err := consul.request("PUT", "/v1/agent/service/register", service, nil)
+	if err != nil {
+		return err
+	}
+
+	var services map[string]struct {
+		ID   string
+		Meta map[string]string
+	}
+	err = consul.request("GET", "/v1/agent/services", nil, &services)
+	if err != nil {
+		return err
+	}
+	for id, svc := range services {
+		if id == inst.ID || svc.Meta["managed-by"] != "docker-webhook-receiver" || svc.Meta["container"] != inst.Container {
+			continue
+		}
+		err := consul.request("PUT", "/v1/agent/service/deregister/"+url.PathEscape(id), nil, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ServiceRegistrar) registerEtcd(inst Instance) error {
+	etcd := s.cfg.Etcd
+	prefix := etcd.Prefix + "/" + inst.Service + "/"
+	value, err := json.Marshal(inst)
+	if err != nil {
+		return err
+	}
+	err = etcd.request("/v3/kv/put", map[string]string{
+		"key":   b64(prefix + inst.ID),
+		"value": b64(string(value)),
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	var reply struct {
+		KVs []struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		} `json:"kvs"`
+	}
+	err = etcd.request("/v3/kv/range", map[string]string{
+		"key":       b64(prefix),
+		"range_end": b64(prefixEnd(prefix)),
+	}, &reply)
+	if err != nil {
+		return err
+	}
+	for _, kv := range reply.KVs {
+		content, _ := base64.StdEncoding.DecodeString(kv.Value)
+		var other Instance
+		if json.Unmarshal(content, &other) != nil || other.Container != inst.Container || other.ID == inst.ID {
+			continue
+		}
+		err := etcd.request("/v3/kv/deleterange", map[string]string{"key": kv.Key}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var etcdClient = &http.Client{Timeout: 10 * time.Second}
+
+// request posts in to the etcd JSON gateway, decoding the
+// reply into out if not nil
+func (c *EtcdConfig) request(path string, in, out interface{}) error {
+	token := ""
+	if c.Username != "" {
+		var auth struct {
+			Token string `json:"token"`
+		}
+		err := c.post("/v3/auth/authenticate", "", map[string]string{"name": c.Username, "password": c.Password}, &auth)
+		if err != nil {
+			return fmt.Errorf("failed to authenticate: %v", err)
+		}
+		token = auth.Token
+	}
+	return c.post(path, token, in, out)
+}
+
+func (c *EtcdConfig) post(path, token string, in, out interface{}) error {
+	content, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(c.Endpoint, "/")+path, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := etcdClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("etcd %s: %s: %s", path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// prefixEnd returns the end of the key range of all keys with the
+// prefix, which is the prefix with its last byte incremented
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	end[len(end)-1]++
+	return string(end)
+}
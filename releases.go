@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// ReleaseConfig records successful deploys as releases
+// in an error tracker
+type ReleaseConfig struct {
+	// Type is sentry or rollbar
+	Type string `json:"type"`
+	// Version is tag (default) or revision, the revision label of
+	// the image, falling back to the tag for unlabeled images
+	Version string `json:"version"`
+	// Environment deployed to, production if empty
+	Environment string `json:"environment"`
+
+	Sentry  *SentryConfig  `json:"sentry"`
+	Rollbar *RollbarConfig `json:"rollbar"`
+}
+
+// SentryConfig are the projects of a Sentry organization
+type SentryConfig struct {
+	// URL of the Sentry instance, https://sentry.io if empty
+	URL          string   `json:"url"`
+	Organization string   `json:"organization"`
+	Projects     []string `json:"projects"`
+	// Token is an auth token, SENTRY_AUTH_TOKEN if empty
+	Token string `json:"token"`
+}
+
+// RollbarConfig is a Rollbar project
+type RollbarConfig struct {
+	// Token is a post_server_item access token,
+	// ROLLBAR_ACCESS_TOKEN if empty
+	Token string `json:"token"`
+}
+
+func (c *ReleaseConfig) validate() error {
+	switch c.Version {
+	case "":
+		c.Version = "tag"
+	case "tag", "revision":
+	default:
+		return fmt.Errorf("unknown release version %q", c.Version)
+	}
+	if c.Environment == "" {
+		c.Environment = "production"
+	}
+	switch c.Type {
+	case "sentry":
+		if c.Sentry == nil || c.Sentry.Organization == "" || len(c.Sentry.Projects) == 0 {
+			return errors.New("release sentry needs an organization and projects")
+		}
+		if c.Sentry.URL == "" {
+			c.Sentry.URL = "https://sentry.io"
+		}
+		c.Sentry.URL = strings.TrimSuffix(c.Sentry.URL, "/")
+		if c.Sentry.Token == "" {
+			c.Sentry.Token = os.Getenv("SENTRY_AUTH_TOKEN")
+		}
+		if c.Sentry.Token == "" {
+			return errors.New("release sentry needs a token")
+		}
+	case "rollbar":
+		if c.Rollbar == nil {
+			c.Rollbar = &RollbarConfig{}
+		}
+		if c.Rollbar.Token == "" {
+			c.Rollbar.Token = os.Getenv("ROLLBAR_ACCESS_TOKEN")
+		}
+		if c.Rollbar.Token == "" {
+			return errors.New("release rollbar needs a token")
+		}
+	default:
+		return fmt.Errorf("unknown release type %q", c.Type)
+	}
+	return nil
+}
+
+// ReleaseTracker creates a release in the error
+// tracker for every successful deploy
+type ReleaseTracker struct {
+	cfg *ReleaseConfig
+}
+
+// DeployStarted implements LifecycleHook
+func (r *ReleaseTracker) DeployStarted(*Deployment) {}
+
+// DeployFinished implements LifecycleHook
+func (r *ReleaseTracker) DeployFinished(dep *Deployment) {
+	if dep.Result != Success {
+		return
+	}
+	version := dep.Tag
+	if r.cfg.Version == "revision" && dep.Labels != nil && dep.Labels.Revision != "" {
+		version = dep.Labels.Revision
+	}
+	started, finished := dep.StartedAt, dep.FinishedAt
+	go func() {
+		var err error
+		if r.cfg.Type == "sentry" {
+			err = r.cfg.Sentry.release(version, r.cfg.Environment, started, finished)
+		} else {
+			err = r.cfg.Rollbar.deploy(version, r.cfg.Environment)
+		}
+		if err != nil {
+			log.WithField("deployment", dep.ID).Printf("Failed to create %s release %s: %v", r.cfg.Type, version, err)
+		}
+	}()
+}
+
+var releaseClient = &http.Client{Timeout: 30 * time.Second}
+
+// release creates the release, if it doesn't exist yet,
+// and records its deploy to the environment
+func (c *SentryConfig) release(version, environment string, started, finished time.Time) error {
+	base := c.URL + "/api/0/organizations/" + url.PathEscape(c.Organization) + "/releases/"
+	auth := "Bearer " + c.Token
+	err := githubRequest(releaseClient, "POST", base, auth, map[string]interface{}{
+		"version":  version,
+		"projects": c.Projects,
+	}, nil)
+	if err != nil {
+		return err
+	}
+	return githubRequest(releaseClient, "POST", base+url.PathEscape(version)+"/deploys/", auth, map[string]interface{}{
+		"environment":  environment,
+		"name":         "docker-webhook-receiver",
+		"dateStarted":  started,
+		"dateFinished": finished,
+	}, nil)
+}
+
+// deploy records the deploy of the revision to the environment
+func (c *RollbarConfig) deploy(version, environment string) error {
+	return githubRequest(releaseClient, "POST", "https://api.rollbar.com/api/1/deploy", "", map[string]string{
+		"access_token":   c.Token,
+		"environment":    environment,
+		"revision":       version,
+		"local_username": "docker-webhook-receiver",
+		"status":         "succeeded",
+	}, nil)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CodeReplayedPayload is used when a webhook looks like
+// a replayed capture of an earlier one
+const CodeReplayedPayload = ErrorCode("replayed_payload")
+
+// replaysRejected counts the webhooks rejected as replayed
+var replaysRejected = NewCounterVec(
+	"webhook_replays_rejected_total",
+	"Webhooks rejected as replayed, by reason.",
+	"reason",
+)
+
+// ReplayConfig rejects Docker Hub webhooks that look replayed by
+// their push_data.pushed_at
+type ReplayConfig struct {
+	// MaxAge is how old, or how far in the future, pushed_at may be,
+	// 10m if empty
+	MaxAge string `json:"max_age"`
+
+	maxAge time.Duration
+}
+
+func (c *ReplayConfig) validate() error {
+	c.maxAge = 10 * time.Minute
+	if c.MaxAge != "" {
+		var err error
+		c.maxAge, err = time.ParseDuration(c.MaxAge)
+		if err != nil || c.maxAge <= 0 {
+			return fmt.Errorf("replay protection: invalid max age %q", c.MaxAge)
+		}
+	}
+	return nil
+}
+
+// ReplayGuard remembers the last push accepted for every repository
+type ReplayGuard struct {
+	cfg *ReplayConfig
+
+	mu sync.Mutex
+	// last is the last accepted push, by tenant and repository
+	last map[string]*lastPush
+}
+
+// lastPush is the pushed_at of the last accepted push of a repository
+type lastPush struct {
+	pushedAt int64
+	// payloads are the hashes of the push data accepted with
+	// pushedAt, as pushes of several tags may share the second
+	payloads map[[sha256.Size]byte]bool
+}
+
+// NewReplayGuard returns a guard checking pushes as configured
+func NewReplayGuard(cfg *ReplayConfig) *ReplayGuard {
+	return &ReplayGuard{
+		cfg:  cfg,
+		last: map[string]*lastPush{},
+	}
+}
+
+// check fails if the push was pushed too long ago, before the
+// last push accepted for its repository or was accepted already.
+// Nothing is remembered until the push is recorded.
+func (g *ReplayGuard) check(tenant string, hook *DockerHubWebhook, now time.Time) *HookError {
+	return g.verify(tenant, hook, now, false)
+}
+
+// record checks the push again and remembers it as accepted, once it
+// is verified to be genuine. Unverified pushes must not be recorded, as
+// a forged one could then block the genuine push or the pushes after it.
+func (g *ReplayGuard) record(tenant string, hook *DockerHubWebhook, now time.Time) *HookError {
+	return g.verify(tenant, hook, now, true)
+}
+
+// verify checks the push, remembering it if accepted and record is set
+func (g *ReplayGuard) verify(tenant string, hook *DockerHubWebhook, now time.Time, record bool) *HookError {
+	if g == nil {
+		return nil
+	}
+	reject := func(reason string, err error) *HookError {
+		replaysRejected.Inc(reason)
+		log.Printf("Rejected webhook for %s:%s as replayed: %v", hook.Repository.RepoName, hook.PushData.Tag, err)
+		herr := clientError(CodeReplayedPayload, PhaseVerify, err)
+		herr.Status = http.StatusConflict
+		return herr
+	}
+
+	pushedAt := int64(hook.PushData.PushedAt)
+	if pushedAt == 0 {
+		return reject("missing", errors.New("push_data.pushed_at is missing"))
+	}
+	age := now.Sub(time.Unix(pushedAt, 0))
+	if age > g.cfg.maxAge || -age > g.cfg.maxAge {
+		return reject("too_old", fmt.Errorf("pushed_at is %s off, more than %s", age.Round(time.Second), g.cfg.maxAge))
+	}
+
+	// Repository metadata like star_count doesn't make another push
+	content, err := json.Marshal(hook.PushData)
+	if err != nil {
+		return serverError(CodeInternal, PhaseVerify, err)
+	}
+	hash := sha256.Sum256(content)
+
+	key := tenant + "/" + hook.Repository.RepoName
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	last := g.last[key]
+	switch {
+	case last == nil || pushedAt > last.pushedAt:
+		last = &lastPush{pushedAt: pushedAt, payloads: map[[sha256.Size]byte]bool{}}
+		if record {
+			g.last[key] = last
+		}
+	case pushedAt < last.pushedAt:
+		return reject("out_of_order", fmt.Errorf("pushed_at is before the last push to %s", hook.Repository.RepoName))
+	case last.payloads[hash]:
+		return reject("duplicate", fmt.Errorf("the push to %s was accepted already", hook.Repository.RepoName))
+	}
+	if record {
+		last.payloads[hash] = true
+	}
+	return nil
+}
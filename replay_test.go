@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplayGuard(t *testing.T) {
+	cfg := &ReplayConfig{}
+	err := cfg.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := NewReplayGuard(cfg)
+	now := time.Now()
+	push := func(repo, tag string, pushedAt time.Time) *DockerHubWebhook {
+		hook := &DockerHubWebhook{}
+		hook.Repository.RepoName = repo
+		hook.PushData.Tag = tag
+		hook.PushData.PushedAt = int(pushedAt.Unix())
+		return hook
+	}
+
+	for _, tt := range []struct {
+		name   string
+		tenant string
+		hook   *DockerHubWebhook
+		reason string
+	}{
+		{"first push", "web", push("example/app", "v1", now.Add(-time.Minute)), ""},
+		{"identical resend", "web", push("example/app", "v1", now.Add(-time.Minute)), "duplicate"},
+		{"other tag in the same second", "web", push("example/app", "v2", now.Add(-time.Minute)), ""},
+		{"resend of the other tag", "web", push("example/app", "v2", now.Add(-time.Minute)), "duplicate"},
+		{"older push", "web", push("example/app", "v0", now.Add(-2*time.Minute)), "out_of_order"},
+		{"later push of the same tag", "web", push("example/app", "v1", now), ""},
+		{"other repository", "web", push("example/other", "v1", now.Add(-time.Minute)), ""},
+		{"other tenant", "api", push("example/app", "v1", now.Add(-time.Minute)), ""},
+		{"too old", "web", push("example/app", "v3", now.Add(-time.Hour)), "too_old"},
+		{"in the future", "web", push("example/app", "v3", now.Add(time.Hour)), "too_old"},
+		{"missing pushed_at", "web", &DockerHubWebhook{}, "missing"},
+	} {
+		herr := g.check(tt.tenant, tt.hook, now)
+		if herr == nil {
+			herr = g.record(tt.tenant, tt.hook, now)
+		}
+		switch {
+		case tt.reason == "" && herr != nil:
+			t.Errorf("%s: rejected with %v", tt.name, herr)
+		case tt.reason != "" && herr == nil:
+			t.Errorf("%s: accepted, want %s", tt.name, tt.reason)
+		case herr != nil && (herr.Code != CodeReplayedPayload || herr.Status != http.StatusConflict):
+			t.Errorf("%s: got %v, want %s with %d", tt.name, herr, CodeReplayedPayload, http.StatusConflict)
+		}
+	}
+}
+
+// callbackTransport answers callbacks with the statuses, in turn
+type callbackTransport struct {
+	statuses []int
+	calls    int
+}
+
+func (c *callbackTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	status := c.statuses[c.calls]
+	c.calls++
+	return &http.Response{
+		StatusCode: status,
+		Status:     http.StatusText(status),
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    r,
+	}, nil
+}
+
+func TestReplayAfterFailedCallback(t *testing.T) {
+	cfg := &Config{
+		Tenants:          []TenantConfig{{Name: DefaultTenant}},
+		ReplayProtection: &ReplayConfig{},
+	}
+	err := cfg.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newFakeDocker()
+	client.addImage("example/app:v1")
+	h := &WebhookHandler{
+		cfg:       cfg,
+		deployers: Deployers{newTestDeployer(client, ContainerConfig{Tag: "v1"})},
+		replays:   NewReplayGuard(cfg.ReplayProtection),
+	}
+	transport := &callbackTransport{statuses: []int{http.StatusServiceUnavailable, http.StatusOK, http.StatusOK}}
+	defer func(t http.RoundTripper) { callbackClient.Transport = t }(callbackClient.Transport)
+	callbackClient.Transport = transport
+
+	body := fmt.Sprintf(`{
+		"callback_url": "https://registry.hub.docker.com/u/example/app/hook/1/",
+		"push_data": {"tag": "v1", "pushed_at": %d},
+		"repository": {"repo_name": "example/app"}
+	}`, time.Now().Unix())
+	send := func() *HookError {
+		_, herr := h.process(&WebhookPayload{Tenant: DefaultTenant, Body: body}, &DockerHubWebhook{}, false)
+		return herr
+	}
+
+	herr := send()
+	if herr == nil || herr.Code != CodeCallbackFailed {
+		t.Fatalf("got %v, want %s", herr, CodeCallbackFailed)
+	}
+	herr = send()
+	if herr != nil {
+		t.Fatalf("resend after the failed callback: %v", herr)
+	}
+	herr = send()
+	if herr == nil || herr.Code != CodeReplayedPayload {
+		t.Errorf("resend after the accepted push: got %v, want %s", herr, CodeReplayedPayload)
+	}
+	if transport.calls != 2 {
+		t.Errorf("got %d callbacks, want 2", transport.calls)
+	}
+}
+
+func TestReplayGuardUnrecorded(t *testing.T) {
+	cfg := &ReplayConfig{}
+	err := cfg.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := NewReplayGuard(cfg)
+	now := time.Now()
+	forged := &DockerHubWebhook{}
+	forged.Repository.RepoName = "example/app"
+	forged.PushData.Tag = "v9"
+	forged.PushData.PushedAt = int(now.Add(5 * time.Minute).Unix())
+	if herr := g.check("web", forged, now); herr != nil {
+		t.Fatal(herr)
+	}
+
+	genuine := &DockerHubWebhook{}
+	genuine.Repository.RepoName = "example/app"
+	genuine.PushData.Tag = "v1"
+	genuine.PushData.PushedAt = int(now.Unix())
+	if herr := g.check("web", genuine, now); herr != nil {
+		t.Errorf("genuine push after an unverified one: %v", herr)
+	}
+}
+
+func TestReplayAfterRestart(t *testing.T) {
+	cfg := &Config{Tenants: []TenantConfig{{Name: DefaultTenant}}}
+	err := cfg.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewDirStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit, err := NewAuditLog(AuditConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newFakeDocker()
+	client.addImage("example/app:v1")
+	defer func(t http.RoundTripper) { callbackClient.Transport = t }(callbackClient.Transport)
+	callbackClient.Transport = &callbackTransport{statuses: []int{http.StatusOK}}
+
+	before := newTestDeployer(client, ContainerConfig{Tag: "v1"})
+	before.State = store
+	h := &WebhookHandler{cfg: cfg, deployers: Deployers{before}, audit: audit}
+	deployments, herr := h.process(&WebhookPayload{Tenant: DefaultTenant, Body: `{
+		"callback_url": "https://registry.hub.docker.com/u/example/app/hook/1/",
+		"push_data": {"tag": "v1"},
+		"repository": {"repo_name": "example/app"}
+	}`}, &DockerHubWebhook{}, false)
+	if herr != nil || len(deployments) != 1 {
+		t.Fatalf("got %v, %v, want a deployment", deployments, herr)
+	}
+
+	// The receiver restarts, reloading the history from the store
+	after := newTestDeployer(client, ContainerConfig{Tag: "v1"})
+	after.State = store
+	after.loadHistory()
+	replay := &ReplayHandler{
+		deployers: Deployers{after},
+		webhooks:  &WebhookHandler{cfg: cfg, deployers: Deployers{after}, audit: audit},
+	}
+	r := httptest.NewRequest(http.MethodPost, "/api/deployments/"+deployments[0].ID+"/replay", nil)
+	r.SetPathValue("id", deployments[0].ID)
+	w := httptest.NewRecorder()
+	replay.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("replay after restart: got %d %s", w.Code, w.Body)
+	}
+	if got := len(after.History()); got != 2 {
+		t.Errorf("got %d deployments after the replay, want 2", got)
+	}
+
+	content, err := json.Marshal(after.History()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), "callback_url") {
+		t.Errorf("deployment exposes its webhook payload: %s", content)
+	}
+}
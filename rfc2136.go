@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// RFC2136Config is a zone updated with RFC 2136 dynamic updates,
+// e.g. by BIND, Knot or PowerDNS
+type RFC2136Config struct {
+	// Server is the host:port of the primary server of the zone,
+	// port 53 if none
+	Server string `json:"server"`
+	Zone   string `json:"zone"`
+	// KeyName and Secret are the name and base64 encoded secret
+	// of the hmac-sha256 TSIG key signing the update, if set
+	KeyName string `json:"key_name"`
+	Secret  string `json:"secret"`
+
+	secret []byte
+}
+
+func (c *RFC2136Config) validate() error {
+	if _, _, err := net.SplitHostPort(c.Server); err != nil {
+		c.Server = net.JoinHostPort(c.Server, "53")
+	}
+	if c.KeyName == "" {
+		return nil
+	}
+	var err error
+	c.secret, err = base64.StdEncoding.DecodeString(c.Secret)
+	if err != nil || len(c.secret) == 0 {
+		return errors.New("dns rfc2136 needs the base64 encoded secret of the key")
+	}
+	return nil
+}
+
+// DNS wire format constants, see RFC 1035 and RFC 2136
+const (
+	dnsOpcodeUpdate = 5
+	dnsClassIN      = 1
+	dnsClassANY     = 255
+	dnsTypeA        = 1
+	dnsTypeSOA      = 6
+	dnsTypeAAAA     = 28
+	dnsTypeSRV      = 33
+	dnsTypeTSIG     = 250
+	tsigFudge       = 300
+	tsigAlgorithm   = "hmac-sha256"
+)
+
+var dnsRcodes = map[byte]string{
+	1:  "FORMERR",
+	2:  "SERVFAIL",
+	3:  "NXDOMAIN",
+	4:  "NOTIMP",
+	5:  "REFUSED",
+	6:  "YXDOMAIN",
+	7:  "YXRRSET",
+	8:  "NXRRSET",
+	9:  "NOTAUTH",
+	10: "NOTZONE",
+}
+
+// update replaces the records of the name and type of the record
+// with the record in a single dynamic update over TCP
+func (c *RFC2136Config) update(name string, ttl int, record dnsRecord) error {
+	msg, id, err := c.updateMessage(name, ttl, record)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", c.Server, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	_, err = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...))
+	if err != nil {
+		return err
+	}
+	var length [2]byte
+	_, err = io.ReadFull(conn, length[:])
+	if err != nil {
+		return err
+	}
+	reply := make([]byte, binary.BigEndian.Uint16(length[:]))
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return err
+	}
+	if len(reply) < 12 || binary.BigEndian.Uint16(reply) != id {
+		return errors.New("invalid reply to dns update")
+	}
+	if rcode := reply[3] & 0x0f; rcode != 0 {
+		name, ok := dnsRcodes[rcode]
+		if !ok {
+			name = fmt.Sprintf("rcode %d", rcode)
+		}
+		return fmt.Errorf("dns update refused by %s: %s", c.Server, name)
+	}
+	return nil
+}
+
+// updateMessage returns the signed update message and its ID
+func (c *RFC2136Config) updateMessage(name string, ttl int, record dnsRecord) ([]byte, uint16, error) {
+	var rtype uint16
+	var rdata []byte
+	switch record.Type {
+	case "A", "AAAA":
+		ip := net.ParseIP(record.Value)
+		rtype, rdata = dnsTypeAAAA, ip.To16()
+		if ip4 := ip.To4(); ip4 != nil {
+			rtype, rdata = dnsTypeA, ip4
+		}
+	case "SRV":
+		rtype = dnsTypeSRV
+		rdata = binary.BigEndian.AppendUint16(rdata, 0)
+		rdata = binary.BigEndian.AppendUint16(rdata, 0)
+		rdata = binary.BigEndian.AppendUint16(rdata, uint16(record.Port))
+		rdata = appendDNSName(rdata, record.Value)
+	}
+
+	var idBytes [2]byte
+	_, err := rand.Read(idBytes[:])
+	if err != nil {
+		return nil, 0, err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = binary.BigEndian.AppendUint16(msg, dnsOpcodeUpdate<<11)
+	// One zone, no prerequisites, two updates, no additional records
+	for _, count := range []uint16{1, 0, 2, 0} {
+		msg = binary.BigEndian.AppendUint16(msg, count)
+	}
+	msg = appendDNSName(msg, c.Zone)
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeSOA)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+	// Delete the RRset, then add the record
+	msg = appendDNSRecord(msg, name, rtype, dnsClassANY, 0, nil)
+	msg = appendDNSRecord(msg, name, rtype, dnsClassIN, uint32(ttl), rdata)
+
+	if c.KeyName == "" {
+		return msg, id, nil
+	}
+	return c.sign(msg, id), id, nil
+}
+
+// sign appends the TSIG record of the message, see RFC 8945
+func (c *RFC2136Config) sign(msg []byte, id uint16) []byte {
+	keyName := appendDNSName(nil, strings.ToLower(c.KeyName))
+	algorithm := appendDNSName(nil, tsigAlgorithm)
+	now := uint64(time.Now().Unix())
+	timeSigned := binary.BigEndian.AppendUint64(nil, now)[2:]
+
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write(msg)
+	mac.Write(keyName)
+	mac.Write(binary.BigEndian.AppendUint16(nil, dnsClassANY))
+	mac.Write(binary.BigEndian.AppendUint32(nil, 0))
+	mac.Write(algorithm)
+	mac.Write(timeSigned)
+	mac.Write(binary.BigEndian.AppendUint16(nil, tsigFudge))
+	// No error and other data
+	mac.Write(binary.BigEndian.AppendUint32(nil, 0))
+	sum := mac.Sum(nil)
+
+	rdata := append(algorithm, timeSigned...)
+	rdata = binary.BigEndian.AppendUint16(rdata, tsigFudge)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(sum)))
+	rdata = append(rdata, sum...)
+	rdata = binary.BigEndian.AppendUint16(rdata, id)
+	rdata = binary.BigEndian.AppendUint32(rdata, 0)
+
+	msg = appendDNSRecord(msg, c.KeyName, dnsTypeTSIG, dnsClassANY, 0, rdata)
+	// One additional record
+	binary.BigEndian.PutUint16(msg[10:], 1)
+	return msg
+}
+
+// appendDNSName appends the uncompressed wire format of the name
+func appendDNSName(b []byte, name string) []byte {
+	name = strings.TrimSuffix(name, ".")
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0)
+}
+
+func appendDNSRecord(b []byte, name string, rtype, class uint16, ttl uint32, rdata []byte) []byte {
+	b = appendDNSName(b, name)
+	b = binary.BigEndian.AppendUint16(b, rtype)
+	b = binary.BigEndian.AppendUint16(b, class)
+	b = binary.BigEndian.AppendUint32(b, ttl)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(rdata)))
+	return append(b, rdata...)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"time"
+)
+
+// PhaseStagedRollout waits for the earlier stages of a staged rollout
+const PhaseStagedRollout = Phase("staged_rollout")
+
+// CodeRolloutHalted is used for deploys skipped because
+// an earlier stage of their rollout failed too often
+const CodeRolloutHalted = ErrorCode("rollout_halted")
+
+// EventRolloutHalted is sent when a staged rollout is halted
+const EventRolloutHalted = Event("rollout_halted")
+
+// RolloutConfig rolls out the pushes to a repository whose containers
+// run on several hosts in stages, one group of hosts after the other
+type RolloutConfig struct {
+	Repository string         `json:"repository"`
+	Stages     []RolloutStage `json:"stages"`
+	// MaxFailureRate is the fraction of the deploys of a stage, e.g.
+	// 0.2, that may fail without halting the rollout. 0 halts it on
+	// the first failure.
+	MaxFailureRate float64 `json:"max_failure_rate"`
+}
+
+// RolloutStage is a group of hosts deployed to together
+type RolloutStage struct {
+	Name string `json:"name"`
+	// Hosts are the hosts of the containers of the stage, as
+	// path.Match patterns, e.g. agent://eu-*. Containers are in
+	// the first stage matching their host.
+	Hosts []string `json:"hosts"`
+	// Bake is how long the containers of the stage must keep running
+	// before the next stage is deployed
+	Bake string `json:"bake"`
+
+	bake time.Duration
+}
+
+func (c *RolloutConfig) validate() error {
+	if c.Repository == "" || len(c.Stages) == 0 {
+		return errors.New("rollouts need a repository and stages")
+	}
+	if c.MaxFailureRate < 0 || c.MaxFailureRate >= 1 {
+		return fmt.Errorf("rollout of %q: max failure rate must be at least 0 and below 1", c.Repository)
+	}
+	for i := range c.Stages {
+		s := &c.Stages[i]
+		if s.Name == "" {
+			s.Name = fmt.Sprint(i + 1)
+		}
+		if len(s.Hosts) == 0 {
+			return fmt.Errorf("rollout of %q: stage %s has no hosts", c.Repository, s.Name)
+		}
+		for _, pattern := range s.Hosts {
+			_, err := path.Match(pattern, "")
+			if err != nil {
+				return fmt.Errorf("rollout of %q: stage %s: invalid host pattern %q", c.Repository, s.Name, pattern)
+			}
+		}
+		if s.Bake != "" {
+			var err error
+			s.bake, err = time.ParseDuration(s.Bake)
+			if err != nil || s.bake < 0 {
+				return fmt.Errorf("rollout of %q: stage %s: invalid bake %q", c.Repository, s.Name, s.Bake)
+			}
+		}
+	}
+	return nil
+}
+
+// rollout returns the rollout of the repository, if any
+func (t *TenantConfig) rollout(repo string) *RolloutConfig {
+	for i := range t.Rollouts {
+		if t.Rollouts[i].Repository == repo {
+			return &t.Rollouts[i]
+		}
+	}
+	return nil
+}
+
+// stage returns the index of the first stage matching
+// host, or len(c.Stages) if there is none
+func (c *RolloutConfig) stage(host string) int {
+	for i, s := range c.Stages {
+		for _, pattern := range s.Hosts {
+			if ok, _ := path.Match(pattern, host); ok {
+				return i
+			}
+		}
+	}
+	return len(c.Stages)
+}
+
+// runRollout runs the pipelines of the deployers like runOrdered, in
+// the stages of their rollout, if any. Containers on hosts of no stage
+// are deployed after the last one. A stage whose failure rate exceeds
+// the max failure rate of the rollout, counting containers that stopped
+// running while it baked, halts it, failing the later stages. Only the
+// first stage is waited for; it bakes and the later stages run in the
+// background, so the deployments returned for them are still queued.
+func (ds Deployers) runRollout(deployers Deployers, enqueued []*Deployment, tag string, payload *WebhookPayload) ([]*Deployment, *HookError) {
+	r := deployers[0].rollout
+	if r == nil {
+		return ds.runOrdered(deployers, enqueued, tag, payload)
+	}
+
+	stages := make([]Deployers, len(r.Stages)+1)
+	stageEnqueued := make([][]*Deployment, len(r.Stages)+1)
+	for i, d := range deployers {
+		s := r.stage(d.container.Host)
+		stages[s] = append(stages[s], d)
+		stageEnqueued[s] = append(stageEnqueued[s], enqueued[i])
+	}
+
+	first := 0
+	for len(stages[first]) == 0 {
+		first++
+	}
+	// The later stages pull while the earlier ones deploy and bake
+	for s := first + 1; s < len(stages); s++ {
+		for i, d := range stages[s] {
+			if dep := stageEnqueued[s][i]; dep.Archive == "" && dep.Action == "" {
+				d.prepull(d.container.Tag)
+			}
+		}
+	}
+	deployments, herr := ds.runOrdered(stages[first], stageEnqueued[first], tag, payload)
+	if !hasLaterStage(stages, first) {
+		return deployments, herr
+	}
+	for _, deps := range stageEnqueued[first+1:] {
+		deployments = append(deployments, deps...)
+	}
+
+	go func() {
+		halted := r.bake(stages, stageEnqueued, first, tag)
+		for s := first + 1; s < len(stages); s++ {
+			if len(stages[s]) == 0 {
+				continue
+			}
+			if halted != nil {
+				for i, d := range stages[s] {
+					d.skip(stageEnqueued[s][i], halted)
+				}
+				continue
+			}
+			_, herr := ds.runOrdered(stages[s], stageEnqueued[s], tag, payload)
+			if herr != nil {
+				log.Print(herr)
+			}
+			if s < len(r.Stages) {
+				halted = r.bake(stages, stageEnqueued, s, tag)
+			}
+		}
+	}()
+	return deployments, herr
+}
+
+// bake waits for the bake of the deployed stage s, if a later stage has
+// deploys, and returns the error halting the rollout if the stage
+// failed too often
+func (r *RolloutConfig) bake(stages []Deployers, stageEnqueued [][]*Deployment, s int, tag string) *HookError {
+	stage := r.Stages[s]
+	failed := rolloutFailures(stages[s], stageEnqueued[s])
+	tooMany := func() bool {
+		return len(failed) > 0 && float64(len(failed))/float64(len(stages[s])) > r.MaxFailureRate
+	}
+	if !tooMany() && stage.bake > 0 && hasLaterStage(stages, s) {
+		log.Printf("Baking stage %s of the rollout of %s:%s for %s", stage.Name, r.Repository, tag, stage.bake)
+		time.Sleep(stage.bake)
+		for _, name := range stoppedContainers(stages[s]) {
+			if !contains(failed, name) {
+				failed = append(failed, name)
+			}
+		}
+	}
+	if !tooMany() {
+		return nil
+	}
+	msg := fmt.Sprintf("Rollout of %s:%s halted, %d of %d deploys of stage %s failed: %v", r.Repository, tag, len(failed), len(stages[s]), stage.Name, failed)
+	log.Print(msg)
+	notify(stages[s][0].notifier, Notification{
+		Event:     EventRolloutHalted,
+		Container: failed[0],
+		Phase:     PhaseStagedRollout,
+		Message:   msg,
+	})
+	return serverError(CodeRolloutHalted, PhaseStagedRollout, errors.New(msg))
+}
+
+// rolloutFailures returns the names of the containers whose deploys failed
+func rolloutFailures(deployers Deployers, enqueued []*Deployment) []string {
+	var failed []string
+	for i, d := range deployers {
+		if result := enqueued[i].Result; result != Success && result != Held {
+			failed = append(failed, d.container.Name)
+		}
+	}
+	return failed
+}
+
+// stoppedContainers returns the names of the containers run by a Docker
+// API that are no longer running or became unhealthy. Containers run by
+// agents or orchestrators can't be checked.
+func stoppedContainers(deployers Deployers) []string {
+	var stopped []string
+	for _, d := range deployers {
+		if d.client == nil {
+			continue
+		}
+		c, err := d.client.InspectContainer(d.container.Name)
+		if err != nil || !c.State.Running || c.State.Health.Status == "unhealthy" {
+			stopped = append(stopped, d.container.Name)
+		}
+	}
+	return stopped
+}
+
+// hasLaterStage reports whether a stage after s has deployers
+func hasLaterStage(stages []Deployers, s int) bool {
+	for _, later := range stages[s+1:] {
+		if len(later) > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// newTestRollout returns deployers of app on a canary and a
+// production host, rolled out in that order
+func newTestRollout(t *testing.T, bake string) (Deployers, *fakeDocker, *fakeDocker) {
+	t.Helper()
+	r := &RolloutConfig{
+		Repository: "example/app",
+		Stages: []RolloutStage{
+			{Name: "canary", Hosts: []string{"canary"}, Bake: bake},
+			{Name: "prod", Hosts: []string{"prod"}},
+		},
+	}
+	err := r.validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	canary, prod := newFakeDocker(), newFakeDocker()
+	canary.addImage("example/app:v1")
+	prod.addImage("example/app:v1")
+	a := newTestDeployer(canary, ContainerConfig{Tag: "v1", Host: "canary"})
+	b := newTestDeployer(prod, ContainerConfig{Tag: "v1", Host: "prod"})
+	a.rollout, b.rollout = r, r
+	return Deployers{a, b}, canary, prod
+}
+
+// waitFinished waits for the deployment to finish
+func waitFinished(t *testing.T, dep *Deployment, d *Deployer) *Deployment {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, finished := range d.History() {
+			if finished.ID == dep.ID {
+				return finished
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("deployment %s didn't finish", dep.ID)
+	return nil
+}
+
+func TestRolloutLaterStagesInBackground(t *testing.T) {
+	ds, _, prod := newTestRollout(t, "200ms")
+	enqueued := []*Deployment{ds[0].enqueue("v1", nil), ds[1].enqueue("v1", nil)}
+
+	start := time.Now()
+	deployments, herr := ds.runRollout(ds, enqueued, "v1", nil)
+	if herr != nil {
+		t.Fatal(herr)
+	}
+	if elapsed := time.Since(start); elapsed >= 200*time.Millisecond {
+		t.Errorf("returned after %s, want before the canary baked", elapsed)
+	}
+	if len(deployments) != 2 || deployments[0].Result != Success || deployments[1] != enqueued[1] {
+		t.Fatalf("got %v, want the canary deployed and prod enqueued", deployments)
+	}
+	if combinedState(deployments) != Queued {
+		t.Errorf("got %s, want %s while prod waits", combinedState(deployments), Queued)
+	}
+
+	dep := waitFinished(t, enqueued[1], ds[1])
+	if dep.Result != Success {
+		t.Errorf("prod deploy got %s, want %s", dep.Result, Success)
+	}
+	if dep.StartedAt.Sub(start) < 200*time.Millisecond {
+		t.Errorf("prod deployed %s after the push, before the canary baked", dep.StartedAt.Sub(start))
+	}
+	prod.running(t, "app")
+}
+
+func TestRolloutHalted(t *testing.T) {
+	ds, canary, prod := newTestRollout(t, "")
+	canary.fail["PullImage"] = errors.New("registry unavailable")
+	enqueued := []*Deployment{ds[0].enqueue("v1", nil), ds[1].enqueue("v1", nil)}
+
+	_, herr := ds.runRollout(ds, enqueued, "v1", nil)
+	if herr == nil {
+		t.Fatal("rollout with a failed canary succeeded")
+	}
+	dep := waitFinished(t, enqueued[1], ds[1])
+	if dep.Error == nil || dep.Error.Code != CodeRolloutHalted {
+		t.Errorf("prod deploy got %v, want %s", dep.Error, CodeRolloutHalted)
+	}
+	if names := prod.names(); len(names) != 0 {
+		t.Errorf("prod was deployed after the canary failed: %v", names)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// LogFileConfig is a log file, rotated once it grows too big or old
+type LogFileConfig struct {
+	File string `json:"file"`
+	// MaxSize, e.g. 100MB, is the size the file is rotated at,
+	// 100MB if empty
+	MaxSize string `json:"max_size"`
+	// RotateEvery, e.g. 24h, additionally rotates the file once it was
+	// written to for that long. Empty only rotates by size.
+	RotateEvery string `json:"rotate_every"`
+	// MaxBackups is the number of rotated files kept as
+	// file.1 (the newest) to file.N, 5 if zero
+	MaxBackups int `json:"max_backups"`
+	// Compress gzips the rotated files, as file.N.gz
+	Compress bool `json:"compress"`
+
+	maxSize     uint64
+	rotateEvery time.Duration
+}
+
+func (c *LogFileConfig) validate() error {
+	if c.File == "" {
+		return errors.New("log files need a file")
+	}
+	c.maxSize = 100 << 20
+	if c.MaxSize != "" {
+		var err error
+		c.maxSize, err = parseBytes(c.MaxSize)
+		if err != nil {
+			return fmt.Errorf("log file %s: max size: %v", c.File, err)
+		}
+	}
+	if c.RotateEvery != "" {
+		var err error
+		c.rotateEvery, err = time.ParseDuration(c.RotateEvery)
+		if err != nil || c.rotateEvery <= 0 {
+			return fmt.Errorf("log file %s: invalid rotate every %q", c.File, c.RotateEvery)
+		}
+	}
+	if c.MaxBackups == 0 {
+		c.MaxBackups = 5
+	}
+	if c.MaxBackups < 0 {
+		return fmt.Errorf("log file %s: invalid max backups %d", c.File, c.MaxBackups)
+	}
+	return nil
+}
+
+// RotatingFile appends to a log file, rotating it by size and age
+type RotatingFile struct {
+	cfg *LogFileConfig
+
+	mu   sync.Mutex
+	f    *os.File
+	size uint64
+	// opened is when the file was opened, which its age counts from
+	opened time.Time
+}
+
+// OpenRotatingFile opens the log file for appending
+func OpenRotatingFile(cfg *LogFileConfig) (*RotatingFile, error) {
+	r := &RotatingFile{cfg: cfg}
+	err := r.open()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size, r.opened = f, uint64(info.Size()), time.Now()
+	return nil
+}
+
+// Write implements io.Writer, rotating the file first if p would
+// take it past its max size, or it is due to be rotated
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	due := r.cfg.rotateEvery > 0 && time.Since(r.opened) >= r.cfg.rotateEvery
+	if r.size > 0 && (r.size+uint64(len(p)) > r.cfg.maxSize || due) {
+		err := r.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += uint64(n)
+	return n, err
+}
+
+// rotate shifts the backups, moves the file to file.1 and starts anew
+func (r *RotatingFile) rotate() error {
+	err := r.f.Close()
+	if err != nil {
+		return err
+	}
+	ext := ""
+	if r.cfg.Compress {
+		ext = ".gz"
+	}
+	backup := func(i int) string {
+		return fmt.Sprintf("%s.%d%s", r.cfg.File, i, ext)
+	}
+	os.Remove(backup(r.cfg.MaxBackups))
+	for i := r.cfg.MaxBackups - 1; i >= 1; i-- {
+		err := os.Rename(backup(i), backup(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	switch {
+	case r.cfg.MaxBackups == 0:
+		err = os.Remove(r.cfg.File)
+	case r.cfg.Compress:
+		err = gzipFile(r.cfg.File, backup(1))
+	default:
+		err = os.Rename(r.cfg.File, backup(1))
+	}
+	if err != nil {
+		return err
+	}
+	return r.open()
+}
+
+// gzipFile compresses the file at src to dst, removing src
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// fileLogHook writes all log entries to a file, without colors
+type fileLogHook struct {
+	w         io.Writer
+	formatter logrus.Formatter
+}
+
+func newFileLogHook(w io.Writer) *fileLogHook {
+	return &fileLogHook{
+		w: w,
+		formatter: &logrus.TextFormatter{
+			DisableColors:   true,
+			FullTimestamp:   true,
+			TimestampFormat: time.RFC3339,
+		},
+	}
+}
+
+// Levels implements logrus.Hook
+func (h *fileLogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire implements logrus.Hook
+func (h *fileLogHook) Fire(entry *logrus.Entry) error {
+	line, err := h.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	_, err = h.w.Write(line)
+	return err
+}
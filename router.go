@@ -0,0 +1,50 @@
+//go:debug httpmuxgo121=0
+
+package main
+
+import (
+	"io"
+	"net/http"
+)
+
+// Middleware wraps a handler with additional behavior
+type Middleware func(http.Handler) http.Handler
+
+// chain wraps h in the middlewares, the first being the outermost
+func chain(h http.Handler, mws ...Middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// Router routes requests by method and path pattern, as understood
+// by http.ServeMux, to handlers with their own middleware chains.
+// Path parameters are available through http.Request.PathValue.
+// The go:debug directive above enables these patterns, which are
+// otherwise disabled for GOPATH builds.
+type Router struct {
+	mux *http.ServeMux
+	// middleware is applied to every route
+	middleware []Middleware
+	// AccessLog is written a line per request, if set
+	AccessLog io.Writer
+}
+
+// NewRouter creates a router applying the middlewares to all routes
+func NewRouter(mws ...Middleware) *Router {
+	return &Router{
+		mux:        http.NewServeMux(),
+		middleware: mws,
+	}
+}
+
+// Handle registers h for the pattern, wrapped in the route's middlewares
+func (rt *Router) Handle(pattern string, h http.Handler, mws ...Middleware) {
+	h = chain(h, append(rt.middleware[:len(rt.middleware):len(rt.middleware)], mws...)...)
+	rt.mux.Handle(pattern, rt.instrument(pattern, h))
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.mux.ServeHTTP(w, r)
+}
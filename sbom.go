@@ -0,0 +1,468 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// PhaseSBOM fetches the SBOM of the pulled image
+const PhaseSBOM = Phase("sbom")
+
+// CodeNoSBOM is used when an image required to have an SBOM has none
+const CodeNoSBOM = ErrorCode("no_sbom")
+
+// SBOMConfig fetches the SBOM attested to the deployed
+// images from their registry
+type SBOMConfig struct {
+	// Required fails deploys of images without an SBOM
+	Required bool `json:"required"`
+	// Username and Password authenticate to the
+	// registry, anonymous if empty
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// SBOMInfo describes the SBOM stored for a deployment
+type SBOMInfo struct {
+	// Format is spdx or cyclonedx
+	Format string `json:"format"`
+	// Digest is the sha256 of the document
+	Digest string `json:"digest"`
+}
+
+// Predicate types of in-toto SBOM attestations, by format
+var sbomPredicates = map[string]string{
+	"https://spdx.dev/Document":  "spdx",
+	"https://cyclonedx.org/bom":  "cyclonedx",
+	"https://cyclonedx.org/spec": "cyclonedx",
+}
+
+// maxSBOMSize bounds the documents read from registries
+const maxSBOMSize = 64 << 20
+
+var registryClient = &http.Client{Timeout: 30 * time.Second}
+
+// fetchSBOM looks up the SBOM of the pulled image and stores it with
+// the deployment, returning the document if found. Images without
+// one fail the deploy if it is required.
+func (d *Deployer) fetchSBOM(dep *Deployment, img *docker.Image) (doc []byte, herr *HookError) {
+	return doc, d.phase(PhaseSBOM, func() error {
+		var format string
+		var err error
+		doc, format, err = d.lookupSBOM(dep.Digest, img)
+		if err == nil && d.SBOMs != nil {
+			err = d.SBOMs.Put(dep.ID, doc)
+		}
+		if err != nil {
+			if d.container.SBOM.Required {
+				return serverError(CodeNoSBOM, PhaseSBOM, err)
+			}
+			d.logger().Printf("Failed to fetch the SBOM of %s: %v", d.imageRef(dep.Tag), err)
+			doc = nil
+			return nil
+		}
+		sum := sha256.Sum256(doc)
+		dep.SBOM = &SBOMInfo{
+			Format: format,
+			Digest: "sha256:" + hex.EncodeToString(sum[:]),
+		}
+		return nil
+	})
+}
+
+func (d *Deployer) lookupSBOM(digest string, img *docker.Image) ([]byte, string, error) {
+	if digest == "" {
+		return nil, "", errors.New("image has no registry digest")
+	}
+	r := newRegistry(d.container.Repository, d.container.SBOM.Username, d.container.SBOM.Password)
+	m, err := r.manifest(digest)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Indexes built by BuildKit list an attestation
+	// manifest for every platform's image
+	image := digest
+	if len(m.Manifests) > 0 {
+		image = ""
+		for _, desc := range m.Manifests {
+			if desc.Platform != nil && desc.Platform.OS == img.OS && desc.Platform.Architecture == img.Architecture &&
+				desc.Annotations["vnd.docker.reference.type"] == "" {
+				image = desc.Digest
+				break
+			}
+		}
+		if image == "" {
+			return nil, "", fmt.Errorf("no %s/%s image in index %s", img.OS, img.Architecture, digest)
+		}
+		for _, desc := range m.Manifests {
+			if desc.Annotations["vnd.docker.reference.type"] != "attestation-manifest" ||
+				desc.Annotations["vnd.docker.reference.digest"] != image {
+				continue
+			}
+			doc, format, err := r.attestedSBOM(desc.Digest)
+			if err != nil || doc != nil {
+				return doc, format, err
+			}
+		}
+	}
+
+	// Otherwise, an SBOM may have been attached with the referrers API
+	doc, format, err := r.referredSBOM(image)
+	if err == nil && doc == nil {
+		err = errors.New("image has no SBOM attestation")
+	}
+	return doc, format, err
+}
+
+// ociDescriptor points at a manifest or blob
+type ociDescriptor struct {
+	MediaType    string            `json:"mediaType"`
+	ArtifactType string            `json:"artifactType"`
+	Digest       string            `json:"digest"`
+	Annotations  map[string]string `json:"annotations"`
+	Platform     *struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+	} `json:"platform"`
+}
+
+// ociManifest is an image manifest or index
+type ociManifest struct {
+	MediaType    string          `json:"mediaType"`
+	ArtifactType string          `json:"artifactType"`
+	Config       ociDescriptor   `json:"config"`
+	Manifests    []ociDescriptor `json:"manifests"`
+	Layers       []ociDescriptor `json:"layers"`
+}
+
+// registry reads manifests and blobs of a repository
+// with the registry HTTP API
+type registry struct {
+	username, password string
+
+	base string
+	name string
+	auth string
+}
+
+func newRegistry(repo, username, password string) *registry {
+	host, name, _ := strings.Cut(qualifiedRepository(repo), "/")
+	scheme := "https"
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+	} else if strings.HasPrefix(host, "localhost") {
+		scheme = "http"
+	}
+	return &registry{
+		username: username,
+		password: password,
+		base:     scheme + "://" + host + "/v2/" + name,
+		name:     name,
+	}
+}
+
+var manifestTypes = strings.Join([]string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}, ", ")
+
+func (r *registry) manifest(digest string) (*ociManifest, error) {
+	m := &ociManifest{}
+	content, err := r.get("/manifests/"+digest, manifestTypes)
+	if err != nil {
+		return nil, err
+	}
+	return m, json.Unmarshal(content, m)
+}
+
+// attestedSBOM returns the SBOM predicate of the in-toto statements of
+// the attestation manifest, or nil if there is none
+func (r *registry) attestedSBOM(digest string) ([]byte, string, error) {
+	m, err := r.manifest(digest)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, layer := range m.Layers {
+		format, ok := sbomPredicates[layer.Annotations["in-toto.io/predicate-type"]]
+		if !ok {
+			continue
+		}
+		content, err := r.get("/blobs/"+layer.Digest, "")
+		if err != nil {
+			return nil, "", err
+		}
+		var statement struct {
+			Predicate json.RawMessage `json:"predicate"`
+		}
+		err = json.Unmarshal(content, &statement)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid attestation %s: %v", layer.Digest, err)
+		}
+		return statement.Predicate, format, nil
+	}
+	return nil, "", nil
+}
+
+// referredSBOM returns the first SBOM artifact referring to the
+// image, or nil if there is none or the registry can't tell
+func (r *registry) referredSBOM(digest string) ([]byte, string, error) {
+	content, err := r.get("/referrers/"+digest, "application/vnd.oci.image.index.v1+json")
+	if err != nil {
+		// Not all registries support the referrers API
+		return nil, "", nil
+	}
+	var index ociManifest
+	err = json.Unmarshal(content, &index)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, desc := range index.Manifests {
+		format := sbomFormat(desc.ArtifactType)
+		if format == "" {
+			continue
+		}
+		m, err := r.manifest(desc.Digest)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(m.Layers) == 0 {
+			continue
+		}
+		doc, err := r.get("/blobs/"+m.Layers[0].Digest, "")
+		return doc, format, err
+	}
+	return nil, "", nil
+}
+
+// sbomFormat returns the SBOM format of an artifact type, if it is one
+func sbomFormat(artifactType string) string {
+	switch {
+	case strings.Contains(artifactType, "spdx"):
+		return "spdx"
+	case strings.Contains(artifactType, "cyclonedx"):
+		return "cyclonedx"
+	}
+	return ""
+}
+
+// get reads path of the repository, authenticating as
+// challenged by the registry
+func (r *registry) get(path, accept string) ([]byte, error) {
+	content, _, err := r.getWithHeader(path, accept)
+	return content, err
+}
+
+// tagDigest returns the digest of the manifest the tag points at
+func (r *registry) tagDigest(tag string) (string, error) {
+	content, header, err := r.getWithHeader("/manifests/"+tag, manifestTypes)
+	if err != nil {
+		return "", err
+	}
+	if digest := header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(content)), nil
+}
+
+// getWithHeader is get, also returning the headers of the reply
+func (r *registry) getWithHeader(path, accept string) ([]byte, http.Header, error) {
+	resp, err := r.do(path, accept)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && r.auth == "" {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		err = r.authenticate(challenge)
+		if err == nil {
+			resp, err = r.do(path, accept)
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("registry GET %s: %s", resp.Request.URL.Path, resp.Status)
+	}
+	content, err := io.ReadAll(io.LimitReader(resp.Body, maxSBOMSize))
+	return content, resp.Header, err
+}
+
+func (r *registry) do(path, accept string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", r.base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if r.auth != "" {
+		req.Header.Set("Authorization", r.auth)
+	}
+	return registryClient.Do(req)
+}
+
+// authenticate answers a Basic or Bearer token challenge
+func (r *registry) authenticate(challenge string) error {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	basic := ""
+	if r.username != "" {
+		basic = "Basic " + base64.StdEncoding.EncodeToString([]byte(r.username+":"+r.password))
+	}
+	if strings.EqualFold(scheme, "basic") {
+		if basic == "" {
+			return errors.New("registry requires credentials")
+		}
+		r.auth = basic
+		return nil
+	}
+	if !strings.EqualFold(scheme, "bearer") {
+		return fmt.Errorf("unsupported registry challenge %q", challenge)
+	}
+
+	values := map[string]string{}
+	for _, param := range strings.Split(params, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+		values[k] = strings.Trim(v, `"`)
+	}
+	u, err := url.Parse(values["realm"])
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid registry token realm %q", values["realm"])
+	}
+	q := u.Query()
+	q.Set("service", values["service"])
+	q.Set("scope", "repository:"+r.name+":pull")
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if basic != "" {
+		req.Header.Set("Authorization", basic)
+	}
+	resp, err := registryClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("registry token request: %s", resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return err
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	r.auth = "Bearer " + token.Token
+	return nil
+}
+
+// sbomsKept is the number of SBOMs kept in memory
+// when they aren't stored in a directory
+const sbomsKept = 50
+
+// SBOMStore keeps the SBOMs of deployments, in files in a
+// directory if set and in memory for the last deploys otherwise
+type SBOMStore struct {
+	dir string
+
+	mu    sync.Mutex
+	docs  map[string][]byte
+	order []string
+}
+
+// NewSBOMStore returns a store, keeping the documents in dir if not empty
+func NewSBOMStore(dir string) (*SBOMStore, error) {
+	if dir != "" {
+		err := os.MkdirAll(dir, 0o755)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &SBOMStore{
+		dir:  dir,
+		docs: map[string][]byte{},
+	}, nil
+}
+
+func (s *SBOMStore) path(id string) string {
+	return filepath.Join(s.dir, filepath.Base(id)+".json")
+}
+
+// Put stores the SBOM of the deployment
+func (s *SBOMStore) Put(id string, doc []byte) error {
+	if s.dir != "" {
+		return os.WriteFile(s.path(id), doc, 0o644)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.docs[id]; !ok {
+		s.order = append(s.order, id)
+		if len(s.order) > sbomsKept {
+			delete(s.docs, s.order[0])
+			s.order = s.order[1:]
+		}
+	}
+	s.docs[id] = doc
+	return nil
+}
+
+// Get returns the SBOM of the deployment, or nil if there is none
+func (s *SBOMStore) Get(id string) ([]byte, error) {
+	if s.dir == "" {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.docs[id], nil
+	}
+	doc, err := os.ReadFile(s.path(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return doc, err
+}
+
+// SBOMHandler serves the SBOM of a deployment on GET /api/deployments/{id}/sbom
+type SBOMHandler struct {
+	deployers Deployers
+	sboms     *SBOMStore
+}
+
+func (h *SBOMHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	dep, ok := h.deployers.ForTenant(requestTenant(r)).Deployment(r.PathValue("id"))
+	if !ok || dep.SBOM == nil {
+		http.NotFound(w, r)
+		return
+	}
+	doc, err := h.sboms.Get(dep.ID)
+	if err != nil {
+		writeError(w, serverError(CodeInternal, PhaseInternal, err))
+		return
+	}
+	if doc == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(doc)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	starlarkjson "go.starlark.net/lib/json"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// loadScript runs the top level of the plugin's Starlark script,
+// leaving its functions to be called
+func (c *PluginConfig) loadScript() error {
+	thread := c.scriptThread()
+	globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, thread, c.Script, nil, starlark.StringDict{
+		"json": starlarkjson.Module,
+	})
+	if err != nil {
+		return fmt.Errorf("plugin %q: %v", c.Name, err)
+	}
+	c.script = globals
+	return nil
+}
+
+// scriptThread returns a thread running the script of the plugin,
+// logging what it prints
+func (c *PluginConfig) scriptThread() *starlark.Thread {
+	return &starlark.Thread{
+		Name: c.Name,
+		Print: func(_ *starlark.Thread, msg string) {
+			log.Printf("Plugin %s: %s", c.Name, msg)
+		},
+	}
+}
+
+// callScript calls the function of the script named after the type of
+// the request. The request and reply are passed as they'd be to and
+// from a command, decoded to Starlark dicts, lists and strings.
+func (c *PluginConfig) callScript(in *PluginRequest) (*PluginReply, error) {
+	fn, ok := c.script[in.Type].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("plugin %s: script defines no %s function", c.Name, in.Type)
+	}
+	content, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	thread := c.scriptThread()
+	timer := time.AfterFunc(c.timeout, func() {
+		thread.Cancel(fmt.Sprintf("timed out after %s", c.timeout))
+	})
+	defer timer.Stop()
+
+	req, err := starlark.Call(thread, starlarkjson.Module.Members["decode"], starlark.Tuple{starlark.String(content)}, nil)
+	if err != nil {
+		return nil, err
+	}
+	out, err := starlark.Call(thread, fn, starlark.Tuple{req}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: %v", c.Name, err)
+	}
+	reply := &PluginReply{}
+	if out == starlark.None {
+		return reply, nil
+	}
+	encoded, err := starlark.Call(thread, starlarkjson.Module.Members["encode"], starlark.Tuple{out}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: %s returned %s: %v", c.Name, in.Type, out.Type(), err)
+	}
+	err = json.Unmarshal([]byte(encoded.(starlark.String)), reply)
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: %s returned an invalid reply: %v", c.Name, in.Type, err)
+	}
+	return reply, nil
+}
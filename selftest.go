@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+func init() {
+	commands["selftest"] = selftestCommand
+}
+
+// selftest deploys a harmless container through the deploy pipeline,
+// so a new host can be validated before real containers are moved
+type selftest struct {
+	d       *Deployer
+	out     *tabwriter.Writer
+	failed  int
+	passed  int
+	lastID  string
+	lastImg string
+}
+
+// selftestCommand runs the self-test against a Docker host
+func selftestCommand(args []string) error {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	host := fs.String("host", "", "Docker daemon endpoint to test, the one from the environment if empty")
+	engine := fs.String("engine", EngineDocker, "Container engine of the host, docker or podman")
+	image := fs.String("image", "nginx:alpine", "Harmless image the test container is created from")
+	name := fs.String("name", "docker-webhook-receiver-selftest", "Name of the test container, replaced if it exists")
+	timeout := fs.Duration("health-timeout", 30*time.Second, "Time to wait for the test container to become healthy")
+	keep := fs.Bool("keep", false, "Keep the test container running after the test")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: docker-webhook-receiver selftest [-host tcp://host:2376] [-image nginx:alpine]")
+		fmt.Fprintln(fs.Output(), "Deploys a test container through the deploy pipeline, failing its health check")
+		fmt.Fprintln(fs.Output(), "and pull on purpose to check rollbacks, and reports which steps passed.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	repo, tag := splitImage(*image)
+	if tag == "" {
+		return errors.New("-image must be a tag, not a digest")
+	}
+	tenant := TenantConfig{
+		Name: "selftest",
+		Containers: []ContainerConfig{{
+			Name:       *name,
+			Repository: repo,
+			Tag:        tag,
+			Host:       *host,
+			Engine:     *engine,
+			Rollback:   true,
+		}},
+	}
+	if *host != "" {
+		tenant.Hosts = []string{*host}
+	}
+	cfg := &Config{Tenants: []TenantConfig{tenant}}
+	err := cfg.validate()
+	if err != nil {
+		return err
+	}
+	deployers, err := NewDeployers(cfg, nopNotifier{}, nil)
+	if err != nil {
+		return err
+	}
+	d := deployers[0]
+	d.HealthTimeout = *timeout
+	d.Chaos = true
+
+	t := &selftest{d: d, out: tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)}
+	fmt.Printf("Testing %s on %s with %s\n", *name, hostName(*host), *image)
+	// Nothing else can pass without the daemon
+	if t.step("docker", t.docker) {
+		t.step("deploy", t.deploy)
+		t.step("redeploy", t.redeploy)
+		t.step("rollback", t.rollback)
+		t.step("failed pull", t.failedPull)
+		if !*keep {
+			t.step("cleanup", t.cleanup)
+		}
+	}
+
+	fmt.Printf("%d passed, %d failed\n", t.passed, t.failed)
+	if t.failed > 0 {
+		return fmt.Errorf("%d of %d steps failed", t.failed, t.passed+t.failed)
+	}
+	return nil
+}
+
+// step runs the step, printing and returning whether it passed
+func (t *selftest) step(name string, fn func() error) bool {
+	start := time.Now()
+	err := fn()
+	took := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		t.failed++
+		fmt.Fprintf(t.out, "FAIL\t%s\t%s\t%v\n", name, took, err)
+	} else {
+		t.passed++
+		fmt.Fprintf(t.out, "PASS\t%s\t%s\n", name, took)
+	}
+	t.out.Flush()
+	return err == nil
+}
+
+// docker checks the daemon answers
+func (t *selftest) docker() error {
+	if t.d.client == nil {
+		return errors.New("not a Docker API")
+	}
+	_, err := t.d.client.Info()
+	return err
+}
+
+// run deploys the test container with the faults, if any
+func (t *selftest) run(faults ...FaultConfig) (*Deployment, *HookError) {
+	t.d.container.Chaos = nil
+	if len(faults) > 0 {
+		t.d.container.Chaos = &ChaosConfig{Faults: faults}
+		err := t.d.container.Chaos.validate()
+		if err != nil {
+			return nil, serverError(CodeInternal, PhaseVerify, err)
+		}
+	}
+	return t.d.run(t.d.container.Tag, t.d.container.Tag, nil)
+}
+
+// running checks the test container runs, returning its ID and image
+func (t *selftest) running() (string, string, error) {
+	c, err := t.d.client.InspectContainer(t.d.container.Name)
+	if err != nil {
+		return "", "", err
+	}
+	if !c.State.Running {
+		return "", "", fmt.Errorf("container isn't running: %s", c.State.String())
+	}
+	return c.ID, c.Image, nil
+}
+
+// deploy deploys the test container, replacing any leftover
+func (t *selftest) deploy() error {
+	t.d.discard(t.d.container.Name)
+	_, herr := t.run()
+	if herr != nil {
+		return herr
+	}
+	var err error
+	t.lastID, t.lastImg, err = t.running()
+	return err
+}
+
+// redeploy replaces the running test container
+func (t *selftest) redeploy() error {
+	_, herr := t.run()
+	if herr != nil {
+		return herr
+	}
+	id, img, err := t.running()
+	if err != nil {
+		return err
+	}
+	if id == t.lastID {
+		return errors.New("container wasn't replaced")
+	}
+	t.lastID, t.lastImg = id, img
+	return nil
+}
+
+// rollback fails the health check of a deploy,
+// which must be rolled back to the previous image
+func (t *selftest) rollback() error {
+	dep, herr := t.run(FaultConfig{Phase: PhaseHealthcheck, Rate: 1})
+	if herr == nil {
+		return errors.New("deploy with a failing health check succeeded")
+	}
+	if herr.Code != CodeUnhealthy {
+		return fmt.Errorf("deploy failed with %v, not the health check", herr)
+	}
+	if dep == nil || !dep.RolledBack {
+		return errors.New("deploy wasn't rolled back")
+	}
+	id, img, err := t.running()
+	if err != nil {
+		return fmt.Errorf("rolled back %v", err)
+	}
+	if img != t.lastImg {
+		return fmt.Errorf("rolled back to %s, not %s", shortID(img), shortID(t.lastImg))
+	}
+	t.lastID = id
+	return nil
+}
+
+// failedPull fails the pull of a deploy,
+// which must leave the container untouched
+func (t *selftest) failedPull() error {
+	_, herr := t.run(FaultConfig{Phase: PhasePull, Rate: 1})
+	if herr == nil {
+		return errors.New("deploy with a failing pull succeeded")
+	}
+	if herr.Phase != PhasePull {
+		return fmt.Errorf("deploy failed with %v, not the pull", herr)
+	}
+	id, _, err := t.running()
+	if err != nil {
+		return err
+	}
+	if id != t.lastID {
+		return errors.New("container was replaced")
+	}
+	return nil
+}
+
+// cleanup removes the test container
+func (t *selftest) cleanup() error {
+	t.d.discard(t.d.container.Name)
+	_, err := t.d.client.InspectContainer(t.d.container.Name)
+	if _, ok := err.(*docker.NoSuchContainer); ok {
+		return nil
+	}
+	if err == nil {
+		return errors.New("container wasn't removed")
+	}
+	return err
+}
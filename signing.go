@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxSignedBody bounds the body read to verify a signature
+const maxSignedBody = 1 << 20
+
+// SigningConfig authenticates deploy triggers of the tenant's CI by an
+// HMAC of the request body, as an alternative to API tokens
+type SigningConfig struct {
+	// Header carries the signature, X-Signature if empty. The HMAC
+	// may be hex or base64 encoded, and prefixed with algorithm=.
+	Header string `json:"header"`
+	// Algorithm is sha1, sha256 (default) or sha512
+	Algorithm string `json:"algorithm"`
+	Secret    string `json:"secret"`
+}
+
+var signingHashes = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+func (c *SigningConfig) validate() error {
+	if c.Secret == "" {
+		return errors.New("signing needs a secret")
+	}
+	if c.Header == "" {
+		c.Header = "X-Signature"
+	}
+	if c.Algorithm == "" {
+		c.Algorithm = "sha256"
+	}
+	if _, ok := signingHashes[c.Algorithm]; !ok {
+		return fmt.Errorf("signing: unknown algorithm %q", c.Algorithm)
+	}
+	return nil
+}
+
+// verify reports whether the signature is the HMAC of the body
+func (c *SigningConfig) verify(signature string, body []byte) bool {
+	signature = strings.TrimPrefix(strings.TrimSpace(signature), c.Algorithm+"=")
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		got, err = base64.StdEncoding.DecodeString(signature)
+		if err != nil {
+			return false
+		}
+	}
+	mac := hmac.New(signingHashes[c.Algorithm], []byte(c.Secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// requireSignatureOrRole passes requests signed for a tenant on to h as
+// requests of that tenant, and leaves unsigned ones to requireRole.
+// Requests with a signature header that doesn't verify are rejected.
+func requireSignatureOrRole(cfg *Config, role Role) Middleware {
+	byToken := requireRole(cfg, role)
+	return func(h http.Handler) http.Handler {
+		unsigned := byToken(h)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var signers []*TenantConfig
+			for i := range cfg.Tenants {
+				t := &cfg.Tenants[i]
+				if t.Signing != nil && r.Header.Get(t.Signing.Header) != "" {
+					signers = append(signers, t)
+				}
+			}
+			if len(signers) == 0 {
+				unsigned.ServeHTTP(w, r)
+				return
+			}
+
+			body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBody))
+			if err != nil {
+				writeError(w, clientError(CodeReadBody, PhaseRead, err))
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			for _, t := range signers {
+				if t.Signing.verify(r.Header.Get(t.Signing.Header), body) {
+					ctx := context.WithValue(r.Context(), tenantKey, t.Name)
+					h.ServeHTTP(w, r.WithContext(ctx))
+					return
+				}
+			}
+			authFailures.fail(r, "invalid signature")
+			herr := clientError(CodeUnauthorized, PhaseVerify, errors.New("invalid signature"))
+			herr.Status = http.StatusUnauthorized
+			writeError(w, herr)
+		})
+	}
+}
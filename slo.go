@@ -0,0 +1,266 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// EventErrorBudget is sent when the error budget of a repository
+// drops below the alert threshold, or is used up
+const EventErrorBudget = Event("error_budget")
+
+// EventSlowDeploys is sent when the p95 duration of the deploys
+// of a repository goes over its target
+const EventSlowDeploys = Event("slow_deploys")
+
+// maxSLODeploys bounds the deploys remembered per repository
+const maxSLODeploys = 10000
+
+var (
+	sloSuccessRate = NewGaugeVec(
+		"webhook_slo_success_rate",
+		"Share of the deploys of the repository within the SLO window that succeeded.",
+		"tenant", "repository",
+	)
+	sloP95Duration = NewGaugeVec(
+		"webhook_slo_p95_duration_seconds",
+		"95th percentile duration of the deploys of the repository within the SLO window.",
+		"tenant", "repository",
+	)
+	sloBudgetRemaining = NewGaugeVec(
+		"webhook_slo_error_budget_remaining",
+		"Share of the error budget of the repository left, negative once overspent.",
+		"tenant", "repository",
+	)
+)
+
+// SLOConfig are the targets for the deploys of every repository
+type SLOConfig struct {
+	// Window is the rolling period the SLOs are measured over,
+	// 30 days (720h) if empty
+	Window string `json:"window"`
+	// SuccessRate is the share of deploys that should succeed,
+	// e.g. 0.95. Rolled back deploys count as failed.
+	SuccessRate float64 `json:"success_rate"`
+	// P95Duration is the duration 95% of deploys should finish in
+	P95Duration string `json:"p95_duration"`
+	// AlertRemaining notifies once the remaining share of the error
+	// budget falls below it, 0.5 if zero
+	AlertRemaining float64 `json:"alert_remaining"`
+
+	window, p95Duration time.Duration
+}
+
+func (c *SLOConfig) validate() error {
+	c.window = 30 * 24 * time.Hour
+	var err error
+	if c.Window != "" {
+		c.window, err = time.ParseDuration(c.Window)
+		if err != nil || c.window <= 0 {
+			return fmt.Errorf("slo: invalid window %q", c.Window)
+		}
+	}
+	if c.SuccessRate < 0 || c.SuccessRate >= 1 {
+		return errors.New("slo: success rate must be at least 0 and below 1")
+	}
+	if c.P95Duration != "" {
+		c.p95Duration, err = time.ParseDuration(c.P95Duration)
+		if err != nil || c.p95Duration <= 0 {
+			return fmt.Errorf("slo: invalid p95 duration %q", c.P95Duration)
+		}
+	}
+	if c.SuccessRate == 0 && c.p95Duration == 0 {
+		return errors.New("slo: needs a success rate or p95 duration")
+	}
+	if c.AlertRemaining == 0 {
+		c.AlertRemaining = 0.5
+	}
+	if c.AlertRemaining < 0 || c.AlertRemaining > 1 {
+		return errors.New("slo: alert remaining must be between 0 and 1")
+	}
+	return nil
+}
+
+// SLOStatus is how the deploys of a repository do against the SLOs
+type SLOStatus struct {
+	Tenant     string `json:"tenant"`
+	Repository string `json:"repository"`
+	// Deploys is the number of deploys within the window
+	Deploys     int     `json:"deploys"`
+	SuccessRate float64 `json:"success_rate"`
+	// SuccessTarget is the targeted success rate, if any
+	SuccessTarget float64 `json:"success_target,omitempty"`
+	// ErrorBudgetRemaining is the share of the error budget left,
+	// negative once overspent
+	ErrorBudgetRemaining *float64 `json:"error_budget_remaining,omitempty"`
+	P95DurationSeconds   float64  `json:"p95_duration_seconds"`
+	// DurationTargetSeconds is the targeted p95 duration, if any
+	DurationTargetSeconds float64 `json:"duration_target_seconds,omitempty"`
+	// Met is whether the deploys meet all SLOs
+	Met bool `json:"met"`
+}
+
+type sloDeploy struct {
+	finished time.Time
+	ok       bool
+	duration time.Duration
+}
+
+type sloRepository struct {
+	deploys []sloDeploy
+	// budgetAlerted and slowAlerted remember what was notified,
+	// so a notification is sent once per crossing
+	budgetAlerted int
+	slowAlerted   bool
+}
+
+// SLOTracker measures the deploys of every repository against the SLOs
+type SLOTracker struct {
+	cfg      *SLOConfig
+	notifier Notifier
+
+	mu    sync.Mutex
+	repos map[[2]string]*sloRepository
+}
+
+// NewSLOTracker returns a tracker notifying the notifier
+// about the SLOs being missed
+func NewSLOTracker(cfg *SLOConfig, notifier Notifier) *SLOTracker {
+	return &SLOTracker{
+		cfg:      cfg,
+		notifier: notifier,
+		repos:    map[[2]string]*sloRepository{},
+	}
+}
+
+// Record adds the finished deploy to the SLOs of its repository
+func (t *SLOTracker) Record(tenant string, dep *Deployment) {
+	if t == nil {
+		return
+	}
+	key := [2]string{tenant, dep.Repository}
+	t.mu.Lock()
+	repo, ok := t.repos[key]
+	if !ok {
+		repo = &sloRepository{}
+		t.repos[key] = repo
+	}
+	repo.deploys = append(repo.deploys, sloDeploy{
+		finished: dep.FinishedAt,
+		ok:       dep.Result == Success && !dep.RolledBack,
+		duration: dep.FinishedAt.Sub(dep.StartedAt),
+	})
+	if len(repo.deploys) > maxSLODeploys {
+		repo.deploys = repo.deploys[len(repo.deploys)-maxSLODeploys:]
+	}
+	status := t.status(tenant, dep.Repository, repo, time.Now())
+
+	var notifications []Notification
+	if status.ErrorBudgetRemaining != nil {
+		// 0 is fine, 1 is below the alert threshold, 2 used up
+		level := 0
+		switch remaining := *status.ErrorBudgetRemaining; {
+		case remaining <= 0:
+			level = 2
+		case remaining < t.cfg.AlertRemaining:
+			level = 1
+		}
+		if level > repo.budgetAlerted {
+			msg := fmt.Sprintf("%.0f%% of the error budget of %s is left, %.1f%% of %d deploys succeeded against a target of %.1f%%",
+				100*math.Max(*status.ErrorBudgetRemaining, 0), dep.Repository, 100*status.SuccessRate, status.Deploys, 100*t.cfg.SuccessRate)
+			notifications = append(notifications, Notification{Event: EventErrorBudget, Message: msg})
+		}
+		repo.budgetAlerted = level
+	}
+	if t.cfg.p95Duration > 0 {
+		slow := status.P95DurationSeconds > t.cfg.p95Duration.Seconds()
+		if slow && !repo.slowAlerted {
+			msg := fmt.Sprintf("95%% of the deploys of %s take up to %s, over the target of %s",
+				dep.Repository, time.Duration(status.P95DurationSeconds*float64(time.Second)).Round(time.Second), t.cfg.p95Duration)
+			notifications = append(notifications, Notification{Event: EventSlowDeploys, Message: msg})
+		}
+		repo.slowAlerted = slow
+	}
+	t.mu.Unlock()
+
+	for _, n := range notifications {
+		n.Container = dep.Container
+		n.DeploymentID = dep.ID
+		log.WithField("deployment", dep.ID).Print(n.Message)
+		notify(t.notifier, n)
+	}
+}
+
+// status measures the deploys of the repository within the window,
+// dropping older ones, and updates the metrics
+func (t *SLOTracker) status(tenant, repository string, repo *sloRepository, now time.Time) SLOStatus {
+	i := 0
+	for i < len(repo.deploys) && now.Sub(repo.deploys[i].finished) > t.cfg.window {
+		i++
+	}
+	repo.deploys = repo.deploys[i:]
+
+	s := SLOStatus{
+		Tenant:                tenant,
+		Repository:            repository,
+		Deploys:               len(repo.deploys),
+		SuccessRate:           1,
+		SuccessTarget:         t.cfg.SuccessRate,
+		DurationTargetSeconds: t.cfg.p95Duration.Seconds(),
+		Met:                   true,
+	}
+	if s.Deploys > 0 {
+		var ok int
+		durations := make([]float64, 0, s.Deploys)
+		for _, dep := range repo.deploys {
+			if dep.ok {
+				ok++
+			}
+			durations = append(durations, dep.duration.Seconds())
+		}
+		s.SuccessRate = float64(ok) / float64(s.Deploys)
+		sort.Float64s(durations)
+		s.P95DurationSeconds = durations[int(math.Ceil(0.95*float64(len(durations))))-1]
+	}
+	if t.cfg.SuccessRate > 0 {
+		remaining := 1 - (1-s.SuccessRate)/(1-t.cfg.SuccessRate)
+		s.ErrorBudgetRemaining = &remaining
+		s.Met = s.SuccessRate >= t.cfg.SuccessRate
+		sloBudgetRemaining.Set(remaining, tenant, repository)
+	}
+	if t.cfg.p95Duration > 0 && s.P95DurationSeconds > t.cfg.p95Duration.Seconds() {
+		s.Met = false
+	}
+	sloSuccessRate.Set(s.SuccessRate, tenant, repository)
+	sloP95Duration.Set(s.P95DurationSeconds, tenant, repository)
+	return s
+}
+
+// Statuses returns the SLOs of the repositories of the tenant,
+// or of all tenants if empty
+func (t *SLOTracker) Statuses(tenant string) []SLOStatus {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var statuses []SLOStatus
+	now := time.Now()
+	for key, repo := range t.repos {
+		if tenant != "" && key[0] != tenant {
+			continue
+		}
+		statuses = append(statuses, t.status(key[0], key[1], repo, now))
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Tenant != statuses[j].Tenant {
+			return statuses[i].Tenant < statuses[j].Tenant
+		}
+		return statuses[i].Repository < statuses[j].Repository
+	})
+	return statuses
+}
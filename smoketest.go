@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// PhaseSmokeTest runs the smoke tests of a freshly started container
+const PhaseSmokeTest = Phase("smoke_test")
+
+// CodeSmokeTestFailed is used when a container fails its smoke tests
+const CodeSmokeTestFailed = ErrorCode("smoke_test_failed")
+
+// maxTestOutput is the amount of test container output
+// kept in the deployment record
+const maxTestOutput = 64 * 1024
+
+// SmokeTestConfig describes the checks a container must pass
+// after starting for the deploy to succeed
+type SmokeTestConfig struct {
+	// URL is requested with GET until it returns ExpectStatus
+	URL string `json:"url"`
+	// ExpectStatus defaults to 200
+	ExpectStatus int `json:"expect_status"`
+	// Timeout is how long to keep trying, 1m if empty
+	Timeout string `json:"timeout"`
+
+	// Image is run as a one-shot test container sharing the network
+	// of the new container, so it can reach it on localhost.
+	// A non-zero exit code fails the deploy.
+	Image string   `json:"image"`
+	Cmd   []string `json:"cmd"`
+}
+
+// smokeTest runs the smoke tests configured for the container
+// against the freshly started container id
+func (d *Deployer) smokeTest(dep *Deployment, id string) *HookError {
+	st := d.container.SmokeTest
+	if st == nil {
+		return nil
+	}
+
+	return d.phase(PhaseSmokeTest, func() error {
+		err := httpSmokeTest(st)
+		if err == nil && st.Image != "" {
+			dep.TestOutput, err = d.containerSmokeTest(st, id)
+		}
+		if err != nil {
+			return &HookError{
+				Code:    CodeSmokeTestFailed,
+				Message: err.Error(),
+				Phase:   PhaseSmokeTest,
+				Status:  http.StatusInternalServerError,
+			}
+		}
+		return nil
+	})
+}
+
+func httpSmokeTest(st *SmokeTestConfig) error {
+	if st.URL == "" {
+		return nil
+	}
+
+	timeout := time.Minute
+	if st.Timeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(st.Timeout)
+		if err != nil {
+			return err
+		}
+	}
+	expect := st.ExpectStatus
+	if expect == 0 {
+		expect = http.StatusOK
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	deadline := time.Now().Add(timeout)
+	var lastErr error
+	for time.Now().Before(deadline) {
+		resp, err := client.Get(st.URL)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == expect {
+				return nil
+			}
+			err = fmt.Errorf("%s returned %s, want %d", st.URL, resp.Status, expect)
+		}
+		lastErr = err
+		time.Sleep(2 * time.Second)
+	}
+	if lastErr == nil {
+		lastErr = errors.New("smoke test timed out")
+	}
+
+	return lastErr
+}
+
+// containerSmokeTest runs the test container to completion
+// and returns its combined output
+func (d *Deployer) containerSmokeTest(st *SmokeTestConfig, id string) (string, error) {
+	image := st.Image
+	if d.container.Engine == EnginePodman {
+		image = qualifiedRepository(image)
+	}
+	repo, tag := splitImage(image)
+	err := d.client.PullImage(docker.PullImageOptions{
+		Repository: repo,
+		Tag:        tag,
+	}, docker.AuthConfiguration{})
+	if err != nil {
+		return "", err
+	}
+
+	test, err := d.client.CreateContainer(docker.CreateContainerOptions{
+		Name: d.container.Name + "-smoketest",
+		Config: &docker.Config{
+			Image: image,
+			Cmd:   st.Cmd,
+		},
+		HostConfig: &docker.HostConfig{
+			NetworkMode: "container:" + id,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		err := d.client.RemoveContainer(docker.RemoveContainerOptions{
+			ID:    test.ID,
+			Force: true,
+		})
+		if err != nil {
+			d.logger().Print("Failed to remove smoke test container: ", err)
+		}
+	}()
+
+	err = d.client.StartContainer(test.ID, nil)
+	if err != nil {
+		return "", err
+	}
+
+	code, err := d.client.WaitContainer(test.ID)
+	if err != nil {
+		return "", err
+	}
+
+	var output bytes.Buffer
+	err = d.client.Logs(docker.LogsOptions{
+		Container:    test.ID,
+		OutputStream: &output,
+		ErrorStream:  &output,
+		Stdout:       true,
+		Stderr:       true,
+	})
+	if err != nil {
+		return "", err
+	}
+	out := output.String()
+	if len(out) > maxTestOutput {
+		out = out[len(out)-maxTestOutput:]
+	}
+
+	if code != 0 {
+		return out, fmt.Errorf("test container %s exited with code %d", st.Image, code)
+	}
+
+	return out, nil
+}
+
+// splitImage splits an image reference into repository and tag,
+// defaulting to the latest tag. Digest references are returned whole.
+func splitImage(ref string) (string, string) {
+	if strings.Contains(ref, "@") {
+		return ref, ""
+	}
+	i := strings.LastIndex(ref, ":")
+	if i < 0 || strings.Contains(ref[i:], "/") {
+		return ref, "latest"
+	}
+	return ref[:i], ref[i+1:]
+}
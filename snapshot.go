@@ -0,0 +1,113 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// PhaseSnapshot saves the image of the replaced container
+const PhaseSnapshot = Phase("snapshot")
+
+// snapshotPath returns the path the image is saved to
+func (d *Deployer) snapshotPath(image string) string {
+	return filepath.Join(d.container.SnapshotDir, d.container.Name+"-"+shortID(image)+".tar")
+}
+
+// snapshot saves the previous image of the deployment, like docker
+// save, unless it was already saved by an earlier deploy
+func (d *Deployer) snapshot(dep *Deployment) *HookError {
+	if d.container.SnapshotDir == "" || dep.PreviousImage == "" {
+		return nil
+	}
+
+	path := d.snapshotPath(dep.PreviousImage)
+	herr := d.phase(PhaseSnapshot, func() error {
+		if _, err := os.Stat(path); err == nil {
+			return nil
+		}
+		err := os.MkdirAll(d.container.SnapshotDir, 0700)
+		if err != nil {
+			return err
+		}
+		f, err := os.Create(path + ".tmp")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		err = d.client.ExportImage(docker.ExportImageOptions{
+			Name:         dep.PreviousImage,
+			OutputStream: f,
+		})
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		return os.Rename(f.Name(), path)
+	})
+	if herr != nil {
+		return herr
+	}
+
+	dep.Snapshot = path
+	d.pruneSnapshots(path)
+	return nil
+}
+
+// pruneSnapshots removes all but the most recent snapshots
+// of the container, always keeping the current one
+func (d *Deployer) pruneSnapshots(current string) {
+	// The current snapshot may have been saved by an earlier
+	// deploy, but is the most recent one to keep
+	now := time.Now()
+	os.Chtimes(current, now, now)
+
+	paths, err := filepath.Glob(filepath.Join(d.container.SnapshotDir, d.container.Name+"-*.tar"))
+	if err != nil {
+		d.logger().Print(err)
+		return
+	}
+	type snapshot struct {
+		path    string
+		modTime time.Time
+	}
+	var snapshots []snapshot
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err == nil {
+			snapshots = append(snapshots, snapshot{p, info.ModTime()})
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].modTime.After(snapshots[j].modTime)
+	})
+	for i := d.container.SnapshotKeep; i < len(snapshots); i++ {
+		err := os.Remove(snapshots[i].path)
+		if err != nil {
+			d.logger().Printf("Failed to remove snapshot %s: %v", snapshots[i].path, err)
+		}
+	}
+}
+
+// restoreSnapshot loads the snapshot of image if
+// the image is no longer known to the daemon
+func (d *Deployer) restoreSnapshot(image string) error {
+	if d.container.SnapshotDir == "" {
+		return nil
+	}
+	_, err := d.client.InspectImage(image)
+	if err != docker.ErrNoSuchImage {
+		return nil
+	}
+	path := d.snapshotPath(image)
+	if _, err := os.Stat(path); err != nil {
+		return nil
+	}
+	d.logger().Printf("Image %s of %q is gone, loading it from %s", shortID(image), d.container.Name, path)
+	return d.load(path)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// StateStore persists the state shared by the deployers, like the
+// baselines, pins, cordons and history of the containers, by key
+type StateStore interface {
+	// Get returns the value of the key, nil if it isn't set
+	Get(key string) ([]byte, error)
+	// Put replaces the value of the key
+	Put(key string, value []byte) error
+	// Delete unsets the key
+	Delete(key string) error
+	// Append adds the value to the list of the key,
+	// keeping only the last max values
+	Append(key string, value []byte, max int) error
+	// List returns the values of the list of the key, oldest first
+	List(key string) ([][]byte, error)
+}
+
+// NewStateStore returns the store of the Redis URL
+// if there is one, or else of the directory
+func NewStateStore(dir, redisURL string) (StateStore, error) {
+	if redisURL != "" {
+		return NewRedisStore(redisURL)
+	}
+	return NewDirStore(dir)
+}
+
+// DirStore stores every key in a file of a directory
+type DirStore struct {
+	dir string
+}
+
+// NewDirStore stores keys in dir, creating it if needed
+func NewDirStore(dir string) (*DirStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &DirStore{dir: dir}, nil
+}
+
+func (s *DirStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+// Get implements StateStore
+func (s *DirStore) Get(key string) ([]byte, error) {
+	content, err := os.ReadFile(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return content, err
+}
+
+// Put implements StateStore. The value is written to a temporary
+// file first, so a crash never leaves a partial value behind.
+func (s *DirStore) Put(key string, value []byte) error {
+	tmp := s.path(key) + ".tmp"
+	err := os.WriteFile(tmp, value, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(key))
+}
+
+// Delete implements StateStore
+func (s *DirStore) Delete(key string) error {
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Append implements StateStore, the list is a file with a value per line
+func (s *DirStore) Append(key string, value []byte, max int) error {
+	values, err := s.List(key)
+	if err != nil {
+		return err
+	}
+	values = append(values, value)
+	if len(values) > max {
+		values = values[len(values)-max:]
+	}
+	var buf bytes.Buffer
+	for _, v := range values {
+		buf.Write(v)
+		buf.WriteByte('\n')
+	}
+	return s.Put(key, buf.Bytes())
+}
+
+// List implements StateStore
+func (s *DirStore) List(key string) ([][]byte, error) {
+	content, err := s.Get(key)
+	if err != nil || content == nil {
+		return nil, err
+	}
+	var values [][]byte
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(nil, len(content)+1)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			values = append(values, []byte(line))
+		}
+	}
+	return values, scanner.Err()
+}
+
+// historyKey is the key of the history of the container in the state store
+func (d *Deployer) historyKey() string {
+	return d.container.Name + ".history"
+}
+
+// recordHistory appends the finished deployment to the history.
+// d.mu must be held.
+func (d *Deployer) recordHistory(dep *Deployment) {
+	d.history = append(d.history, dep)
+	if len(d.history) > historySize {
+		d.history = d.history[len(d.history)-historySize:]
+	}
+}
+
+// storedDeployment is a deployment as kept in the history in the state
+// store, with the webhook payload that triggered it, so it can still be
+// replayed after a restart. The payload is left out of the API.
+type storedDeployment struct {
+	*Deployment
+	Webhook *WebhookPayload `json:"webhook,omitempty"`
+}
+
+// saveHistory appends the finished deployment to
+// the history in the state store, if there is one
+func (d *Deployer) saveHistory(dep *Deployment) {
+	if d.State == nil {
+		return
+	}
+	content, err := json.Marshal(storedDeployment{Deployment: dep, Webhook: dep.Webhook})
+	if err == nil {
+		err = d.State.Append(d.historyKey(), content, historySize)
+	}
+	if err != nil {
+		d.logger().Printf("Failed to save deployment %s of %q: %v", dep.ID, d.container.Name, err)
+	}
+}
+
+// loadHistory restores the history of the container from the state store
+func (d *Deployer) loadHistory() {
+	history, err := d.storedHistory()
+	if err != nil {
+		log.Printf("Failed to load history of %q: %v", d.container.Name, err)
+		return
+	}
+	d.mu.Lock()
+	d.history = append(history, d.history...)
+	if len(d.history) > historySize {
+		d.history = d.history[len(d.history)-historySize:]
+	}
+	d.mu.Unlock()
+}
+
+// storedHistory returns the history of the container in the state store
+func (d *Deployer) storedHistory() ([]*Deployment, error) {
+	values, err := d.State.List(d.historyKey())
+	if err != nil {
+		return nil, err
+	}
+	var history []*Deployment
+	for _, v := range values {
+		stored := storedDeployment{Deployment: &Deployment{}}
+		err := json.Unmarshal(v, &stored)
+		if err != nil {
+			return nil, err
+		}
+		stored.Deployment.Webhook = stored.Webhook
+		history = append(history, stored.Deployment)
+	}
+	return history, nil
+}
+
+// SharedHistory returns the finished deployments in the state store,
+// which include those of the other receivers sharing it. Without a
+// state store, or if it fails, it returns History.
+func (d *Deployer) SharedHistory() []*Deployment {
+	if d.State == nil {
+		return d.History()
+	}
+	history, err := d.storedHistory()
+	if err != nil {
+		d.logger().Printf("Failed to read history of %q: %v", d.container.Name, err)
+		return d.History()
+	}
+	return history
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// ContainerStatus summarizes the state of a managed container
+type ContainerStatus struct {
+	Name          string      `json:"name"`
+	Tenant        string      `json:"tenant"`
+	Running       bool        `json:"running"`
+	Image         string      `json:"image,omitempty"`
+	ImageID       string      `json:"image_id,omitempty"`
+	Digest        string      `json:"digest,omitempty"`
+	StartedAt     *time.Time  `json:"started_at,omitempty"`
+	UptimeSeconds float64     `json:"uptime_seconds"`
+	QueueLength   int         `json:"queue_length"`
+	LastDeploy    *Deployment `json:"last_deploy,omitempty"`
+	// ExternalEvent is the last change made outside the receiver
+	ExternalEvent *ExternalEvent `json:"external_event,omitempty"`
+	// Drift lists differences from the configured spec
+	Drift []string `json:"drift,omitempty"`
+	// Labels are the OCI labels of the running image
+	Labels *ImageLabels `json:"labels,omitempty"`
+	// Prepulled are the images of waiting deploys already pulled
+	Prepulled []PrepulledImage `json:"prepulled,omitempty"`
+	// Pin holds the deploys of the container, if pinned
+	Pin *Pin `json:"pin,omitempty"`
+}
+
+// Status is the reply of the status endpoint
+type Status struct {
+	Time       time.Time         `json:"time"`
+	Containers []ContainerStatus `json:"containers"`
+	// SLOs are the SLOs of the repositories deployed to, if configured
+	SLOs []SLOStatus `json:"slos,omitempty"`
+}
+
+// StatusHandler serves a machine readable summary of the
+// managed containers, for dashboards and status pages
+type StatusHandler struct {
+	deployers Deployers
+	slos      *SLOTracker
+}
+
+func (h *StatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := Status{
+		Time:       time.Now(),
+		Containers: []ContainerStatus{},
+	}
+	for _, d := range h.deployers.ForTenant(requestTenant(r)) {
+		status.Containers = append(status.Containers, d.Status())
+	}
+	status.SLOs = h.slos.Statuses(requestTenant(r))
+
+	writeJSON(w, http.StatusOK, &status)
+}
+
+// Status returns the current status of the container
+func (d *Deployer) Status() ContainerStatus {
+	cs := ContainerStatus{
+		Name:   d.container.Name,
+		Tenant: d.tenant,
+	}
+	cs.QueueLength, cs.LastDeploy = d.Pending()
+	d.mu.Lock()
+	cs.ExternalEvent = d.external
+	cs.Drift = d.drift
+	d.mu.Unlock()
+	cs.Prepulled = d.Prepulled()
+	cs.Pin = d.Pinned()
+
+	if d.client == nil {
+		// Run by an orchestrator, only the deploys are known
+		return cs
+	}
+
+	// A missing container is still reported, it may be
+	// in the middle of being redeployed.
+	c, err := d.client.InspectContainer(d.container.Name)
+	if err != nil {
+		log.Print(err)
+		return cs
+	}
+
+	cs.Running = c.State.Running
+	cs.Image = c.Config.Image
+	cs.ImageID = c.Image
+	if c.State.Running {
+		startedAt := c.State.StartedAt
+		cs.StartedAt = &startedAt
+		cs.UptimeSeconds = time.Since(startedAt).Seconds()
+	}
+
+	img, err := d.client.InspectImage(c.Image)
+	if err != nil {
+		log.Print(err)
+		return cs
+	}
+	if len(img.RepoDigests) > 0 {
+		cs.Digest = img.RepoDigests[0]
+	}
+	cs.Labels = imageLabels(img)
+
+	return cs
+}
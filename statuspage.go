@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// StatusPageConfig announces deploys of a container on a status page
+type StatusPageConfig struct {
+	// Type is statuspage (Atlassian Statuspage) or instatus
+	Type   string `json:"type"`
+	PageID string `json:"page_id"`
+	// Token is the API key, STATUSPAGE_API_KEY or
+	// INSTATUS_API_KEY if empty
+	Token string `json:"token"`
+	// Components are the IDs of the components of the container
+	Components []string `json:"components"`
+	// Maintenance opens a maintenance for every deploy,
+	// completed when it finishes
+	Maintenance bool `json:"maintenance"`
+	// MaintenanceDuration is the scheduled length
+	// of maintenances, 30m if empty
+	MaintenanceDuration string `json:"maintenance_duration"`
+	// Incident opens an incident when a deploy fails
+	// and the container couldn't be rolled back
+	Incident bool `json:"incident"`
+
+	maintenanceDuration time.Duration
+}
+
+func (c *StatusPageConfig) validate() error {
+	if c.PageID == "" {
+		return errors.New("status page needs a page id")
+	}
+	switch c.Type {
+	case "statuspage":
+		if c.Token == "" {
+			c.Token = os.Getenv("STATUSPAGE_API_KEY")
+		}
+	case "instatus":
+		if c.Token == "" {
+			c.Token = os.Getenv("INSTATUS_API_KEY")
+		}
+	default:
+		return fmt.Errorf("unknown status page type %q", c.Type)
+	}
+	if c.Token == "" {
+		return fmt.Errorf("status page %s needs a token", c.Type)
+	}
+	c.maintenanceDuration = 30 * time.Minute
+	if c.MaintenanceDuration != "" {
+		var err error
+		c.maintenanceDuration, err = time.ParseDuration(c.MaintenanceDuration)
+		if err != nil {
+			return fmt.Errorf("invalid maintenance duration: %v", err)
+		}
+	}
+	return nil
+}
+
+// StatusPageReporter opens maintenances and incidents on the status page
+type StatusPageReporter struct {
+	cfg       *StatusPageConfig
+	container string
+
+	mu sync.Mutex
+	// finished passes the result of a deploy to the goroutine
+	// closing its maintenance, by deployment ID
+	finished map[string]chan *Deployment
+}
+
+// NewStatusPageReporter returns a reporter for the container
+func NewStatusPageReporter(c ContainerConfig) *StatusPageReporter {
+	return &StatusPageReporter{
+		cfg:       c.StatusPage,
+		container: c.Name,
+		finished:  map[string]chan *Deployment{},
+	}
+}
+
+// DeployStarted implements LifecycleHook
+func (s *StatusPageReporter) DeployStarted(dep *Deployment) {
+	if !s.cfg.Maintenance {
+		return
+	}
+	finished := make(chan *Deployment, 1)
+	s.mu.Lock()
+	s.finished[dep.ID] = finished
+	s.mu.Unlock()
+
+	id, tag := dep.ID, dep.Tag
+	go func() {
+		maintenanceID, err := s.openMaintenance(tag)
+		if err != nil {
+			log.WithField("deployment", id).Printf("Failed to open %s maintenance: %v", s.cfg.Type, err)
+		}
+		<-finished
+		if err != nil {
+			return
+		}
+		err = s.completeMaintenance(maintenanceID)
+		if err != nil {
+			log.WithField("deployment", id).Printf("Failed to complete %s maintenance: %v", s.cfg.Type, err)
+		}
+	}()
+}
+
+// DeployFinished implements LifecycleHook
+func (s *StatusPageReporter) DeployFinished(dep *Deployment) {
+	s.mu.Lock()
+	finished, ok := s.finished[dep.ID]
+	delete(s.finished, dep.ID)
+	s.mu.Unlock()
+	if ok {
+		finished <- dep
+	}
+
+	if !s.cfg.Incident || dep.Result == Success || dep.RolledBack {
+		return
+	}
+	message := "The deploy failed"
+	if dep.Error != nil {
+		message = dep.Error.Message
+	}
+	go func() {
+		err := s.openIncident(dep.Tag, message)
+		if err != nil {
+			log.WithField("deployment", dep.ID).Printf("Failed to open %s incident: %v", s.cfg.Type, err)
+		}
+	}()
+}
+
+var statusPageClient = &http.Client{Timeout: 30 * time.Second}
+
+func (s *StatusPageReporter) openMaintenance(tag string) (string, error) {
+	name := fmt.Sprintf("Deploying %s:%s", s.container, tag)
+	now := time.Now().UTC()
+	var created struct {
+		ID string `json:"id"`
+	}
+	if s.cfg.Type == "statuspage" {
+		err := s.statuspage("POST", "/incidents", map[string]interface{}{
+			"incident": map[string]interface{}{
+				"name":                       name,
+				"status":                     "in_progress",
+				"scheduled_for":              now,
+				"scheduled_until":            now.Add(s.cfg.maintenanceDuration),
+				"scheduled_auto_in_progress": true,
+				"scheduled_auto_completed":   false,
+				"component_ids":              s.cfg.Components,
+				"components":                 s.componentStatuses("under_maintenance"),
+			},
+		}, &created)
+		return created.ID, err
+	}
+	err := s.instatus("POST", "/maintenances", map[string]interface{}{
+		"name":       name,
+		"message":    name,
+		"components": s.cfg.Components,
+		"start":      now,
+		"duration":   int(s.cfg.maintenanceDuration.Minutes()),
+		"status":     "INPROGRESS",
+		"notify":     true,
+		"statuses":   s.instatusStatuses("UNDERMAINTENANCE"),
+	}, &created)
+	return created.ID, err
+}
+
+func (s *StatusPageReporter) completeMaintenance(id string) error {
+	if s.cfg.Type == "statuspage" {
+		return s.statuspage("PATCH", "/incidents/"+url.PathEscape(id), map[string]interface{}{
+			"incident": map[string]interface{}{
+				"status":     "completed",
+				"components": s.componentStatuses("operational"),
+			},
+		}, nil)
+	}
+	return s.instatus("POST", "/maintenances/"+url.PathEscape(id)+"/maintenance-updates", map[string]interface{}{
+		"message":  "The deploy finished",
+		"status":   "COMPLETED",
+		"started":  time.Now().UTC(),
+		"notify":   true,
+		"statuses": s.instatusStatuses("OPERATIONAL"),
+	}, nil)
+}
+
+func (s *StatusPageReporter) openIncident(tag, message string) error {
+	name := fmt.Sprintf("Deploy of %s:%s failed", s.container, tag)
+	if s.cfg.Type == "statuspage" {
+		return s.statuspage("POST", "/incidents", map[string]interface{}{
+			"incident": map[string]interface{}{
+				"name":          name,
+				"status":        "investigating",
+				"body":          message,
+				"component_ids": s.cfg.Components,
+				"components":    s.componentStatuses("major_outage"),
+			},
+		}, nil)
+	}
+	return s.instatus("POST", "/incidents", map[string]interface{}{
+		"name":       name,
+		"message":    message,
+		"components": s.cfg.Components,
+		"started":    time.Now().UTC(),
+		"status":     "INVESTIGATING",
+		"notify":     true,
+		"statuses":   s.instatusStatuses("MAJOROUTAGE"),
+	}, nil)
+}
+
+func (s *StatusPageReporter) componentStatuses(status string) map[string]string {
+	statuses := map[string]string{}
+	for _, id := range s.cfg.Components {
+		statuses[id] = status
+	}
+	return statuses
+}
+
+func (s *StatusPageReporter) instatusStatuses(status string) []map[string]string {
+	var statuses []map[string]string
+	for _, id := range s.cfg.Components {
+		statuses = append(statuses, map[string]string{"id": id, "status": status})
+	}
+	return statuses
+}
+
+func (s *StatusPageReporter) statuspage(method, path string, in, out interface{}) error {
+	return githubRequest(statusPageClient, method, "https://api.statuspage.io/v1/pages/"+url.PathEscape(s.cfg.PageID)+path, "OAuth "+s.cfg.Token, in, out)
+}
+
+func (s *StatusPageReporter) instatus(method, path string, in, out interface{}) error {
+	return githubRequest(statusPageClient, method, "https://api.instatus.com/v1/"+url.PathEscape(s.cfg.PageID)+path, "Bearer "+s.cfg.Token, in, out)
+}
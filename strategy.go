@@ -0,0 +1,521 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Phases used by strategies that start the new container
+// alongside the old one
+const (
+	// PhaseSwitch replaces the old container with the new one
+	PhaseSwitch = Phase("switch")
+	// PhaseBake observes a canary before completing the deploy
+	PhaseBake = Phase("bake")
+	// PhaseRollback restores the previous image after a failed deploy
+	PhaseRollback = Phase("rollback")
+)
+
+// EventRollback is sent when a failed deploy is rolled back
+const EventRollback = Event("rollback")
+
+// Allowed values of the pull_order of a container
+const (
+	PullBeforeStop = "before_stop"
+	PullAfterStop  = "after_stop"
+)
+
+// CodePlatformMismatch is used when the pulled image
+// is not built for the configured platform
+const CodePlatformMismatch = ErrorCode("platform_mismatch")
+
+// Strategy replaces the container of a Deployer with one created from
+// version, a tag or digest of its repository. Strategies only talk to
+// Docker through the Deployer, so they can be exercised with any
+// DockerClient.
+type Strategy interface {
+	Deploy(d *Deployer, dep *Deployment, version string) *HookError
+}
+
+// strategies are the strategies selectable
+// with the strategy field of a container
+var strategies = map[string]Strategy{
+	"":           Recreate{},
+	"recreate":   Recreate{},
+	"blue_green": BlueGreen{},
+	"rolling":    Rolling{},
+	"canary":     Canary{},
+}
+
+// Recreate stops and removes the old container before creating the new
+// one. It is the only strategy that can publish host ports, at the cost
+// of downtime while the image is pulled and the container starts.
+type Recreate struct{}
+
+// Deploy implements Strategy
+func (Recreate) Deploy(d *Deployer, dep *Deployment, version string) *HookError {
+	herr := d.recordPrevious(dep)
+	if herr != nil {
+		return herr
+	}
+
+	// Pulling first keeps the old container serving during the pull,
+	// which is usually the longest part of the deploy
+	pullFirst := d.container.PullOrder != PullAfterStop
+	if pullFirst {
+		herr = d.pullNew(dep, version)
+		if herr != nil {
+			return herr
+		}
+	}
+
+	herr = d.drain()
+	if herr != nil {
+		return herr
+	}
+	herr = d.stopOld()
+	if herr != nil {
+		// Still serving
+		d.enable()
+		return herr
+	}
+
+	herr = d.removeOld()
+	if herr == nil && !pullFirst {
+		herr = d.pullNew(dep, version)
+	}
+	if herr == nil {
+		herr = d.runNew(dep, d.container.Name, version)
+	}
+	if herr != nil && d.container.Rollback && dep.PreviousImage != "" {
+		d.rollback(dep, herr)
+	}
+	if herr == nil || dep.RolledBack {
+		d.enable()
+	}
+
+	return herr
+}
+
+// BlueGreen starts and verifies the new container under a temporary name
+// while the old one keeps serving, then swaps them. The containers must
+// be reached through their name on a Docker network, as the names are
+// swapped but host ports can't be bound by both.
+type BlueGreen struct{}
+
+// Deploy implements Strategy
+func (BlueGreen) Deploy(d *Deployer, dep *Deployment, version string) *HookError {
+	herr := d.recordPrevious(dep)
+	if herr != nil {
+		return herr
+	}
+
+	next := d.container.Name + "-next"
+	// Left behind if the receiver died mid-deploy
+	d.discard(next)
+	herr = d.startNew(dep, next, version)
+	if herr != nil {
+		d.discard(next)
+		return herr
+	}
+
+	return d.switchTo(next)
+}
+
+// Rolling starts the new container with the same network aliases as the
+// old one, so both serve traffic until the new one is healthy and the
+// old one is removed.
+type Rolling struct{}
+
+// Deploy implements Strategy
+func (Rolling) Deploy(d *Deployer, dep *Deployment, version string) *HookError {
+	// Same as BlueGreen, the difference is in the network aliases
+	// being shared, which is enforced by config validation
+	return BlueGreen{}.Deploy(d, dep, version)
+}
+
+// Canary starts the new container alongside the old one sharing its
+// network aliases, and watches it for the canary duration before
+// completing the deploy. A canary that fails in that time is removed,
+// leaving the old container untouched.
+type Canary struct{}
+
+// Deploy implements Strategy
+func (Canary) Deploy(d *Deployer, dep *Deployment, version string) *HookError {
+	herr := d.recordPrevious(dep)
+	if herr != nil {
+		return herr
+	}
+
+	canary := d.container.Name + "-canary"
+	d.discard(canary)
+	herr = d.startNew(dep, canary, version)
+	if herr == nil {
+		herr = d.phase(PhaseBake, func() error {
+			return d.bake(canary)
+		})
+	}
+	if herr != nil {
+		d.discard(canary)
+		return herr
+	}
+
+	return d.switchTo(canary)
+}
+
+// recordPrevious records the image of the container being replaced,
+// saving a snapshot of it if configured. A container of the same name
+// not managed by the receiver is dealt with as configured first.
+func (d *Deployer) recordPrevious(dep *Deployment) *HookError {
+	old, err := d.client.InspectContainer(d.container.Name)
+	if err == nil {
+		replaced, herr := d.resolveConflict(old)
+		if herr != nil {
+			return herr
+		}
+		if !replaced {
+			return nil
+		}
+		dep.PreviousImage = old.Image
+	}
+	return d.snapshot(dep)
+}
+
+// stopOld stops the container. It may legitimately be
+// stopped or missing, e.g. when converging a fresh host.
+func (d *Deployer) stopOld() *HookError {
+	return d.phase(PhaseStop, func() error {
+		err := d.client.StopContainer(d.container.Name, 5)
+		switch err.(type) {
+		case *docker.NoSuchContainer, *docker.ContainerNotRunning:
+			return nil
+		}
+		return err
+	})
+}
+
+// removeOld removes the stopped container, if any, or
+// keeps it for rollbacks if the container keeps old ones
+func (d *Deployer) removeOld() *HookError {
+	return d.phase(PhaseRemove, func() error {
+		var err error
+		if d.container.KeepOld > 0 {
+			err = d.keep(d.container.Name)
+		} else {
+			err = d.client.RemoveContainer(docker.RemoveContainerOptions{
+				ID:            d.container.Name,
+				RemoveVolumes: true,
+			})
+		}
+		if _, ok := err.(*docker.NoSuchContainer); ok {
+			return nil
+		}
+		return err
+	})
+}
+
+// startNew pulls version and starts it as a container named name,
+// returning once it is healthy and passed its smoke tests
+func (d *Deployer) startNew(dep *Deployment, name, version string) *HookError {
+	herr := d.pullNew(dep, version)
+	if herr != nil {
+		return herr
+	}
+	return d.runNew(dep, name, version)
+}
+
+// pullNew pulls version and verifies it can be run, recording
+// what was pulled in the deployment
+func (d *Deployer) pullNew(dep *Deployment, version string) *HookError {
+	herr := d.checkDisk()
+	if herr != nil {
+		return herr
+	}
+	if dep.Archive != "" {
+		herr = d.phase(PhaseLoad, func() error {
+			return d.load(dep.Archive)
+		})
+	} else {
+		herr = d.phase(PhasePull, func() error {
+			return d.pull(version)
+		})
+	}
+	if herr != nil {
+		return herr
+	}
+
+	img, err := d.client.InspectImage(d.imageRef(version))
+	if err != nil {
+		return serverError(CodeDockerError, PhasePull, err)
+	}
+	if !matchesPlatform(img, d.container.Platform) {
+		return &HookError{
+			Code:    CodePlatformMismatch,
+			Message: fmt.Sprintf("image %s is built for %s/%s, not %s", d.imageRef(version), img.OS, img.Architecture, d.container.Platform),
+			Phase:   PhasePull,
+			Status:  http.StatusInternalServerError,
+		}
+	}
+	dep.Image = img.ID
+	dep.Digest = repoDigest(img, d.repository())
+	if dep.Digest == "" && d.container.Mirror != "" {
+		// The digest is the same in the mirror
+		dep.Digest = repoDigest(img, d.mirrorRepository())
+	}
+	dep.Labels = imageLabels(img)
+	if dep.Labels != nil && dep.Labels.Revision != "" {
+		dep.Commit = &Commit{SHA: dep.Labels.Revision}
+		if d.container.Forge != nil {
+			dep.Commit = d.container.Forge.lookupCommit(dep.Commit.SHA)
+		}
+	}
+	d.recordSize(dep, img)
+	var sbom []byte
+	if d.container.SBOM != nil {
+		sbom, herr = d.fetchSBOM(dep, img)
+		if herr != nil {
+			return herr
+		}
+	}
+
+	return d.checkPolicy(dep, img, sbom)
+}
+
+// runNew starts the pulled version as a container named name,
+// returning once it is healthy and passed its smoke tests
+func (d *Deployer) runNew(dep *Deployment, name, version string) *HookError {
+	var container *docker.Container
+	herr := d.phase(PhaseCreate, func() (err error) {
+		container, err = d.client.CreateContainer(d.createOptionsNamed(name, d.imageRef(version)))
+		return err
+	})
+	if herr != nil {
+		return herr
+	}
+
+	d.mu.Lock()
+	d.imageID = container.Image
+	d.mu.Unlock()
+
+	herr = d.phase(PhaseStart, func() error {
+		return d.client.StartContainer(container.ID, nil)
+	})
+	if herr != nil {
+		return herr
+	}
+
+	herr = d.phase(PhaseHealthcheck, func() error {
+		return d.waitHealthy(container.ID)
+	})
+	if herr != nil {
+		herr.Code = CodeUnhealthy
+		return herr
+	}
+
+	return d.smokeTest(dep, container.ID)
+}
+
+// switchTo replaces the old container with the verified container
+// next. The stopped old container is renamed out of the way before
+// next takes its name, and only removed once it did, so a failed
+// rename has the old container back within a second.
+func (d *Deployer) switchTo(next string) *HookError {
+	herr := d.drain()
+	if herr != nil {
+		return herr
+	}
+	herr = d.stopOld()
+	if herr != nil {
+		// Still serving
+		d.enable()
+		return herr
+	}
+
+	old := d.container.Name + "-old"
+	// Left behind if the receiver died mid-switch
+	d.discard(old)
+	renamed := false
+	herr = d.phase(PhaseSwitch, func() error {
+		err := d.client.RenameContainer(docker.RenameContainerOptions{
+			ID:   d.container.Name,
+			Name: old,
+		})
+		switch err.(type) {
+		case nil:
+			renamed = true
+		case *docker.NoSuchContainer:
+		default:
+			return err
+		}
+		return d.client.RenameContainer(docker.RenameContainerOptions{
+			ID:   next,
+			Name: d.container.Name,
+		})
+	})
+	if herr != nil {
+		d.discard(next)
+		d.restoreOld(old, renamed)
+		return herr
+	}
+
+	d.enable()
+	if renamed && d.container.KeepOld > 0 {
+		herr = d.phase(PhaseRemove, func() error {
+			return d.keep(old)
+		})
+		if herr != nil {
+			d.logger().Printf("Failed to keep the old container of %q: %v", d.container.Name, herr)
+		}
+	} else if renamed {
+		d.discard(old)
+	}
+	return nil
+}
+
+// restoreOld starts the stopped old container again after a failed
+// switch, renaming it back first if it was renamed to old
+func (d *Deployer) restoreOld(old string, renamed bool) {
+	var err error
+	if renamed {
+		err = d.client.RenameContainer(docker.RenameContainerOptions{
+			ID:   old,
+			Name: d.container.Name,
+		})
+	}
+	if err == nil {
+		err = d.client.StartContainer(d.container.Name, nil)
+	}
+	if _, ok := err.(*docker.NoSuchContainer); ok {
+		// Nothing to restore on a fresh host
+		return
+	}
+	if err != nil {
+		d.logger().Printf("Failed to restore the old container of %q: %v", d.container.Name, err)
+		return
+	}
+	d.logger().Printf("Restored the old container of %q", d.container.Name)
+	d.enable()
+}
+
+// discard removes a new container that failed verification
+func (d *Deployer) discard(name string) {
+	err := d.client.RemoveContainer(docker.RemoveContainerOptions{
+		ID:    name,
+		Force: true,
+	})
+	if _, ok := err.(*docker.NoSuchContainer); !ok && err != nil {
+		d.logger().Printf("Failed to remove %q: %v", name, err)
+	}
+}
+
+// bake watches the canary for the configured duration,
+// failing as soon as it stops running or becomes unhealthy
+func (d *Deployer) bake(name string) error {
+	duration, err := time.ParseDuration(d.container.CanaryDuration)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(duration)
+	for time.Now().Before(deadline) {
+		c, err := d.client.InspectContainer(name)
+		if err != nil {
+			return err
+		}
+		if !c.State.Running {
+			return fmt.Errorf("canary exited with code %d", c.State.ExitCode)
+		}
+		if c.State.Health.Status == "unhealthy" {
+			return errors.New("canary became unhealthy")
+		}
+		time.Sleep(5 * time.Second)
+	}
+
+	return nil
+}
+
+// rollback replaces whatever the failed deploy left behind
+// with a container created from the previous image
+func (d *Deployer) rollback(dep *Deployment, cause *HookError) {
+	herr := d.phase(PhaseRollback, func() error {
+		restored, err := d.restoreKept(dep.PreviousImage)
+		if err != nil || restored {
+			return err
+		}
+
+		err = d.restoreSnapshot(dep.PreviousImage)
+		if err != nil {
+			return err
+		}
+
+		err = d.client.RemoveContainer(docker.RemoveContainerOptions{
+			ID:    d.container.Name,
+			Force: true,
+		})
+		if _, ok := err.(*docker.NoSuchContainer); !ok && err != nil {
+			return err
+		}
+
+		c, err := d.client.CreateContainer(d.createOptions(dep.PreviousImage))
+		if err != nil {
+			return err
+		}
+		d.mu.Lock()
+		d.imageID = c.Image
+		d.mu.Unlock()
+
+		return d.client.StartContainer(c.ID, nil)
+	})
+	if herr != nil {
+		d.logger().Printf("Failed to roll back %q: %v", d.container.Name, herr)
+		notify(d.notifier, Notification{
+			Event:        EventRollback,
+			Container:    d.container.Name,
+			DeploymentID: dep.ID,
+			Labels:       dep.Labels,
+			Commit:       dep.Commit,
+			Phase:        PhaseRollback,
+			Message:      fmt.Sprintf("Rollback of %s to %s failed: %s", d.container.Name, shortID(dep.PreviousImage), herr.Message),
+		})
+		return
+	}
+
+	dep.RolledBack = true
+	d.logger().Printf("Rolled back %q to %s", d.container.Name, shortID(dep.PreviousImage))
+	notify(d.notifier, Notification{
+		Event:        EventRollback,
+		Container:    d.container.Name,
+		DeploymentID: dep.ID,
+		Labels:       dep.Labels,
+		Commit:       dep.Commit,
+		Message:      fmt.Sprintf("Deploy of %s failed in %s, rolled back to %s", d.container.Name, cause.Phase, shortID(dep.PreviousImage)),
+	})
+}
+
+// repoDigest returns the digest of the image in the repository, if any
+func repoDigest(img *docker.Image, repo string) string {
+	for _, rd := range img.RepoDigests {
+		if strings.HasPrefix(rd, repo+"@") {
+			return strings.TrimPrefix(rd, repo+"@")
+		}
+	}
+	return ""
+}
+
+// matchesPlatform reports whether the image is built for platform,
+// in the os[/architecture] format. An empty platform matches any image.
+func matchesPlatform(img *docker.Image, platform string) bool {
+	if platform == "" {
+		return true
+	}
+	os, arch := platform, ""
+	if i := strings.Index(platform, "/"); i >= 0 {
+		os, arch = platform[:i], platform[i+1:]
+	}
+	return strings.EqualFold(img.OS, os) && (arch == "" || strings.EqualFold(img.Architecture, arch))
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// newTestDeployer returns a deployer of the container to the fake daemon
+func newTestDeployer(client *fakeDocker, c ContainerConfig) *Deployer {
+	if c.Name == "" {
+		c.Name = "app"
+	}
+	if c.Repository == "" {
+		c.Repository = "example/app"
+	}
+	return &Deployer{
+		client:        client,
+		notifier:      nopNotifier{},
+		tenant:        DefaultTenant,
+		container:     c,
+		strategy:      strategies[c.Strategy],
+		HealthTimeout: time.Second,
+	}
+}
+
+// index returns the index of the first call, -1 if it wasn't made
+func index(calls []string, call string) int {
+	for i, c := range calls {
+		if c == call {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestStrategies(t *testing.T) {
+	for _, strategy := range []string{"recreate", "blue_green", "rolling", "canary"} {
+		t.Run(strategy, func(t *testing.T) {
+			client := newFakeDocker()
+			v1 := client.addImage("example/app:v1")
+			v2 := client.addImage("example/app:v2")
+			v3 := client.addImage("example/app:v3")
+			client.crashing[v3] = true
+			d := newTestDeployer(client, ContainerConfig{
+				Strategy:       strategy,
+				CanaryDuration: "1ns",
+				Rollback:       true,
+			})
+
+			herr := d.strategy.Deploy(d, &Deployment{}, "v1")
+			if herr != nil {
+				t.Fatalf("deploy to a fresh host: %v", herr)
+			}
+			if got := client.running(t, "app"); got != v1 {
+				t.Fatalf("running %s, want %s", got, v1)
+			}
+
+			dep := &Deployment{}
+			herr = d.strategy.Deploy(d, dep, "v2")
+			if herr != nil {
+				t.Fatalf("deploy: %v", herr)
+			}
+			if got := client.running(t, "app"); got != v2 {
+				t.Fatalf("running %s, want %s", got, v2)
+			}
+			if dep.PreviousImage != v1 || dep.Image != v2 {
+				t.Errorf("deployed %s over %s, want %s over %s", dep.Image, dep.PreviousImage, v2, v1)
+			}
+
+			herr = d.strategy.Deploy(d, &Deployment{}, "v3")
+			if herr == nil || herr.Code != CodeUnhealthy {
+				t.Fatalf("deploy of a crashing image: got %v, want %s", herr, CodeUnhealthy)
+			}
+			if got := client.running(t, "app"); got != v2 {
+				t.Errorf("running %s after the failed deploy, want %s", got, v2)
+			}
+			if names := client.names(); len(names) != 1 {
+				t.Errorf("containers %v left behind", names)
+			}
+		})
+	}
+}
+
+func TestRecreatePullOrder(t *testing.T) {
+	for _, order := range []string{PullBeforeStop, PullAfterStop} {
+		t.Run(order, func(t *testing.T) {
+			client := newFakeDocker()
+			client.addImage("example/app:v1")
+			client.addImage("example/app:v2")
+			d := newTestDeployer(client, ContainerConfig{PullOrder: order})
+			herr := d.strategy.Deploy(d, &Deployment{}, "v1")
+			if herr != nil {
+				t.Fatal(herr)
+			}
+
+			client.calls = nil
+			herr = d.strategy.Deploy(d, &Deployment{}, "v2")
+			if herr != nil {
+				t.Fatal(herr)
+			}
+			pulled := index(client.calls, "PullImage example/app:v2")
+			stopped := index(client.calls, "StopContainer app")
+			if pulled < 0 || stopped < 0 || (pulled < stopped) != (order == PullBeforeStop) {
+				t.Errorf("calls %v aren't in the %s order", client.calls, order)
+			}
+		})
+	}
+}
+
+func TestRecreateFailedPull(t *testing.T) {
+	client := newFakeDocker()
+	v1 := client.addImage("example/app:v1")
+	d := newTestDeployer(client, ContainerConfig{})
+	herr := d.strategy.Deploy(d, &Deployment{}, "v1")
+	if herr != nil {
+		t.Fatal(herr)
+	}
+
+	client.calls = nil
+	herr = d.strategy.Deploy(d, &Deployment{}, "v2")
+	if herr == nil || herr.Phase != PhasePull {
+		t.Fatalf("got %v, want a pull failure", herr)
+	}
+	if got := client.running(t, "app"); got != v1 {
+		t.Errorf("running %s, want %s", got, v1)
+	}
+	if index(client.calls, "StopContainer app") >= 0 {
+		t.Error("container stopped before the pull succeeded")
+	}
+}
+
+func TestRecreateWithoutRollback(t *testing.T) {
+	client := newFakeDocker()
+	client.addImage("example/app:v1")
+	v2 := client.addImage("example/app:v2")
+	client.crashing[v2] = true
+	d := newTestDeployer(client, ContainerConfig{})
+	herr := d.strategy.Deploy(d, &Deployment{}, "v1")
+	if herr != nil {
+		t.Fatal(herr)
+	}
+
+	dep := &Deployment{}
+	herr = d.strategy.Deploy(d, dep, "v2")
+	if herr == nil || herr.Code != CodeUnhealthy {
+		t.Fatalf("got %v, want %s", herr, CodeUnhealthy)
+	}
+	if dep.RolledBack {
+		t.Error("rolled back without rollback configured")
+	}
+	c, err := client.InspectContainer("app")
+	if err != nil || c.State.Running || c.Image != v2 {
+		t.Errorf("got %+v, %v, want the stopped %s", c, err, v2)
+	}
+}
+
+func TestBlueGreenFailedSwitch(t *testing.T) {
+	client := newFakeDocker()
+	v1 := client.addImage("example/app:v1")
+	client.addImage("example/app:v2")
+	d := newTestDeployer(client, ContainerConfig{Strategy: "blue_green"})
+	herr := d.strategy.Deploy(d, &Deployment{}, "v1")
+	if herr != nil {
+		t.Fatal(herr)
+	}
+
+	client.fail["RenameContainer"] = errors.New("rename failed")
+	herr = d.strategy.Deploy(d, &Deployment{}, "v2")
+	if herr == nil || herr.Phase != PhaseSwitch {
+		t.Fatalf("got %v, want a switch failure", herr)
+	}
+	if got := client.running(t, "app"); got != v1 {
+		t.Errorf("running %s after the failed switch, want the restored %s", got, v1)
+	}
+	if names := client.names(); len(names) != 1 {
+		t.Errorf("containers %v left behind", names)
+	}
+}
+
+func TestCanaryFailedBake(t *testing.T) {
+	client := newFakeDocker()
+	v1 := client.addImage("example/app:v1")
+	v2 := client.addImage("example/app:v2")
+	d := newTestDeployer(client, ContainerConfig{Strategy: "canary", CanaryDuration: "1ns"})
+	herr := d.strategy.Deploy(d, &Deployment{}, "v1")
+	if herr != nil {
+		t.Fatal(herr)
+	}
+
+	d.container.CanaryDuration = "1h"
+	client.fail["StopContainer"] = errors.New("must not be stopped")
+	// Healthy, then dies while baking
+	client.dying[v2] = 1
+	herr = d.strategy.Deploy(d, &Deployment{}, "v2")
+	if herr == nil || herr.Phase != PhaseBake {
+		t.Fatalf("got %v, want a bake failure", herr)
+	}
+	if got := client.running(t, "app"); got != v1 {
+		t.Errorf("running %s, want the untouched %s", got, v1)
+	}
+	if names := client.names(); names["app-canary"] {
+		t.Error("failed canary left behind")
+	}
+}
+
+func TestMatchesPlatform(t *testing.T) {
+	img := &docker.Image{OS: "linux", Architecture: "arm64"}
+	for platform, want := range map[string]bool{
+		"":              true,
+		"linux":         true,
+		"linux/arm64":   true,
+		"Linux/ARM64":   true,
+		"linux/amd64":   false,
+		"windows":       false,
+		"windows/arm64": false,
+	} {
+		if got := matchesPlatform(img, platform); got != want {
+			t.Errorf("%q: got %v, want %v", platform, got, want)
+		}
+	}
+}
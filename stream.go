@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Deployment lifecycle events published on the event stream
+const (
+	EventDeployStarted  = Event("deploy_started")
+	EventPhaseFinished  = Event("phase_finished")
+	EventDeployFinished = Event("deploy_finished")
+)
+
+// StreamEvent is a deployment lifecycle event
+type StreamEvent struct {
+	Event        Event     `json:"event"`
+	Time         time.Time `json:"time"`
+	Tenant       string    `json:"tenant"`
+	Container    string    `json:"container"`
+	DeploymentID string    `json:"deployment_id,omitempty"`
+	Phase        Phase     `json:"phase,omitempty"`
+	// Error is the failure of the phase, if any
+	Error string `json:"error,omitempty"`
+	// Deployment is the finished deployment
+	Deployment *Deployment `json:"deployment,omitempty"`
+}
+
+// streamBuffer is the number of events buffered per subscriber.
+// Slow subscribers miss events rather than blocking deploys.
+const streamBuffer = 64
+
+// EventStream broadcasts lifecycle events to its subscribers
+type EventStream struct {
+	mu          sync.Mutex
+	subscribers map[chan StreamEvent]string
+}
+
+// NewEventStream returns a stream without subscribers
+func NewEventStream() *EventStream {
+	return &EventStream{
+		subscribers: map[chan StreamEvent]string{},
+	}
+}
+
+// Publish sends the event to the subscribers of its tenant.
+// Publishing on a nil stream does nothing.
+func (s *EventStream) Publish(ev StreamEvent) {
+	if s == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch, tenant := range s.subscribers {
+		if tenant != "" && tenant != ev.Tenant {
+			continue
+		}
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel receiving the events of the tenant,
+// or of all tenants if empty, until cancel is called
+func (s *EventStream) Subscribe(tenant string) (events <-chan StreamEvent, cancel func()) {
+	ch := make(chan StreamEvent, streamBuffer)
+	s.mu.Lock()
+	s.subscribers[ch] = tenant
+	s.mu.Unlock()
+
+	return ch, func() {
+		s.mu.Lock()
+		delete(s.subscribers, ch)
+		s.mu.Unlock()
+	}
+}
+
+// ServeHTTP streams the events of the requesting tenant as server-sent events
+func (s *EventStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	events, cancel := s.Subscribe(requestTenant(r))
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Comments keep proxies from closing an idle stream
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case ev := <-events:
+			content, err := json.Marshal(&ev)
+			if err != nil {
+				log.Print(err)
+				continue
+			}
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Event, content)
+			if err != nil {
+				return
+			}
+		case <-keepalive.C:
+			_, err := fmt.Fprint(w, ": keepalive\n\n")
+			if err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// maxIncludeDepth stops includes including themselves
+const maxIncludeDepth = 10
+
+// expandTemplate executes the config file content as a Go template, so
+// repeated container specs can be generated from shared snippets. The
+// included files are looked up relative to dir.
+func expandTemplate(name, dir string, content []byte) ([]byte, error) {
+	depth := 0
+	var root *template.Template
+	funcs := template.FuncMap{
+		"env": os.Getenv,
+		"default": func(def, v interface{}) interface{} {
+			if v == nil || v == "" {
+				return def
+			}
+			return v
+		},
+		"include": func(file string, data ...interface{}) (string, error) {
+			depth++
+			defer func() { depth-- }()
+			if depth > maxIncludeDepth {
+				return "", fmt.Errorf("includes nested deeper than %d", maxIncludeDepth)
+			}
+			if !filepath.IsAbs(file) {
+				file = filepath.Join(dir, file)
+			}
+			content, err := os.ReadFile(file)
+			if err != nil {
+				return "", err
+			}
+			t, err := root.New(file).Parse(string(content))
+			if err != nil {
+				return "", err
+			}
+			var arg interface{}
+			if len(data) > 0 {
+				arg = data[0]
+			}
+			var buf bytes.Buffer
+			err = t.Execute(&buf, arg)
+			return buf.String(), err
+		},
+		"dict": func(pairs ...interface{}) (map[string]interface{}, error) {
+			if len(pairs)%2 != 0 {
+				return nil, errors.New("dict needs key and value pairs")
+			}
+			m := map[string]interface{}{}
+			for i := 0; i < len(pairs); i += 2 {
+				key, ok := pairs[i].(string)
+				if !ok {
+					return nil, fmt.Errorf("dict key %v is not a string", pairs[i])
+				}
+				m[key] = pairs[i+1]
+			}
+			return m, nil
+		},
+		"list": func(items ...interface{}) []interface{} {
+			return items
+		},
+		"toJson": func(v interface{}) (string, error) {
+			content, err := json.Marshal(v)
+			return string(content), err
+		},
+		"quote": func(s string) (string, error) {
+			content, err := json.Marshal(s)
+			return string(content), err
+		},
+		"upper":   strings.ToUpper,
+		"lower":   strings.ToLower,
+		"trim":    strings.TrimSpace,
+		"replace": func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+		"split":   func(sep, s string) []string { return strings.Split(s, sep) },
+		"join": func(sep string, list []string) string {
+			return strings.Join(list, sep)
+		},
+	}
+
+	root, err := template.New(name).Funcs(funcs).Option("missingkey=error").Parse(string(content))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = root.Execute(&buf, nil)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+)
+
+// DeployRequest is the body of POST /api/deploy
+type DeployRequest struct {
+	Repo string `json:"repo"`
+	Tag  string `json:"tag"`
+	// Archive is an image archive to load instead of pulling the
+	// image, a URL or a path relative to the archive dir
+	Archive string `json:"archive"`
+	// Artifact is deployed to containers with the artifact engine
+	Artifact *ArtifactRef `json:"artifact"`
+}
+
+// DeployHandler starts the same pipeline as a webhook for the pushed
+// repository on POST /api/deploy, for CI systems that can't send
+// registry webhooks. The repo and tag are read from a JSON body or
+// form parameters. It replies as soon as the deploys are queued.
+type DeployHandler struct {
+	deployers Deployers
+	audit     *AuditLog
+	// archiveDir holds the archives that may be deployed from disk
+	archiveDir string
+	// archiveURLs are the prefixes archives may be downloaded from
+	archiveURLs []string
+}
+
+func (h *DeployHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req, herr := decodeDeployRequest(r)
+	if herr != nil {
+		writeError(w, herr)
+		return
+	}
+
+	tenantDeployers := h.deployers.ForTenant(requestTenant(r))
+	deployers := tenantDeployers.ForPush(req.Repo)
+	if len(deployers) == 0 {
+		herr := clientError(CodeUnknownRepository, PhaseVerify, fmt.Errorf("no container configured for %q", req.Repo))
+		herr.Status = http.StatusNotFound
+		writeError(w, herr)
+		return
+	}
+	deployers = deployers.Uncordoned(req.Repo, req.Tag)
+	if len(deployers) == 0 {
+		herr := serverError(CodeHostCordoned, PhaseCordon, fmt.Errorf("the hosts of all containers of %s are cordoned", req.Repo))
+		herr.Status = http.StatusServiceUnavailable
+		writeError(w, herr)
+		return
+	}
+
+	herr = deployers.admit(req.Repo, req.Tag)
+	if herr != nil {
+		writeError(w, herr)
+		return
+	}
+
+	archive := ""
+	if req.Archive != "" {
+		// Loaded images run on the host, so whoever deploys
+		// them must be known, not just let in by a listener
+		if requestTenant(r) == "" {
+			herr := clientError(CodeInvalidArchive, PhaseVerify, errors.New("archives can only be deployed with an API token or signature"))
+			herr.Status = http.StatusForbidden
+			writeError(w, herr)
+			return
+		}
+		archive, herr = resolveArchive(req.Archive, h.archiveDir, h.archiveURLs)
+		if herr != nil {
+			writeError(w, herr)
+			return
+		}
+		for _, d := range deployers {
+			if d.client == nil {
+				writeError(w, clientError(CodeInvalidArchive, PhaseVerify, fmt.Errorf("container %q isn't run by a Docker daemon, archives can't be loaded for it", d.container.Name)))
+				return
+			}
+		}
+	}
+
+	var deployments []*Deployment
+	for _, d := range deployers {
+		dep := d.enqueuePush(req.Repo, req.Tag, nil)
+		dep.Archive = archive
+		dep.Artifact = req.Artifact
+		deployments = append(deployments, dep)
+	}
+	go func() {
+		_, herr := tenantDeployers.runRollout(deployers, deployments, req.Tag, nil)
+		if herr != nil {
+			log.Print(herr)
+		}
+	}()
+
+	h.audit.Record(AuditEntry{
+		Remote:      r.RemoteAddr,
+		Tenant:      requestTenant(r),
+		Repository:  req.Repo,
+		Tag:         req.Tag,
+		Result:      Success,
+		Deployments: deploymentIDs(deployments),
+	})
+
+	writeJSON(w, http.StatusAccepted, newAck(deployments))
+}
+
+// decodeDeployRequest reads the request from a JSON body or form
+// parameters. The tag defaults to latest.
+func decodeDeployRequest(r *http.Request) (*DeployRequest, *HookError) {
+	req := &DeployRequest{}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		err := json.NewDecoder(r.Body).Decode(req)
+		if err != nil {
+			return nil, clientError(CodeInvalidPayload, PhaseDecode, err)
+		}
+	} else {
+		err := r.ParseForm()
+		if err != nil {
+			return nil, clientError(CodeInvalidPayload, PhaseDecode, err)
+		}
+		req.Repo = r.Form.Get("repo")
+		req.Tag = r.Form.Get("tag")
+		req.Archive = r.Form.Get("archive")
+		if url := r.Form.Get("artifact_url"); url != "" {
+			req.Artifact = &ArtifactRef{URL: url, Checksum: r.Form.Get("artifact_checksum")}
+		}
+	}
+
+	if req.Repo == "" {
+		herr := clientError(CodeInvalidPayload, PhaseDecode, errors.New("missing required fields: repo"))
+		herr.Status = http.StatusUnprocessableEntity
+		herr.Details = []string{"repo"}
+		return nil, herr
+	}
+	if req.Tag == "" {
+		req.Tag = "latest"
+	}
+
+	return req, nil
+}
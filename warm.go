@@ -0,0 +1,91 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// PrepulledImage is an image pulled for a deploy that hasn't run yet
+type PrepulledImage struct {
+	Image    string    `json:"image"`
+	PulledAt time.Time `json:"pulled_at"`
+}
+
+// warmPull pulls version in the background if the deploy won't run
+// right away, so it is fast once it does
+func (d *Deployer) warmPull(version string) {
+	d.refreshPin()
+	if d.mustWait() {
+		d.prepull(version)
+	}
+}
+
+// mustWait reports whether a deploy would have to wait: for another one
+// to finish, for the container to be unpinned, or for a deploy of
+// another container of its group
+func (d *Deployer) mustWait() bool {
+	d.mu.Lock()
+	waiting := d.current != nil || d.pin != nil
+	d.mu.Unlock()
+	if waiting || d.group == nil {
+		return waiting
+	}
+	if !d.group.TryLock() {
+		return true
+	}
+	d.group.Unlock()
+	return false
+}
+
+// prepull pulls version in the background, unless it already was
+func (d *Deployer) prepull(version string) {
+	if d.client == nil {
+		return
+	}
+	d.mu.Lock()
+	_, pulled := d.prepulled[version]
+	d.mu.Unlock()
+	if pulled {
+		return
+	}
+
+	go func() {
+		err := d.pull(version)
+		if err != nil {
+			// The deploy pulls again and reports the failure
+			log.Printf("Failed to pull %s ahead of its deploy: %v", d.imageRef(version), err)
+			return
+		}
+		log.Printf("Pulled %s ahead of its deploy", d.imageRef(version))
+
+		d.mu.Lock()
+		if d.prepulled == nil {
+			d.prepulled = map[string]time.Time{}
+		}
+		d.prepulled[version] = time.Now()
+		d.mu.Unlock()
+	}()
+}
+
+// deployed forgets that version was pulled ahead of its deploy.
+// d.mu must be held.
+func (d *Deployer) deployed(version string) {
+	delete(d.prepulled, version)
+}
+
+// Prepulled returns the images pulled ahead of their deploys
+func (d *Deployer) Prepulled() []PrepulledImage {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var images []PrepulledImage
+	for version, at := range d.prepulled {
+		images = append(images, PrepulledImage{
+			Image:    d.imageRef(version),
+			PulledAt: at,
+		})
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].PulledAt.Before(images[j].PulledAt)
+	})
+	return images
+}
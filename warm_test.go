@@ -0,0 +1,93 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitPrepulled waits for the image to be pulled ahead of its deploy
+func waitPrepulled(t *testing.T, d *Deployer, image string, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		for _, img := range d.Prepulled() {
+			if img.Image == image {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s wasn't pulled ahead of its deploy, prepulled %v", image, d.Prepulled())
+}
+
+func TestWarmPullHeld(t *testing.T) {
+	client := newFakeDocker()
+	client.addImage("example/app:v1")
+	client.addImage("example/app:v2")
+	d := newTestDeployer(client, ContainerConfig{Tag: "v1"})
+	herr := d.Deploy("v1")
+	if herr != nil {
+		t.Fatal(herr)
+	}
+	_, herr = d.Pin()
+	if herr != nil {
+		t.Fatal(herr)
+	}
+
+	dep, herr := d.run("v2", "v2", nil)
+	if herr != nil || dep.Result != Held {
+		t.Fatalf("got %s, %v, want %s", dep.Result, herr, Held)
+	}
+	waitPrepulled(t, d, "example/app:v2", 5*time.Second)
+}
+
+func TestWarmPullGroup(t *testing.T) {
+	client := newFakeDocker()
+	client.addImage("example/app:v1")
+	d := newTestDeployer(client, ContainerConfig{Tag: "v1", Group: "web"})
+	// Another container of the group is being deployed
+	d.group = &sync.Mutex{}
+	d.group.Lock()
+
+	done := make(chan *HookError)
+	go func() {
+		done <- d.Deploy("v1")
+	}()
+	waitPrepulled(t, d, "example/app:v1", 5*time.Second)
+	d.group.Unlock()
+	if herr := <-done; herr != nil {
+		t.Fatal(herr)
+	}
+	if images := d.Prepulled(); len(images) != 0 {
+		t.Errorf("deployed images still listed as prepulled: %v", images)
+	}
+}
+
+func TestWarmPullRolloutStage(t *testing.T) {
+	ds, _, _ := newTestRollout(t, "1s")
+	enqueued := []*Deployment{ds[0].enqueue("v1", nil), ds[1].enqueue("v1", nil)}
+	_, herr := ds.runRollout(ds, enqueued, "v1", nil)
+	if herr != nil {
+		t.Fatal(herr)
+	}
+	// Pulled while the canary bakes
+	waitPrepulled(t, ds[1], "example/app:v1", 500*time.Millisecond)
+	waitFinished(t, enqueued[1], ds[1])
+}
+
+func TestWarmPullRunsRightAway(t *testing.T) {
+	client := newFakeDocker()
+	client.addImage("example/app:v1")
+	d := newTestDeployer(client, ContainerConfig{Tag: "v1"})
+	if d.mustWait() {
+		t.Error("idle container waits")
+	}
+	herr := d.Deploy("v1")
+	if herr != nil {
+		t.Fatal(herr)
+	}
+	if images := d.Prepulled(); len(images) != 0 {
+		t.Errorf("deploy that ran right away pulled ahead: %v", images)
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CodeUnknownRepository is used when no container is configured
+// for the repository the webhook was sent for
+const CodeUnknownRepository = ErrorCode("unknown_repository")
+
+// CodeUnauthorized is used when the webhook secret is missing or wrong
+const CodeUnauthorized = ErrorCode("unauthorized")
+
+// maxWebhookBody bounds the size of webhooks
+const maxWebhookBody = 1 << 20
+
+// WebhookHandler handles requests on /docker-webhook/{tenant}.
+// The unqualified /docker-webhook is served for the default tenant.
+type WebhookHandler struct {
+	cfg       *Config
+	deployers Deployers
+	audit     *AuditLog
+	// idempotency dedupes deliveries with an Idempotency-Key header
+	idempotency *IdempotencyCache
+	// rates detects spikes in the pushes, nil if disabled
+	rates *PushRates
+	// replays rejects replayed webhooks, nil if disabled
+	replays *ReplayGuard
+	// deadLetters keeps the webhooks that failed, nil if disabled
+	deadLetters *DeadLetters
+	// RejectUnknownFields fails payloads with fields
+	// not in DockerHubWebhook
+	RejectUnknownFields bool
+}
+
+// WebhookPayload is a webhook as it was received, archived
+// so the webhook can be replayed later
+type WebhookPayload struct {
+	Tenant     string      `json:"tenant"`
+	ReceivedAt time.Time   `json:"received_at"`
+	Headers    http.Header `json:"headers"`
+	Body       string      `json:"body"`
+	// Plugin is the plugin parsing the payload, if not from Docker Hub
+	Plugin string `json:"plugin,omitempty"`
+}
+
+// unarchivedHeaders are left out of archived payloads
+var unarchivedHeaders = []string{"Authorization", "Cookie"}
+
+func (h *WebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tenant := r.PathValue("tenant")
+	if tenant == "" {
+		tenant = DefaultTenant
+	}
+
+	payload := &WebhookPayload{
+		Tenant:     tenant,
+		ReceivedAt: time.Now(),
+		Headers:    r.Header.Clone(),
+		Plugin:     r.PathValue("plugin"),
+	}
+	for _, name := range unarchivedHeaders {
+		payload.Headers.Del(name)
+	}
+
+	hook := DockerHubWebhook{}
+	var deployments []*Deployment
+	herr := h.authenticate(r, tenant)
+	if herr == nil {
+		var content []byte
+		content, herr = readBody(w, r)
+		payload.Body = string(content)
+	}
+	if herr == nil {
+		run := func() ([]*Deployment, *HookError) {
+			return h.process(payload, &hook, false)
+		}
+		key := r.Header.Get("Idempotency-Key")
+		replayed := false
+		if key == "" {
+			deployments, herr = run()
+		} else {
+			deployments, herr, replayed = h.idempotency.Do(tenant+"/"+key, run)
+			if replayed {
+				log.Printf("Webhook with idempotency key %q was already handled", key)
+				w.Header().Set("Idempotent-Replayed", "true")
+				// Only decoded for the audit log
+				_ = h.parse(payload, &hook)
+			}
+		}
+		if herr != nil && !replayed {
+			h.deadLetters.Add(payload, &hook, deployments, herr)
+		}
+	}
+	h.record(r.RemoteAddr, payload, &hook, deployments, herr)
+
+	for _, dep := range deployments {
+		w.Header().Add("X-Deployment-Id", dep.ID)
+	}
+	if herr != nil {
+		log.Print(herr)
+		writeError(w, herr)
+		return
+	}
+
+	log.Print("Container restarted successfully")
+	writeAck(w, deployments)
+}
+
+// Ack is the reply to a handled webhook or deploy request
+type Ack struct {
+	// Status is the combined status of the deployments
+	Status      HookState       `json:"status"`
+	Deployments []DeploymentAck `json:"deployments"`
+}
+
+// DeploymentAck identifies a deployment started by a request
+type DeploymentAck struct {
+	ID        string    `json:"id"`
+	Container string    `json:"container"`
+	Status    HookState `json:"status"`
+	// StatusURL serves the deployment as it progresses
+	StatusURL string `json:"status_url"`
+}
+
+func newAck(deployments []*Deployment) *Ack {
+	ack := &Ack{
+		Status:      combinedState(deployments),
+		Deployments: []DeploymentAck{},
+	}
+	for _, dep := range deployments {
+		ack.Deployments = append(ack.Deployments, DeploymentAck{
+			ID:        dep.ID,
+			Container: dep.Container,
+			Status:    dep.Result,
+			StatusURL: "/api/deployments/" + dep.ID,
+		})
+	}
+	return ack
+}
+
+// writeAck replies with the ack of the deployments of a webhook, with
+// 202 Accepted if later stages of a rollout are still to be deployed
+func writeAck(w http.ResponseWriter, deployments []*Deployment) {
+	status := http.StatusOK
+	for _, dep := range deployments {
+		if !dep.Finished() {
+			status = http.StatusAccepted
+		}
+	}
+	writeJSON(w, status, newAck(deployments))
+}
+
+// record writes the outcome of handling the webhook to the audit log
+func (h *WebhookHandler) record(remote string, payload *WebhookPayload, hook *DockerHubWebhook, deployments []*Deployment, herr *HookError) {
+	entry := AuditEntry{
+		Remote:      remote,
+		Tenant:      payload.Tenant,
+		Repository:  hook.Repository.RepoName,
+		Tag:         hook.PushData.Tag,
+		Pusher:      hook.PushData.Pusher,
+		Result:      Success,
+		Payload:     payload,
+		Deployments: deploymentIDs(deployments),
+	}
+	if herr != nil {
+		entry.Result = Failure
+		if herr.Retryable {
+			entry.Result = Error
+		}
+		entry.Error = herr
+	}
+	h.audit.Record(entry)
+}
+
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, *HookError) {
+	content, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBody))
+	if err != nil {
+		herr := clientError(CodeReadBody, PhaseRead, err)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			herr.Status = http.StatusRequestEntityTooLarge
+		}
+		return nil, herr
+	}
+	return content, nil
+}
+
+// authenticate checks the webhook secret of the tenant
+func (h *WebhookHandler) authenticate(r *http.Request, tenant string) *HookError {
+	t, ok := h.cfg.Tenant(tenant)
+	if !ok {
+		herr := clientError(CodeUnauthorized, PhaseVerify, fmt.Errorf("unknown tenant %q", tenant))
+		herr.Status = http.StatusNotFound
+		return herr
+	}
+	if t.WebhookSecret != "" {
+		secret := r.URL.Query().Get("secret")
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(t.WebhookSecret)) != 1 {
+			authFailures.fail(r, "invalid webhook secret")
+			herr := clientError(CodeUnauthorized, PhaseVerify, errors.New("invalid webhook secret"))
+			herr.Status = http.StatusUnauthorized
+			return herr
+		}
+	}
+
+	return nil
+}
+
+// process decodes the payload into hook and redeploys the tenant's
+// containers using the pushed repository, returning the deployments
+// that were run. Replayed payloads were verified when first received,
+// so the callback is skipped.
+func (h *WebhookHandler) process(payload *WebhookPayload, hook *DockerHubWebhook, replay bool) ([]*Deployment, *HookError) {
+	herr := h.parse(payload, hook)
+	if herr != nil {
+		return nil, herr
+	}
+
+	tenantDeployers := h.deployers.ForTenant(payload.Tenant)
+	deployers := tenantDeployers.ForPush(hook.Repository.RepoName)
+	if len(deployers) == 0 {
+		herr := clientError(CodeUnknownRepository, PhaseVerify, fmt.Errorf("no container configured for %q", hook.Repository.RepoName))
+		herr.Status = http.StatusNotFound
+		return nil, herr
+	}
+
+	// Plugins verify the origin of their webhooks themselves
+	if payload.Plugin == "" && !strings.HasPrefix(hook.CallbackURL, "https://registry.hub.docker.com/u/"+hook.Repository.RepoName) {
+		return nil, clientError(CodeUntrustedOrigin, PhaseVerify, errors.New("got request not from docker hub"))
+	}
+
+	if !replay && payload.Plugin == "" {
+		herr := h.replays.check(payload.Tenant, hook, time.Now())
+		if herr != nil {
+			return nil, herr
+		}
+		herr = h.callback(hook, deployers[0].container.TargetURL)
+		if herr != nil {
+			return nil, herr
+		}
+		// Concurrent resends may have passed the check too
+		herr = h.replays.record(payload.Tenant, hook, time.Now())
+		if herr != nil {
+			return nil, herr
+		}
+	}
+	// Plugin payloads were verified by parsing them,
+	// replays when they were first received
+	hook.verified = true
+
+	// At this point we can be sure this was a genuine request, because
+	// the CallbackURL worked (when the payload was first received).
+	deployers, herr = checkPushers(deployers, hook)
+	if herr != nil {
+		return nil, herr
+	}
+	deploy, herr := h.filter(payload, hook)
+	if !deploy {
+		return nil, herr
+	}
+	deployers = deployers.When(pushVars(payload.Tenant, hook))
+	if len(deployers) == 0 {
+		log.Printf("Push of %s:%s meets the when of no container", hook.Repository.RepoName, hook.PushData.Tag)
+		return nil, nil
+	}
+	deployers = deployers.Uncordoned(hook.Repository.RepoName, hook.PushData.Tag)
+	if len(deployers) == 0 {
+		herr := serverError(CodeHostCordoned, PhaseCordon, fmt.Errorf("the hosts of all containers of %s are cordoned", hook.Repository.RepoName))
+		herr.Status = http.StatusServiceUnavailable
+		return nil, herr
+	}
+	if !replay {
+		herr := h.rates.checkRate(payload.Tenant, deployers, hook)
+		if herr != nil {
+			return nil, herr
+		}
+	}
+	herr = deployers.admit(hook.Repository.RepoName, hook.PushData.Tag)
+	if herr != nil {
+		return nil, herr
+	}
+	var enqueued []*Deployment
+	for _, d := range deployers {
+		dep := d.enqueuePush(hook.Repository.RepoName, hook.PushData.Tag, payload)
+		dep.Artifact = hook.artifact
+		enqueued = append(enqueued, dep)
+	}
+	return tenantDeployers.runRollout(deployers, enqueued, hook.PushData.Tag, payload)
+}
+
+// deploymentIDs returns the IDs of the deployments
+func deploymentIDs(deployments []*Deployment) []string {
+	var ids []string
+	for _, dep := range deployments {
+		ids = append(ids, dep.ID)
+	}
+	return ids
+}
+
+// parse decodes the payload into hook, with the plugin
+// it was sent to, if any
+func (h *WebhookHandler) parse(payload *WebhookPayload, hook *DockerHubWebhook) *HookError {
+	if payload.Plugin != "" {
+		return h.parsePlugin(payload, hook)
+	}
+	return h.decode(payload.Body, hook)
+}
+
+// decode strictly parses the body into hook
+func (h *WebhookHandler) decode(body string, hook *DockerHubWebhook) *HookError {
+	dec := json.NewDecoder(strings.NewReader(body))
+	if h.RejectUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+	err := dec.Decode(hook)
+	if err == nil && dec.More() {
+		err = errors.New("unexpected data after payload")
+	}
+	if err != nil {
+		return clientError(CodeInvalidPayload, PhaseDecode, err)
+	}
+
+	var missing []string
+	if hook.Repository.RepoName == "" {
+		missing = append(missing, "repository.repo_name")
+	}
+	if hook.PushData.Tag == "" {
+		missing = append(missing, "push_data.tag")
+	}
+	if hook.CallbackURL == "" {
+		missing = append(missing, "callback_url")
+	}
+	if len(missing) > 0 {
+		herr := clientError(CodeInvalidPayload, PhaseDecode, fmt.Errorf("missing required fields: %s", strings.Join(missing, ", ")))
+		herr.Status = http.StatusUnprocessableEntity
+		herr.Details = missing
+		return herr
+	}
+
+	return nil
+}
+
+// callback reports success to Docker Hub
+var callbackClient = &http.Client{Timeout: 30 * time.Second}
+
+func (h *WebhookHandler) callback(hook *DockerHubWebhook, targetURL string) *HookError {
+	reply := DockerCallback{
+		State:       Success,
+		Description: "Redeploy was successful",
+		Context:     "docker-webhook-receiver",
+		TargetURL:   targetURL,
+	}
+	respBytes, err := json.Marshal(&reply)
+	if err != nil {
+		return serverError(CodeInternal, PhaseCallback, err)
+	}
+
+	resp, err := callbackClient.Post(hook.CallbackURL, "application/json", bytes.NewReader(respBytes))
+	if err != nil {
+		return serverError(CodeCallbackFailed, PhaseCallback, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return serverError(CodeCallbackFailed, PhaseCallback, errors.New(resp.Status+": "+strings.TrimSpace(string(msg))))
+	}
+
+	return nil
+}
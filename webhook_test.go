@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCallback(t *testing.T) {
+	for _, status := range []int{http.StatusOK, http.StatusNoContent, http.StatusNotFound, http.StatusBadGateway} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			w.Write([]byte("unknown callback"))
+		}))
+		hook := &DockerHubWebhook{CallbackURL: server.URL}
+		herr := (&WebhookHandler{}).callback(hook, "")
+		server.Close()
+		if status < 300 && herr != nil {
+			t.Errorf("%d: got %v", status, herr)
+		}
+		if status >= 300 && (herr == nil || herr.Code != CodeCallbackFailed || !strings.Contains(herr.Message, "unknown callback")) {
+			t.Errorf("%d: got %+v, want %s", status, herr, CodeCallbackFailed)
+		}
+	}
+}
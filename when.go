@@ -0,0 +1,711 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// whenExpr is a compiled when condition of a container, in a subset of
+// CEL: literals (strings, integers, booleans and lists), the variables of
+// the push, ! && || == != < <= > >= in + -, parentheses, size() and the
+// string and timestamp methods defined in callMethod.
+type whenExpr struct {
+	source string
+	root   whenNode
+}
+
+// whenVars are the variables of a when condition
+type whenVars struct {
+	Tenant     string
+	Repository string
+	Namespace  string
+	Tag        string
+	Pusher     string
+	Now        time.Time
+}
+
+func (v whenVars) lookup(name string) (interface{}, bool) {
+	switch name {
+	case "tenant":
+		return v.Tenant, true
+	case "repository":
+		return v.Repository, true
+	case "namespace":
+		return v.Namespace, true
+	case "tag":
+		return v.Tag, true
+	case "pusher":
+		return v.Pusher, true
+	case "now":
+		return v.Now, true
+	}
+	return nil, false
+}
+
+// compileWhen parses the condition and checks it evaluates
+// to a boolean for a sample push
+func compileWhen(source string) (*whenExpr, error) {
+	p := &whenParser{src: source}
+	p.next()
+	root, err := p.parseOr()
+	if err == nil {
+		// The lexer stops at errors with an EOF token,
+		// which could have ended the expression early
+		err = p.err
+	}
+	if err == nil && p.tok.kind != tokEOF {
+		err = fmt.Errorf("unexpected %q", p.tok.text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid when %q: %v", source, err)
+	}
+	e := &whenExpr{source: source, root: root}
+	_, err = e.eval(whenVars{Tenant: DefaultTenant, Repository: "example/app", Namespace: "example", Tag: "v1.0.0", Pusher: "ci", Now: time.Now()})
+	if err != nil {
+		return nil, fmt.Errorf("invalid when %q: %v", source, err)
+	}
+	return e, nil
+}
+
+// eval evaluates the condition for the push
+func (e *whenExpr) eval(vars whenVars) (bool, error) {
+	v, err := e.root.eval(vars)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("evaluates to %s, not a bool", typeName(v))
+	}
+	return b, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokInt
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+type whenParser struct {
+	src string
+	pos int
+	tok token
+	err error
+}
+
+// next reads the next token, EOF after an error
+func (p *whenParser) next() {
+	if p.err != nil {
+		p.tok = token{kind: tokEOF}
+		return
+	}
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+	if p.pos >= len(p.src) {
+		p.tok = token{kind: tokEOF}
+		return
+	}
+	start := p.pos
+	c := p.src[p.pos]
+	switch {
+	case c == '_' || unicode.IsLetter(rune(c)):
+		for p.pos < len(p.src) && (p.src[p.pos] == '_' || unicode.IsLetter(rune(p.src[p.pos])) || unicode.IsDigit(rune(p.src[p.pos]))) {
+			p.pos++
+		}
+		p.tok = token{kind: tokIdent, text: p.src[start:p.pos]}
+	case unicode.IsDigit(rune(c)):
+		for p.pos < len(p.src) && unicode.IsDigit(rune(p.src[p.pos])) {
+			p.pos++
+		}
+		p.tok = token{kind: tokInt, text: p.src[start:p.pos]}
+	case c == '"' || c == '\'':
+		var b strings.Builder
+		p.pos++
+		for p.pos < len(p.src) && p.src[p.pos] != c {
+			if p.src[p.pos] == '\\' && p.pos+1 < len(p.src) {
+				p.pos++
+			}
+			b.WriteByte(p.src[p.pos])
+			p.pos++
+		}
+		if p.pos >= len(p.src) {
+			p.err = errors.New("unterminated string")
+			p.tok = token{kind: tokEOF}
+			return
+		}
+		p.pos++
+		p.tok = token{kind: tokString, text: b.String()}
+	default:
+		for _, op := range []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "+", "-", "(", ")", "[", "]", ",", "."} {
+			if strings.HasPrefix(p.src[p.pos:], op) {
+				p.pos += len(op)
+				p.tok = token{kind: tokOp, text: op}
+				return
+			}
+		}
+		p.err = fmt.Errorf("unexpected %q", string(c))
+		p.tok = token{kind: tokEOF}
+	}
+}
+
+func (p *whenParser) isOp(ops ...string) bool {
+	if p.tok.kind != tokOp && !(p.tok.kind == tokIdent && p.tok.text == "in") {
+		return false
+	}
+	for _, op := range ops {
+		if p.tok.text == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *whenParser) expect(op string) error {
+	if p.err != nil {
+		return p.err
+	}
+	if !p.isOp(op) {
+		if p.tok.kind == tokEOF {
+			return fmt.Errorf("expected %q at end", op)
+		}
+		return fmt.Errorf("expected %q, got %q", op, p.tok.text)
+	}
+	p.next()
+	return nil
+}
+
+func (p *whenParser) parseOr() (whenNode, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.isOp("||") {
+		p.next()
+		var right whenNode
+		right, err = p.parseAnd()
+		left = binaryNode{op: "||", left: left, right: right}
+	}
+	return left, err
+}
+
+func (p *whenParser) parseAnd() (whenNode, error) {
+	left, err := p.parseRelation()
+	for err == nil && p.isOp("&&") {
+		p.next()
+		var right whenNode
+		right, err = p.parseRelation()
+		left = binaryNode{op: "&&", left: left, right: right}
+	}
+	return left, err
+}
+
+func (p *whenParser) parseRelation() (whenNode, error) {
+	left, err := p.parseAdd()
+	if err == nil && p.isOp("==", "!=", "<", "<=", ">", ">=", "in") {
+		op := p.tok.text
+		p.next()
+		var right whenNode
+		right, err = p.parseAdd()
+		left = binaryNode{op: op, left: left, right: right}
+	}
+	return left, err
+}
+
+func (p *whenParser) parseAdd() (whenNode, error) {
+	left, err := p.parseUnary()
+	for err == nil && p.isOp("+", "-") {
+		op := p.tok.text
+		p.next()
+		var right whenNode
+		right, err = p.parseUnary()
+		left = binaryNode{op: op, left: left, right: right}
+	}
+	return left, err
+}
+
+func (p *whenParser) parseUnary() (whenNode, error) {
+	if p.isOp("!", "-") {
+		op := p.tok.text
+		p.next()
+		operand, err := p.parseUnary()
+		return unaryNode{op: op, operand: operand}, err
+	}
+	return p.parseMember()
+}
+
+func (p *whenParser) parseMember() (whenNode, error) {
+	node, err := p.parsePrimary()
+	for err == nil && p.isOp(".", "[") {
+		if p.isOp("[") {
+			p.next()
+			var index whenNode
+			index, err = p.parseOr()
+			if err == nil {
+				err = p.expect("]")
+			}
+			node = indexNode{operand: node, index: index}
+			continue
+		}
+		p.next()
+		if p.tok.kind != tokIdent {
+			return nil, errors.New("expected a method name after .")
+		}
+		name := p.tok.text
+		p.next()
+		var args []whenNode
+		args, err = p.parseArgs()
+		node = callNode{receiver: node, name: name, args: args}
+	}
+	return node, err
+}
+
+func (p *whenParser) parseArgs() ([]whenNode, error) {
+	err := p.expect("(")
+	if err != nil {
+		return nil, err
+	}
+	var args []whenNode
+	for err == nil && !p.isOp(")") {
+		var arg whenNode
+		arg, err = p.parseOr()
+		args = append(args, arg)
+		if err == nil && !p.isOp(")") {
+			err = p.expect(",")
+		}
+	}
+	if err == nil {
+		err = p.expect(")")
+	}
+	return args, err
+}
+
+func (p *whenParser) parsePrimary() (whenNode, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	tok := p.tok
+	switch tok.kind {
+	case tokInt:
+		p.next()
+		n, err := strconv.ParseInt(tok.text, 10, 64)
+		return literalNode{value: n}, err
+	case tokString:
+		p.next()
+		return literalNode{value: tok.text}, nil
+	case tokIdent:
+		p.next()
+		switch tok.text {
+		case "true", "false":
+			return literalNode{value: tok.text == "true"}, nil
+		}
+		if p.isOp("(") {
+			args, err := p.parseArgs()
+			return callNode{name: tok.text, args: args}, err
+		}
+		return identNode{name: tok.text}, nil
+	case tokOp:
+		switch tok.text {
+		case "(":
+			p.next()
+			node, err := p.parseOr()
+			if err == nil {
+				err = p.expect(")")
+			}
+			return node, err
+		case "[":
+			p.next()
+			var items []whenNode
+			var err error
+			for err == nil && !p.isOp("]") {
+				var item whenNode
+				item, err = p.parseOr()
+				items = append(items, item)
+				if err == nil && !p.isOp("]") {
+					err = p.expect(",")
+				}
+			}
+			if err == nil {
+				err = p.expect("]")
+			}
+			return listNode{items: items}, err
+		}
+	case tokEOF:
+		return nil, errors.New("unexpected end")
+	}
+	return nil, fmt.Errorf("unexpected %q", tok.text)
+}
+
+// whenNode is a node of the syntax tree of a when condition
+type whenNode interface {
+	eval(vars whenVars) (interface{}, error)
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n literalNode) eval(whenVars) (interface{}, error) {
+	return n.value, nil
+}
+
+type identNode struct {
+	name string
+}
+
+func (n identNode) eval(vars whenVars) (interface{}, error) {
+	v, ok := vars.lookup(n.name)
+	if !ok {
+		return nil, fmt.Errorf("unknown variable %s", n.name)
+	}
+	return v, nil
+}
+
+type listNode struct {
+	items []whenNode
+}
+
+func (n listNode) eval(vars whenVars) (interface{}, error) {
+	list := make([]interface{}, 0, len(n.items))
+	for _, item := range n.items {
+		v, err := item.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+type indexNode struct {
+	operand, index whenNode
+}
+
+func (n indexNode) eval(vars whenVars) (interface{}, error) {
+	v, err := n.operand.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	i, err := n.index.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	list, ok := v.([]interface{})
+	idx, ok2 := i.(int64)
+	if !ok || !ok2 {
+		return nil, fmt.Errorf("can't index %s with %s", typeName(v), typeName(i))
+	}
+	if idx < 0 || idx >= int64(len(list)) {
+		return nil, fmt.Errorf("index %d out of range", idx)
+	}
+	return list[idx], nil
+}
+
+type unaryNode struct {
+	op      string
+	operand whenNode
+}
+
+func (n unaryNode) eval(vars whenVars) (interface{}, error) {
+	v, err := n.operand.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	switch x := v.(type) {
+	case bool:
+		if n.op == "!" {
+			return !x, nil
+		}
+	case int64:
+		if n.op == "-" {
+			return -x, nil
+		}
+	}
+	return nil, fmt.Errorf("no operator %s for %s", n.op, typeName(v))
+}
+
+type binaryNode struct {
+	op          string
+	left, right whenNode
+}
+
+func (n binaryNode) eval(vars whenVars) (interface{}, error) {
+	l, err := n.left.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	// && and || short circuit
+	if b, ok := l.(bool); ok && (n.op == "&&" && !b || n.op == "||" && b) {
+		return b, nil
+	}
+	r, err := n.right.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "&&", "||":
+		if _, ok := l.(bool); ok {
+			if b, ok := r.(bool); ok {
+				return b, nil
+			}
+		}
+	case "==":
+		return equal(l, r), nil
+	case "!=":
+		return !equal(l, r), nil
+	case "in":
+		switch c := r.(type) {
+		case []interface{}:
+			for _, item := range c {
+				if equal(l, item) {
+					return true, nil
+				}
+			}
+			return false, nil
+		case string:
+			if s, ok := l.(string); ok {
+				return strings.Contains(c, s), nil
+			}
+		}
+	case "+":
+		switch x := l.(type) {
+		case int64:
+			if y, ok := r.(int64); ok {
+				return x + y, nil
+			}
+		case string:
+			if y, ok := r.(string); ok {
+				return x + y, nil
+			}
+		}
+	case "-":
+		if x, ok := l.(int64); ok {
+			if y, ok := r.(int64); ok {
+				return x - y, nil
+			}
+		}
+	case "<", "<=", ">", ">=":
+		c, ok := compare(l, r)
+		if ok {
+			switch n.op {
+			case "<":
+				return c < 0, nil
+			case "<=":
+				return c <= 0, nil
+			case ">":
+				return c > 0, nil
+			default:
+				return c >= 0, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no operator %s for %s and %s", n.op, typeName(l), typeName(r))
+}
+
+func equal(l, r interface{}) bool {
+	if c, ok := compare(l, r); ok {
+		return c == 0
+	}
+	if lb, ok := l.(bool); ok {
+		rb, ok := r.(bool)
+		return ok && lb == rb
+	}
+	return false
+}
+
+// compare orders integers, strings and timestamps
+func compare(l, r interface{}) (int, bool) {
+	switch x := l.(type) {
+	case int64:
+		if y, ok := r.(int64); ok {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+	case string:
+		if y, ok := r.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	case time.Time:
+		if y, ok := r.(time.Time); ok {
+			switch {
+			case x.Before(y):
+				return -1, true
+			case x.After(y):
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+type callNode struct {
+	// receiver is nil for global functions
+	receiver whenNode
+	name     string
+	args     []whenNode
+}
+
+func (n callNode) eval(vars whenVars) (interface{}, error) {
+	var args []interface{}
+	if n.receiver != nil {
+		v, err := n.receiver.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+	}
+	for _, arg := range n.args {
+		v, err := arg.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("%s() needs an argument", n.name)
+	}
+	return callMethod(n.name, args[0], args[1:])
+}
+
+// callMethod calls the function or method name on v. Like in CEL, the
+// timestamp methods take an optional time zone, UTC by default.
+func callMethod(name string, v interface{}, args []interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case string:
+		if name == "size" && len(args) == 0 {
+			return int64(len(x)), nil
+		}
+		if len(args) != 1 {
+			break
+		}
+		arg, ok := args[0].(string)
+		if !ok {
+			break
+		}
+		switch name {
+		case "startsWith":
+			return strings.HasPrefix(x, arg), nil
+		case "endsWith":
+			return strings.HasSuffix(x, arg), nil
+		case "contains":
+			return strings.Contains(x, arg), nil
+		case "matches":
+			re, err := regexp.Compile(arg)
+			if err != nil {
+				return nil, err
+			}
+			return re.MatchString(x), nil
+		}
+	case []interface{}:
+		if name == "size" && len(args) == 0 {
+			return int64(len(x)), nil
+		}
+	case time.Time:
+		if len(args) > 1 {
+			break
+		}
+		if len(args) == 1 {
+			zone, ok := args[0].(string)
+			if !ok {
+				break
+			}
+			loc, err := time.LoadLocation(zone)
+			if err != nil {
+				return nil, err
+			}
+			x = x.In(loc)
+		} else {
+			x = x.UTC()
+		}
+		switch name {
+		case "getHours":
+			return int64(x.Hour()), nil
+		case "getMinutes":
+			return int64(x.Minute()), nil
+		case "getDayOfWeek":
+			// 0 is Sunday
+			return int64(x.Weekday()), nil
+		case "getDate":
+			return int64(x.Day()), nil
+		case "getMonth":
+			// 0 is January
+			return int64(x.Month()) - 1, nil
+		case "getFullYear":
+			return int64(x.Year()), nil
+		}
+	}
+	return nil, fmt.Errorf("no function %s for %s", name, typeName(v))
+}
+
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case int64:
+		return "int"
+	case bool:
+		return "bool"
+	case []interface{}:
+		return "list"
+	case time.Time:
+		return "timestamp"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// pushVars returns the variables of a when condition for the push
+func pushVars(tenant string, hook *DockerHubWebhook) whenVars {
+	namespace := hook.Repository.Namespace
+	if namespace == "" {
+		if i := strings.Index(hook.Repository.RepoName, "/"); i >= 0 {
+			namespace = hook.Repository.RepoName[:i]
+		}
+	}
+	return whenVars{
+		Tenant:     tenant,
+		Repository: hook.Repository.RepoName,
+		Namespace:  namespace,
+		Tag:        hook.PushData.Tag,
+		Pusher:     hook.PushData.Pusher,
+		Now:        time.Now(),
+	}
+}
+
+// When returns the deployers whose when condition holds for the
+// push. Conditions failing to evaluate are logged and don't hold.
+func (ds Deployers) When(vars whenVars) Deployers {
+	var res Deployers
+	for _, d := range ds {
+		if d.container.when == nil {
+			res = append(res, d)
+			continue
+		}
+		ok, err := d.container.when.eval(vars)
+		if err != nil {
+			log.Printf("Failed to evaluate the when of %q: %v", d.container.Name, err)
+			continue
+		}
+		if ok {
+			res = append(res, d)
+		}
+	}
+	return res
+}
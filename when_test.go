@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompileWhenErrors(t *testing.T) {
+	for _, tt := range []struct {
+		source, err string
+	}{
+		{`tag.startsWith("v") & pusher == "ci"`, `unexpected "&"`},
+		{`tag.startsWith("v") | pusher == "ci"`, `unexpected "|"`},
+		{`tag == "v1`, "unterminated string"},
+		{`tag == 'v1`, "unterminated string"},
+		{`tag == "v1\`, "unterminated string"},
+		{`pusher == "ci" && tag == "v1`, "unterminated string"},
+		{`tag == "v1" #`, `unexpected "#"`},
+		{`tag ==`, "unexpected end"},
+		{`(tag == "v1"`, `expected ")" at end`},
+		{`pusher in ["ci", "release"`, `expected "," at end`},
+		{`tag.startsWith("v"`, `expected "," at end`},
+		{`tag "v1"`, `unexpected "v1"`},
+		{`tag`, "evaluates to string, not a bool"},
+		{`tag + 1 == "v1"`, "no operator + for string and int"},
+		{`unknown == "v1"`, "unknown variable"},
+		{`tag.matches("(")`, "missing closing )"},
+		{`now.getHours("Mars/Olympus") < 17`, "unknown time zone"},
+	} {
+		_, err := compileWhen(tt.source)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got error %v, want %q", tt.source, err, tt.err)
+		}
+	}
+}
+
+func TestWhenEval(t *testing.T) {
+	vars := whenVars{
+		Tenant:     "web",
+		Repository: "example/app",
+		Namespace:  "example",
+		Tag:        "v1.2.3",
+		Pusher:     "ci",
+		// A Friday
+		Now: time.Date(2026, 10, 16, 15, 30, 0, 0, time.UTC),
+	}
+	for source, want := range map[string]bool{
+		`tag.startsWith("v") && pusher == "ci"`:                 true,
+		`tag.startsWith("v") && pusher == "bob"`:                false,
+		`tag.startsWith("x") || pusher == "ci"`:                 true,
+		`!(pusher == "ci")`:                                     false,
+		`pusher in ['ci', 'release']`:                           true,
+		`pusher in []`:                                          false,
+		`tag.matches('^v[0-9]+\\.[0-9]+\\.[0-9]+$')`:            true,
+		`tag.endsWith(".3") && tag.contains("2")`:               true,
+		`size(tag) == 6 && tag.size() == 6`:                     true,
+		`size(["a", "b"]) == 2`:                                 true,
+		`["a", "b"][1] == "b"`:                                  true,
+		`repository == namespace + "/app"`:                      true,
+		`tenant != "web"`:                                       false,
+		`1 + 2 == 3 && 3 - 5 == -2`:                             true,
+		`"a" < "b" && 2 >= 2 && 3 > 2 && 2 <= 1`:                false,
+		`now.getHours() < 17`:                                   true,
+		`now.getHours('Asia/Kolkata') < 17`:                     false,
+		`now.getDayOfWeek() == 5 && now.getMonth() == 9`:        true,
+		`now.getDate() == 16 && now.getFullYear() == 2026`:      true,
+		`now.getMinutes() == 30`:                                true,
+		`tag == "v1.2.3" && pusher == "ci" || tenant == "none"`: true,
+	} {
+		e, err := compileWhen(source)
+		if err != nil {
+			t.Errorf("%s: %v", source, err)
+			continue
+		}
+		got, err := e.eval(vars)
+		if err != nil || got != want {
+			t.Errorf("%s: got %v, %v, want %v", source, got, err, want)
+		}
+	}
+}